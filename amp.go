@@ -0,0 +1,50 @@
+package caddy_chrome
+
+import (
+	"github.com/chromedp/cdproto/cdp"
+)
+
+// Scripts of the AMP runtime and its components, they rewrite the DOM into a state that isn't valid AMP, e.g. add
+// i-amphtml classes and runtime styles.
+var ampRuntimeURLPatterns = []string{
+	"*://cdn.ampproject.org/*",
+}
+
+// Attributes of the html element marking AMP documents, for websites, emails, and ads.
+var ampAttributes = map[string]bool{
+	"⚡":         true,
+	"amp":       true,
+	"⚡4email":   true,
+	"amp4email": true,
+	"⚡4ads":     true,
+	"amp4ads":   true,
+}
+
+// isAMP reports whether the tree is an AMP document, i.e. its html element has the ⚡ or amp attribute.
+func isAMP(root *cdp.Node) bool {
+	if root.NodeType != cdp.NodeTypeDocument {
+		return false
+	}
+	for _, html := range root.Children {
+		if html.NodeType != cdp.NodeTypeElement || html.LocalName != "html" {
+			continue
+		}
+		for i := 0; i < len(html.Attributes); i += 2 {
+			if ampAttributes[html.Attributes[i]] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// keepAMP turns off options of the serializer adding, or removing markup the AMP validator would reject, the AMP
+// runtime and boilerplate must be kept as they are, and no other scripts or styles may be added.
+func (s *domSerializer) keepAMP() {
+	s.skipDoctype = false
+	s.stripScripts = false
+	s.stripHydration = nil
+	s.optimizeImages = nil
+	s.critical = nil
+	s.omitEmptyHeadBody = false
+}
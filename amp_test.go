@@ -0,0 +1,62 @@
+package caddy_chrome
+
+import (
+	"bytes"
+	"github.com/alecthomas/assert/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIsAMP(t *testing.T) {
+	assert.True(t, isAMP(document(element("html", []string{"⚡", "", "lang", "en"}))))
+	assert.True(t, isAMP(document(element("html", []string{"amp", ""}))))
+	assert.True(t, isAMP(document(element("html", []string{"⚡4email", ""}))))
+	assert.False(t, isAMP(document(element("html", []string{"lang", "en"}))))
+	assert.False(t, isAMP(element("html", []string{"amp", ""})))
+}
+
+func TestRenderer_AMP(t *testing.T) {
+	expected, err := os.ReadFile(filepath.Join("testdata", "dom", "amp.html"))
+	assert.NoError(t, err)
+
+	serialize := func(r *Renderer) string {
+		root := loadDom(t, "amp")
+		req := &renderRequest{
+			url:      "https://example.com/articles/amp",
+			document: &responseWriter{status: http.StatusOK, header: http.Header{"Content-Type": {"text/html"}}},
+			bot:      true,
+		}
+		s := r.newSerializer(root, req, r.NoForcedDoctype, nil)
+		defer s.release()
+		var buf bytes.Buffer
+		assert.NoError(t, s.Serialize(&buf))
+		return buf.String()
+	}
+	options := func(amp bool) *Renderer {
+		return &Renderer{
+			AMP:               amp,
+			NoForcedDoctype:   true,
+			OmitEmptyHeadBody: true,
+			OptimizeImages:    &OptimizeImages{},
+			StripHydration:    &StripHydration{},
+			Bots:              &Bots{StripScripts: true},
+		}
+	}
+
+	// the runtime, boilerplate, and canonical link survive, nothing is added
+	assert.Equal(t, string(expected), serialize(options(true)))
+
+	html := serialize(options(false))
+	assert.False(t, strings.Contains(html, `https://cdn.ampproject.org/v0.js`))
+	assert.True(t, strings.Contains(html, `loading="lazy"`))
+	assert.True(t, strings.Contains(html, `<noscript><style amp-boilerplate>`))
+}
+
+func TestAMPRuntimeURLPatterns(t *testing.T) {
+	assert.True(t, matchAnyText(ampRuntimeURLPatterns, "https://cdn.ampproject.org/v0.js"))
+	assert.True(t, matchAnyText(ampRuntimeURLPatterns, "https://cdn.ampproject.org/v0/amp-carousel-0.2.js"))
+	assert.False(t, matchAnyText(ampRuntimeURLPatterns, "https://example.com/v0.js"))
+}
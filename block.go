@@ -0,0 +1,66 @@
+package caddy_chrome
+
+import (
+	"regexp"
+	"sync"
+)
+
+// Requests of common analytics and advertising scripts, they rarely affect the content of the page.
+var analyticsURLPatterns = []string{
+	"*://*.google-analytics.com/*",
+	"*://*.googletagmanager.com/*",
+	"*://*.googlesyndication.com/*",
+	"*://*.doubleclick.net/*",
+	"*://connect.facebook.net/*",
+	"*://*.hotjar.com/*",
+	"*://cdn.segment.com/*",
+	"*://*.mixpanel.com/*",
+	"*://*.clarity.ms/*",
+	"*://bat.bing.com/*",
+}
+
+// BlockURLs fails requests of the page to matching URLs, regardless of the host lists.
+type BlockURLs struct {
+	// Patterns are matched against full URLs using path.Match, except * also matches /.
+	Patterns []string `json:"patterns,omitempty"`
+	Regexps  []string `json:"regexps,omitempty"`
+	// Analytics blocks common analytics and advertising scripts.
+	Analytics bool `json:"analytics,omitempty"`
+
+	once     sync.Once
+	compiled []*regexp.Regexp
+	err      error
+}
+
+func (b *BlockURLs) compile() error {
+	b.once.Do(func() {
+		for _, expr := range b.Regexps {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				b.err = err
+				return
+			}
+			b.compiled = append(b.compiled, re)
+		}
+	})
+	return b.err
+}
+
+// Match reports whether requests to the URL are blocked.
+func (b *BlockURLs) Match(rawURL string) bool {
+	if b == nil {
+		return false
+	}
+	if matchAnyText(b.Patterns, rawURL) || b.Analytics && matchAnyText(analyticsURLPatterns, rawURL) {
+		return true
+	}
+	if b.compile() != nil {
+		return false
+	}
+	for _, re := range b.compiled {
+		if re.MatchString(rawURL) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,27 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"testing"
+)
+
+func TestBlockURLs_Match(t *testing.T) {
+	block := &BlockURLs{
+		Patterns: []string{"*://cdn.example.com/ads/*"},
+		Regexps:  []string{`^https?://[^/]+/track\?`},
+	}
+	assert.NoError(t, block.compile())
+	assert.True(t, block.Match("https://cdn.example.com/ads/banner/top.js"))
+	assert.True(t, block.Match("https://example.com/track?event=view"))
+	assert.False(t, block.Match("https://cdn.example.com/app.js"))
+	assert.False(t, block.Match("https://www.google-analytics.com/analytics.js"))
+
+	analytics := &BlockURLs{Analytics: true}
+	assert.True(t, analytics.Match("https://www.google-analytics.com/analytics.js"))
+	assert.True(t, analytics.Match("https://www.googletagmanager.com/gtag/js?id=G-1"))
+
+	var none *BlockURLs
+	assert.False(t, none.Match("https://www.google-analytics.com/analytics.js"))
+
+	assert.Error(t, (&BlockURLs{Regexps: []string{"("}}).compile())
+}
@@ -0,0 +1,48 @@
+package caddy_chrome
+
+import (
+	"github.com/chromedp/cdproto/cdp"
+	"strings"
+)
+
+var defaultBotUserAgents = []string{"*bot*", "*crawler*", "*spider*", "*slurp*", "*facebookexternalhit*", "*embedly*"}
+
+// Bots classifies requests from crawlers by their user agent, they get a leaner variant of the page.
+type Bots struct {
+	// UserAgents are patterns of lowercase user agents, matched using path.Match, except * also matches /. Default
+	// matches common crawlers.
+	UserAgents []string `json:"user_agents,omitempty"`
+	// StripScripts removes scripts, except data blocks such as JSON-LD.
+	StripScripts bool `json:"strip_scripts,omitempty"`
+	// StripHydration overrides the one of the middleware for bots.
+	StripHydration *StripHydration `json:"strip_hydration,omitempty"`
+}
+
+// Match reports whether the user agent is a bot.
+func (b *Bots) Match(userAgent string) bool {
+	if b == nil || userAgent == "" {
+		return false
+	}
+	patterns := b.UserAgents
+	if len(patterns) == 0 {
+		patterns = defaultBotUserAgents
+	}
+	return matchAnyText(patterns, strings.ToLower(userAgent))
+}
+
+// isExecutableScript reports whether the element is a script the browser would run.
+// See https://html.spec.whatwg.org/multipage/scripting.html#prepare-the-script-element
+func isExecutableScript(node *cdp.Node) bool {
+	if node.LocalName != "script" {
+		return false
+	}
+	for i := 0; i+1 < len(node.Attributes); i += 2 {
+		if strings.ToLower(node.Attributes[i]) != "type" {
+			continue
+		}
+		scriptType := strings.ToLower(strings.TrimSpace(node.Attributes[i+1]))
+		return scriptType == "" || scriptType == "module" ||
+			strings.Contains(scriptType, "javascript") || strings.Contains(scriptType, "ecmascript")
+	}
+	return true
+}
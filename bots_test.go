@@ -0,0 +1,30 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"testing"
+)
+
+func TestBots_Match(t *testing.T) {
+	defaults := &Bots{}
+	assert.True(t, defaults.Match("Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"))
+	assert.True(t, defaults.Match("facebookexternalhit/1.1"))
+	assert.False(t, defaults.Match("Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0 Safari/537.36"))
+	assert.False(t, defaults.Match(""))
+
+	custom := &Bots{UserAgents: []string{"*mybot/*"}}
+	assert.True(t, custom.Match("MyBot/1.0"))
+	assert.False(t, custom.Match("Googlebot/2.1"))
+
+	var none *Bots
+	assert.False(t, none.Match("Googlebot/2.1"))
+}
+
+func TestIsExecutableScript(t *testing.T) {
+	assert.True(t, isExecutableScript(element("script", nil)))
+	assert.True(t, isExecutableScript(element("script", []string{"type", "module"})))
+	assert.True(t, isExecutableScript(element("script", []string{"type", "text/javascript"})))
+	assert.False(t, isExecutableScript(element("script", []string{"type", "application/ld+json"})))
+	assert.False(t, isExecutableScript(element("script", []string{"type", "importmap"})))
+	assert.False(t, isExecutableScript(element("div", nil)))
+}
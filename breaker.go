@@ -0,0 +1,106 @@
+package caddy_chrome
+
+import (
+	"sync"
+	"time"
+)
+
+// circuitBreaker opens after threshold failures happen within the window and stays open for the cooldown period. Once
+// the cooldown passes, it's half-open until a success closes it, a single failure opens it again.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	failures  []time.Time
+	openUntil time.Time
+	// tripped is set when the breaker opens, until a success
+	tripped bool
+	now     func() time.Time
+}
+
+func newCircuitBreaker(threshold int, window time.Duration, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// Allow reports whether the breaker is closed, or half-open.
+func (b *circuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return !b.now().Before(b.openUntil)
+}
+
+// OpenFor returns how long the breaker stays open, zero if it's closed.
+func (b *circuitBreaker) OpenFor() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return max(b.openUntil.Sub(b.now()), 0)
+}
+
+// Failure records a failure and reports whether it opened the breaker.
+func (b *circuitBreaker) Failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.threshold <= 0 {
+		return false
+	}
+
+	now := b.now()
+	if b.tripped {
+		// half-open, the trial failed
+		if now.Before(b.openUntil) {
+			return false
+		}
+		b.openUntil = now.Add(b.cooldown)
+		return true
+	}
+
+	failures := b.failures[:0]
+	for _, failure := range b.failures {
+		if now.Sub(failure) < b.window {
+			failures = append(failures, failure)
+		}
+	}
+	b.failures = append(failures, now)
+
+	if len(b.failures) >= b.threshold {
+		b.failures = b.failures[:0]
+		b.openUntil = now.Add(b.cooldown)
+		b.tripped = true
+		return true
+	}
+	return false
+}
+
+// Success records a success, which closes the half-open breaker.
+func (b *circuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.now().Before(b.openUntil) {
+		b.tripped = false
+	}
+}
+
+// State returns closed, open, or half-open.
+func (b *circuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case b.now().Before(b.openUntil):
+		return "open"
+	case b.tripped:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
@@ -0,0 +1,54 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker(2, time.Minute, 5*time.Minute)
+	b.now = func() time.Time { return now }
+
+	for _, step := range []struct {
+		name    string
+		elapsed time.Duration
+		failure bool
+		success bool
+		opened  bool
+		state   string
+	}{
+		{name: "closed", state: "closed"},
+		{name: "failure below threshold", failure: true, state: "closed"},
+		{name: "failure out of window", elapsed: 2 * time.Minute, failure: true, state: "closed"},
+		{name: "threshold reached", elapsed: 10 * time.Second, failure: true, opened: true, state: "open"},
+		{name: "failure while open", elapsed: time.Minute, failure: true, state: "open"},
+		{name: "cooldown passed", elapsed: 4 * time.Minute, state: "half-open"},
+		{name: "trial failed", failure: true, opened: true, state: "open"},
+		{name: "success while open", elapsed: time.Minute, success: true, state: "open"},
+		{name: "cooldown passed again", elapsed: 4 * time.Minute, state: "half-open"},
+		{name: "trial succeeded", success: true, state: "closed"},
+		{name: "failure below threshold again", failure: true, state: "closed"},
+	} {
+		t.Run(step.name, func(t *testing.T) {
+			now = now.Add(step.elapsed)
+			if step.failure {
+				assert.Equal(t, step.opened, b.Failure())
+			}
+			if step.success {
+				b.Success()
+			}
+			assert.Equal(t, step.state, b.State())
+			assert.Equal(t, step.state != "open", b.Allow())
+		})
+	}
+}
+
+func TestCircuitBreaker_Disabled(t *testing.T) {
+	b := newCircuitBreaker(0, time.Minute, 5*time.Minute)
+	for range 10 {
+		assert.False(t, b.Failure())
+	}
+	assert.Equal(t, "closed", b.State())
+}
@@ -0,0 +1,646 @@
+package caddy_chrome
+
+import (
+	"context"
+	"github.com/chromedp/cdproto/browser"
+	"github.com/chromedp/chromedp"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errBrowserUnavailable = errors.New("browser unavailable")
+
+type browserState struct {
+	// url is the remote browser URL, it's empty for the exec browser
+	url         string
+	mu          sync.Mutex
+	chromeCtx   context.Context
+	allocCancel context.CancelFunc
+	lastSeen    time.Time
+	version     BrowserVersion
+	restarts    int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	backoff     time.Duration
+	nextRestart time.Time
+	// connecting is closed once the ongoing (re)start of the browser ends, it's nil if there's none, the lock isn't held
+	// meanwhile, so that a browser that's slow to connect doesn't block the others, nor the status
+	connecting chan struct{}
+	breaker    *circuitBreaker
+	keepAlive  time.Duration
+	// healthCheck is the interval of probes of the remote browser while it's disconnected, zero disables them
+	healthCheck time.Duration
+	// cleanupTimeout is how long closing the browser gracefully may take, before the exec browser is killed, and how
+	// long cleanup waits for in-flight renders
+	cleanupTimeout time.Duration
+	// renders tracks in-flight renders, so that cleanup can drain them, once closing is set, no new render starts
+	renders sync.WaitGroup
+	// inFlight counts in-flight renders for balancing, and for the concurrency limit, if maxConcurrency is set
+	inFlight       int
+	maxConcurrency int
+	closing        bool
+	// userDataDir is the profile directory of the exec browser, it's removed on cleanup if removeUserDataDir is set
+	userDataDir       string
+	removeUserDataDir bool
+}
+
+// BrowserVersion is what the browser reports about itself when connected.
+type BrowserVersion struct {
+	ProtocolVersion string `json:"protocol_version"`
+	// Product is e.g. HeadlessChrome/120.0.6099.109.
+	Product   string `json:"product"`
+	Revision  string `json:"revision"`
+	UserAgent string `json:"user_agent"`
+	JSVersion string `json:"js_version"`
+}
+
+// BrowserStatus describes health of the browser used for rendering.
+type BrowserStatus struct {
+	Connected bool      `json:"connected"`
+	LastSeen  time.Time `json:"last_seen,omitempty"`
+	Restarts  int       `json:"restarts"`
+	Breaker   string    `json:"breaker"`
+	Product   string    `json:"product,omitempty"`
+	InFlight  int       `json:"in_flight,omitempty"`
+	// Browsers are statuses of each of multiple remote browsers, in the order of their URLs in the config, the status is
+	// connected if any of them is. The URLs aren't disclosed, since they may carry credentials.
+	Browsers []BrowserStatus `json:"browsers,omitempty"`
+}
+
+// connectTimeout bounds starting the exec browser, or connecting to the remote one, including getting its version.
+const connectTimeout = 30 * time.Second
+
+// connectedBrowser is a browser started by connectBrowser, before it's published to its state.
+type connectedBrowser struct {
+	chromeCtx   context.Context
+	allocCancel context.CancelFunc
+	version     BrowserVersion
+}
+
+// startBrowser allocates a new browser, verifies the connection to it, and publishes it to the state, the caller holds
+// the lock, or there are no concurrent users of the state yet.
+func (m *Middleware) startBrowser(b *browserState) error {
+	connected, err := m.connectBrowser(b)
+	if err != nil {
+		return err
+	}
+	m.publishBrowser(b, connected)
+	return nil
+}
+
+// connectBrowser allocates a new browser and verifies the connection to it within connectTimeout. It only reads
+// configuration of the state, so it doesn't need the lock.
+func (m *Middleware) connectBrowser(b *browserState) (_ *connectedBrowser, err error) {
+	var allocCtx context.Context
+	var allocCancel context.CancelFunc
+	if m.ExecBrowser != nil {
+		var opts []chromedp.ExecAllocatorOption
+		if m.ExecBrowser.Path != "" {
+			opts = append(opts, chromedp.ExecPath(m.ExecBrowser.Path))
+		}
+		if m.ExecBrowser.DefaultFlags {
+			opts = append(opts, chromedp.DefaultExecAllocatorOptions[:]...)
+		}
+		// DevTools give full control of the browser, they must not be reachable from the network, flags can override it
+		opts = append(opts, chromedp.Flag("remote-debugging-address", "127.0.0.1"))
+		for _, flag := range m.ExecBrowser.Flags {
+			name, value := parseFlag(flag)
+			opts = append(opts, chromedp.Flag(name, value))
+		}
+		for name, value := range m.ExecBrowser.Env {
+			opts = append(opts, chromedp.Env(name+"="+value))
+		}
+		if m.MixedContent == "allow" {
+			opts = append(opts, chromedp.Flag("allow-running-insecure-content", true))
+		}
+		if b.userDataDir != "" {
+			opts = append(opts, chromedp.UserDataDir(b.userDataDir))
+		}
+		allocCtx, allocCancel = chromedp.NewExecAllocator(context.Background(), opts...)
+
+	} else if m.RemoteBrowser != nil {
+		discoverCtx, discoverCancel := context.WithTimeout(context.Background(), connectTimeout)
+		defer discoverCancel()
+		allocCtx, allocCancel, err = remoteAllocator(discoverCtx, b.url)
+		if err != nil {
+			return nil, err
+		}
+
+	} else {
+		panic("unreachable")
+	}
+	chromeCtx, _ := chromedp.NewContext(allocCtx)
+	defer func() {
+		if err != nil {
+			allocCancel()
+		}
+	}()
+	// the first run allocates the browser, whose lifetime is bound to its context, so the timeout cancels the allocator
+	// instead of the context of the run
+	timer := time.AfterFunc(connectTimeout, allocCancel)
+	var version BrowserVersion
+	err = chromedp.Run(chromeCtx, chromedp.ActionFunc(func(ctx context.Context) (err error) {
+		version.ProtocolVersion, version.Product, version.Revision, version.UserAgent, version.JSVersion, err = browser.GetVersion().Do(ctx)
+		return err
+	}))
+	if !timer.Stop() {
+		// the allocator was canceled, even if the browser responded just in time
+		return nil, errors.Errorf("browser didn't connect within %s", connectTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.browserLog(b).Info("browser connected",
+		zap.String("protocol_version", version.ProtocolVersion),
+		zap.String("product", version.Product),
+		zap.String("revision", version.Revision),
+		zap.String("user_agent", version.UserAgent),
+		zap.String("js_version", version.JSVersion))
+	return &connectedBrowser{chromeCtx: chromeCtx, allocCancel: allocCancel, version: version}, nil
+}
+
+// publishBrowser makes the connected browser the one of the state, the caller holds the lock.
+func (m *Middleware) publishBrowser(b *browserState, connected *connectedBrowser) {
+	b.chromeCtx = connected.chromeCtx
+	b.allocCancel = connected.allocCancel
+	b.lastSeen = time.Now()
+	b.version = connected.version
+	if b.keepAlive > 0 {
+		go m.keepAlive(b, connected.chromeCtx, connected.allocCancel)
+	}
+}
+
+// remoteAllocator returns the allocator connecting to the remote browser at the URL, the context bounds discovery of
+// the browser on a unix socket.
+func remoteAllocator(ctx context.Context, remoteURL string) (context.Context, context.CancelFunc, error) {
+	if socketPath, ok := unixSocketPath(remoteURL); ok {
+		wsURL, err := discoverUnixSocket(ctx, socketPath)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to discover browser on unix socket")
+		}
+		allocCtx, allocCancel := chromedp.NewRemoteAllocator(context.Background(), wsURL, chromedp.NoModifyURL)
+		return allocCtx, allocCancel, nil
+	}
+	allocCtx, allocCancel := chromedp.NewRemoteAllocator(context.Background(), remoteURL)
+	return allocCtx, allocCancel, nil
+}
+
+// browserLog returns the logger with the URL of the browser, if it's one of remote browsers.
+func (m *Middleware) browserLog(b *browserState) *zap.Logger {
+	if b.url == "" || len(m.browsers) < 2 {
+		return m.log
+	}
+	return m.log.With(zap.String("browser_url", m.RedactQuery.Redact(b.url)))
+}
+
+// keepAlive pings the browser until it's stopped, so that the connection isn't idle. If a ping fails, the connection
+// is closed, so that it's re-established on the next render instead of the render failing.
+func (m *Middleware) keepAlive(b *browserState, chromeCtx context.Context, allocCancel context.CancelFunc) {
+	ticker := time.NewTicker(b.keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-chromeCtx.Done():
+			return
+		case <-ticker.C:
+		}
+		pingCtx, cancel := context.WithTimeout(chromeCtx, 5*time.Second)
+		err := pingBrowser(pingCtx)
+		cancel()
+		if chromeCtx.Err() != nil {
+			return
+		}
+		if err != nil {
+			m.browserLog(b).Warn("browser keep-alive ping failed, closing connection", zap.Error(err))
+			allocCancel()
+			return
+		}
+		b.mu.Lock()
+		b.lastSeen = time.Now()
+		b.mu.Unlock()
+	}
+}
+
+// healthCheck probes the remote browser periodically while it's disconnected, e.g. it was unreachable when the config
+// was loaded, or its connection was lost, and reconnects it once it responds, so that renders don't wait for it to
+// reconnect, nor skip it until its restart backoff passes. It stops once done is closed.
+func (m *Middleware) healthCheck(b *browserState, done <-chan struct{}) {
+	ticker := time.NewTicker(b.healthCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		b.mu.Lock()
+		connected := b.closing || b.connecting != nil || b.chromeCtx != nil && b.chromeCtx.Err() == nil
+		b.mu.Unlock()
+		if connected {
+			continue
+		}
+		// the probe has a connection of its own, so that renders don't wait for the lock while it times out
+		if err := probeBrowser(b.url, min(b.healthCheck, 10*time.Second)); err != nil {
+			m.browserLog(b).Debug("browser health check failed", zap.Error(err))
+			continue
+		}
+		b.mu.Lock()
+		if !b.closing && (b.chromeCtx == nil || b.chromeCtx.Err() != nil) {
+			// it responds, it's reconnected without waiting for the backoff
+			b.nextRestart = time.Time{}
+			if _, err := m.liveBrowser(b); err == nil {
+				m.browserLog(b).Info("browser healthy again, reconnected")
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+// probeBrowser checks that the remote browser at the URL responds within the timeout.
+func probeBrowser(remoteURL string, timeout time.Duration) error {
+	discoverCtx, discoverCancel := context.WithTimeout(context.Background(), timeout)
+	defer discoverCancel()
+	allocCtx, allocCancel, err := remoteAllocator(discoverCtx, remoteURL)
+	if err != nil {
+		return err
+	}
+	defer allocCancel()
+	chromeCtx, cancel := chromedp.NewContext(allocCtx)
+	defer cancel()
+	timeoutCtx, timeoutCancel := context.WithTimeout(chromeCtx, timeout)
+	defer timeoutCancel()
+	return pingBrowser(timeoutCtx)
+}
+
+// pingBrowser checks the connection using a lightweight version call.
+func pingBrowser(ctx context.Context) error {
+	return chromedp.Run(ctx, chromedp.ActionFunc(func(ctx context.Context) error {
+		_, _, _, _, _, err := browser.GetVersion().Do(ctx)
+		return err
+	}))
+}
+
+// smokeTest renders a blank page in a new tab, so that a browser that connects, but can't render, e.g. because of
+// missing sandboxing support, fails provisioning instead of the first request.
+func smokeTest(chromeCtx context.Context) error {
+	tabCtx, cancel := chromedp.NewContext(chromeCtx)
+	defer cancel()
+	timeoutCtx, timeoutCancel := context.WithTimeout(tabCtx, 30*time.Second)
+	defer timeoutCancel()
+	var readyState string
+	return chromedp.Run(timeoutCtx,
+		chromedp.Navigate("about:blank"),
+		chromedp.Evaluate("document.readyState", &readyState),
+	)
+}
+
+// warmUp renders the warm-up page in the background, so that the first request doesn't pay the cold start of the
+// browser, e.g. creating the first browser context. A failure is only logged.
+func (m *Middleware) warmUp() {
+	chromeCtx, release, err := m.acquireBrowser()
+	if err != nil {
+		m.log.Warn("browser warm-up skipped", zap.Error(err))
+		return
+	}
+	go func() {
+		defer release()
+		start := time.Now()
+		if err := m.warmUpRender(chromeCtx); err != nil {
+			m.log.Warn("browser warm-up failed", zap.String("url", m.RedactQuery.Redact(m.Warmup)), zap.Error(err))
+			return
+		}
+		m.log.Info("browser warmed up", zap.String("url", m.RedactQuery.Redact(m.Warmup)), zap.Duration("duration", time.Since(start)))
+	}()
+}
+
+// warmUpRender navigates a new browser context to about:blank, or renders the warm-up URL, requested over the network.
+func (m *Middleware) warmUpRender(chromeCtx context.Context) error {
+	timeout := m.timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	if m.Warmup == "about:blank" {
+		timeoutCtx, timeoutCancel := context.WithTimeout(chromeCtx, timeout)
+		defer timeoutCancel()
+		browserCtx, browserCancel := chromedp.NewContext(timeoutCtx, chromedp.WithNewBrowserContext())
+		defer browserCancel()
+		return chromedp.Run(browserCtx, chromedp.Navigate("about:blank"))
+	}
+
+	u, err := url.Parse(m.Warmup)
+	if err != nil {
+		return err
+	}
+	rendering, err := m.renderer.render(chromeCtx, &renderRequest{
+		url:     m.Warmup,
+		host:    u.Host,
+		handler: transportHandler{http.DefaultTransport},
+		ctx:     context.Background(),
+		timeout: timeout,
+	})
+	if err != nil {
+		return err
+	}
+	rendering.release()
+	return nil
+}
+
+// stopBrowser gracefully closes the browser, if there's any. If the exec browser doesn't close within the cleanup
+// timeout, its process is killed, so that a wedged browser doesn't block shutdown or reload.
+func (m *Middleware) stopBrowser(b *browserState) error {
+	if b.chromeCtx == nil {
+		return nil
+	}
+	var process *os.Process
+	if c := chromedp.FromContext(b.chromeCtx); c != nil && c.Browser != nil {
+		process = c.Browser.Process()
+	}
+	defer func() {
+		b.allocCancel()
+		b.chromeCtx = nil
+		b.allocCancel = nil
+	}()
+	if b.chromeCtx.Err() != nil {
+		return nil
+	}
+	timeoutCtx, cancel := context.WithTimeout(b.chromeCtx, b.cleanupTimeout)
+	defer cancel()
+	err := chromedp.Cancel(timeoutCtx)
+	if err != nil && process != nil {
+		m.browserLog(b).Warn("browser didn't close gracefully, killing it", zap.Int("pid", process.Pid), zap.Error(err))
+		if killErr := process.Kill(); killErr != nil && !errors.Is(killErr, os.ErrProcessDone) {
+			m.browserLog(b).Error("failed to kill browser", zap.Int("pid", process.Pid), zap.Error(killErr))
+		}
+	}
+	return err
+}
+
+// acquireBrowser returns context of a live browser and a function releasing it once the render is done. Of multiple
+// remote browsers, the one with the fewest in-flight renders under its concurrency limit is used, ones that can't be
+// acquired are skipped. If the browser has crashed or lost connection, it's restarted with exponential backoff, until
+// then it's skipped. When the browser keeps failing, the circuit breaker opens and errBrowserUnavailable is returned
+// until the cooldown passes, it's also returned once the middleware is being cleaned up, or when all browsers are at
+// their concurrency limit.
+func (m *Middleware) acquireBrowser() (context.Context, func(), error) {
+	for _, b := range m.balancedBrowsers() {
+		chromeCtx, release, err := m.acquire(b)
+		if err == nil {
+			return chromeCtx, release, nil
+		}
+	}
+	return nil, nil, errBrowserUnavailable
+}
+
+// balancedBrowsers returns the browsers ordered by in-flight renders, the fewest first, ties are rotated round-robin,
+// so that idle browsers share the load.
+func (m *Middleware) balancedBrowsers() []*browserState {
+	if len(m.browsers) < 2 {
+		return m.browsers
+	}
+	start := int(atomic.AddUint64(&m.nextBrowser, 1) % uint64(len(m.browsers)))
+	browsers := append(slices.Clone(m.browsers[start:]), m.browsers[:start]...)
+	inFlight := make(map[*browserState]int, len(browsers))
+	for _, b := range browsers {
+		b.mu.Lock()
+		inFlight[b] = b.inFlight
+		b.mu.Unlock()
+	}
+	slices.SortStableFunc(browsers, func(a, b *browserState) int {
+		return inFlight[a] - inFlight[b]
+	})
+	return browsers
+}
+
+// acquire returns context of the browser and a function releasing it, unless it's at its concurrency limit, or not
+// live and can't be restarted.
+func (m *Middleware) acquire(b *browserState) (context.Context, func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	chromeCtx, err := m.liveBrowser(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	// checked once the browser is live, renders may have started while it was being restarted
+	if b.maxConcurrency > 0 && b.inFlight >= b.maxConcurrency {
+		return nil, nil, errBrowserUnavailable
+	}
+	b.inFlight++
+	b.renders.Add(1)
+	addActiveBrowserContexts(1)
+	return chromeCtx, func() {
+		b.mu.Lock()
+		b.inFlight--
+		b.mu.Unlock()
+		b.renders.Done()
+		addActiveBrowserContexts(-1)
+	}, nil
+}
+
+// liveBrowser returns context of a live browser, restarting it if needed, the caller holds the lock. The lock is released
+// while the browser is being restarted, concurrent callers wait for it, unless there are other browsers to render by.
+func (m *Middleware) liveBrowser(b *browserState) (context.Context, error) {
+	for b.connecting != nil {
+		if len(m.browsers) > 1 {
+			return nil, errBrowserUnavailable
+		}
+		connecting := b.connecting
+		b.mu.Unlock()
+		<-connecting
+		b.mu.Lock()
+	}
+	if b.closing {
+		return nil, errBrowserUnavailable
+	}
+	if b.chromeCtx != nil && b.chromeCtx.Err() == nil {
+		return b.chromeCtx, nil
+	}
+
+	now := time.Now()
+	if !b.breaker.Allow() || now.Before(b.nextRestart) {
+		return nil, errBrowserUnavailable
+	}
+
+	log := m.browserLog(b)
+	failure := func() {
+		if b.breaker.Failure() {
+			log.Error("browser keeps failing, rendering disabled until cooldown passes",
+				zap.Duration("cooldown", b.breaker.cooldown),
+				zap.Int("restarts", b.restarts))
+		}
+	}
+
+	if b.chromeCtx != nil {
+		log.Warn("browser lost, restarting", zap.Error(context.Cause(b.chromeCtx)))
+		_ = m.stopBrowser(b)
+		b.restarts++
+		failure()
+		if !b.breaker.Allow() {
+			return nil, errBrowserUnavailable
+		}
+	}
+
+	connecting := make(chan struct{})
+	b.connecting = connecting
+	b.mu.Unlock()
+	connected, err := m.connectBrowser(b)
+	b.mu.Lock()
+	b.connecting = nil
+	close(connecting)
+	if err == nil && b.closing {
+		// cleanup started meanwhile, it doesn't know about the browser
+		connected.allocCancel()
+		return nil, errBrowserUnavailable
+	}
+	if err != nil {
+		log.Error("failed to start browser", zap.Error(err), zap.Duration("backoff", b.backoff))
+		b.nextRestart = time.Now().Add(b.backoff)
+		b.backoff = min(b.backoff*2, b.maxBackoff)
+		failure()
+		return nil, errBrowserUnavailable
+	}
+
+	m.publishBrowser(b, connected)
+	b.backoff = b.minBackoff
+	b.nextRestart = time.Time{}
+	b.breaker.Success()
+	return b.chromeCtx, nil
+}
+
+// browserLost reports whether the browser of the failed render lost its connection, e.g. a remote browser restarted,
+// rather than the render failing because of the page, or the request being canceled.
+func browserLost(chromeCtx context.Context, r *http.Request) bool {
+	return chromeCtx.Err() != nil && r.Context().Err() == nil
+}
+
+// retryAfter returns how long it takes before the browser may be available again, i.e. until the breaker closes, or
+// the next restart attempt, at least a second.
+func (b *browserState) retryAfter() time.Duration {
+	b.mu.Lock()
+	wait := time.Until(b.nextRestart)
+	b.mu.Unlock()
+	return max(wait, b.breaker.OpenFor(), time.Second)
+}
+
+// retryAfter returns how long it takes before any of the browsers may be available again.
+func (m *Middleware) retryAfter() time.Duration {
+	var wait time.Duration
+	for i, b := range m.browsers {
+		if browserWait := b.retryAfter(); i == 0 || browserWait < wait {
+			wait = browserWait
+		}
+	}
+	return wait
+}
+
+// breakerStates are states reported by breakerState, the more available first.
+var breakerStates = []string{"closed", "half-open", "backoff", "open"}
+
+// breakerState returns the state of the browser's circuit breaker, or backoff while the breaker is closed, but the lost
+// browser waits for its restart, the caller holds the lock.
+func (b *browserState) breakerState(now time.Time) string {
+	state := b.breaker.State()
+	if state != "open" && (b.chromeCtx == nil || b.chromeCtx.Err() != nil) && now.Before(b.nextRestart) {
+		return "backoff"
+	}
+	return state
+}
+
+// breakerState returns the state of the most available of the browsers, open if there's none.
+func (m *Middleware) breakerState() string {
+	now := time.Now()
+	state := len(breakerStates) - 1
+	for _, b := range m.browsers {
+		b.mu.Lock()
+		state = min(state, slices.Index(breakerStates, b.breakerState(now)))
+		b.mu.Unlock()
+	}
+	return breakerStates[state]
+}
+
+// drainRenders waits for in-flight renders to finish, at most for the timeout, and reports whether they did. New renders
+// must not start, i.e. closing must be set.
+func (b *browserState) drainRenders(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		b.renders.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// BrowserVersion returns the version of the browser as of the last time it was connected, it's empty if it never was.
+// Of multiple remote browsers, it's the version of the first one that was connected.
+func (m *Middleware) BrowserVersion() BrowserVersion {
+	for _, b := range m.browsers {
+		b.mu.Lock()
+		version := b.version
+		b.mu.Unlock()
+		if version != (BrowserVersion{}) {
+			return version
+		}
+	}
+	return BrowserVersion{}
+}
+
+// BrowserStatus checks the browser connection using a lightweight version call, without rendering anything. It doesn't
+// try to restart the browser, that only happens when there is a request to render. Multiple remote browsers are checked
+// each, the status is connected if any of them is.
+func (m *Middleware) BrowserStatus(ctx context.Context) BrowserStatus {
+	if len(m.browsers) == 1 {
+		return m.browserStatus(ctx, m.browsers[0])
+	}
+	status := BrowserStatus{Breaker: m.breakerState(), Product: m.BrowserVersion().Product}
+	for _, b := range m.browsers {
+		browserStatus := m.browserStatus(ctx, b)
+		status.Connected = status.Connected || browserStatus.Connected
+		if browserStatus.LastSeen.After(status.LastSeen) {
+			status.LastSeen = browserStatus.LastSeen
+		}
+		status.Restarts += browserStatus.Restarts
+		status.InFlight += browserStatus.InFlight
+		status.Browsers = append(status.Browsers, browserStatus)
+	}
+	return status
+}
+
+func (m *Middleware) browserStatus(ctx context.Context, b *browserState) BrowserStatus {
+	b.mu.Lock()
+	chromeCtx := b.chromeCtx
+	b.mu.Unlock()
+
+	connected := false
+	if chromeCtx != nil && chromeCtx.Err() == nil {
+		pingCtx, cancel := context.WithTimeout(chromeCtx, 5*time.Second)
+		defer cancel()
+		stop := context.AfterFunc(ctx, cancel)
+		defer stop()
+		connected = pingBrowser(pingCtx) == nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if connected {
+		b.lastSeen = time.Now()
+	}
+	return BrowserStatus{
+		Connected: connected,
+		LastSeen:  b.lastSeen,
+		Restarts:  b.restarts,
+		Breaker:   b.breakerState(time.Now()),
+		Product:   b.version.Product,
+		InFlight:  b.inFlight,
+	}
+}
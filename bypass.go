@@ -0,0 +1,30 @@
+package caddy_chrome
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// bypasses reports whether the request asks for the un-rendered upstream response by the bypass query parameter, e.g.
+// ?__raw, to compare it with the rendered page. It's off unless the parameter is configured.
+func (m *Middleware) bypasses(r *http.Request) bool {
+	return m.BypassQuery != "" && r.URL.Query().Has(m.BypassQuery)
+}
+
+// withoutQueryParam returns the request without the query parameter, other parameters are kept as they are, so that
+// the upstream responds as it does to the request the page would be rendered from.
+func withoutQueryParam(r *http.Request, name string) *http.Request {
+	var kept []string
+	for _, param := range strings.Split(r.URL.RawQuery, "&") {
+		key, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(key); err == nil && unescaped == name {
+			continue
+		}
+		kept = append(kept, param)
+	}
+	r = r.Clone(r.Context())
+	r.URL.RawQuery = strings.Join(kept, "&")
+	r.RequestURI = r.URL.RequestURI()
+	return r
+}
@@ -0,0 +1,39 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddleware_bypasses(t *testing.T) {
+	m := &Middleware{}
+	assert.False(t, m.bypasses(httptest.NewRequest("GET", "/?__raw", nil)))
+
+	m.BypassQuery = "__raw"
+	assert.True(t, m.bypasses(httptest.NewRequest("GET", "/?__raw", nil)))
+	assert.True(t, m.bypasses(httptest.NewRequest("GET", "/?page=2&__raw=1", nil)))
+	assert.False(t, m.bypasses(httptest.NewRequest("GET", "/?raw", nil)))
+	assert.False(t, m.bypasses(httptest.NewRequest("GET", "/", nil)))
+}
+
+func TestWithoutQueryParam(t *testing.T) {
+	for _, testCase := range []struct {
+		url        string
+		requestURI string
+	}{
+		{url: "/?__raw", requestURI: "/"},
+		{url: "/page?__raw=1", requestURI: "/page"},
+		{url: "/page?a=1&__raw&b=%2F", requestURI: "/page?a=1&b=%2F"},
+		{url: "/page?%5F_raw&__raw=2&a", requestURI: "/page?a"},
+		{url: "/page?__rawer=1", requestURI: "/page?__rawer=1"},
+	} {
+		t.Run(testCase.url, func(t *testing.T) {
+			r := httptest.NewRequest("GET", testCase.url, nil)
+			stripped := withoutQueryParam(r, "__raw")
+			assert.Equal(t, testCase.requestURI, stripped.RequestURI)
+			assert.Equal(t, testCase.requestURI, stripped.URL.RequestURI())
+			assert.Equal(t, testCase.url, r.RequestURI)
+		})
+	}
+}
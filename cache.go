@@ -0,0 +1,311 @@
+package caddy_chrome
+
+import (
+	"bytes"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache keeps rendered pages in memory for the TTL, so that pages rendered over and over, e.g. marketing pages
+// changing a few times a day, are served without calling the upstream handlers and loading them in Chrome. Pages are
+// keyed by the render key, i.e. the URL with the query normalized, and the bot variant, and by values of request
+// headers the page varies by, always including User-Agent and Cookie, so that personalized pages aren't served to
+// others.
+type Cache struct {
+	TTL string `json:"ttl,omitempty"`
+	// MaxEntries bounds the number of cached pages, the oldest ones are evicted first.
+	MaxEntries int `json:"max_entries,omitempty"`
+}
+
+// defaultCacheMaxEntries is the number of cached pages if the limit isn't configured.
+const defaultCacheMaxEntries = 10_000
+
+// renderCache is the cache of rendered pages.
+type renderCache struct {
+	ttl        time.Duration
+	maxEntries int
+	mu         sync.Mutex
+	entries    map[string][]*cacheEntry
+	// queue is of entries in the order they were stored, i.e. the order they expire, replaced ones are skipped
+	queue []queuedEntry
+}
+
+// cacheEntry is a rendered page, the variant for requests with the vary header values.
+type cacheEntry struct {
+	status int
+	header http.Header
+	body   []byte
+	vary   map[string]string
+	stored time.Time
+	// expires is when the page stops being fresh, by the TTL, or sooner if the upstream response says so
+	expires time.Time
+	// etag and lastModified are validators of the upstream response the page was rendered from, once the page is
+	// stale, the upstream is asked by them whether it has changed, before it's rendered again
+	etag         string
+	lastModified string
+}
+
+type queuedEntry struct {
+	key   string
+	entry *cacheEntry
+}
+
+func newRenderCache(ttl time.Duration, maxEntries int) *renderCache {
+	return &renderCache{ttl: ttl, maxEntries: maxEntries, entries: make(map[string][]*cacheEntry)}
+}
+
+// get returns the variant of the page matching the request, if it's still fresh.
+func (c *renderCache) get(key string, r *http.Request, now time.Time) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, entry := range c.entries[key] {
+		if now.Before(entry.expires) && entry.matches(r) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// stale returns the variant of the page matching the request that's no longer fresh, but can be revalidated.
+func (c *renderCache) stale(key string, r *http.Request, now time.Time) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, entry := range c.entries[key] {
+		if !now.Before(entry.expires) && entry.revalidatable() && entry.matches(r) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// put stores the variant of the page, replacing the previous one, after expired entries are evicted.
+func (c *renderCache) put(key string, entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evict(entry.stored)
+	variants := slices.DeleteFunc(c.entries[key], func(variant *cacheEntry) bool {
+		return maps.Equal(variant.vary, entry.vary)
+	})
+	c.entries[key] = append(variants, entry)
+	c.queue = append(c.queue, queuedEntry{key: key, entry: entry})
+}
+
+// evict removes expired entries, and the oldest ones while the cache is full, the caller holds the lock. Entries
+// expiring sooner than by the TTL are removed once they're the oldest, get skips them until then. Expired entries that
+// can be revalidated are kept until the cache is full.
+func (c *renderCache) evict(now time.Time) {
+	for len(c.queue) > 0 {
+		oldest := c.queue[0]
+		if (now.Before(oldest.entry.expires) || oldest.entry.revalidatable()) && len(c.queue) < c.maxEntries {
+			return
+		}
+		c.queue[0] = queuedEntry{}
+		c.queue = c.queue[1:]
+		variants := slices.DeleteFunc(c.entries[oldest.key], func(variant *cacheEntry) bool {
+			return variant == oldest.entry
+		})
+		if len(variants) == 0 {
+			delete(c.entries, oldest.key)
+		} else {
+			c.entries[oldest.key] = variants
+		}
+	}
+}
+
+// matches reports whether the request has the header values the page was rendered with.
+func (e *cacheEntry) matches(r *http.Request) bool {
+	for name, value := range e.vary {
+		if strings.Join(r.Header.Values(name), ", ") != value {
+			return false
+		}
+	}
+	return true
+}
+
+// revalidatable reports whether the entry has validators of the upstream response.
+func (e *cacheEntry) revalidatable() bool {
+	return e.etag != "" || e.lastModified != ""
+}
+
+// conditional returns the request with the validators of the entry, so that the upstream responds 304 Not Modified
+// if the page hasn't changed.
+func (e *cacheEntry) conditional(r *http.Request) *http.Request {
+	r = r.Clone(r.Context())
+	if e.etag != "" {
+		r.Header.Set("If-None-Match", e.etag)
+	}
+	if e.lastModified != "" {
+		r.Header.Set("If-Modified-Since", e.lastModified)
+	}
+	return r
+}
+
+// revalidated returns the entry fresh again by the 304 Not Modified response of the upstream, for the TTL, or as long
+// as the response says.
+func (e *cacheEntry) revalidated(header http.Header, now time.Time, ttl time.Duration) *cacheEntry {
+	if fresh, ok := freshness(header, cacheControl(header), now); ok {
+		ttl = min(ttl, fresh)
+	}
+	entry := *e
+	entry.stored, entry.expires = now, now.Add(ttl)
+	if etag := header.Get("Etag"); etag != "" {
+		entry.etag = etag
+	}
+	if lastModified := header.Get("Last-Modified"); lastModified != "" {
+		entry.lastModified = lastModified
+	}
+	return &entry
+}
+
+// write writes the cached page, with Age of it.
+func (e *cacheEntry) write(w http.ResponseWriter, r *http.Request, now time.Time) error {
+	for name := range w.Header() {
+		w.Header().Del(name)
+	}
+	for name, values := range e.header {
+		w.Header()[name] = slices.Clone(values)
+	}
+	w.Header().Set("Age", strconv.Itoa(int(now.Sub(e.stored)/time.Second)))
+	w.WriteHeader(e.status)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	_, err := w.Write(e.body)
+	return err
+}
+
+// newCacheEntry returns the entry of the recorded response, fresh for the TTL, or as long as the response says, unless
+// it can't be shared, i.e. it isn't 200, it's private, sets cookies, varies by everything, isn't fresh at all, or it's
+// a response to a request with credentials that doesn't allow it explicitly (RFC 9111, section 3.5).
+func newCacheEntry(r *http.Request, recorder *cacheRecorder, now time.Time, ttl time.Duration) *cacheEntry {
+	header := recorder.header
+	if recorder.status != http.StatusOK || header.Get("Set-Cookie") != "" {
+		return nil
+	}
+	directives := cacheControl(header)
+	for _, name := range []string{"no-store", "private", "no-cache"} {
+		if _, ok := directives[name]; ok {
+			return nil
+		}
+	}
+	if r.Header.Get("Authorization") != "" {
+		_, public := directives["public"]
+		_, sMaxAge := directives["s-maxage"]
+		if !public && !sMaxAge {
+			return nil
+		}
+	}
+	if fresh, ok := freshness(header, directives, now); ok {
+		ttl = min(ttl, fresh)
+	}
+	if ttl <= 0 {
+		return nil
+	}
+	vary := make(map[string]string)
+	// Chrome renders the page with the user agent and cookies of the request, whether the response varies by them or not
+	for _, name := range strings.Split(mergeVary(append(header.Values("Vary"), "User-Agent", "Cookie")...), ", ") {
+		if name == "*" {
+			return nil
+		}
+		if name != "" {
+			vary[name] = strings.Join(r.Header.Values(name), ", ")
+		}
+	}
+	// the recorded header is a copy, headers describing the response rather than the page are dropped from it
+	for _, name := range perResponseHeaders {
+		header.Del(name)
+	}
+	return &cacheEntry{status: recorder.status, header: header, body: recorder.body.Bytes(), vary: vary, stored: now, expires: now.Add(ttl)}
+}
+
+// perResponseHeaders describe the response they're sent with, e.g. timings of the render, they aren't replayed with
+// the cached page.
+var perResponseHeaders = []string{"Server-Timing"}
+
+// cacheControl returns directives of the Cache-Control header by their lowercase names, with values unquoted.
+func cacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				directives[name] = strings.Trim(strings.TrimSpace(value), `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// freshness returns how long the response is fresh for shared caches, by s-maxage, max-age, or Expires, in that order,
+// and whether it says at all. Invalid values mean it isn't fresh.
+func freshness(header http.Header, directives map[string]string, now time.Time) (time.Duration, bool) {
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[name]; ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil {
+				return 0, true
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	if value := header.Get("Expires"); value != "" {
+		expires, err := http.ParseTime(value)
+		if err != nil {
+			return 0, true
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		return expires.Sub(date), true
+	}
+	return 0, false
+}
+
+// conditionalHeaders make the upstream evaluate conditions of the client, a stale page isn't revalidated for such
+// requests, their responses are passed through.
+var conditionalHeaders = []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range", "Range"}
+
+// isConditional reports whether the request has conditional headers.
+func isConditional(r *http.Request) bool {
+	for _, name := range conditionalHeaders {
+		if r.Header.Get(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheRecorder writes the response through, keeping a copy of it to be cached.
+type cacheRecorder struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (c *cacheRecorder) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+		c.header = c.Header().Clone()
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *cacheRecorder) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	c.body.Write(p)
+	return c.ResponseWriter.Write(p)
+}
+
+// Unwrap lets the serializer flush the response.
+func (c *cacheRecorder) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
@@ -0,0 +1,156 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRenderCache(t *testing.T) {
+	now := time.Now()
+	cache := newRenderCache(time.Minute, 2)
+	anonymous := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	session := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	session.Header.Set("Cookie", "session=1")
+
+	cache.put("http://localhost/", &cacheEntry{body: []byte("anonymous"), vary: map[string]string{"Cookie": ""}, stored: now, expires: now.Add(time.Minute)})
+	assert.Equal(t, "anonymous", string(cache.get("http://localhost/", anonymous, now).body))
+	assert.Zero(t, cache.get("http://localhost/", session, now))
+	assert.Zero(t, cache.get("http://localhost/other", anonymous, now))
+	assert.Zero(t, cache.get("http://localhost/", anonymous, now.Add(time.Minute)))
+
+	cache.put("http://localhost/", &cacheEntry{body: []byte("session"), vary: map[string]string{"Cookie": "session=1"}, stored: now, expires: now.Add(time.Minute)})
+	assert.Equal(t, "session", string(cache.get("http://localhost/", session, now).body))
+	assert.Equal(t, "anonymous", string(cache.get("http://localhost/", anonymous, now).body))
+
+	// the oldest entry is evicted once the cache is full
+	cache.put("http://localhost/other", &cacheEntry{body: []byte("other"), stored: now.Add(time.Second), expires: now.Add(time.Second + time.Minute)})
+	assert.Zero(t, cache.get("http://localhost/", anonymous, now))
+	assert.Equal(t, "session", string(cache.get("http://localhost/", session, now).body))
+
+	// expired entries are evicted
+	cache.put("http://localhost/new", &cacheEntry{body: []byte("new"), stored: now.Add(2 * time.Minute), expires: now.Add(3 * time.Minute)})
+	assert.Equal(t, 1, len(cache.entries))
+	assert.Equal(t, 1, len(cache.queue))
+}
+
+func TestNewCacheEntry(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	r.Header.Set("User-Agent", "Googlebot")
+	r.Header.Set("Accept-Language", "cs")
+	record := func(status int, header http.Header) *cacheRecorder {
+		recorder := &cacheRecorder{ResponseWriter: httptest.NewRecorder()}
+		for name, values := range header {
+			recorder.Header()[name] = values
+		}
+		recorder.WriteHeader(status)
+		_, _ = recorder.Write([]byte("<p>rendered</p>"))
+		return recorder
+	}
+
+	entry := newCacheEntry(r, record(http.StatusOK, http.Header{"Vary": {"Accept-Language"}, "Server-Timing": {"render;dur=120"}}), time.Now(), time.Minute)
+	assert.Equal(t, "<p>rendered</p>", string(entry.body))
+	assert.Equal(t, map[string]string{"Accept-Language": "cs", "User-Agent": "Googlebot", "Cookie": ""}, entry.vary)
+	assert.Equal(t, http.Header{"Vary": {"Accept-Language"}}, entry.header)
+
+	assert.Zero(t, newCacheEntry(r, record(http.StatusNotFound, nil), time.Now(), time.Minute))
+	assert.Zero(t, newCacheEntry(r, record(http.StatusOK, http.Header{"Cache-Control": {"private, max-age=60"}}), time.Now(), time.Minute))
+	assert.Zero(t, newCacheEntry(r, record(http.StatusOK, http.Header{"Set-Cookie": {"session=1"}}), time.Now(), time.Minute))
+	assert.Zero(t, newCacheEntry(r, record(http.StatusOK, http.Header{"Vary": {"*"}}), time.Now(), time.Minute))
+}
+
+func TestNewCacheEntry_Authorization(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	record := func(cacheControl string) *cacheRecorder {
+		recorder := &cacheRecorder{ResponseWriter: httptest.NewRecorder()}
+		if cacheControl != "" {
+			recorder.Header().Set("Cache-Control", cacheControl)
+		}
+		recorder.WriteHeader(http.StatusOK)
+		return recorder
+	}
+
+	// pages rendered for authenticated clients aren't served to others, unless the upstream allows it
+	assert.Zero(t, newCacheEntry(r, record(""), time.Now(), time.Minute))
+	assert.Zero(t, newCacheEntry(r, record("max-age=60"), time.Now(), time.Minute))
+	assert.NotZero(t, newCacheEntry(r, record("public, max-age=60"), time.Now(), time.Minute))
+	assert.NotZero(t, newCacheEntry(r, record("s-maxage=60"), time.Now(), time.Minute))
+}
+
+func TestNewCacheEntry_Freshness(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	for _, testCase := range []struct {
+		name    string
+		header  http.Header
+		expires time.Time
+	}{
+		{name: "ttl", header: http.Header{}, expires: now.Add(time.Minute)},
+		{name: "max-age", header: http.Header{"Cache-Control": {"max-age=10"}}, expires: now.Add(10 * time.Second)},
+		{name: "max-age over ttl", header: http.Header{"Cache-Control": {"max-age=3600"}}, expires: now.Add(time.Minute)},
+		{name: "s-maxage", header: http.Header{"Cache-Control": {`max-age=5, s-maxage="20"`}}, expires: now.Add(20 * time.Second)},
+		{name: "expires", header: http.Header{"Expires": {now.Add(30 * time.Second).Format(http.TimeFormat)}}, expires: now.Add(30 * time.Second)},
+		{name: "max-age over expires", header: http.Header{"Cache-Control": {"max-age=15"}, "Expires": {now.Add(30 * time.Second).Format(http.TimeFormat)}}, expires: now.Add(15 * time.Second)},
+		{name: "max-age=0", header: http.Header{"Cache-Control": {"max-age=0"}}},
+		{name: "expired", header: http.Header{"Expires": {now.Add(-time.Minute).Format(http.TimeFormat)}}},
+		{name: "invalid expires", header: http.Header{"Expires": {"0"}}},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			recorder := &cacheRecorder{ResponseWriter: httptest.NewRecorder()}
+			for name, values := range testCase.header {
+				recorder.Header()[name] = values
+			}
+			recorder.WriteHeader(http.StatusOK)
+			entry := newCacheEntry(r, recorder, now, time.Minute)
+			if testCase.expires.IsZero() {
+				assert.Zero(t, entry)
+				return
+			}
+			assert.Equal(t, testCase.expires, entry.expires)
+		})
+	}
+
+	// the page is served only while it's fresh
+	cache := newRenderCache(time.Minute, 10)
+	recorder := &cacheRecorder{ResponseWriter: httptest.NewRecorder()}
+	recorder.Header().Set("Cache-Control", "max-age=10")
+	recorder.WriteHeader(http.StatusOK)
+	cache.put("http://localhost/", newCacheEntry(r, recorder, now, time.Minute))
+	assert.NotZero(t, cache.get("http://localhost/", r, now.Add(9*time.Second)))
+	assert.Zero(t, cache.get("http://localhost/", r, now.Add(10*time.Second)))
+}
+
+func TestRenderCache_Stale(t *testing.T) {
+	now := time.Now()
+	cache := newRenderCache(time.Minute, 10)
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	cache.put("http://localhost/", &cacheEntry{body: []byte("etag"), stored: now, expires: now.Add(time.Minute), etag: `"v1"`})
+	cache.put("http://localhost/other", &cacheEntry{body: []byte("other"), stored: now, expires: now.Add(time.Minute)})
+	assert.Zero(t, cache.stale("http://localhost/", r, now))
+
+	// expired entries with validators are kept to be revalidated
+	later := now.Add(2 * time.Minute)
+	cache.put("http://localhost/new", &cacheEntry{stored: later, expires: later.Add(time.Minute)})
+	assert.Zero(t, cache.get("http://localhost/", r, later))
+	entry := cache.stale("http://localhost/", r, later)
+	assert.Equal(t, "etag", string(entry.body))
+
+	conditional := entry.conditional(r)
+	assert.Equal(t, `"v1"`, conditional.Header.Get("If-None-Match"))
+	assert.Zero(t, r.Header.Get("If-None-Match"))
+
+	revalidated := entry.revalidated(http.Header{"Cache-Control": {"max-age=10"}, "Etag": {`"v2"`}}, later, time.Minute)
+	assert.Equal(t, later.Add(10*time.Second), revalidated.expires)
+	assert.Equal(t, `"v2"`, revalidated.etag)
+	assert.Zero(t, revalidated.lastModified)
+
+	revalidated = revalidated.revalidated(http.Header{"Last-Modified": {"Mon, 02 Jan 2006 15:04:05 GMT"}}, later, time.Minute)
+	assert.Equal(t, later.Add(time.Minute), revalidated.expires)
+	assert.Equal(t, `"v2"`, revalidated.etag)
+	assert.Equal(t, "Mon, 02 Jan 2006 15:04:05 GMT", revalidated.conditional(r).Header.Get("If-Modified-Since"))
+	cache.put("http://localhost/", revalidated)
+	assert.Equal(t, "etag", string(cache.get("http://localhost/", r, later).body))
+}
@@ -0,0 +1,48 @@
+package caddy_chrome
+
+import (
+	"github.com/chromedp/cdproto/network"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RenderIfCookie renders only pages requested with the cookie, or with the cookie of the value, if it's set, e.g. for
+// a gradual rollout, or an A/B test. Other requests are passed through un-rendered.
+type RenderIfCookie struct {
+	Name  string `json:"name,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+// Match reports whether the request has the cookie.
+func (c *RenderIfCookie) Match(r *http.Request) bool {
+	if c == nil {
+		return true
+	}
+	cookie, err := r.Cookie(c.Name)
+	if err != nil {
+		return false
+	}
+	return c.Value == "" || cookie.Value == c.Value
+}
+
+// setCookie sets the cookie of the request in Chrome for the host of the request, without its port, Chrome rejects
+// domains with one. Hosts that can't be a cookie domain, IP addresses and localhost, get a host-only cookie of the URL
+// of the page.
+func setCookie(cookie *http.Cookie, host string, pageURL string) *network.SetCookieParams {
+	params := network.SetCookie(cookie.Name, cookie.Value).WithPath("/")
+	if domain := cookieDomain(host); domain != "" {
+		return params.WithDomain(domain)
+	}
+	return params.WithURL(pageURL)
+}
+
+// cookieDomain returns the host without its port, or nothing if it's an IP address, or a bare hostname such as
+// localhost.
+func cookieDomain(host string) string {
+	name := strings.TrimSuffix(hostname(host), ".")
+	if net.ParseIP(name) != nil || !strings.Contains(name, ".") {
+		return ""
+	}
+	return name
+}
@@ -0,0 +1,61 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRenderIfCookie_Match(t *testing.T) {
+	request := func(cookies ...*http.Cookie) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		return r
+	}
+
+	assert.True(t, (*RenderIfCookie)(nil).Match(request()))
+
+	presence := &RenderIfCookie{Name: "prerender"}
+	assert.True(t, presence.Match(request(&http.Cookie{Name: "prerender", Value: "1"})))
+	assert.True(t, presence.Match(request(&http.Cookie{Name: "prerender", Value: ""})))
+	assert.False(t, presence.Match(request()))
+	assert.False(t, presence.Match(request(&http.Cookie{Name: "other", Value: "1"})))
+
+	value := &RenderIfCookie{Name: "bucket", Value: "b"}
+	assert.True(t, value.Match(request(&http.Cookie{Name: "bucket", Value: "b"})))
+	assert.False(t, value.Match(request(&http.Cookie{Name: "bucket", Value: "a"})))
+	assert.False(t, value.Match(request()))
+}
+
+func TestSetCookie(t *testing.T) {
+	cookie := &http.Cookie{Name: "session", Value: "1"}
+	for _, testCase := range []struct {
+		host   string
+		domain string
+		url    string
+	}{
+		{host: "example.com", domain: "example.com"},
+		{host: "app.example.com:9443", domain: "app.example.com"},
+		{host: "example.com.:8080", domain: "example.com"},
+		{host: "localhost", url: "http://localhost/page"},
+		{host: "localhost:9080", url: "http://localhost:9080/page"},
+		{host: "127.0.0.1:9080", url: "http://127.0.0.1:9080/page"},
+		{host: "[::1]:9443", url: "https://[::1]:9443/page"},
+	} {
+		t.Run(testCase.host, func(t *testing.T) {
+			pageURL := testCase.url
+			if pageURL == "" {
+				pageURL = "http://" + testCase.host + "/page"
+			}
+			params := setCookie(cookie, testCase.host, pageURL)
+			assert.Equal(t, "session", params.Name)
+			assert.Equal(t, "1", params.Value)
+			assert.Equal(t, "/", params.Path)
+			assert.Equal(t, testCase.domain, params.Domain)
+			assert.Equal(t, testCase.url, params.URL)
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package caddy_chrome
+
+import (
+	"context"
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/css"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"unicode/utf16"
+)
+
+// criticalCSS collects external stylesheets loaded by the page, so that rules the page uses can be inlined and the
+// stylesheets loaded without blocking rendering.
+type criticalCSS struct {
+	mu     sync.Mutex
+	sheets map[css.StyleSheetID]string
+}
+
+func newCriticalCSS() *criticalCSS {
+	return &criticalCSS{sheets: make(map[css.StyleSheetID]string)}
+}
+
+func (c *criticalCSS) addStyleSheet(header *css.StyleSheetHeader) {
+	if header.Origin != css.StyleSheetOriginRegular || header.IsInline || header.SourceURL == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sheets[header.StyleSheetID] = header.SourceURL
+}
+
+// collect returns rules of the stylesheets used by the rendered document, and stylesheet links to move to the end of
+// the body. Rule usage tracking forces style recalculation, so it only has to run once the page is rendered.
+func (c *criticalCSS) collect(ctx context.Context, root *cdp.Node) (*criticalStyles, error) {
+	head, body := documentHeadBody(root)
+	if head == nil || body == nil {
+		return nil, nil
+	}
+	if err := css.StartRuleUsageTracking().Do(ctx); err != nil {
+		return nil, err
+	}
+	usage, err := css.StopRuleUsageTracking().Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	sheets := make(map[css.StyleSheetID]string, len(c.sheets))
+	for id, sourceURL := range c.sheets {
+		sheets[id] = sourceURL
+	}
+	c.mu.Unlock()
+
+	sheetUsage := make(map[css.StyleSheetID][]*css.RuleUsage)
+	var order []css.StyleSheetID
+	for _, rule := range usage {
+		if _, ok := sheets[rule.StyleSheetID]; !ok {
+			continue
+		}
+		if _, ok := sheetUsage[rule.StyleSheetID]; !ok {
+			order = append(order, rule.StyleSheetID)
+		}
+		sheetUsage[rule.StyleSheetID] = append(sheetUsage[rule.StyleSheetID], rule)
+	}
+
+	var rules strings.Builder
+	inlined := make(map[string]bool)
+	for _, id := range order {
+		text, err := css.GetStyleSheetText(id).Do(ctx)
+		if err != nil {
+			return nil, err
+		}
+		rules.WriteString(usedRules(text, sheetUsage[id]))
+		inlined[sheets[id]] = true
+	}
+	// stylesheets with no used rules don't need to block rendering either
+	for id, sourceURL := range sheets {
+		if _, ok := sheetUsage[id]; !ok {
+			inlined[sourceURL] = true
+		}
+	}
+
+	base, _ := url.Parse(root.BaseURL)
+	styles := &criticalStyles{
+		css:   rules.String(),
+		head:  head,
+		body:  body,
+		links: make(map[*cdp.Node]bool),
+	}
+	for _, child := range head.Children {
+		if href, ok := stylesheetHref(child); ok && base != nil {
+			if u, err := base.Parse(href); err == nil && inlined[u.String()] {
+				styles.links[child] = true
+				styles.order = append(styles.order, child)
+			}
+		}
+	}
+	return styles, nil
+}
+
+// criticalStyles are injected at the end of the head, the stylesheet links are moved from the head to the end of the
+// body, where they don't block rendering of the content.
+type criticalStyles struct {
+	css   string
+	head  *cdp.Node
+	body  *cdp.Node
+	links map[*cdp.Node]bool
+	order []*cdp.Node
+}
+
+var styleEndTagRegexp = regexp.MustCompile(`(?i)</style`)
+
+// styleText returns the rules escaped to be put inside a style element.
+func (c *criticalStyles) styleText() string {
+	return styleEndTagRegexp.ReplaceAllStringFunc(c.css, func(s string) string {
+		return s[:1] + `\` + s[1:]
+	})
+}
+
+// injectedStyle returns the text of the style element the serializer injects into the head, or an empty string if it
+// doesn't inject one.
+func (s *domSerializer) injectedStyle() string {
+	if s.critical == nil || s.critical.head == nil || s.critical.css == "" {
+		return ""
+	}
+	if s.xml {
+		// the text is escaped in XML documents, the element's content is the rules as they are
+		return s.critical.css
+	}
+	return s.critical.styleText()
+}
+
+func documentHeadBody(root *cdp.Node) (head, body *cdp.Node) {
+	if root.NodeType != cdp.NodeTypeDocument {
+		return nil, nil
+	}
+	for _, html := range root.Children {
+		if html.NodeType != cdp.NodeTypeElement || html.LocalName != "html" {
+			continue
+		}
+		for _, child := range html.Children {
+			if child.NodeType != cdp.NodeTypeElement {
+				continue
+			}
+			switch child.LocalName {
+			case "head":
+				head = child
+			case "body":
+				body = child
+			}
+		}
+	}
+	return head, body
+}
+
+// stylesheetHref returns href of a stylesheet link element.
+func stylesheetHref(node *cdp.Node) (string, bool) {
+	if node.NodeType != cdp.NodeTypeElement || node.LocalName != "link" {
+		return "", false
+	}
+	var href string
+	isStylesheet := false
+	for i := 0; i+1 < len(node.Attributes); i += 2 {
+		switch node.Attributes[i] {
+		case "rel":
+			for _, rel := range strings.Fields(node.Attributes[i+1]) {
+				if strings.EqualFold(rel, "stylesheet") {
+					isStylesheet = true
+				} else if strings.EqualFold(rel, "alternate") {
+					return "", false
+				}
+			}
+		case "href":
+			href = node.Attributes[i+1]
+		}
+	}
+	return href, isStylesheet && href != ""
+}
+
+// usedRules returns the used rules of the stylesheet, rules nested in blocks (e.g. @media, or @supports) are wrapped
+// in copies of them. Offsets of the rules are in UTF-16 code units.
+func usedRules(text string, usage []*css.RuleUsage) string {
+	src := utf16.Encode([]rune(text))
+
+	type span struct{ start, end int }
+	var spans []span
+	for _, rule := range usage {
+		start, end := int(rule.StartOffset), int(rule.EndOffset)
+		if rule.Used && start >= 0 && start < end && end <= len(src) {
+			spans = append(spans, span{start, end})
+		}
+	}
+	slices.SortFunc(spans, func(a, b span) int { return a.start - b.start })
+
+	type block struct{ preludeStart, brace int }
+	var (
+		out            strings.Builder
+		blocks         []block
+		statementStart int
+		pos            int
+	)
+	for _, rule := range spans {
+		if rule.start < pos {
+			// nested in the previous used rule, which already contains it
+			continue
+		}
+		for ; pos < rule.start; pos++ {
+			switch src[pos] {
+			case '/':
+				if pos+1 < len(src) && src[pos+1] == '*' {
+					for pos += 2; pos+1 < len(src) && (src[pos] != '*' || src[pos+1] != '/'); pos++ {
+					}
+					pos++
+				}
+			case '"', '\'':
+				quote := src[pos]
+				for pos++; pos < len(src) && src[pos] != quote; pos++ {
+					if src[pos] == '\\' {
+						pos++
+					}
+				}
+			case '{':
+				blocks = append(blocks, block{statementStart, pos})
+				statementStart = pos + 1
+			case '}':
+				if len(blocks) > 0 {
+					blocks = blocks[:len(blocks)-1]
+				}
+				statementStart = pos + 1
+			case ';':
+				statementStart = pos + 1
+			}
+		}
+		if pos > rule.start {
+			// the rule starts inside a comment or a string, offsets don't match the text
+			continue
+		}
+		for _, b := range blocks {
+			out.WriteString(strings.TrimSpace(string(utf16.Decode(src[b.preludeStart:b.brace]))))
+			out.WriteString("{")
+		}
+		ruleText := string(utf16.Decode(src[rule.start:rule.end]))
+		if rule.end < len(src) && src[rule.end] == '}' && strings.Count(ruleText, "{") > strings.Count(ruleText, "}") {
+			// the offset is at the closing brace rather than after it
+			ruleText += "}"
+			rule.end++
+		}
+		out.WriteString(ruleText)
+		for range blocks {
+			out.WriteString("}")
+		}
+		out.WriteString("\n")
+		pos = rule.end
+		statementStart = rule.end
+	}
+	return out.String()
+}
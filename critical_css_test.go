@@ -0,0 +1,98 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"github.com/chromedp/cdproto/css"
+	"strings"
+	"testing"
+)
+
+func TestUsedRules(t *testing.T) {
+	for _, testCase := range []struct {
+		name     string
+		text     string
+		used     []string
+		unused   []string
+		expected string
+	}{
+		{
+			name:     "top-level",
+			text:     ".a { color: red }\n.b { color: blue }\n",
+			used:     []string{".a { color: red }"},
+			unused:   []string{".b { color: blue }"},
+			expected: ".a { color: red }\n",
+		},
+		{
+			name:     "media",
+			text:     "@media (min-width: 600px) {\n  .a { color: red }\n  .b { color: blue }\n}\n",
+			used:     []string{".b { color: blue }"},
+			unused:   []string{".a { color: red }"},
+			expected: "@media (min-width: 600px){.b { color: blue }}\n",
+		},
+		{
+			name:     "nested blocks",
+			text:     ".x{}@supports (display: grid) { @media print { .a { display: grid } } }",
+			used:     []string{".a { display: grid }"},
+			expected: "@supports (display: grid){@media print{.a { display: grid }}}\n",
+		},
+		{
+			name:     "braces in comments and strings",
+			text:     "/* { */ .a::before { content: \"}\" }\n@media screen { .b { color: red } }",
+			used:     []string{".a::before { content: \"}\" }", ".b { color: red }"},
+			expected: ".a::before { content: \"}\" }\n@media screen{.b { color: red }}\n",
+		},
+		{
+			name:     "utf-16 offsets",
+			text:     ".emoji::before { content: \"😀\" }\n.a { color: red }",
+			used:     []string{".a { color: red }"},
+			expected: ".a { color: red }\n",
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			var usage []*css.RuleUsage
+			for _, rules := range []struct {
+				texts []string
+				used  bool
+			}{{testCase.used, true}, {testCase.unused, false}} {
+				for _, rule := range rules.texts {
+					start := utf16Len(testCase.text[:strings.Index(testCase.text, rule)])
+					usage = append(usage, &css.RuleUsage{
+						StartOffset: float64(start),
+						EndOffset:   float64(start + utf16Len(rule)),
+						Used:        rules.used,
+					})
+				}
+			}
+			assert.Equal(t, testCase.expected, usedRules(testCase.text, usage))
+		})
+	}
+}
+
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		if r > 0xffff {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+func TestStylesheetHref(t *testing.T) {
+	href, ok := stylesheetHref(element("link", []string{"rel", "Stylesheet", "href", "/app.css"}))
+	assert.True(t, ok)
+	assert.Equal(t, "/app.css", href)
+
+	_, ok = stylesheetHref(element("link", []string{"rel", "alternate stylesheet", "href", "/dark.css"}))
+	assert.False(t, ok)
+
+	_, ok = stylesheetHref(element("link", []string{"rel", "preload", "href", "/app.css"}))
+	assert.False(t, ok)
+}
+
+func TestCriticalStyles_StyleText(t *testing.T) {
+	styles := &criticalStyles{css: `.a::after { content: "</style>" } .b::after { content: "</STYLE" }`}
+	assert.Equal(t, `.a::after { content: "<\/style>" } .b::after { content: "<\/STYLE" }`, styles.styleText())
+}
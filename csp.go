@@ -0,0 +1,147 @@
+package caddy_chrome
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"regexp"
+	"strings"
+)
+
+const defaultCSPPolicy = "script-src 'self' 'nonce-{nonce}'; style-src 'self' 'nonce-{nonce}'"
+
+type CSPNonce struct {
+	Policy string `json:"policy,omitempty"`
+}
+
+var nonceSourceRegexp = regexp.MustCompile(`'nonce-[^']*'`)
+
+// inlineAllowlistRegexp matches sources allowing specific inline elements, with any of them 'unsafe-inline' is ignored.
+var inlineAllowlistRegexp = regexp.MustCompile(`(?i)'(nonce|sha256|sha384|sha512)-[^']*'`)
+
+// newNonce generates a random nonce to be used for a single response.
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// Header returns the Content-Security-Policy header value allowing the nonce. Without a configured policy, nonce
+// sources in the upstream header are replaced, if it has none, the nonce is added to its directives applying to
+// scripts and styles, other directives are kept. If there isn't an upstream header, the default policy is used.
+func (c *CSPNonce) Header(upstream string, nonce string) string {
+	source := "'nonce-" + nonce + "'"
+	if c.Policy == "" && nonceSourceRegexp.MatchString(upstream) {
+		return nonceSourceRegexp.ReplaceAllLiteralString(upstream, source)
+	}
+	if c.Policy == "" && strings.TrimSpace(upstream) != "" {
+		directives, indexes := parsePolicy(upstream)
+		for _, names := range [][]string{{"script-src-elem", "script-src"}, {"style-src-elem", "style-src"}} {
+			directives = addSource(directives, indexes, names, source)
+		}
+		return joinPolicy(directives)
+	}
+	policy := c.Policy
+	if policy == "" {
+		policy = defaultCSPPolicy
+	}
+	return strings.ReplaceAll(policy, "{nonce}", nonce)
+}
+
+// parsePolicy splits the policy into directives, and returns indexes of the first occurrences of them by name, browsers
+// ignore repeated ones.
+func parsePolicy(policy string) ([][]string, map[string]int) {
+	var directives [][]string
+	indexes := make(map[string]int)
+	for _, directive := range strings.Split(policy, ";") {
+		fields := strings.Fields(directive)
+		if len(fields) == 0 {
+			continue
+		}
+		name := strings.ToLower(fields[0])
+		if _, ok := indexes[name]; !ok {
+			indexes[name] = len(directives)
+		}
+		directives = append(directives, fields)
+	}
+	return directives, indexes
+}
+
+// joinPolicy joins the directives back into a policy.
+func joinPolicy(directives [][]string) string {
+	joined := make([]string, len(directives))
+	for i, fields := range directives {
+		joined[i] = strings.Join(fields, " ")
+	}
+	return strings.Join(joined, "; ")
+}
+
+// addSource adds the source to the directives of the names that are present, e.g. both script-src-elem and
+// script-src, or to the last of the names copied from default-src if none of them is. If there's no default-src
+// either, the elements aren't restricted, and the directives are returned as they are.
+func addSource(directives [][]string, indexes map[string]int, names []string, source string) [][]string {
+	var targets []int
+	for _, name := range names {
+		if i, ok := indexes[name]; ok {
+			targets = append(targets, i)
+		}
+	}
+	if len(targets) == 0 {
+		defaultSrc, ok := indexes["default-src"]
+		if !ok {
+			return directives
+		}
+		indexes[names[len(names)-1]] = len(directives)
+		targets = append(targets, len(directives))
+		directives = append(directives, append([]string{names[len(names)-1]}, directives[defaultSrc][1:]...))
+	}
+	for _, target := range targets {
+		sources := directives[target][1:]
+		if len(sources) == 1 && strings.EqualFold(sources[0], "'none'") {
+			sources = nil
+		}
+		directives[target] = append(append([]string{directives[target][0]}, sources...), source)
+	}
+	return directives
+}
+
+// allowInlineStyle returns the policy allowing an inline style element with the text by its hash, so that styles
+// injected into the rendered page (critical CSS) aren't blocked by the policy of the upstream response, which doesn't
+// know about them. The most specific directive applying to style elements gets the hash, a style-src copied from
+// default-src if there's none. Directives allowing all inline styles are kept, a hash would disallow the rest.
+func allowInlineStyle(policy string, text string) string {
+	hash := sha256.Sum256([]byte(text))
+	source := "'sha256-" + base64.StdEncoding.EncodeToString(hash[:]) + "'"
+
+	directives, indexes := parsePolicy(policy)
+	target, ok := indexes["style-src-elem"]
+	if !ok {
+		target, ok = indexes["style-src"]
+	}
+	if !ok {
+		defaultSrc, ok := indexes["default-src"]
+		if !ok {
+			// inline styles aren't restricted
+			return policy
+		}
+		target = len(directives)
+		directives = append(directives, append([]string{"style-src"}, directives[defaultSrc][1:]...))
+	}
+
+	sources := directives[target][1:]
+	allowsInline, allowlist := false, false
+	for _, s := range sources {
+		allowsInline = allowsInline || strings.EqualFold(s, "'unsafe-inline'")
+		allowlist = allowlist || inlineAllowlistRegexp.MatchString(s)
+	}
+	if allowsInline && !allowlist {
+		return policy
+	}
+	if len(sources) == 1 && strings.EqualFold(sources[0], "'none'") {
+		sources = nil
+	}
+	directives[target] = append(append([]string{directives[target][0]}, sources...), source)
+	return joinPolicy(directives)
+}
@@ -0,0 +1,104 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"testing"
+)
+
+func TestCSPNonce_Header(t *testing.T) {
+	for _, testCase := range []struct {
+		name     string
+		csp      *CSPNonce
+		upstream string
+		expected string
+	}{
+		{
+			name:     "default",
+			csp:      &CSPNonce{},
+			expected: "script-src 'self' 'nonce-abc'; style-src 'self' 'nonce-abc'",
+		},
+		{
+			name:     "upstream nonces",
+			csp:      &CSPNonce{},
+			upstream: "default-src 'self'; script-src 'nonce-old' 'strict-dynamic'; style-src 'nonce-old'",
+			expected: "default-src 'self'; script-src 'nonce-abc' 'strict-dynamic'; style-src 'nonce-abc'",
+		},
+		{
+			name:     "upstream without nonces",
+			csp:      &CSPNonce{},
+			upstream: "default-src 'self'; frame-ancestors 'none'",
+			expected: "default-src 'self'; frame-ancestors 'none'; script-src 'self' 'nonce-abc'; style-src 'self' 'nonce-abc'",
+		},
+		{
+			name:     "upstream script-src and style-src",
+			csp:      &CSPNonce{},
+			upstream: "script-src 'self' https://cdn.example.com; script-src-elem 'self'; style-src 'none'; connect-src 'self'",
+			expected: "script-src 'self' https://cdn.example.com 'nonce-abc'; script-src-elem 'self' 'nonce-abc'; style-src 'nonce-abc'; connect-src 'self'",
+		},
+		{
+			name:     "upstream not restricting scripts and styles",
+			csp:      &CSPNonce{},
+			upstream: "frame-ancestors 'none'",
+			expected: "frame-ancestors 'none'",
+		},
+		{
+			name:     "policy",
+			csp:      &CSPNonce{Policy: "script-src 'nonce-{nonce}'"},
+			upstream: "script-src 'nonce-old'",
+			expected: "script-src 'nonce-abc'",
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert.Equal(t, testCase.expected, testCase.csp.Header(testCase.upstream, "abc"))
+		})
+	}
+}
+
+func TestAllowInlineStyle(t *testing.T) {
+	const hash = "'sha256-p0bF+un5yUb9MBO6xRb8kPHlY2BdpHVtLiFkDrZPF64='"
+	for _, testCase := range []struct {
+		name     string
+		policy   string
+		expected string
+	}{
+		{
+			name:     "style-src",
+			policy:   "script-src 'self'; style-src 'self'",
+			expected: "script-src 'self'; style-src 'self' " + hash,
+		},
+		{
+			name:     "style-src-elem",
+			policy:   "style-src 'self'; style-src-elem 'self' https://cdn.example.com",
+			expected: "style-src 'self'; style-src-elem 'self' https://cdn.example.com " + hash,
+		},
+		{
+			name:     "default-src",
+			policy:   "default-src 'self'; img-src *",
+			expected: "default-src 'self'; img-src *; style-src 'self' " + hash,
+		},
+		{
+			name:     "none",
+			policy:   "style-src 'none'",
+			expected: "style-src " + hash,
+		},
+		{
+			name:     "nonce",
+			policy:   "style-src 'unsafe-inline' 'nonce-abc'",
+			expected: "style-src 'unsafe-inline' 'nonce-abc' " + hash,
+		},
+		{
+			name:     "unsafe-inline",
+			policy:   "style-src 'self' 'unsafe-inline'",
+			expected: "style-src 'self' 'unsafe-inline'",
+		},
+		{
+			name:     "unrestricted",
+			policy:   "script-src 'self'; frame-ancestors 'none'",
+			expected: "script-src 'self'; frame-ancestors 'none'",
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert.Equal(t, testCase.expected, allowInlineStyle(testCase.policy, "p{color:red}"))
+		})
+	}
+}
@@ -0,0 +1,17 @@
+package caddy_chrome
+
+import (
+	"github.com/chromedp/chromedp/device"
+	"strings"
+)
+
+// lookupDevice returns the device preset of chromedp by its name, the same as in Chrome DevTools (e.g. "iPhone 13",
+// or "Pixel 5 landscape"), case-insensitive.
+func lookupDevice(name string) (device.Info, bool) {
+	for d := device.Reset + 1; d <= device.MotoG4landscape; d++ {
+		if info := d.Device(); strings.EqualFold(info.Name, name) {
+			return info, true
+		}
+	}
+	return device.Info{}, false
+}
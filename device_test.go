@@ -0,0 +1,22 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"testing"
+)
+
+func TestLookupDevice(t *testing.T) {
+	info, ok := lookupDevice("iPhone 13")
+	assert.True(t, ok)
+	assert.Equal(t, "iPhone 13", info.Name)
+	assert.True(t, info.Mobile)
+
+	info, ok = lookupDevice("pixel 5 LANDSCAPE")
+	assert.True(t, ok)
+	assert.True(t, info.Landscape)
+
+	_, ok = lookupDevice("Nokia 3310")
+	assert.False(t, ok)
+	_, ok = lookupDevice("")
+	assert.False(t, ok)
+}
@@ -0,0 +1,42 @@
+package caddy_chrome
+
+import (
+	"encoding/json"
+	"github.com/chromedp/cdproto/cdp"
+	"io"
+)
+
+// DOMSerializer serializes DOM trees in the format returned by DOM.getDocument to HTML, the same way rendered pages
+// are, so it can be used on saved snapshots without Chrome.
+type DOMSerializer struct {
+	Root *cdp.Node
+}
+
+// NewDOMSerializer reads the DOM tree from JSON, either the node itself or the result of DOM.getDocument with
+// the node under the root key.
+func NewDOMSerializer(r io.Reader) (*DOMSerializer, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Root *cdp.Node `json:"root"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	if result.Root != nil {
+		return &DOMSerializer{Root: result.Root}, nil
+	}
+	root := new(cdp.Node)
+	if err := json.Unmarshal(data, root); err != nil {
+		return nil, err
+	}
+	return &DOMSerializer{Root: root}, nil
+}
+
+func (s *DOMSerializer) Serialize(w io.Writer) error {
+	serializer := newDomSerializer(s.Root)
+	defer serializer.release()
+	return serializer.Serialize(w)
+}
@@ -1,11 +1,17 @@
 package caddy_chrome
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/chromedp/cdproto/cdp"
 	"html"
 	"io"
+	"net/http"
+	"runtime"
 	"strings"
+	"sync"
 )
 
 // See https://developer.mozilla.org/en-US/docs/Glossary/Void_element
@@ -26,23 +32,226 @@ var voidElements = map[string]bool{
 	"wbr":    true,
 }
 
+// Elements whose text content must be kept as is.
+var preformattedElements = map[string]bool{
+	"listing":   true,
+	"plaintext": true,
+	"pre":       true,
+	"script":    true,
+	"style":     true,
+	"textarea":  true,
+}
+
+// Elements whose leading newline is dropped by the HTML parser.
+var leadingNewlineElements = map[string]bool{
+	"listing":  true,
+	"pre":      true,
+	"textarea": true,
+}
+
+// Elements whose text is written as is, without escaping, noscript is one since Chrome parses it with scripting
+// enabled, its content is a single text node of markup, e.g. the AMP boilerplate.
+// See https://html.spec.whatwg.org/multipage/parsing.html#serialising-html-fragments
+var rawTextElements = map[string]bool{
+	"iframe":    true,
+	"noembed":   true,
+	"noframes":  true,
+	"noscript":  true,
+	"plaintext": true,
+	"script":    true,
+	"style":     true,
+	"xmp":       true,
+}
+
+var errNoDocument = errors.New("no document to serialize")
+
 type domSerializer struct {
 	root           *cdp.Node
 	doctypeWritten bool
-	noEscape       bool
+	// skipDoctype disables writing HTML doctype before the first element if the document doesn't have one
+	skipDoctype bool
+	// xml serializes by XML rules, e.g. for XHTML or SVG documents, element names keep their prefix and case, empty
+	// elements are self-closed, and text of scripts and styles is escaped
+	xml      bool
+	noEscape bool
+	// preformatted is set inside elements where whitespace is significant, any whitespace transforms must leave text
+	// there byte-exact
+	preformatted bool
+
+	// nonce is set on inline script and style elements
+	nonce string
+	// sanitize removes matching attributes if set
+	sanitize *Sanitize
+	// stripScripts removes executable scripts
+	stripScripts bool
+	// stripHydration removes matching comments and attributes if set
+	stripHydration *StripHydration
+	// optimizeImages adds lazy loading to images except eagerImages if set
+	optimizeImages *OptimizeImages
+	eagerImages    map[*cdp.Node]bool
+	// iframesOrigin inlines content documents of iframes of this origin into the srcdoc attribute if set
+	iframesOrigin string
+	// critical styles are injected into the head and the stylesheet links moved to the end of the body if set
+	critical *criticalStyles
+	// omitEmptyHeadBody omits head and body elements without attributes and children, whose tags are optional, e.g.
+	// the ones the browser inserted into a document without them
+	omitEmptyHeadBody bool
+	// minify leaves out whitespace between blocks
+	minify bool
+
+	// parallelThreshold enables serializing children of nodes with at least this many descendants concurrently
+	parallelThreshold int
+	sizes             map[*cdp.Node]int
+	sem               chan struct{}
+
+	// stream fetches subtrees of the tree while it's serialized if set, what's written is flushed to the client
+	// whenever the serializer waits for a subtree
+	stream *domStream
+	flush  func() error
+
+	// truncateAt stops serializing nodes once this many bytes were written if set, truncated is set if it did
+	truncateAt int64
+	written    *countingWriter
+	truncated  bool
+}
+
+var serializerPool = sync.Pool{
+	New: func() interface{} {
+		return new(domSerializer)
+	},
+}
+
+var bufWriterPool = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewWriterSize(nil, 32*1024)
+	},
+}
+
+// newDomSerializer returns a serializer from the pool, it should be given back by calling release once not needed.
+func newDomSerializer(root *cdp.Node) *domSerializer {
+	s := serializerPool.Get().(*domSerializer)
+	s.reset()
+	s.root = root
+	return s
+}
+
+func (s *domSerializer) reset() {
+	*s = domSerializer{}
+}
+
+func (s *domSerializer) release() {
+	s.reset()
+	serializerPool.Put(s)
 }
 
 func (s *domSerializer) Serialize(w io.Writer) error {
-	return s.serializeNode(w, s.root)
+	if s.root == nil {
+		return errNoDocument
+	}
+	// HTML doctype isn't valid in XML documents, e.g. an XHTML page whose document Chrome reports without XML version
+	if s.skipDoctype || s.xml || !forcesDoctype(s.root) {
+		s.doctypeWritten = true
+	}
+	if s.optimizeImages != nil {
+		s.eagerImages = firstImages(s.root, s.optimizeImages.SkipFirst)
+	}
+	if s.parallelThreshold > 0 && s.root != nil {
+		s.sizes = make(map[*cdp.Node]int)
+		if countNodes(s.root, s.sizes) >= s.parallelThreshold {
+			s.sem = make(chan struct{}, runtime.GOMAXPROCS(0))
+		} else {
+			s.sizes = nil
+		}
+	}
+	bw := bufWriterPool.Get().(*bufio.Writer)
+	bw.Reset(w)
+	defer func() {
+		bw.Reset(nil)
+		bufWriterPool.Put(bw)
+	}()
+	if s.stream != nil {
+		s.flush = func() error {
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+			if rw, ok := w.(http.ResponseWriter); ok {
+				if err := http.NewResponseController(rw).Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	var out io.Writer = bw
+	if s.truncateAt > 0 {
+		s.written = &countingWriter{w: bw}
+		out = s.written
+	}
+	if err := s.serializeNode(out, s.root); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// isForeignRoot reports whether the first element of the document is an SVG or MathML one, e.g. of a standalone SVG
+// image.
+func isForeignRoot(node *cdp.Node) bool {
+	localName := strings.ToLower(node.LocalName)
+	return node.IsSVG || localName == "svg" || localName == "math"
+}
+
+// forcesDoctype reports whether HTML doctype can be written before the first element if the document doesn't have
+// one, it can't for XML documents and documents in quirks or limited-quirks mode, since the doctype would change how
+// they're rendered.
+func forcesDoctype(root *cdp.Node) bool {
+	if root.NodeType != cdp.NodeTypeDocument {
+		return true
+	}
+	return root.XMLVersion == "" && root.CompatibilityMode != cdp.CompatibilityModeQuirksMode &&
+		root.CompatibilityMode != cdp.CompatibilityModeLimitedQuirksMode
+}
+
+// countNodes returns the number of nodes in the subtree, including shadow roots and template contents, and records
+// subtree sizes.
+func countNodes(node *cdp.Node, sizes map[*cdp.Node]int) int {
+	count := 1
+	for _, shadowRoot := range node.ShadowRoots {
+		count += countNodes(shadowRoot, sizes)
+	}
+	if node.TemplateContent != nil {
+		count += countNodes(node.TemplateContent, sizes)
+	}
+	for _, child := range node.Children {
+		count += countNodes(child, sizes)
+	}
+	sizes[node] = count
+	return count
 }
 
 func (s *domSerializer) serializeNode(w io.Writer, node *cdp.Node) error {
+	if s.truncates() {
+		return nil
+	}
 	switch node.NodeType {
 	case cdp.NodeTypeElement:
+		if s.stream != nil {
+			if err := s.stream.wait(node, s.flush); err != nil {
+				return fmt.Errorf("failed to fetch streamed subtree: %w", err)
+			}
+		}
+		if s.critical != nil && s.critical.links[node] {
+			return nil
+		}
+		if s.stripScripts && isExecutableScript(node) {
+			return nil
+		}
 		return s.serializeElementNode(w, node)
 	case cdp.NodeTypeText:
 		return s.serializeTextNode(w, node)
 	case cdp.NodeTypeComment:
+		if s.stripHydration != nil && s.stripHydration.dropComment(node.NodeValue) {
+			return nil
+		}
 		return s.serializeComment(w, node)
 	case cdp.NodeTypeDocument:
 		return s.serializeDocumentNode(w, node)
@@ -50,6 +259,12 @@ func (s *domSerializer) serializeNode(w io.Writer, node *cdp.Node) error {
 		return s.serializeDocumentTypeNode(w, node)
 	case cdp.NodeTypeDocumentFragment:
 		return s.serializeChildren(w, node)
+	case cdp.NodeTypeCDATA:
+		_, err := io.WriteString(w, "<![CDATA["+node.NodeValue+"]]>")
+		return err
+	case cdp.NodeTypeProcessingInstruction:
+		_, err := io.WriteString(w, "<?"+node.NodeName+" "+node.NodeValue+"?>")
+		return err
 	default:
 		return fmt.Errorf("node type [%d] not implemeted", node.NodeType)
 	}
@@ -59,50 +274,132 @@ func (s *domSerializer) serializeDocumentNode(w io.Writer, node *cdp.Node) error
 	return s.serializeChildren(w, node)
 }
 
+// omitsElement reports whether the element is an empty head or body omitted from the output, they're re-created when
+// the document is parsed. Elements critical styles are injected into are kept, and XML requires all tags.
+func (s *domSerializer) omitsElement(node *cdp.Node) bool {
+	if !s.omitEmptyHeadBody || s.xml || node.IsSVG || node.LocalName != "head" && node.LocalName != "body" {
+		return false
+	}
+	if s.critical != nil && (node == s.critical.head || node == s.critical.body) {
+		return false
+	}
+	return len(node.Attributes) == 0 && len(node.Children) == 0 && len(node.ShadowRoots) == 0
+}
+
 func (s *domSerializer) serializeElementNode(w io.Writer, node *cdp.Node) error {
 	if !s.doctypeWritten {
-		if _, err := w.Write([]byte("<!DOCTYPE html>")); err != nil {
-			return err
+		// the doctype is HTML's, documents whose root is a foreign element don't get one
+		if !isForeignRoot(node) {
+			if _, err := io.WriteString(w, "<!DOCTYPE html>"); err != nil {
+				return err
+			}
 		}
 		s.doctypeWritten = true
 	}
+	if s.omitsElement(node) {
+		return nil
+	}
 
 	// start tag
-	if _, err := w.Write([]byte(`<`)); err != nil {
+	if _, err := io.WriteString(w, `<`); err != nil {
 		return err
 	}
 	localName := node.LocalName
-	if _, err := w.Write([]byte(localName)); err != nil {
+	tagName := localName
+	if s.xml {
+		tagName = node.NodeName
+	}
+	if _, err := io.WriteString(w, tagName); err != nil {
 		return err
 	}
-	for i, l := 0, len(node.Attributes); i < l; i += 2 {
-		if _, err := w.Write([]byte(` `)); err != nil {
+	withNonce := s.nonce != "" && needsNonce(node)
+	var srcdoc string
+	withSrcdoc := false
+	if s.iframesOrigin != "" && localName == "iframe" && node.ContentDocument != nil && s.inlinesFrame(node.ContentDocument) {
+		var err error
+		srcdoc, err = s.serializeFrame(node.ContentDocument)
+		if err != nil {
 			return err
 		}
+		withSrcdoc = true
+	}
+	for i, l := 0, len(node.Attributes); i < l; i += 2 {
 		attributeName := node.Attributes[i]
-		if _, err := w.Write([]byte(attributeName)); err != nil {
+		if withNonce && attributeName == "nonce" {
+			continue
+		}
+		if withSrcdoc && attributeName == "srcdoc" {
+			continue
+		}
+		if s.sanitize != nil && s.sanitize.dropAttribute(attributeName, node.Attributes[i+1]) {
+			continue
+		}
+		if s.stripHydration != nil && s.stripHydration.dropAttribute(attributeName) {
+			continue
+		}
+		if _, err := io.WriteString(w, ` `); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, attributeName); err != nil {
 			return err
 		}
-		if node.Attributes[i+1] != "" {
-			if _, err := w.Write([]byte(`="`)); err != nil {
+		if node.Attributes[i+1] != "" || s.xml {
+			if _, err := io.WriteString(w, `="`); err != nil {
+				return err
+			}
+			if err := writeEscaped(w, node.Attributes[i+1]); err != nil {
 				return err
 			}
-			attributeValue := html.EscapeString(node.Attributes[i+1])
-			if _, err := w.Write([]byte(attributeValue)); err != nil {
+			if _, err := io.WriteString(w, `"`); err != nil {
 				return err
 			}
-			if _, err := w.Write([]byte(`"`)); err != nil {
+		}
+	}
+	if withNonce {
+		if _, err := io.WriteString(w, ` nonce="`); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, html.EscapeString(s.nonce)); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, `"`); err != nil {
+			return err
+		}
+	}
+	if withSrcdoc {
+		if _, err := io.WriteString(w, ` srcdoc="`); err != nil {
+			return err
+		}
+		if err := writeEscaped(w, srcdoc); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, `"`); err != nil {
+			return err
+		}
+	}
+	if s.optimizeImages != nil && localName == "img" && !s.eagerImages[node] {
+		attributes := s.optimizeImages.imageAttributes(node)
+		for i := 0; i < len(attributes); i += 2 {
+			if _, err := io.WriteString(w, ` `+attributes[i]+`="`+attributes[i+1]+`"`); err != nil {
 				return err
 			}
 		}
 	}
-	isVoid := voidElements[strings.ToLower(localName)]
+	var isVoid bool
+	if s.xml {
+		isVoid = len(node.Children) == 0 && len(node.ShadowRoots) == 0 && node.TemplateContent == nil &&
+			(s.critical == nil || node != s.critical.head && node != s.critical.body)
+	} else {
+		// local names are written as Chrome reports them, i.e. lowercased for HTML elements, and case-preserved for
+		// foreign ones (e.g. SVG linearGradient), which are never void
+		isVoid = !node.IsSVG && voidElements[strings.ToLower(localName)]
+	}
 	if isVoid {
-		if _, err := w.Write([]byte(` />`)); err != nil {
+		if _, err := io.WriteString(w, ` />`); err != nil {
 			return err
 		}
 	} else {
-		if _, err := w.Write([]byte(`>`)); err != nil {
+		if _, err := io.WriteString(w, `>`); err != nil {
 			return err
 		}
 	}
@@ -113,44 +410,69 @@ func (s *domSerializer) serializeElementNode(w io.Writer, node *cdp.Node) error
 			continue
 		}
 
-		if _, err := w.Write([]byte(`<template shadowrootmode="`)); err != nil {
+		if _, err := io.WriteString(w, `<template shadowrootmode="`); err != nil {
 			return err
 		}
-		if _, err := w.Write([]byte(shadowRoot.ShadowRootType)); err != nil {
+		if _, err := io.WriteString(w, shadowRoot.ShadowRootType.String()); err != nil {
 			return err
 		}
-		if _, err := w.Write([]byte(`">`)); err != nil {
+		if _, err := io.WriteString(w, `">`); err != nil {
 			return err
 		}
 		if err := s.serializeNode(w, shadowRoot); err != nil {
 			return err
 		}
-		if _, err := w.Write([]byte(`</template>`)); err != nil {
+		if _, err := io.WriteString(w, `</template>`); err != nil {
 			return err
 		}
 	}
 
 	// children
-	if localName == "script" || localName == "style" {
+	if rawTextElements[localName] && !s.xml {
 		savedNoEscape := s.noEscape
 		s.noEscape = true
 		defer func() {
 			s.noEscape = savedNoEscape
 		}()
 	}
+	if preformattedElements[localName] && !s.preformatted {
+		s.preformatted = true
+		defer func() {
+			s.preformatted = false
+		}()
+	}
+	if leadingNewlineElements[localName] && !s.xml && len(node.Children) > 0 &&
+		node.Children[0].NodeType == cdp.NodeTypeText && strings.HasPrefix(node.Children[0].NodeValue, "\n") {
+		// the parser drops a newline right after the start tag, the one of the text has to be preceded by another
+		if _, err := io.WriteString(w, "\n"); err != nil {
+			return err
+		}
+	}
+	if node.TemplateContent != nil {
+		// contents of template elements are in a separate document fragment
+		if err := s.serializeNode(w, node.TemplateContent); err != nil {
+			return err
+		}
+	}
 	if err := s.serializeChildren(w, node); err != nil {
 		return err
 	}
 
+	if s.critical != nil {
+		if err := s.serializeCritical(w, node); err != nil {
+			return err
+		}
+	}
+
 	// end tag
 	if !isVoid {
-		if _, err := w.Write([]byte("</")); err != nil {
+		if _, err := io.WriteString(w, "</"); err != nil {
 			return err
 		}
-		if _, err := w.Write([]byte(localName)); err != nil {
+		if _, err := io.WriteString(w, tagName); err != nil {
 			return err
 		}
-		if _, err := w.Write([]byte(">")); err != nil {
+		if _, err := io.WriteString(w, ">"); err != nil {
 			return err
 		}
 	}
@@ -158,8 +480,95 @@ func (s *domSerializer) serializeElementNode(w io.Writer, node *cdp.Node) error
 	return nil
 }
 
+// serializeCritical writes critical styles at the end of the head, and the stylesheet links at the end of the body.
+func (s *domSerializer) serializeCritical(w io.Writer, node *cdp.Node) error {
+	switch node {
+	case s.critical.head:
+		if s.critical.css == "" {
+			return nil
+		}
+		if _, err := io.WriteString(w, `<style`); err != nil {
+			return err
+		}
+		if s.nonce != "" {
+			if _, err := io.WriteString(w, ` nonce="`+html.EscapeString(s.nonce)+`"`); err != nil {
+				return err
+			}
+		}
+		if _, err := io.WriteString(w, `>`); err != nil {
+			return err
+		}
+		if s.xml {
+			// style text is parsed as XML, e.g. & of the rules must be escaped
+			if err := writeEscaped(w, s.critical.css); err != nil {
+				return err
+			}
+		} else if _, err := io.WriteString(w, s.critical.styleText()); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, `</style>`); err != nil {
+			return err
+		}
+	case s.critical.body:
+		for _, link := range s.critical.order {
+			if err := s.serializeElementNode(w, link); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// inlinesFrame reports whether the content document of an iframe is inlined, i.e. it's of the same origin, or it's
+// e.g. about:blank, which inherits the origin of the page.
+func (s *domSerializer) inlinesFrame(document *cdp.Node) bool {
+	return strings.HasPrefix(document.DocumentURL, "about:") || origin(document.DocumentURL) == s.iframesOrigin
+}
+
+// serializeFrame returns the serialized content document of an iframe, with the same options as the page.
+func (s *domSerializer) serializeFrame(document *cdp.Node) (string, error) {
+	sub := newDomSerializer(document)
+	defer sub.release()
+	sub.nonce = s.nonce
+	sub.sanitize = s.sanitize
+	sub.stripScripts = s.stripScripts
+	sub.stripHydration = s.stripHydration
+	sub.optimizeImages = s.optimizeImages
+	sub.iframesOrigin = s.iframesOrigin
+	sub.omitEmptyHeadBody = s.omitEmptyHeadBody
+	sub.minify = s.minify
+	var buf bytes.Buffer
+	if err := sub.Serialize(&buf); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// needsNonce reports whether the element is an inline script or style.
+func needsNonce(node *cdp.Node) bool {
+	switch node.LocalName {
+	case "style":
+		return true
+	case "script":
+		for i := 0; i < len(node.Attributes); i += 2 {
+			if node.Attributes[i] == "src" {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
 func (s *domSerializer) serializeChildren(w io.Writer, node *cdp.Node) error {
-	for _, child := range node.Children {
+	if s.sem != nil && s.doctypeWritten && len(node.Children) > 1 && s.sizes[node] >= s.parallelThreshold {
+		return s.serializeChildrenParallel(w, node)
+	}
+	for i, child := range node.Children {
+		if s.dropsWhitespace(node, i) {
+			continue
+		}
 		if err := s.serializeNode(w, child); err != nil {
 			return err
 		}
@@ -167,14 +576,101 @@ func (s *domSerializer) serializeChildren(w io.Writer, node *cdp.Node) error {
 	return nil
 }
 
+// serializeChildrenParallel serializes each child into its own buffer and then writes the buffers in order. Children
+// are serialized in new goroutines while there are free slots, otherwise in the current one.
+func (s *domSerializer) serializeChildrenParallel(w io.Writer, node *cdp.Node) error {
+	bufs := make([]*bytes.Buffer, len(node.Children))
+	errs := make([]error, len(node.Children))
+	defer func() {
+		for _, buf := range bufs {
+			if buf != nil {
+				serializerBufPool.Put(buf)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i, child := range node.Children {
+		buf := serializerBufPool.Get().(*bytes.Buffer)
+		buf.Reset()
+		bufs[i] = buf
+		if s.dropsWhitespace(node, i) {
+			continue
+		}
+		sub := newDomSerializer(nil)
+		sub.doctypeWritten = true
+		sub.xml = s.xml
+		sub.noEscape = s.noEscape
+		sub.preformatted = s.preformatted
+		sub.nonce = s.nonce
+		sub.sanitize = s.sanitize
+		sub.critical = s.critical
+		sub.stripScripts = s.stripScripts
+		sub.stripHydration = s.stripHydration
+		sub.optimizeImages = s.optimizeImages
+		sub.iframesOrigin = s.iframesOrigin
+		sub.eagerImages = s.eagerImages
+		sub.omitEmptyHeadBody = s.omitEmptyHeadBody
+		sub.minify = s.minify
+		sub.parallelThreshold = s.parallelThreshold
+		sub.sizes = s.sizes
+		sub.sem = s.sem
+		select {
+		case s.sem <- struct{}{}:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-s.sem }()
+				defer sub.release()
+				errs[i] = sub.serializeNode(buf, child)
+			}()
+		default:
+			errs[i] = sub.serializeNode(buf, child)
+			sub.release()
+		}
+	}
+	wg.Wait()
+
+	for i, buf := range bufs {
+		if errs[i] != nil {
+			return errs[i]
+		}
+		if _, err := buf.WriteTo(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var serializerBufPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
 func (s *domSerializer) serializeDocumentTypeNode(w io.Writer, node *cdp.Node) error {
-	if _, err := w.Write([]byte("<!DOCTYPE ")); err != nil {
+	if _, err := io.WriteString(w, "<!DOCTYPE "); err != nil {
 		return err
 	}
-	if _, err := w.Write([]byte(node.NodeName)); err != nil {
+	if _, err := io.WriteString(w, node.NodeName); err != nil {
 		return err
 	}
-	if _, err := w.Write([]byte(">")); err != nil {
+	// legacy doctypes are kept whole, since their identifiers decide whether the document is rendered in quirks mode
+	if node.PublicID != "" {
+		if _, err := io.WriteString(w, ` PUBLIC "`+node.PublicID+`"`); err != nil {
+			return err
+		}
+	} else if node.SystemID != "" {
+		if _, err := io.WriteString(w, ` SYSTEM`); err != nil {
+			return err
+		}
+	}
+	if node.SystemID != "" {
+		if _, err := io.WriteString(w, ` "`+node.SystemID+`"`); err != nil {
+			return err
+		}
+	}
+	if _, err := io.WriteString(w, ">"); err != nil {
 		return err
 	}
 	s.doctypeWritten = true
@@ -182,26 +678,62 @@ func (s *domSerializer) serializeDocumentTypeNode(w io.Writer, node *cdp.Node) e
 }
 
 func (s *domSerializer) serializeTextNode(w io.Writer, node *cdp.Node) error {
-	var text string
 	if s.noEscape {
-		text = node.NodeValue
-	} else {
-		text = html.EscapeString(node.NodeValue)
+		_, err := io.WriteString(w, node.NodeValue)
+		return err
 	}
-	if _, err := w.Write([]byte(text)); err != nil {
+	return writeEscaped(w, node.NodeValue)
+}
+
+// streamEscapeThreshold is the length of values from which they're escaped straight to the writer, so that huge
+// values (e.g. data URIs, or JSON in data attributes) aren't copied whole.
+const streamEscapeThreshold = 4096
+
+const escapedChars = `&'<>"`
+
+// writeEscaped writes the value escaped the same way as html.EscapeString.
+func writeEscaped(w io.Writer, value string) error {
+	if len(value) < streamEscapeThreshold {
+		_, err := io.WriteString(w, html.EscapeString(value))
 		return err
 	}
-	return nil
+	for {
+		i := strings.IndexAny(value, escapedChars)
+		if i < 0 {
+			_, err := io.WriteString(w, value)
+			return err
+		}
+		if _, err := io.WriteString(w, value[:i]); err != nil {
+			return err
+		}
+		var entity string
+		switch value[i] {
+		case '&':
+			entity = "&amp;"
+		case '\'':
+			entity = "&#39;"
+		case '<':
+			entity = "&lt;"
+		case '>':
+			entity = "&gt;"
+		case '"':
+			entity = "&#34;"
+		}
+		if _, err := io.WriteString(w, entity); err != nil {
+			return err
+		}
+		value = value[i+1:]
+	}
 }
 
 func (s *domSerializer) serializeComment(w io.Writer, node *cdp.Node) error {
-	if _, err := w.Write([]byte("<!--")); err != nil {
+	if _, err := io.WriteString(w, "<!--"); err != nil {
 		return err
 	}
-	if _, err := w.Write([]byte(node.NodeValue)); err != nil {
+	if _, err := io.WriteString(w, node.NodeValue); err != nil {
 		return err
 	}
-	if _, err := w.Write([]byte("-->")); err != nil {
+	if _, err := io.WriteString(w, "-->"); err != nil {
 		return err
 	}
 	return nil
@@ -0,0 +1,730 @@
+package caddy_chrome
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/alecthomas/assert/v2"
+	"github.com/chromedp/cdproto/cdp"
+	"golang.org/x/net/html"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadDom loads a DOM tree saved in testdata/dom in the format returned by dom.GetDocument.
+func loadDom(tb testing.TB, name string) *cdp.Node {
+	data, err := os.ReadFile(filepath.Join("testdata", "dom", name+".json"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	root := new(cdp.Node)
+	if err := json.Unmarshal(data, root); err != nil {
+		tb.Fatal(err)
+	}
+	return root
+}
+
+func element(localName string, attributes []string, children ...*cdp.Node) *cdp.Node {
+	return &cdp.Node{
+		NodeType:   cdp.NodeTypeElement,
+		NodeName:   localName,
+		LocalName:  localName,
+		Attributes: attributes,
+		Children:   children,
+	}
+}
+
+func text(value string) *cdp.Node {
+	return &cdp.Node{
+		NodeType:  cdp.NodeTypeText,
+		NodeName:  "#text",
+		NodeValue: value,
+	}
+}
+
+func comment(value string) *cdp.Node {
+	return &cdp.Node{
+		NodeType:  cdp.NodeTypeComment,
+		NodeName:  "#comment",
+		NodeValue: value,
+	}
+}
+
+func document(children ...*cdp.Node) *cdp.Node {
+	return &cdp.Node{
+		NodeType: cdp.NodeTypeDocument,
+		NodeName: "#document",
+		Children: children,
+	}
+}
+
+// largeDocument generates a document with sections of list items, each item consisting of four nodes.
+func largeDocument(sections int, items int) *cdp.Node {
+	body := element("body", nil)
+	for i := 0; i < sections; i++ {
+		list := element("ul", []string{"class", "list"})
+		for j := 0; j < items; j++ {
+			list.Children = append(list.Children, element("li", []string{"data-index", fmt.Sprint(j)},
+				element("a", []string{"href", fmt.Sprintf("/items/%d/%d", i, j)}, text(fmt.Sprintf("Item %d & more", j))),
+				text(" ")))
+		}
+		body.Children = append(body.Children, element("section", nil, element("h2", nil, text(fmt.Sprintf("Section %d", i))), list))
+	}
+	return document(
+		&cdp.Node{NodeType: cdp.NodeTypeDocumentType, NodeName: "html"},
+		element("html", nil,
+			element("head", nil, element("title", nil, text("Large"))),
+			body))
+}
+
+func TestDomSerializer_Parallel(t *testing.T) {
+	root := largeDocument(50, 250)
+
+	var sequential bytes.Buffer
+	assert.NoError(t, (&domSerializer{root: root}).Serialize(&sequential))
+
+	var parallel bytes.Buffer
+	assert.NoError(t, (&domSerializer{root: root, parallelThreshold: 1000}).Serialize(&parallel))
+
+	assert.Equal(t, sequential.String(), parallel.String())
+}
+
+func TestDomSerializer_Nonce(t *testing.T) {
+	root := document(element("html", nil,
+		element("head", nil,
+			element("script", []string{"nonce", ""}, text("console.log(1)")),
+			element("script", []string{"src", "/app.js"}),
+			element("style", nil, text("p { color: red }"))),
+		element("body", []string{"onload", "init()"})))
+
+	s := newDomSerializer(root)
+	defer s.release()
+	s.nonce = "abc"
+	var buf bytes.Buffer
+	assert.NoError(t, s.Serialize(&buf))
+	assert.Equal(t, `<!DOCTYPE html><html><head>`+
+		`<script nonce="abc">console.log(1)</script>`+
+		`<script src="/app.js"></script>`+
+		`<style nonce="abc">p { color: red }</style>`+
+		`</head><body onload="init()"></body></html>`, buf.String())
+}
+
+func TestDomSerializer_CriticalCSS(t *testing.T) {
+	stylesheet := element("link", []string{"rel", "stylesheet", "href", "/app.css"})
+	head := element("head", nil, stylesheet, element("title", nil, text("Title")))
+	body := element("body", nil, element("h1", nil, text("Hello")))
+	root := document(element("html", nil, head, body))
+
+	s := newDomSerializer(root)
+	defer s.release()
+	s.nonce = "abc"
+	s.critical = &criticalStyles{
+		css:   "h1 { color: red }\n",
+		head:  head,
+		body:  body,
+		links: map[*cdp.Node]bool{stylesheet: true},
+		order: []*cdp.Node{stylesheet},
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, s.Serialize(&buf))
+	assert.Equal(t, `<!DOCTYPE html><html><head><title>Title</title>`+
+		`<style nonce="abc">h1 { color: red }`+"\n"+`</style></head>`+
+		`<body><h1>Hello</h1><link rel="stylesheet" href="/app.css" /></body></html>`, buf.String())
+}
+
+func TestDomSerializer_CriticalCSSXML(t *testing.T) {
+	head := element("head", nil)
+	body := element("body", nil)
+	root := document(element("html", []string{"xmlns", "http://www.w3.org/1999/xhtml"}, head, body))
+
+	s := newDomSerializer(root)
+	defer s.release()
+	s.xml = true
+	s.critical = &criticalStyles{
+		css:  `ul > li::after { content: "&" }`,
+		head: head,
+		body: body,
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, s.Serialize(&buf))
+	assert.Equal(t, `<html xmlns="http://www.w3.org/1999/xhtml"><head>`+
+		`<style>ul &gt; li::after { content: &#34;&amp;&#34; }</style></head><body></body></html>`, buf.String())
+	assert.Equal(t, `ul > li::after { content: "&" }`, s.injectedStyle())
+}
+
+func TestDomSerializer_OptimizeImages(t *testing.T) {
+	root := document(element("body", nil,
+		element("img", []string{"src", "/hero.jpg"}),
+		element("img", []string{"src", "/a.jpg"}),
+		element("img", []string{"src", "/b.jpg", "loading", "eager"}),
+		element("img", []string{"src", "/c.jpg", "decoding", "sync"})))
+
+	s := newDomSerializer(root)
+	defer s.release()
+	s.optimizeImages = &OptimizeImages{SkipFirst: 1}
+	var buf bytes.Buffer
+	assert.NoError(t, s.Serialize(&buf))
+	assert.Equal(t, `<!DOCTYPE html><body>`+
+		`<img src="/hero.jpg" />`+
+		`<img src="/a.jpg" loading="lazy" decoding="async" />`+
+		`<img src="/b.jpg" loading="eager" decoding="async" />`+
+		`<img src="/c.jpg" decoding="sync" loading="lazy" />`+
+		`</body>`, buf.String())
+}
+
+func TestDomSerializer_StripHydration(t *testing.T) {
+	root := document(element("div", []string{"id", "root", "data-reactroot", ""},
+		element("p", nil, text("Hello, "), comment(" "), text("world")),
+		comment("$"),
+		element("p", nil, text("Loaded")),
+		comment("/$"),
+		comment(" Hello from comment ")))
+
+	s := newDomSerializer(root)
+	defer s.release()
+	s.stripHydration = &StripHydration{}
+	var buf bytes.Buffer
+	assert.NoError(t, s.Serialize(&buf))
+	assert.Equal(t, `<!DOCTYPE html><div id="root"><p>Hello, world</p><p>Loaded</p><!-- Hello from comment --></div>`, buf.String())
+}
+
+func TestDomSerializer_StripScripts(t *testing.T) {
+	root := document(element("head", nil,
+		element("script", []string{"src", "/app.js"}),
+		element("script", []string{"type", "application/ld+json"}, text(`{"@type":"Article"}`)),
+		element("script", []string{"type", "module"}, text("import './app.js'"))))
+
+	s := newDomSerializer(root)
+	defer s.release()
+	s.stripScripts = true
+	var buf bytes.Buffer
+	assert.NoError(t, s.Serialize(&buf))
+	assert.Equal(t, `<!DOCTYPE html><head><script type="application/ld+json">{"@type":"Article"}</script></head>`, buf.String())
+}
+
+func TestDomSerializer_Sanitize(t *testing.T) {
+	root := document(element("body", []string{"onload", "init()", "class", "page"},
+		element("a", []string{"href", "javascript:void(0)", "onclick", "go()"}, text("Go")),
+		element("img", []string{"src", "data:image/gif;base64,R0lGODlhAQABAAAAACw="})))
+
+	s := newDomSerializer(root)
+	defer s.release()
+	s.sanitize = &Sanitize{}
+	var buf bytes.Buffer
+	assert.NoError(t, s.Serialize(&buf))
+	assert.Equal(t, `<!DOCTYPE html><body class="page"><a>Go</a><img src="data:image/gif;base64,R0lGODlhAQABAAAAACw=" /></body>`, buf.String())
+}
+
+func TestDomSerializer_Preformatted(t *testing.T) {
+	code := "func main() {\n\tif  x  {\n\t\treturn   1\n\t}\n}\n\n   "
+	root := document(element("body", nil,
+		element("pre", nil, text(code)),
+		element("textarea", nil, text("  first line\n\n    indented <line>\n"))))
+
+	s := newDomSerializer(root)
+	defer s.release()
+	var buf bytes.Buffer
+	assert.NoError(t, s.Serialize(&buf))
+	assert.Equal(t, "<!DOCTYPE html><body>"+
+		"<pre>"+code+"</pre>"+
+		"<textarea>  first line\n\n    indented &lt;line&gt;\n</textarea>"+
+		"</body>", buf.String())
+	assert.False(t, s.preformatted)
+}
+
+func TestDomSerializer_PreformattedLeadingNewline(t *testing.T) {
+	root := document(
+		&cdp.Node{NodeType: cdp.NodeTypeDocumentType, NodeName: "html"},
+		element("html", nil,
+			element("head", nil),
+			element("body", nil,
+				element("pre", nil, text("\nfirst line")),
+				element("textarea", nil, text("\n\nsecond line")),
+				element("listing", nil, text("no newline")))))
+
+	s := newDomSerializer(root)
+	defer s.release()
+	var buf bytes.Buffer
+	assert.NoError(t, s.Serialize(&buf))
+	assert.Contains(t, buf.String(), "<body>"+
+		"<pre>\n\nfirst line</pre>"+
+		"<textarea>\n\n\nsecond line</textarea>"+
+		"<listing>no newline</listing>"+
+		"</body>")
+
+	parsed, err := html.Parse(&buf)
+	assert.NoError(t, err)
+	var expected, actual strings.Builder
+	describeCdp(root, &expected)
+	describeHTML(parsed, &actual)
+	assert.Equal(t, expected.String(), actual.String())
+}
+
+func TestDomSerializer_HTMLAttributes(t *testing.T) {
+	root := document(element("html", []string{"lang", "cs", "class", "nuxt", "data-theme", "dark", "data-n-head-ssr", "", "ng-version", "17.0.0"}))
+
+	s := newDomSerializer(root)
+	defer s.release()
+	var buf bytes.Buffer
+	assert.NoError(t, s.Serialize(&buf))
+	assert.Equal(t, `<!DOCTYPE html><html lang="cs" class="nuxt" data-theme="dark" data-n-head-ssr ng-version="17.0.0"></html>`, buf.String())
+}
+
+func TestDomSerializer_ElementNameCase(t *testing.T) {
+	svg := func(localName string, attributes []string, children ...*cdp.Node) *cdp.Node {
+		node := element(localName, attributes, children...)
+		node.IsSVG = true
+		return node
+	}
+	root := document(element("body", nil,
+		element("my-element-2", []string{"data-fooBar", "1"}),
+		svg("svg", []string{"viewBox", "0 0 10 10"},
+			svg("defs", nil, svg("linearGradient", []string{"id", "g", "gradientUnits", "userSpaceOnUse"})),
+			svg("foreignObject", nil, element("p", nil, element("br", nil))),
+			svg("source", nil))))
+
+	s := newDomSerializer(root)
+	defer s.release()
+	var buf bytes.Buffer
+	assert.NoError(t, s.Serialize(&buf))
+	assert.Equal(t, `<!DOCTYPE html><body><my-element-2 data-fooBar="1"></my-element-2>`+
+		`<svg viewBox="0 0 10 10"><defs><linearGradient id="g" gradientUnits="userSpaceOnUse"></linearGradient></defs>`+
+		`<foreignObject><p><br /></p></foreignObject><source></source></svg></body>`, buf.String())
+}
+
+func TestDomSerializer_NamespacedAttributes(t *testing.T) {
+	root := document(element("svg", []string{"xmlns", "http://www.w3.org/2000/svg", "xmlns:xlink", "http://www.w3.org/1999/xlink"},
+		element("use", []string{"xlink:href", "#icon", "xml:lang", "en"})))
+
+	s := newDomSerializer(root)
+	defer s.release()
+	var buf bytes.Buffer
+	assert.NoError(t, s.Serialize(&buf))
+	assert.Equal(t, `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink"><use xlink:href="#icon" xml:lang="en"></use></svg>`, buf.String())
+}
+
+// describeCdp and describeHTML describe the element and text structure of a tree in the same format to compare trees
+// before serialization and after parsing the output.
+func describeCdp(node *cdp.Node, b *strings.Builder) {
+	switch node.NodeType {
+	case cdp.NodeTypeElement:
+		b.WriteString(node.LocalName + "(")
+		for _, child := range node.Children {
+			describeCdp(child, b)
+		}
+		b.WriteString(")")
+	case cdp.NodeTypeText:
+		b.WriteString(fmt.Sprintf("%q", node.NodeValue))
+	case cdp.NodeTypeDocument:
+		for _, child := range node.Children {
+			describeCdp(child, b)
+		}
+	}
+}
+
+func describeHTML(node *html.Node, b *strings.Builder) {
+	switch node.Type {
+	case html.ElementNode:
+		b.WriteString(node.Data + "(")
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			describeHTML(child, b)
+		}
+		b.WriteString(")")
+	case html.TextNode:
+		b.WriteString(fmt.Sprintf("%q", node.Data))
+	case html.DocumentNode:
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			describeHTML(child, b)
+		}
+	}
+}
+
+func TestDomSerializer_TableRoundTrip(t *testing.T) {
+	root := document(
+		&cdp.Node{NodeType: cdp.NodeTypeDocumentType, NodeName: "html"},
+		element("html", nil,
+			element("head", nil),
+			element("body", nil,
+				text("Loose text"),
+				element("table", nil,
+					text("\n    "),
+					element("caption", nil, text("Caption")),
+					element("colgroup", nil, element("col", []string{"span", "2"})),
+					element("thead", nil, element("tr", nil, element("th", nil, text("A")), element("th", nil, text("B")))),
+					text("\n    "),
+					element("tbody", nil,
+						element("tr", nil, element("td", nil, text("1 < 2")), element("td", nil, element("table", nil))),
+						element("tr", nil, text(" "), element("td", []string{"colspan", "2"}, text("3"))),
+					),
+					element("tfoot", nil, element("tr", nil, element("td", nil))),
+				))))
+
+	s := newDomSerializer(root)
+	defer s.release()
+	var buf bytes.Buffer
+	assert.NoError(t, s.Serialize(&buf))
+
+	parsed, err := html.Parse(&buf)
+	assert.NoError(t, err)
+	var expected, actual strings.Builder
+	describeCdp(root, &expected)
+	describeHTML(parsed, &actual)
+	assert.Equal(t, expected.String(), actual.String())
+}
+
+func TestDomSerializer_Template(t *testing.T) {
+	template := element("template", []string{"id", "row"})
+	template.TemplateContent = &cdp.Node{
+		NodeType: cdp.NodeTypeDocumentFragment,
+		NodeName: "#document-fragment",
+		Children: []*cdp.Node{element("tr", nil, element("td", []string{"class", "name"}, text("a & b")))},
+	}
+	root := document(element("body", nil, template))
+
+	s := newDomSerializer(root)
+	defer s.release()
+	var buf bytes.Buffer
+	assert.NoError(t, s.Serialize(&buf))
+	assert.Equal(t, `<!DOCTYPE html><body><template id="row"><tr><td class="name">a &amp; b</td></tr></template></body>`, buf.String())
+}
+
+func TestDomSerializer_Comments(t *testing.T) {
+	root := document(element("html", nil,
+		element("head", nil, comment(" build:css styles.css "), element("title", nil, text("Comments"))),
+		element("body", nil,
+			element("p", nil, text("a")),
+			comment("[if IE]><p>IE & friends</p><![endif]"),
+			element("p", nil, text("b")))))
+
+	s := newDomSerializer(root)
+	defer s.release()
+	var buf bytes.Buffer
+	assert.NoError(t, s.Serialize(&buf))
+	assert.Equal(t, `<!DOCTYPE html><html><head><!-- build:css styles.css --><title>Comments</title></head>`+
+		`<body><p>a</p><!--[if IE]><p>IE & friends</p><![endif]--><p>b</p></body></html>`, buf.String())
+}
+
+func TestDomSerializer_NilRoot(t *testing.T) {
+	s := newDomSerializer(nil)
+	defer s.release()
+	var buf bytes.Buffer
+	assert.IsError(t, s.Serialize(&buf), errNoDocument)
+	assert.Equal(t, "", buf.String())
+}
+
+func TestDomSerializer_ForcedDoctype(t *testing.T) {
+	for _, testCase := range []struct {
+		name        string
+		root        *cdp.Node
+		skipDoctype bool
+		expected    string
+	}{
+		{
+			name:     "html",
+			root:     document(element("p", nil)),
+			expected: `<!DOCTYPE html><p></p>`,
+		},
+		{
+			name: "html with doctype",
+			root: document(
+				&cdp.Node{NodeType: cdp.NodeTypeDocumentType, NodeName: "html"},
+				element("p", nil)),
+			expected: `<!DOCTYPE html><p></p>`,
+		},
+		{
+			name:        "skip",
+			root:        document(element("p", nil)),
+			skipDoctype: true,
+			expected:    `<p></p>`,
+		},
+		{
+			name: "quirks mode",
+			root: &cdp.Node{
+				NodeType:          cdp.NodeTypeDocument,
+				CompatibilityMode: cdp.CompatibilityModeQuirksMode,
+				Children:          []*cdp.Node{element("p", nil)},
+			},
+			expected: `<p></p>`,
+		},
+		{
+			name: "legacy doctype",
+			root: &cdp.Node{
+				NodeType:          cdp.NodeTypeDocument,
+				CompatibilityMode: cdp.CompatibilityModeLimitedQuirksMode,
+				Children: []*cdp.Node{
+					{
+						NodeType: cdp.NodeTypeDocumentType,
+						NodeName: "html",
+						PublicID: "-//W3C//DTD HTML 4.01 Transitional//EN",
+						SystemID: "http://www.w3.org/TR/html4/loose.dtd",
+					},
+					element("p", nil),
+				},
+			},
+			expected: `<!DOCTYPE html PUBLIC "-//W3C//DTD HTML 4.01 Transitional//EN" "http://www.w3.org/TR/html4/loose.dtd"><p></p>`,
+		},
+		{
+			name: "system doctype",
+			root: document(
+				&cdp.Node{NodeType: cdp.NodeTypeDocumentType, NodeName: "html", SystemID: "about:legacy-compat"},
+				element("p", nil)),
+			expected: `<!DOCTYPE html SYSTEM "about:legacy-compat"><p></p>`,
+		},
+		{
+			name: "limited quirks mode",
+			root: &cdp.Node{
+				NodeType:          cdp.NodeTypeDocument,
+				CompatibilityMode: cdp.CompatibilityModeLimitedQuirksMode,
+				Children:          []*cdp.Node{element("p", nil)},
+			},
+			expected: `<p></p>`,
+		},
+		{
+			name: "xml",
+			root: &cdp.Node{
+				NodeType:   cdp.NodeTypeDocument,
+				XMLVersion: "1.0",
+				Children:   []*cdp.Node{element("svg", []string{"xmlns", "http://www.w3.org/2000/svg"})},
+			},
+			expected: `<svg xmlns="http://www.w3.org/2000/svg"></svg>`,
+		},
+		{
+			name:     "math",
+			root:     document(element("math", []string{"xmlns", "http://www.w3.org/1998/Math/MathML"}, element("mi", nil, text("x")))),
+			expected: `<math xmlns="http://www.w3.org/1998/Math/MathML"><mi>x</mi></math>`,
+		},
+		{
+			name:     "svg in html",
+			root:     document(element("html", nil, element("body", nil, element("svg", nil)))),
+			expected: `<!DOCTYPE html><html><body><svg></svg></body></html>`,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			s := newDomSerializer(testCase.root)
+			defer s.release()
+			s.skipDoctype = testCase.skipDoctype
+			var buf bytes.Buffer
+			assert.NoError(t, s.Serialize(&buf))
+			assert.Equal(t, testCase.expected, buf.String())
+		})
+	}
+}
+
+func TestDomSerializer_Iframes(t *testing.T) {
+	frame := func(documentURL string) *cdp.Node {
+		iframe := element("iframe", []string{"src", documentURL, "srcdoc", "stale"})
+		iframe.ContentDocument = &cdp.Node{
+			NodeType:    cdp.NodeTypeDocument,
+			DocumentURL: documentURL,
+			Children:    []*cdp.Node{element("p", []string{"class", "a"}, text("1 < 2"))},
+		}
+		return iframe
+	}
+	root := document(element("body", nil,
+		frame("http://localhost/frame.html"),
+		frame("http://example.com/frame.html"),
+		frame("about:blank")))
+
+	s := newDomSerializer(root)
+	defer s.release()
+	s.iframesOrigin = "http://localhost"
+	var buf bytes.Buffer
+	assert.NoError(t, s.Serialize(&buf))
+	assert.Equal(t, `<!DOCTYPE html><body>`+
+		`<iframe src="http://localhost/frame.html" srcdoc="&lt;!DOCTYPE html&gt;&lt;p class=&#34;a&#34;&gt;1 &amp;lt; 2&lt;/p&gt;"></iframe>`+
+		`<iframe src="http://example.com/frame.html" srcdoc="stale"></iframe>`+
+		`<iframe src="about:blank" srcdoc="&lt;!DOCTYPE html&gt;&lt;p class=&#34;a&#34;&gt;1 &amp;lt; 2&lt;/p&gt;"></iframe>`+
+		`</body>`, buf.String())
+}
+
+func TestDomSerializer_XML(t *testing.T) {
+	htmlElement := element("html", []string{"xmlns", "http://www.w3.org/1999/xhtml"},
+		element("head", nil,
+			element("script", nil, text("if (a < b) {}"))),
+		element("body", nil,
+			element("input", []string{"disabled", ""}),
+			&cdp.Node{NodeType: cdp.NodeTypeElement, NodeName: "svg:rect", LocalName: "rect", Attributes: []string{"width", "10"}},
+			element("p", nil, &cdp.Node{NodeType: cdp.NodeTypeCDATA, NodeName: "#cdata-section", NodeValue: "1 < 2"})))
+	root := &cdp.Node{
+		NodeType:   cdp.NodeTypeDocument,
+		XMLVersion: "1.0",
+		Children: []*cdp.Node{
+			{NodeType: cdp.NodeTypeProcessingInstruction, NodeName: "xml-stylesheet", NodeValue: `href="style.css"`},
+			{
+				NodeType: cdp.NodeTypeDocumentType,
+				NodeName: "html",
+				PublicID: "-//W3C//DTD XHTML 1.0 Strict//EN",
+				SystemID: "http://www.w3.org/TR/xhtml1/DTD/xhtml1-strict.dtd",
+			},
+			htmlElement,
+		},
+	}
+
+	s := newDomSerializer(root)
+	defer s.release()
+	s.xml = true
+	var buf bytes.Buffer
+	assert.NoError(t, s.Serialize(&buf))
+	assert.Equal(t, `<?xml-stylesheet href="style.css"?>`+
+		`<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Strict//EN" "http://www.w3.org/TR/xhtml1/DTD/xhtml1-strict.dtd">`+
+		`<html xmlns="http://www.w3.org/1999/xhtml"><head><script>if (a &lt; b) {}</script></head>`+
+		`<body><input disabled="" /><svg:rect width="10" /><p><![CDATA[1 < 2]]></p></body></html>`, buf.String())
+
+	// HTML doctype isn't written even if the document doesn't say it's XML
+	s = newDomSerializer(document(htmlElement))
+	defer s.release()
+	s.xml = true
+	buf.Reset()
+	assert.NoError(t, s.Serialize(&buf))
+	assert.True(t, strings.HasPrefix(buf.String(), `<html xmlns="http://www.w3.org/1999/xhtml">`))
+}
+
+// writeCounter counts calls to Write to measure how well the serializer batches its output.
+type writeCounter struct {
+	writes int
+}
+
+func (c *writeCounter) Write(p []byte) (int, error) {
+	c.writes++
+	return len(p), nil
+}
+
+func TestDomSerializer_Reset(t *testing.T) {
+	s := newDomSerializer(document(element("script", nil, text("1 < 2"))))
+	s.noEscape = true
+	s.parallelThreshold = 1
+	s.release()
+
+	s = newDomSerializer(document(element("p", nil, text("1 < 2"))))
+	defer s.release()
+	var buf bytes.Buffer
+	assert.NoError(t, s.Serialize(&buf))
+	assert.Equal(t, `<!DOCTYPE html><p>1 &lt; 2</p>`, buf.String())
+}
+
+func TestDomSerializer_OmitEmptyHeadBody(t *testing.T) {
+	for _, testCase := range []struct {
+		name     string
+		root     *cdp.Node
+		xml      bool
+		expected string
+	}{
+		{
+			name:     "empty head",
+			root:     document(element("html", nil, element("head", nil), element("body", nil, element("p", nil, text("Hello"))))),
+			expected: `<!DOCTYPE html><html><body><p>Hello</p></body></html>`,
+		},
+		{
+			name:     "empty head and body",
+			root:     document(element("html", nil, element("head", nil), element("body", nil))),
+			expected: `<!DOCTYPE html><html></html>`,
+		},
+		{
+			name:     "head with children",
+			root:     document(element("html", nil, element("head", nil, element("title", nil, text("Title"))), element("body", nil))),
+			expected: `<!DOCTYPE html><html><head><title>Title</title></head></html>`,
+		},
+		{
+			name:     "body with attributes",
+			root:     document(element("html", nil, element("head", nil), element("body", []string{"class", "home"}))),
+			expected: `<!DOCTYPE html><html><body class="home"></body></html>`,
+		},
+		{
+			name:     "fragment",
+			root:     fragmentRoot(document(element("html", nil, element("head", nil), element("body", nil, element("p", nil, text("Hello")))))),
+			expected: `<p>Hello</p>`,
+		},
+		{
+			name:     "xml",
+			root:     document(element("html", []string{"xmlns", "http://www.w3.org/1999/xhtml"}, element("head", nil), element("body", nil))),
+			xml:      true,
+			expected: `<html xmlns="http://www.w3.org/1999/xhtml"><head /><body /></html>`,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			s := newDomSerializer(testCase.root)
+			defer s.release()
+			s.omitEmptyHeadBody = true
+			s.xml = testCase.xml
+			s.skipDoctype = testCase.xml || testCase.root.NodeType == cdp.NodeTypeDocumentFragment
+			var buf bytes.Buffer
+			assert.NoError(t, s.Serialize(&buf))
+			assert.Equal(t, testCase.expected, buf.String())
+		})
+	}
+}
+
+func TestWriteEscaped(t *testing.T) {
+	// the same as html.EscapeString of the standard library
+	escaper := strings.NewReplacer(`&`, "&amp;", `'`, "&#39;", `<`, "&lt;", `>`, "&gt;", `"`, "&#34;")
+	for _, value := range []string{
+		"",
+		`plain`,
+		`<a href="x">Tom & 'Jerry'</a>`,
+		strings.Repeat(`{"key":"<value> & 'more'"}`, 500),
+		strings.Repeat("x", streamEscapeThreshold) + "&",
+		"&" + strings.Repeat("x", streamEscapeThreshold),
+	} {
+		var buf bytes.Buffer
+		assert.NoError(t, writeEscaped(&buf, value))
+		assert.Equal(t, escaper.Replace(value), buf.String())
+	}
+}
+
+func BenchmarkDomSerializer_LargeAttribute(b *testing.B) {
+	data := "data:image/png;base64," + strings.Repeat("iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR4nGNgYGD4DwABBAEAcCBlCwAAAABJRU5ErkJggg==", 20000)
+	root := document(element("html", nil, element("body", nil,
+		element("img", []string{"src", data}),
+		element("div", []string{"data-state", strings.Repeat(`{"id":1,"name":"<item> & more"},`, 50000)}),
+	)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s := newDomSerializer(root)
+		if err := s.Serialize(io.Discard); err != nil {
+			b.Fatal(err)
+		}
+		s.release()
+	}
+}
+
+func BenchmarkDomSerializer_Writes(b *testing.B) {
+	root := largeDocument(10, 100)
+	b.ReportAllocs()
+	var c writeCounter
+	for i := 0; i < b.N; i++ {
+		s := newDomSerializer(root)
+		if err := s.Serialize(&c); err != nil {
+			b.Fatal(err)
+		}
+		s.release()
+	}
+	b.ReportMetric(float64(c.writes)/float64(b.N), "writes/op")
+}
+
+func BenchmarkDomSerializer_Serialize(b *testing.B) {
+	for _, benchmark := range []struct {
+		name              string
+		root              *cdp.Node
+		parallelThreshold int
+	}{
+		{name: "small", root: loadDom(b, "small")},
+		{name: "medium", root: loadDom(b, "medium")},
+		{name: "large", root: largeDocument(50, 250)}, // ~50k nodes
+		{name: "large_parallel", root: largeDocument(50, 250), parallelThreshold: 10000},
+	} {
+		b.Run(benchmark.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				s := newDomSerializer(benchmark.root)
+				s.parallelThreshold = benchmark.parallelThreshold
+				if err := s.Serialize(io.Discard); err != nil {
+					b.Fatal(err)
+				}
+				s.release()
+			}
+		})
+	}
+}
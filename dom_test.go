@@ -0,0 +1,38 @@
+package caddy_chrome
+
+import (
+	"bytes"
+	"github.com/alecthomas/assert/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDOMSerializer(t *testing.T) {
+	for _, name := range []string{"small", "medium", "amp", "svg"} {
+		t.Run(name, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", "dom", name+".json"))
+			assert.NoError(t, err)
+			defer f.Close()
+			expected, err := os.ReadFile(filepath.Join("testdata", "dom", name+".html"))
+			assert.NoError(t, err)
+
+			s, err := NewDOMSerializer(f)
+			assert.NoError(t, err)
+			var buf bytes.Buffer
+			assert.NoError(t, s.Serialize(&buf))
+			assert.Equal(t, string(expected), buf.String())
+		})
+	}
+}
+
+func TestNewDOMSerializer_GetDocumentResult(t *testing.T) {
+	s, err := NewDOMSerializer(strings.NewReader(`{"root":{"nodeId":1,"nodeType":9,"nodeName":"#document","children":[` +
+		`{"nodeId":2,"nodeType":1,"nodeName":"P","localName":"p","attributes":["class","a"],"children":[` +
+		`{"nodeId":3,"nodeType":3,"nodeName":"#text","nodeValue":"x < y"}]}]}}`))
+	assert.NoError(t, err)
+	var buf bytes.Buffer
+	assert.NoError(t, s.Serialize(&buf))
+	assert.Equal(t, `<!DOCTYPE html><p class="a">x &lt; y</p>`, buf.String())
+}
@@ -5,4 +5,6 @@ import _ "embed"
 var (
 	//go:embed js/on_new_document.js
 	onNewDocumentScript string
+	//go:embed js/adopted_style_sheets.js
+	adoptedStyleSheetsScript string
 )
@@ -0,0 +1,53 @@
+package caddy_chrome
+
+import (
+	"fmt"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/pkg/errors"
+	"net/http"
+	"strings"
+)
+
+// exceptionsHeader lists exceptions the page threw during the render, in responses to requests with the debug header.
+const exceptionsHeader = "X-Caddy-Chrome-Exceptions"
+
+// ErrUncaughtException is the error of a render during which JavaScript of the page threw an uncaught exception, see
+// FailOnException.
+var ErrUncaughtException = errors.New("uncaught exception")
+
+// exceptionsError is ErrUncaughtException with the exceptions the page threw.
+type exceptionsError struct {
+	exceptions []string
+}
+
+func (e *exceptionsError) Error() string {
+	return fmt.Sprintf("%s: %d thrown, first %q", ErrUncaughtException, len(e.exceptions), e.exceptions[0])
+}
+
+func (e *exceptionsError) Unwrap() error {
+	return ErrUncaughtException
+}
+
+// exceptionText returns the first line of the exception's description, e.g. "TypeError: x is not a function" without
+// the stack trace, or the text of the details if the thrown value has no description.
+func exceptionText(details *runtime.ExceptionDetails) string {
+	text := details.Text
+	if details.Exception != nil && details.Exception.Description != "" {
+		text = details.Exception.Description
+	}
+	text, _, _ = strings.Cut(text, "\n")
+	return strings.TrimSpace(text)
+}
+
+// setExceptionsHeader adds the exceptions to the debug header, with control characters a header can't have replaced.
+func setExceptionsHeader(header http.Header, exceptions []string) {
+	header.Del(exceptionsHeader)
+	for _, exception := range exceptions {
+		header.Add(exceptionsHeader, strings.Map(func(r rune) rune {
+			if r < ' ' || r == 0x7f {
+				return ' '
+			}
+			return r
+		}, exception))
+	}
+}
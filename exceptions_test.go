@@ -0,0 +1,34 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/pkg/errors"
+	"net/http"
+	"testing"
+)
+
+func TestExceptionText(t *testing.T) {
+	assert.Equal(t, "TypeError: x is not a function", exceptionText(&runtime.ExceptionDetails{
+		Text:      "Uncaught",
+		Exception: &runtime.RemoteObject{Description: "TypeError: x is not a function\n    at app.js:1:1"},
+	}))
+	// a thrown primitive has no description
+	assert.Equal(t, "Uncaught 42", exceptionText(&runtime.ExceptionDetails{
+		Text:      "Uncaught 42",
+		Exception: &runtime.RemoteObject{Type: runtime.TypeNumber},
+	}))
+	assert.Equal(t, "Uncaught", exceptionText(&runtime.ExceptionDetails{Text: "Uncaught"}))
+}
+
+func TestSetExceptionsHeader(t *testing.T) {
+	header := http.Header{exceptionsHeader: {"stale"}}
+	setExceptionsHeader(header, []string{"Error: a\tb", "ReferenceError: x is not defined"})
+	assert.Equal(t, []string{"Error: a b", "ReferenceError: x is not defined"}, header.Values(exceptionsHeader))
+}
+
+func TestExceptionsError(t *testing.T) {
+	err := errors.Wrap(&exceptionsError{exceptions: []string{"Error: boom", "Error: again"}}, "failed to render")
+	assert.True(t, errors.Is(err, ErrUncaughtException))
+	assert.EqualError(t, err, `failed to render: uncaught exception: 2 thrown, first "Error: boom"`)
+}
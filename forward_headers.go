@@ -0,0 +1,46 @@
+package caddy_chrome
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// defaultForwardHeaders are forwarded if forward_headers isn't configured, they're safe to pass to the upstream
+// handlers in requests of the page.
+var defaultForwardHeaders = []string{"Accept-Language"}
+
+// unforwardableHeaders can't be forwarded, they're either handled on their own (cookies, and the user agent are always
+// forwarded), or they're specific to the request.
+var unforwardableHeaders = []string{"Content-Length", "Cookie", "Host", "User-Agent"}
+
+// validateForwardHeaders checks that the headers can be forwarded.
+func validateForwardHeaders(names []string) error {
+	for _, name := range names {
+		canonical := http.CanonicalHeaderKey(name)
+		if slices.Contains(hopByHopHeaders, canonical) || slices.Contains(unforwardableHeaders, canonical) {
+			return fmt.Errorf("header %s can't be forwarded", canonical)
+		}
+	}
+	return nil
+}
+
+// forwardHeaderNames returns names of the request headers forwarded to requests of the page.
+func (m *Middleware) forwardHeaderNames() []string {
+	if m.ForwardHeaders == nil {
+		return defaultForwardHeaders
+	}
+	return m.ForwardHeaders
+}
+
+// forwardedHeaders returns the request headers forwarded to requests of the page, i.e. the navigation, and requests
+// served by the upstream handlers, they're not sent to continued hosts. The rendered page varies by them.
+func (m *Middleware) forwardedHeaders(r *http.Request) http.Header {
+	header := make(http.Header)
+	for _, name := range m.forwardHeaderNames() {
+		if values := r.Header.Values(name); len(values) > 0 {
+			header[http.CanonicalHeaderKey(name)] = slices.Clone(values)
+		}
+	}
+	return header
+}
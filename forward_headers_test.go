@@ -0,0 +1,26 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidateForwardHeaders(t *testing.T) {
+	assert.NoError(t, validateForwardHeaders([]string{"Accept-Language", "authorization", "X-Tenant"}))
+	assert.EqualError(t, validateForwardHeaders([]string{"X-Tenant", "connection"}), "header Connection can't be forwarded")
+	assert.EqualError(t, validateForwardHeaders([]string{"Cookie"}), "header Cookie can't be forwarded")
+}
+
+func TestMiddleware_forwardedHeaders(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Language", "cs-CZ")
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Add("X-Tenant", "a")
+	r.Header.Add("X-Tenant", "b")
+
+	assert.Equal(t, http.Header{"Accept-Language": {"cs-CZ"}}, (&Middleware{}).forwardedHeaders(r))
+	assert.Equal(t, http.Header{"X-Tenant": {"a", "b"}, "Authorization": {"Bearer secret"}},
+		(&Middleware{ForwardHeaders: []string{"x-tenant", "Authorization", "X-Missing"}}).forwardedHeaders(r))
+}
@@ -0,0 +1,95 @@
+package caddy_chrome
+
+import (
+	"context"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chromedp/chromedp"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// remoteBrowserEnv is the environment variable with the URL of a remote browser tests render in instead of Chrome
+// found on the machine, e.g. http://localhost:9222 of a headless-shell container.
+const remoteBrowserEnv = "CADDY_CHROME_TEST_REMOTE_URL"
+
+// testBrowser returns a chromedp context of a browser for renders of the test, the remote one if remoteBrowserEnv is
+// set, or Chrome found on the machine, the test is skipped if there's none.
+func testBrowser(tb testing.TB) context.Context {
+	var allocCtx context.Context
+	var allocCancel context.CancelFunc
+	if remoteURL := os.Getenv(remoteBrowserEnv); remoteURL != "" {
+		allocCtx, allocCancel = chromedp.NewRemoteAllocator(context.Background(), remoteURL)
+	} else {
+		skipWithoutChrome(tb)
+		allocCtx, allocCancel = chromedp.NewExecAllocator(context.Background(), chromedp.DefaultExecAllocatorOptions[:]...)
+	}
+	tb.Cleanup(allocCancel)
+	chromeCtx, chromeCancel := chromedp.NewContext(allocCtx)
+	tb.Cleanup(chromeCancel)
+	if err := chromedp.Run(chromeCtx); err != nil {
+		tb.Fatal(err)
+	}
+	return chromeCtx
+}
+
+// testHarness serves requests by the middleware without a Caddy server, for focused tests of its behavior. The upstream
+// handler serves both the documents and the requests of the pages, as the server would, by default it's a file server
+// of testdata.
+type testHarness struct {
+	tb       testing.TB
+	m        *Middleware
+	upstream http.Handler
+}
+
+// newTestHarness provisions the middleware with the browser of testBrowser, it's cleaned up when the test ends.
+func newTestHarness(tb testing.TB, m *Middleware, upstream http.Handler) *testHarness {
+	if remoteURL := os.Getenv(remoteBrowserEnv); remoteURL != "" {
+		m.RemoteBrowser = &RemoteBrowser{URL: remoteURL}
+	} else {
+		skipWithoutChrome(tb)
+	}
+	if upstream == nil {
+		upstream = http.FileServer(http.Dir("testdata"))
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	tb.Cleanup(cancel)
+	if err := m.Provision(ctx); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		if err := m.Cleanup(); err != nil {
+			tb.Error(err)
+		}
+	})
+	return &testHarness{tb: tb, m: m, upstream: upstream}
+}
+
+// serve serves the request, with the context values of Caddy the middleware uses, the replacer has the HTTP
+// placeholders of the request.
+func (h *testHarness) serve(r *http.Request) (*httptest.ResponseRecorder, error) {
+	caddyhttp.NewTestReplacer(r)
+	ctx := context.WithValue(r.Context(), caddyhttp.VarsCtxKey, make(map[string]any))
+	ctx = context.WithValue(ctx, caddyhttp.ServerCtxKey, h.upstream)
+	w := httptest.NewRecorder()
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		h.upstream.ServeHTTP(w, r)
+		return nil
+	})
+	return w, h.m.ServeHTTP(w, r.WithContext(ctx), next)
+}
+
+// get serves a GET request of the URL, e.g. http://localhost/html.html, the test fails if the middleware fails.
+func (h *testHarness) get(url string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, url, nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w, err := h.serve(r)
+	if err != nil {
+		h.tb.Fatal(err)
+	}
+	return w
+}
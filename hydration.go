@@ -0,0 +1,36 @@
+package caddy_chrome
+
+import (
+	"strings"
+)
+
+var (
+	// React (text separators and Suspense boundaries), Vue (fragments and v-if placeholders), and Svelte markers
+	defaultHydrationComments   = []string{"", "$", "/$", "$?", "$!", "[", "]", "[!", "v-if", "HTML_TAG_START", "HTML_TAG_END"}
+	defaultHydrationAttributes = []string{"data-reactroot", "data-server-rendered", "ngh", "ng-server-context"}
+)
+
+// StripHydration removes markers frameworks leave in server-rendered HTML for hydration, for clients that don't
+// hydrate the page, e.g. crawlers.
+type StripHydration struct {
+	// Comments are patterns of text of comments to remove, matched using path.Match, except * also matches /.
+	Comments []string `json:"comments,omitempty"`
+	// Attributes are patterns of attribute names to remove, matched using path.Match.
+	Attributes []string `json:"attributes,omitempty"`
+}
+
+func (s *StripHydration) dropComment(text string) bool {
+	patterns := s.Comments
+	if len(patterns) == 0 {
+		patterns = defaultHydrationComments
+	}
+	return matchAnyText(patterns, strings.TrimSpace(text))
+}
+
+func (s *StripHydration) dropAttribute(name string) bool {
+	patterns := s.Attributes
+	if len(patterns) == 0 {
+		patterns = defaultHydrationAttributes
+	}
+	return matchAny(patterns, strings.ToLower(name))
+}
@@ -0,0 +1,30 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"testing"
+)
+
+func TestStripHydration_DropComment(t *testing.T) {
+	defaults := &StripHydration{}
+	assert.True(t, defaults.dropComment(" "))
+	assert.True(t, defaults.dropComment("$"))
+	assert.True(t, defaults.dropComment("/$"))
+	assert.True(t, defaults.dropComment("v-if"))
+	assert.False(t, defaults.dropComment(" Hello from comment "))
+
+	custom := &StripHydration{Comments: []string{"ko *", "/ko"}}
+	assert.True(t, custom.dropComment(" ko if: visible/ready "))
+	assert.True(t, custom.dropComment("/ko"))
+	assert.False(t, custom.dropComment("$"))
+}
+
+func TestStripHydration_DropAttribute(t *testing.T) {
+	defaults := &StripHydration{}
+	assert.True(t, defaults.dropAttribute("data-reactroot"))
+	assert.False(t, defaults.dropAttribute("data-v-7ba5bd90"))
+
+	custom := &StripHydration{Attributes: []string{"data-hk", "q:*"}}
+	assert.True(t, custom.dropAttribute("q:key"))
+	assert.False(t, custom.dropAttribute("data-reactroot"))
+}
@@ -0,0 +1,60 @@
+package caddy_chrome
+
+import (
+	"github.com/chromedp/cdproto/cdp"
+)
+
+// OptimizeImages adds loading="lazy" and decoding="async" to images that don't set them.
+type OptimizeImages struct {
+	// SkipFirst leaves out the first images in the document, which are likely to be above the fold, e.g. the largest
+	// contentful paint.
+	SkipFirst int `json:"skip_first,omitempty"`
+}
+
+// firstImages returns the first n img elements in the order they're serialized.
+func firstImages(root *cdp.Node, n int) map[*cdp.Node]bool {
+	images := make(map[*cdp.Node]bool, n)
+	var walk func(node *cdp.Node)
+	walk = func(node *cdp.Node) {
+		if len(images) >= n {
+			return
+		}
+		if node.NodeType == cdp.NodeTypeElement && node.LocalName == "img" {
+			images[node] = true
+		}
+		for _, shadowRoot := range node.ShadowRoots {
+			walk(shadowRoot)
+		}
+		if node.TemplateContent != nil {
+			walk(node.TemplateContent)
+		}
+		for _, child := range node.Children {
+			walk(child)
+		}
+	}
+	if n > 0 {
+		walk(root)
+	}
+	return images
+}
+
+// imageAttributes returns the attributes to add to the image.
+func (o *OptimizeImages) imageAttributes(node *cdp.Node) []string {
+	loading, decoding := true, true
+	for i := 0; i+1 < len(node.Attributes); i += 2 {
+		switch node.Attributes[i] {
+		case "loading":
+			loading = false
+		case "decoding":
+			decoding = false
+		}
+	}
+	var attributes []string
+	if loading {
+		attributes = append(attributes, "loading", "lazy")
+	}
+	if decoding {
+		attributes = append(attributes, "decoding", "async")
+	}
+	return attributes
+}
@@ -0,0 +1,45 @@
+// shadow roots are recorded when attached, so that closed ones, which aren't reachable from their hosts, are found too
+const shadowRoots = new Set();
+const attachShadow = Element.prototype.attachShadow;
+Element.prototype.attachShadow = function (init) {
+    const shadowRoot = attachShadow.call(this, init);
+    shadowRoots.add(shadowRoot);
+    return shadowRoot;
+};
+
+function styleText(styleSheets) {
+    return styleSheets
+        .map(styleSheet => Array.from(styleSheet.cssRules, rule => rule.cssText).join("\n"))
+        .join("\n");
+}
+
+function collectShadowRoots(root) {
+    for (const element of root.querySelectorAll("*")) {
+        if (element.shadowRoot && !shadowRoots.has(element.shadowRoot)) {
+            shadowRoots.add(element.shadowRoot);
+            collectShadowRoots(element.shadowRoot);
+        }
+    }
+}
+
+// inlineAdoptedStyleSheets appends style elements with rules of adopted stylesheets to the shadow roots and the
+// document head, after other styles, as adopted stylesheets come after them in the cascade
+window.CaddyChrome.inlineAdoptedStyleSheets = function () {
+    collectShadowRoots(document);
+    for (const shadowRoot of Array.from(shadowRoots)) {
+        collectShadowRoots(shadowRoot);
+    }
+    for (const shadowRoot of shadowRoots) {
+        if (shadowRoot.adoptedStyleSheets.length === 0) {
+            continue;
+        }
+        const style = document.createElement("style");
+        style.textContent = styleText(shadowRoot.adoptedStyleSheets);
+        shadowRoot.append(style);
+    }
+    if (document.adoptedStyleSheets.length > 0 && document.head) {
+        const style = document.createElement("style");
+        style.textContent = styleText(document.adoptedStyleSheets);
+        document.head.append(style);
+    }
+};
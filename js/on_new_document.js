@@ -39,3 +39,31 @@ document.addEventListener("pending-task", async function (ev) {
         window.CaddyChrome.pendingTask = Promise.resolve();
     }
 });
+
+// printing would wait for a print dialog, which headless Chrome never closes
+window.print = function () {};
+
+// restoreIsAttributes sets the is attribute of customized built-in elements created by document.createElement with the
+// is option, which doesn't set it, so that they're upgraded when the serialized document is parsed again
+window.CaddyChrome.restoreIsAttributes = function (root = document) {
+    for (const element of root.querySelectorAll("*")) {
+        if (!element.hasAttribute("is")) {
+            const name = customElements.getName?.(element.constructor);
+            if (name && name !== element.localName) {
+                element.setAttribute("is", name);
+            }
+        }
+        if (element.shadowRoot) {
+            window.CaddyChrome.restoreIsAttributes(element.shadowRoot);
+        }
+    }
+};
+
+// moduleScripts returns URLs of external module scripts, and of modules preloaded by the page, since the parser
+// requests them as it does classic scripts
+window.CaddyChrome.moduleScripts = function () {
+    return Array.from(
+        document.querySelectorAll('script[type="module"][src], link[rel="modulepreload"][href]'),
+        (element) => element.src || element.href,
+    );
+};
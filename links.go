@@ -3,49 +3,189 @@ package caddy_chrome
 import (
 	"github.com/chromedp/cdproto/network"
 	"net/http"
+	"net/url"
 	"sync"
 )
 
-type links struct {
-	mu   sync.Mutex
-	urls map[string]string
+// firstImagePattern matches the first image the page loaded.
+const firstImagePattern = "first_image"
+
+type LinksConfig struct {
+	Priorities []LinkPriority `json:"priorities,omitempty"`
+	// PreconnectThreshold is the number of requests to an origin needed to preconnect to it, origins with fewer
+	// requests get dns-prefetch instead, unless they served a stylesheet or a font. Zero means always preconnect.
+	PreconnectThreshold int `json:"preconnect_threshold,omitempty"`
+	// Static entries are always emitted before the discovered ones, which are left out if they have the same URL.
+	Static []LinkEntry `json:"static,omitempty"`
+}
+
+type LinkEntry struct {
+	URL string `json:"url,omitempty"`
+	Rel string `json:"rel,omitempty"`
+	As  string `json:"as,omitempty"`
 }
 
-func newLinks() *links {
-	return &links{
-		urls: make(map[string]string),
+func (e LinkEntry) String() string {
+	value := "<" + e.URL + ">; rel=" + e.Rel
+	if e.As != "" {
+		value += "; as=" + e.As
 	}
+	return value
 }
 
-func (l *links) AddResource(url string, resourceType network.ResourceType) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
+// LinkPriority sets fetchpriority of preloads of resources with paths matching the patterns (using path.Match).
+type LinkPriority struct {
+	Priority string   `json:"priority,omitempty"`
+	Patterns []string `json:"patterns,omitempty"`
+}
+
+// LinkHints collects resources and third-party origins used by a page and turns them into Link header values, so
+// that clients can preload them, or preconnect to the origins, before they parse the page.
+type LinkHints struct {
+	mu       sync.Mutex
+	config   *LinksConfig
+	urls     map[string]string
+	order    []string
+	excluded map[string]bool
+	origins  map[string]int
+	critical map[string]bool
+	// modules are URLs of ES module scripts, they're preloaded by modulepreload, with the CORS mode they're loaded in
+	modules    map[string]bool
+	firstImage string
+}
+
+// NewLinkHints returns empty hints, the config may be nil.
+func NewLinkHints(config *LinksConfig) *LinkHints {
+	if config == nil {
+		config = &LinksConfig{}
+	}
+	return &LinkHints{
+		config:   config,
+		urls:     make(map[string]string),
+		excluded: make(map[string]bool),
+		origins:  make(map[string]int),
+		critical: make(map[string]bool),
+		modules:  make(map[string]bool),
+	}
+}
 
+// Add records a resource to preload, resource types that can't be preloaded are ignored.
+func (l *LinkHints) Add(url string, resourceType network.ResourceType) {
 	switch resourceType {
 	case network.ResourceTypeFont:
-		l.urls[url] = "font"
+		l.set(url, "font")
 	case network.ResourceTypeImage:
-		l.urls[url] = "image"
+		l.set(url, "image")
+		l.mu.Lock()
+		if l.firstImage == "" {
+			l.firstImage = url
+		}
+		l.mu.Unlock()
 	case network.ResourceTypeScript:
-		l.urls[url] = "script"
+		l.set(url, "script")
 	case network.ResourceTypeStylesheet:
-		l.urls[url] = "style"
+		l.set(url, "style")
+	}
+}
+
+// AddModule marks the script of the URL as an ES module, whether it's added before, or after.
+func (l *LinkHints) AddModule(url string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.modules[url] = true
+}
+
+// AddPreconnect records a request of given resource type to an origin to preconnect to.
+func (l *LinkHints) AddPreconnect(origin string, resourceType network.ResourceType) {
+	l.set(origin, "preconnect")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.origins[origin]++
+	if resourceType == network.ResourceTypeStylesheet || resourceType == network.ResourceTypeFont {
+		l.critical[origin] = true
 	}
 }
 
-func (l *links) AddPreconnect(origin string) {
+func (l *LinkHints) set(url string, relAs string) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	l.urls[origin] = "preconnect"
+	if _, exists := l.urls[url]; !exists {
+		l.order = append(l.order, url)
+	}
+	l.urls[url] = relAs
 }
 
-func (l *links) MakeHeaders(header http.Header) {
-	for url, relAs := range l.urls {
-		if relAs == "preconnect" {
-			header.Add("Link", "<"+url+">; rel=preconnect")
+// Exclude leaves the URL out of the headers, e.g. because it failed to load, even if it's added again.
+func (l *LinkHints) Exclude(url string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.excluded[url] = true
+}
+
+// Headers returns Link header values in the order URLs were first added.
+func (l *LinkHints) Headers() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	headers := make([]string, 0, len(l.config.Static)+len(l.order))
+	static := make(map[string]bool, len(l.config.Static))
+	for _, entry := range l.config.Static {
+		headers = append(headers, entry.String())
+		static[entry.URL] = true
+	}
+	for _, url := range l.order {
+		if l.excluded[url] || static[url] {
+			continue
+		}
+		if relAs := l.urls[url]; relAs == "preconnect" {
+			if l.critical[url] || l.origins[url] >= l.config.PreconnectThreshold {
+				headers = append(headers, "<"+url+">; rel=preconnect")
+			} else {
+				headers = append(headers, "<"+url+">; rel=dns-prefetch")
+			}
 		} else {
-			header.Add("Link", "<"+url+">; rel=preload; as="+relAs)
+			value := "<" + url + ">; rel=preload; as=" + relAs
+			if relAs == "script" && l.modules[url] {
+				value = "<" + url + ">; rel=modulepreload"
+			}
+			if priority := l.priority(url); priority != "" {
+				value += "; fetchpriority=" + priority
+			}
+			headers = append(headers, value)
 		}
 	}
+	return headers
+}
+
+// priority returns fetchpriority of the first matching rule, or empty string if none matches.
+func (l *LinkHints) priority(rawURL string) string {
+	if len(l.config.Priorities) == 0 {
+		return ""
+	}
+	urlPath := rawURL
+	if u, err := url.Parse(rawURL); err == nil {
+		urlPath = u.Path
+	}
+	for _, rule := range l.config.Priorities {
+		for _, pattern := range rule.Patterns {
+			if pattern == firstImagePattern {
+				if rawURL == l.firstImage {
+					return rule.Priority
+				}
+			} else if matchAny([]string{pattern}, urlPath) {
+				return rule.Priority
+			}
+		}
+	}
+	return ""
+}
+
+func (l *LinkHints) MakeHeaders(header http.Header) {
+	for _, value := range l.Headers() {
+		header.Add("Link", value)
+	}
 }
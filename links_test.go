@@ -0,0 +1,168 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"github.com/chromedp/cdproto/network"
+	"net/http"
+	"testing"
+)
+
+func TestLinkHints_Headers(t *testing.T) {
+	for _, testCase := range []struct {
+		name     string
+		config   *LinksConfig
+		add      func(l *LinkHints)
+		expected []string
+	}{
+		{
+			name:     "empty",
+			add:      func(l *LinkHints) {},
+			expected: []string{},
+		},
+		{
+			name: "resource types",
+			add: func(l *LinkHints) {
+				l.Add("http://localhost/font.woff2", network.ResourceTypeFont)
+				l.Add("http://localhost/image.jpg", network.ResourceTypeImage)
+				l.Add("http://localhost/app.js", network.ResourceTypeScript)
+				l.Add("http://localhost/style.css", network.ResourceTypeStylesheet)
+				l.Add("http://localhost/api", network.ResourceTypeFetch)
+				l.Add("http://localhost/data", network.ResourceTypeXHR)
+				l.Add("http://localhost/", network.ResourceTypeDocument)
+			},
+			expected: []string{
+				"<http://localhost/font.woff2>; rel=preload; as=font",
+				"<http://localhost/image.jpg>; rel=preload; as=image",
+				"<http://localhost/app.js>; rel=preload; as=script",
+				"<http://localhost/style.css>; rel=preload; as=style",
+			},
+		},
+		{
+			name: "modules",
+			config: &LinksConfig{Priorities: []LinkPriority{
+				{Priority: "high", Patterns: []string{"/js/entry.js"}},
+			}},
+			add: func(l *LinkHints) {
+				l.Add("http://localhost/js/entry.js", network.ResourceTypeScript)
+				l.AddModule("http://localhost/js/entry.js")
+				l.AddModule("http://localhost/js/chunk.js")
+				l.Add("http://localhost/js/chunk.js", network.ResourceTypeScript)
+				l.Add("http://localhost/js/classic.js", network.ResourceTypeScript)
+				l.Add("http://localhost/style.css", network.ResourceTypeStylesheet)
+				l.AddModule("http://localhost/style.css")
+			},
+			expected: []string{
+				"<http://localhost/js/entry.js>; rel=modulepreload; fetchpriority=high",
+				"<http://localhost/js/chunk.js>; rel=modulepreload",
+				"<http://localhost/js/classic.js>; rel=preload; as=script",
+				"<http://localhost/style.css>; rel=preload; as=style",
+			},
+		},
+		{
+			name: "preconnect",
+			add: func(l *LinkHints) {
+				l.AddPreconnect("https://fonts.gstatic.com", network.ResourceTypeScript)
+				l.Add("http://localhost/app.js", network.ResourceTypeScript)
+			},
+			expected: []string{
+				"<https://fonts.gstatic.com>; rel=preconnect",
+				"<http://localhost/app.js>; rel=preload; as=script",
+			},
+		},
+		{
+			name: "dedup keeps first position",
+			add: func(l *LinkHints) {
+				l.Add("http://localhost/a.js", network.ResourceTypeScript)
+				l.AddPreconnect("https://cdn.example.com", network.ResourceTypeScript)
+				l.Add("http://localhost/a.js", network.ResourceTypeScript)
+				l.AddPreconnect("https://cdn.example.com", network.ResourceTypeScript)
+			},
+			expected: []string{
+				"<http://localhost/a.js>; rel=preload; as=script",
+				"<https://cdn.example.com>; rel=preconnect",
+			},
+		},
+		{
+			name: "exclude",
+			add: func(l *LinkHints) {
+				l.Add("http://localhost/missing.js", network.ResourceTypeScript)
+				l.Add("http://localhost/app.js", network.ResourceTypeScript)
+				l.Exclude("http://localhost/missing.js")
+				l.Add("http://localhost/missing.js", network.ResourceTypeScript)
+			},
+			expected: []string{
+				"<http://localhost/app.js>; rel=preload; as=script",
+			},
+		},
+		{
+			name:   "preconnect threshold",
+			config: &LinksConfig{PreconnectThreshold: 2},
+			add: func(l *LinkHints) {
+				l.AddPreconnect("https://cdn.example.com", network.ResourceTypeScript)
+				l.AddPreconnect("https://cdn.example.com", network.ResourceTypeImage)
+				l.AddPreconnect("https://analytics.example.com", network.ResourceTypeScript)
+				l.AddPreconnect("https://fonts.gstatic.com", network.ResourceTypeFont)
+			},
+			expected: []string{
+				"<https://cdn.example.com>; rel=preconnect",
+				"<https://analytics.example.com>; rel=dns-prefetch",
+				"<https://fonts.gstatic.com>; rel=preconnect",
+			},
+		},
+		{
+			name: "static",
+			config: &LinksConfig{Static: []LinkEntry{
+				{URL: "https://fonts.gstatic.com", Rel: "preconnect"},
+				{URL: "http://localhost/critical.css", Rel: "preload", As: "style"},
+			}},
+			add: func(l *LinkHints) {
+				l.Add("http://localhost/app.js", network.ResourceTypeScript)
+				l.Add("http://localhost/critical.css", network.ResourceTypeStylesheet)
+				l.AddPreconnect("https://fonts.gstatic.com", network.ResourceTypeFont)
+			},
+			expected: []string{
+				"<https://fonts.gstatic.com>; rel=preconnect",
+				"<http://localhost/critical.css>; rel=preload; as=style",
+				"<http://localhost/app.js>; rel=preload; as=script",
+			},
+		},
+		{
+			name: "priority",
+			config: &LinksConfig{Priorities: []LinkPriority{
+				{Priority: "high", Patterns: []string{"/img/hero-*.jpg", firstImagePattern}},
+				{Priority: "low", Patterns: []string{"/js/analytics*"}},
+			}},
+			add: func(l *LinkHints) {
+				l.Add("http://localhost/img/logo.png", network.ResourceTypeImage)
+				l.Add("http://localhost/img/hero-1.jpg", network.ResourceTypeImage)
+				l.Add("http://localhost/img/other.jpg", network.ResourceTypeImage)
+				l.Add("http://localhost/js/analytics.js", network.ResourceTypeScript)
+				l.Add("http://localhost/js/app.js", network.ResourceTypeScript)
+				l.AddPreconnect("https://cdn.example.com", network.ResourceTypeScript)
+			},
+			expected: []string{
+				"<http://localhost/img/logo.png>; rel=preload; as=image; fetchpriority=high",
+				"<http://localhost/img/hero-1.jpg>; rel=preload; as=image; fetchpriority=high",
+				"<http://localhost/img/other.jpg>; rel=preload; as=image",
+				"<http://localhost/js/analytics.js>; rel=preload; as=script; fetchpriority=low",
+				"<http://localhost/js/app.js>; rel=preload; as=script",
+				"<https://cdn.example.com>; rel=preconnect",
+			},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			l := NewLinkHints(testCase.config)
+			testCase.add(l)
+			assert.Equal(t, testCase.expected, l.Headers())
+		})
+	}
+}
+
+func TestLinkHints_MakeHeaders(t *testing.T) {
+	l := NewLinkHints(nil)
+	l.Add("http://localhost/app.js", network.ResourceTypeScript)
+	l.AddPreconnect("https://cdn.example.com", network.ResourceTypeScript)
+	header := make(http.Header)
+	l.MakeHeaders(header)
+	assert.Equal(t, []string{"<http://localhost/app.js>; rel=preload; as=script", "<https://cdn.example.com>; rel=preconnect"}, header.Values("Link"))
+}
@@ -0,0 +1,26 @@
+package caddy_chrome
+
+import (
+	"golang.org/x/text/language"
+)
+
+// localeFromRequest is the locale of the page taken from the forwarded Accept-Language header of the request.
+const localeFromRequest = "from_request"
+
+// anyLanguage is the tag the wildcard of Accept-Language is parsed as.
+var anyLanguage = language.Make("mul")
+
+// acceptedLocale returns the language tag the request prefers the most by the Accept-Language header, or an empty
+// string if it has none, or it's invalid, so that the page is rendered in the locale of the browser.
+func acceptedLocale(acceptLanguage string) string {
+	tags, _, err := language.ParseAcceptLanguage(acceptLanguage)
+	if err != nil {
+		return ""
+	}
+	for _, tag := range tags {
+		if tag != language.Und && tag != anyLanguage {
+			return tag.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,15 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"testing"
+)
+
+func TestAcceptedLocale(t *testing.T) {
+	assert.Equal(t, "cs-CZ", acceptedLocale("cs-CZ,cs;q=0.9,en;q=0.8"))
+	assert.Equal(t, "de", acceptedLocale("en;q=0.5, de"))
+	assert.Equal(t, "fr", acceptedLocale("*, fr;q=0.1"))
+	assert.Equal(t, "", acceptedLocale("*"))
+	assert.Equal(t, "", acceptedLocale(""))
+	assert.Equal(t, "", acceptedLocale("en;q=x=y"))
+}
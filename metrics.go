@@ -0,0 +1,87 @@
+package caddy_chrome
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"sync"
+	"time"
+)
+
+// Outcomes of renders the renders counter is partitioned by.
+const (
+	renderOutcomeSuccess   = "success"
+	renderOutcomeTimeout   = "timeout"
+	renderOutcomeException = "exception"
+	renderOutcomeError     = "error"
+	renderOutcomeBypass    = "bypass"
+)
+
+// renderMetrics are registered once to the default registry Caddy exposes on its metrics endpoint, they're shared by
+// all instances of the middleware, so that provisioning it again, e.g. on config reload, doesn't register them twice.
+var renderMetrics = struct {
+	init                  sync.Once
+	renderDuration        prometheus.Histogram
+	renders               *prometheus.CounterVec
+	activeBrowserContexts prometheus.Gauge
+}{}
+
+func initRenderMetrics() {
+	const ns, sub = "caddy", "chrome"
+
+	renderMetrics.renderDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "render_duration_seconds",
+		Help:      "Histogram of durations of renders in the browser, including a retry after the browser was lost.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	})
+	renderMetrics.renders = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "renders_total",
+		Help:      "Counter of renders by outcome, success, timeout, exception, error, or bypass.",
+	}, []string{"outcome"})
+	renderMetrics.activeBrowserContexts = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "active_browser_contexts",
+		Help:      "Number of browser contexts currently rendering a page.",
+	})
+}
+
+// observeRender records the render, and how long it took.
+func observeRender(duration time.Duration, outcome string) {
+	renderMetrics.init.Do(initRenderMetrics)
+	renderMetrics.renderDuration.Observe(duration.Seconds())
+	renderMetrics.renders.WithLabelValues(outcome).Inc()
+}
+
+// countBypass records a request that skipped the render by bypass_query.
+func countBypass() {
+	renderMetrics.init.Do(initRenderMetrics)
+	renderMetrics.renders.WithLabelValues(renderOutcomeBypass).Inc()
+}
+
+// addActiveBrowserContexts changes the number of browser contexts rendering a page, by +1 when a render acquires the
+// browser, and -1 when it releases it.
+func addActiveBrowserContexts(delta float64) {
+	renderMetrics.init.Do(initRenderMetrics)
+	renderMetrics.activeBrowserContexts.Add(delta)
+}
+
+// renderOutcome returns the outcome of the render by its error.
+func renderOutcome(err error) string {
+	var thrown *exceptionsError
+	switch {
+	case err == nil:
+		return renderOutcomeSuccess
+	case errors.As(err, &thrown):
+		return renderOutcomeException
+	case errors.Is(err, context.DeadlineExceeded):
+		return renderOutcomeTimeout
+	default:
+		return renderOutcomeError
+	}
+}
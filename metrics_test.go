@@ -0,0 +1,63 @@
+package caddy_chrome
+
+import (
+	"context"
+	"fmt"
+	"github.com/alecthomas/assert/v2"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+// metricValue returns the value of the counter, or the gauge, or the sample count of the histogram.
+func metricValue(t *testing.T, metric prometheus.Metric) float64 {
+	var m dto.Metric
+	assert.NoError(t, metric.Write(&m))
+	switch {
+	case m.Counter != nil:
+		return m.Counter.GetValue()
+	case m.Gauge != nil:
+		return m.Gauge.GetValue()
+	default:
+		return float64(m.Histogram.GetSampleCount())
+	}
+}
+
+func TestRenderOutcome(t *testing.T) {
+	assert.Equal(t, renderOutcomeSuccess, renderOutcome(nil))
+	assert.Equal(t, renderOutcomeException, renderOutcome(errors.Wrap(&exceptionsError{exceptions: []string{"Error: x"}}, "failed to render")))
+	assert.Equal(t, renderOutcomeTimeout, renderOutcome(fmt.Errorf("failed to navigate: %w", context.DeadlineExceeded)))
+	assert.Equal(t, renderOutcomeError, renderOutcome(errors.New("websocket closed")))
+}
+
+func TestObserveRender(t *testing.T) {
+	// registered once even if provisioned repeatedly, registering twice would panic
+	for range 2 {
+		renderMetrics.init.Do(initRenderMetrics)
+	}
+
+	timeouts := metricValue(t, renderMetrics.renders.WithLabelValues(renderOutcomeTimeout))
+	bypasses := metricValue(t, renderMetrics.renders.WithLabelValues(renderOutcomeBypass))
+	observed := metricValue(t, renderMetrics.renderDuration)
+
+	observeRender(2*time.Second, renderOutcomeTimeout)
+	countBypass()
+	assert.Equal(t, timeouts+1, metricValue(t, renderMetrics.renders.WithLabelValues(renderOutcomeTimeout)))
+	assert.Equal(t, bypasses+1, metricValue(t, renderMetrics.renders.WithLabelValues(renderOutcomeBypass)))
+	assert.Equal(t, observed+1, metricValue(t, renderMetrics.renderDuration))
+}
+
+func TestMiddleware_acquireBrowser_ActiveBrowserContexts(t *testing.T) {
+	m := &Middleware{log: zap.NewNop(), browsers: liveBrowsers(t, "ws://a")}
+	renderMetrics.init.Do(initRenderMetrics)
+	active := metricValue(t, renderMetrics.activeBrowserContexts)
+
+	_, release, err := m.acquireBrowser()
+	assert.NoError(t, err)
+	assert.Equal(t, active+1, metricValue(t, renderMetrics.activeBrowserContexts))
+	release()
+	assert.Equal(t, active, metricValue(t, renderMetrics.activeBrowserContexts))
+}
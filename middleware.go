@@ -1,15 +1,22 @@
 package caddy_chrome
 
 import (
-	"context"
 	"fmt"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
-	"github.com/chromedp/cdproto/browser"
-	"github.com/chromedp/chromedp"
+	"github.com/chromedp/cdproto/network"
+	"github.com/dustin/go-humanize"
 	"go.uber.org/zap"
+	"golang.org/x/text/language"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -20,27 +27,172 @@ func init() {
 	httpcaddyfile.RegisterDirectiveOrder("chrome", "after", "templates")
 }
 
+// defaultTimeout is the render timeout if it isn't configured.
+const defaultTimeout = 10 * time.Second
+
 type Middleware struct {
-	Timeout       string         `json:"timeout,omitempty"`
-	MIMETypes     []string       `json:"mime_types,omitempty"`
-	ExecBrowser   *ExecBrowser   `json:"exec_browser,omitempty"`
-	RemoteBrowser *RemoteBrowser `json:"remote_browser,omitempty"`
-	FulfillHosts  []string       `json:"fulfill_hosts,omitempty"`
-	ContinueHosts []string       `json:"continue_hosts,omitempty"`
-	Links         bool           `json:"links,omitempty"`
-	log           *zap.Logger
-	timeout       time.Duration
-	chromeCtx     context.Context
+	Timeout             string            `json:"timeout,omitempty"`
+	TimeoutDefault      string            `json:"timeout_default,omitempty"`
+	MaxTimeout          string            `json:"max_timeout,omitempty"`
+	MaxTotalTime        string            `json:"max_total_time,omitempty"`
+	MIMETypes           []string          `json:"mime_types,omitempty"`
+	RenderStatuses      []int             `json:"render_statuses,omitempty"`
+	ExecBrowser         *ExecBrowser      `json:"exec_browser,omitempty"`
+	RemoteBrowser       *RemoteBrowser    `json:"remote_browser,omitempty"`
+	FulfillHosts        []string          `json:"fulfill_hosts,omitempty"`
+	ContinueHosts       []string          `json:"continue_hosts,omitempty"`
+	ResourceTypes       []string          `json:"resource_types,omitempty"`
+	Links               bool              `json:"links,omitempty"`
+	LinksConfig         *LinksConfig      `json:"links_config,omitempty"`
+	RestartBackoff      *RestartBackoff   `json:"restart_backoff,omitempty"`
+	CircuitBreaker      *CircuitBreaker   `json:"circuit_breaker,omitempty"`
+	LazyStart           bool              `json:"lazy_start,omitempty"`
+	Warmup              string            `json:"warmup,omitempty"`
+	CleanupTimeout      string            `json:"cleanup_timeout,omitempty"`
+	StatusPath          string            `json:"status_path,omitempty"`
+	ParallelSerialize   int               `json:"parallel_serialize,omitempty"`
+	NoForcedDoctype     bool              `json:"no_forced_doctype,omitempty"`
+	AMP                 bool              `json:"amp,omitempty"`
+	Fragment            bool              `json:"fragment,omitempty"`
+	Select              *Select           `json:"select,omitempty"`
+	WaitFor             *WaitFor          `json:"wait_for,omitempty"`
+	SettleTime          string            `json:"settle_time,omitempty"`
+	RemoveSelectors     []string          `json:"remove_selectors,omitempty"`
+	SnapshotMethod      string            `json:"snapshot_method,omitempty"`
+	ShadowDOM           string            `json:"shadow_dom,omitempty"`
+	OmitEmptyHeadBody   bool              `json:"omit_empty_head_body,omitempty"`
+	Minify              bool              `json:"minify,omitempty"`
+	CriticalCSS         bool              `json:"critical_css,omitempty"`
+	Iframes             bool              `json:"iframes,omitempty"`
+	AdoptedStyleSheets  bool              `json:"adopted_style_sheets,omitempty"`
+	OptimizeImages      *OptimizeImages   `json:"optimize_images,omitempty"`
+	StripHydration      *StripHydration   `json:"strip_hydration,omitempty"`
+	Bots                *Bots             `json:"bots,omitempty"`
+	RenderIfCookie      *RenderIfCookie   `json:"render_if_cookie,omitempty"`
+	ServiceWorkers      string            `json:"service_workers,omitempty"`
+	BrowserCache        string            `json:"browser_cache,omitempty"`
+	Downloads           string            `json:"downloads,omitempty"`
+	NetworkEmulation    *NetworkEmulation `json:"network_emulation,omitempty"`
+	Proxy               *Proxy            `json:"proxy,omitempty"`
+	Device              string            `json:"device,omitempty"`
+	Viewport            *Viewport         `json:"viewport,omitempty"`
+	Locale              string            `json:"locale,omitempty"`
+	Timezone            string            `json:"timezone,omitempty"`
+	BlockURLs           *BlockURLs        `json:"block_urls,omitempty"`
+	RewriteURLs         []*RewriteURL     `json:"rewrite_urls,omitempty"`
+	MaxConcurrency      int               `json:"max_concurrency,omitempty"`
+	Cache               *Cache            `json:"cache,omitempty"`
+	MaxRequests         int               `json:"max_requests,omitempty"`
+	MaxUpstreamErrors   int               `json:"max_upstream_errors,omitempty"`
+	MaxNodes            int               `json:"max_nodes,omitempty"`
+	MaxOutputSize       *MaxOutputSize    `json:"max_output_size,omitempty"`
+	ValidateOutput      bool              `json:"validate_output,omitempty"`
+	FailOnException     string            `json:"fail_on_exception,omitempty"`
+	MixedContent        string            `json:"mixed_content,omitempty"`
+	ReferrerPolicy      string            `json:"referrer_policy,omitempty"`
+	MetaRefresh         string            `json:"meta_refresh,omitempty"`
+	RedirectBehavior    string            `json:"redirect_behavior,omitempty"`
+	Mode                string            `json:"mode,omitempty"`
+	Output              *Output           `json:"output,omitempty"`
+	Dialogs             string            `json:"dialogs,omitempty"`
+	ForceScheme         string            `json:"force_scheme,omitempty"`
+	OnUnavailable       string            `json:"on_unavailable,omitempty"`
+	OnError             *OnError          `json:"on_error,omitempty"`
+	HostHeader          string            `json:"host_header,omitempty"`
+	DebugHeader         string            `json:"debug_header,omitempty"`
+	DebugSecret         string            `json:"debug_secret,omitempty"`
+	BypassQuery         string            `json:"bypass_query,omitempty"`
+	SnapshotToken       string            `json:"snapshot_token,omitempty"`
+	RecordDir           string            `json:"record_dir,omitempty"`
+	ServerTiming        bool              `json:"server_timing,omitempty"`
+	NormalizeQuery      *NormalizeQuery   `json:"normalize_query,omitempty"`
+	RedactQuery         RedactQuery       `json:"redact_query,omitempty"`
+	CanonicalURL        *CanonicalURL     `json:"canonical_url,omitempty"`
+	OnNewDocumentScript *Script           `json:"on_new_document_script,omitempty"`
+	InjectScripts       []string          `json:"inject_scripts,omitempty"`
+	PostRenderScript    *Script           `json:"post_render_script,omitempty"`
+	PageContext         map[string]string `json:"page_context,omitempty"`
+	ForwardHeaders      []string          `json:"forward_headers,omitempty"`
+	CSPNonce            *CSPNonce         `json:"csp_nonce,omitempty"`
+	Sanitize            *Sanitize         `json:"sanitize,omitempty"`
+	log                 *zap.Logger
+	timeout             time.Duration
+	timeoutTemplate     string
+	maxTimeout          time.Duration
+	maxTotalTime        time.Duration
+	snapshotToken       string
+	debugSecret         string
+	// renderSlots is the semaphore limiting renders in flight across all browsers
+	renderSlots chan struct{}
+	cache       *renderCache
+	// browsers are the exec browser, or remote browsers renders are balanced across
+	browsers    []*browserState
+	nextBrowser uint64
+	// stopHealthChecks stops health checks of remote browsers on cleanup, if there are any
+	stopHealthChecks chan struct{}
+	renderer         *Renderer
 }
 
 type ExecBrowser struct {
-	Path         string   `json:"path,omitempty"`
-	DefaultFlags bool     `json:"default_flags,omitempty"`
-	Flags        []string `json:"flags,omitempty"`
+	Path         string            `json:"path,omitempty"`
+	DefaultFlags bool              `json:"default_flags,omitempty"`
+	Flags        []string          `json:"flags,omitempty"`
+	Env          map[string]string `json:"env,omitempty"`
+	// UserDataDir is a persistent profile directory, so that e.g. cache survives browser restarts.
+	UserDataDir string `json:"user_data_dir,omitempty"`
+	// TempUserDataDir uses a profile directory created on provisioning and removed on cleanup, instead of a new one
+	// for every browser start.
+	TempUserDataDir bool `json:"temp_user_data_dir,omitempty"`
 }
 
 type RemoteBrowser struct {
 	URL string `json:"url,omitempty"`
+	// URLs are more remote browsers, e.g. a fleet of containers, renders are balanced across all of them.
+	URLs []string `json:"urls,omitempty"`
+	// MaxConcurrency limits in-flight renders of each remote browser, zero means unlimited.
+	MaxConcurrency int `json:"max_concurrency,omitempty"`
+	// KeepAlive is the interval of pings keeping the idle connection open, so that it isn't dropped by intermediaries
+	// like load balancers.
+	KeepAlive string `json:"keep_alive,omitempty"`
+	// HealthCheck is the interval of probes of disconnected remote browsers, which are reconnected once they respond.
+	HealthCheck string `json:"health_check,omitempty"`
+}
+
+// urls returns URLs of all remote browsers, URL may be left out when they're given by URLs.
+func (b *RemoteBrowser) urls() []string {
+	if b.URL == "" {
+		return b.URLs
+	}
+	return append([]string{b.URL}, b.URLs...)
+}
+
+// Script is JavaScript given either inline or by a path to a file.
+type Script struct {
+	Inline string `json:"inline,omitempty"`
+	File   string `json:"file,omitempty"`
+}
+
+func (s *Script) Load() (string, error) {
+	if s.File == "" {
+		return s.Inline, nil
+	}
+	source, err := os.ReadFile(s.File)
+	if err != nil {
+		return "", fmt.Errorf("failed to load script: %w", err)
+	}
+	return string(source), nil
+}
+
+type RestartBackoff struct {
+	Min string `json:"min,omitempty"`
+	Max string `json:"max,omitempty"`
+}
+
+type CircuitBreaker struct {
+	// Failures is the threshold opening the breaker, 5 if it's not set, 0 disables the breaker.
+	Failures *int   `json:"failures,omitempty"`
+	Window   string `json:"window,omitempty"`
+	Cooldown string `json:"cooldown,omitempty"`
 }
 
 func (Middleware) CaddyModule() caddy.ModuleInfo {
@@ -63,74 +215,693 @@ func (m *Middleware) Provision(ctx caddy.Context) (err error) {
 	}
 
 	m.log = ctx.Logger()
+	renderMetrics.init.Do(initRenderMetrics)
+
+	repl := caddy.NewReplacer()
 
+	m.timeout = defaultTimeout
 	if m.Timeout != "" {
-		m.timeout, err = time.ParseDuration(m.Timeout)
+		timeout := repl.ReplaceKnown(m.Timeout, "")
+		if strings.Contains(timeout, "{") {
+			// resolved for each request in ServeHTTP, clients mustn't be able to hold the browser as long as they like
+			m.timeoutTemplate = timeout
+			if m.TimeoutDefault != "" {
+				m.timeout, err = time.ParseDuration(m.TimeoutDefault)
+				if err != nil {
+					return fmt.Errorf("invalid timeout default: %w", err)
+				}
+			}
+			m.maxTimeout = m.timeout
+			if m.MaxTimeout != "" {
+				m.maxTimeout, err = time.ParseDuration(m.MaxTimeout)
+				if err != nil {
+					return fmt.Errorf("invalid max timeout: %w", err)
+				}
+				if m.maxTimeout < m.timeout {
+					return fmt.Errorf("max timeout must not be less than the default")
+				}
+			}
+		} else {
+			m.timeout, err = time.ParseDuration(timeout)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if m.MaxTotalTime != "" {
+		m.maxTotalTime, err = time.ParseDuration(m.MaxTotalTime)
 		if err != nil {
 			return err
 		}
-	} else {
-		m.timeout = 10 * time.Second
 	}
 
-	var cancel context.CancelFunc
+	if m.MaxConcurrency < 0 {
+		return fmt.Errorf("max concurrency must not be negative")
+	}
+	maxConcurrency := m.MaxConcurrency
+	if maxConcurrency == 0 {
+		maxConcurrency = runtime.GOMAXPROCS(0)
+	}
+	m.renderSlots = make(chan struct{}, maxConcurrency)
+
+	if m.Cache != nil {
+		ttl, err := time.ParseDuration(m.Cache.TTL)
+		if err != nil {
+			return fmt.Errorf("invalid cache TTL %q: %v", m.Cache.TTL, err)
+		}
+		if ttl <= 0 {
+			return fmt.Errorf("cache TTL must be positive")
+		}
+		if m.Cache.MaxEntries < 0 {
+			return fmt.Errorf("cache max entries must not be negative")
+		}
+		if m.CSPNonce != nil {
+			m.log.Warn("pages with csp_nonce aren't cached, the nonce has to be different in every response")
+		}
+		maxEntries := m.Cache.MaxEntries
+		if maxEntries == 0 {
+			maxEntries = defaultCacheMaxEntries
+		}
+		m.cache = newRenderCache(ttl, maxEntries)
+	}
+
 	if m.ExecBrowser != nil {
-		var opts []chromedp.ExecAllocatorOption
-		if m.ExecBrowser.Path != "" {
-			opts = append(opts, chromedp.ExecPath(m.ExecBrowser.Path))
+		m.ExecBrowser.Path = repl.ReplaceKnown(m.ExecBrowser.Path, "")
+		for i, flag := range m.ExecBrowser.Flags {
+			m.ExecBrowser.Flags[i] = repl.ReplaceKnown(flag, "")
 		}
-		if m.ExecBrowser.DefaultFlags {
-			opts = append(opts, chromedp.DefaultExecAllocatorOptions[:]...)
+		for name, value := range m.ExecBrowser.Env {
+			m.ExecBrowser.Env[name] = repl.ReplaceKnown(value, "")
 		}
 		for _, flag := range m.ExecBrowser.Flags {
-			parts := strings.SplitN(flag, "=", 2)
-			opts = append(opts, chromedp.Flag(parts[0], parts[1]))
+			if name, value := parseFlag(flag); name == "remote-debugging-address" && !isLoopback(fmt.Sprint(value)) {
+				m.log.Warn("browser DevTools are exposed to the network, anyone who can reach them controls the browser",
+					zap.String("remote_debugging_address", fmt.Sprint(value)))
+			}
+		}
+		m.ExecBrowser.UserDataDir = repl.ReplaceKnown(m.ExecBrowser.UserDataDir, "")
+		if m.ExecBrowser.UserDataDir != "" && m.ExecBrowser.TempUserDataDir {
+			return fmt.Errorf("cannot specify both user data dir and temp user data dir")
+		}
+	}
+	m.snapshotToken = repl.ReplaceKnown(m.SnapshotToken, "")
+	m.debugSecret = repl.ReplaceKnown(m.DebugSecret, "")
+	if m.DebugHeader != "" && m.debugSecret == "" {
+		// debug requests have their DOM logged, anyone could fill the logs with it
+		return fmt.Errorf("debug header requires a secret")
+	}
+	m.RecordDir = repl.ReplaceKnown(m.RecordDir, "")
+	if m.RecordDir != "" {
+		if err := os.MkdirAll(m.RecordDir, 0o755); err != nil {
+			return fmt.Errorf("cannot create record dir: %w", err)
+		}
+	}
+	if m.Proxy != nil {
+		m.Proxy.URL = repl.ReplaceKnown(m.Proxy.URL, "")
+		m.Proxy.Username = repl.ReplaceKnown(m.Proxy.Username, "")
+		m.Proxy.Password = repl.ReplaceKnown(m.Proxy.Password, "")
+	}
+	if m.RemoteBrowser != nil {
+		m.RemoteBrowser.URL = repl.ReplaceKnown(m.RemoteBrowser.URL, "")
+		for i, remoteURL := range m.RemoteBrowser.URLs {
+			m.RemoteBrowser.URLs[i] = repl.ReplaceKnown(remoteURL, "")
+		}
+		if len(m.RemoteBrowser.urls()) == 0 {
+			return fmt.Errorf("remote browser URL is required")
+		}
+		for _, rawURL := range m.RemoteBrowser.urls() {
+			// websocket URL is discovered from /json/version of http URLs on every connect, since it changes with
+			// every browser restart
+			remoteURL, err := url.Parse(rawURL)
+			if err != nil {
+				return fmt.Errorf("invalid remote browser URL: %w", err)
+			}
+			switch remoteURL.Scheme {
+			case "ws", "wss", "http", "https", "unix":
+			default:
+				return fmt.Errorf("invalid remote browser URL scheme %q, expected ws, wss, http, https, or unix", remoteURL.Scheme)
+			}
 		}
-		m.chromeCtx, cancel = chromedp.NewExecAllocator(context.Background(), opts...)
+		if m.RemoteBrowser.MaxConcurrency < 0 {
+			return fmt.Errorf("remote browser max concurrency must not be negative")
+		}
+	}
 
-	} else if m.RemoteBrowser != nil {
-		m.chromeCtx, cancel = chromedp.NewRemoteAllocator(context.Background(), m.RemoteBrowser.URL)
+	if m.NormalizeQuery != nil {
+		for _, pattern := range append(m.NormalizeQuery.Strip, m.NormalizeQuery.Keep...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid query parameter pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	for _, pattern := range m.RedactQuery {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid query parameter pattern %q: %w", pattern, err)
+		}
+	}
 
-	} else {
-		panic("unreachable")
+	if m.LinksConfig != nil {
+		for _, rule := range m.LinksConfig.Priorities {
+			switch rule.Priority {
+			case "high", "low", "auto":
+			default:
+				return fmt.Errorf("invalid link priority %q, expected high, low, or auto", rule.Priority)
+			}
+			for _, pattern := range rule.Patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("invalid link priority pattern %q: %w", pattern, err)
+				}
+			}
+		}
+	}
+
+	if m.Sanitize != nil {
+		for _, pattern := range m.Sanitize.Attributes {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid attribute pattern %q: %w", pattern, err)
+			}
+		}
+	}
+
+	var onNewDocumentScript string
+	if m.OnNewDocumentScript != nil {
+		onNewDocumentScript, err = m.OnNewDocumentScript.Load()
+		if err != nil {
+			return err
+		}
+	}
+
+	// files are read upfront, so that a missing one fails the config, rather than renders
+	injectScripts := make([]string, 0, len(m.InjectScripts))
+	for _, file := range m.InjectScripts {
+		source, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to load injected script %q: %w", file, err)
+		}
+		injectScripts = append(injectScripts, string(source))
+	}
+
+	var postRenderScript string
+	if m.PostRenderScript != nil {
+		postRenderScript, err = m.PostRenderScript.Load()
+		if err != nil {
+			return err
+		}
+	}
+
+	switch m.ServiceWorkers {
+	case "", "bypass", "allow":
+	default:
+		return fmt.Errorf("invalid service workers policy %q, expected bypass or allow", m.ServiceWorkers)
+	}
+
+	switch m.Mode {
+	case "", "render":
+	case "hints_only":
+		if m.RecordDir != "" {
+			return fmt.Errorf("hints_only mode cannot be used with record_dir, there's no DOM tree to record")
+		}
+	default:
+		return fmt.Errorf("invalid mode %q, expected render or hints_only", m.Mode)
+	}
+
+	switch m.Dialogs {
+	case "", "dismiss", "accept":
+	default:
+		return fmt.Errorf("invalid dialogs behavior %q, expected dismiss or accept", m.Dialogs)
+	}
+
+	switch m.RedirectBehavior {
+	case "", "pass", "follow":
+	default:
+		return fmt.Errorf("invalid redirect behavior %q, expected pass or follow", m.RedirectBehavior)
+	}
+
+	switch m.MetaRefresh {
+	case "", "render", "pass", "redirect":
+	default:
+		return fmt.Errorf("invalid meta refresh policy %q, expected render, pass, or redirect", m.MetaRefresh)
+	}
+
+	switch m.FailOnException {
+	case "", "error", "pass":
+	default:
+		return fmt.Errorf("invalid exception policy %q, expected error or pass", m.FailOnException)
+	}
+
+	switch m.ForceScheme {
+	case "", "http", "https":
+	default:
+		return fmt.Errorf("invalid forced scheme %q, expected http or https", m.ForceScheme)
 	}
-	m.chromeCtx, _ = chromedp.NewContext(m.chromeCtx)
-	defer func() {
+
+	switch m.OnUnavailable {
+	case "", "fallback", "serve_503":
+	default:
+		return fmt.Errorf("invalid unavailable browser behavior %q, expected fallback or serve_503", m.OnUnavailable)
+	}
+	if m.OnError != nil && m.OnError.Status != 0 && (m.OnError.Status < 400 || m.OnError.Status > 599) {
+		return fmt.Errorf("invalid render error status %d, expected 4xx or 5xx", m.OnError.Status)
+	}
+
+	switch m.MixedContent {
+	case "", "block", "upgrade":
+	case "allow":
+		if m.ExecBrowser == nil {
+			return fmt.Errorf("allowing mixed content requires exec browser, it's a browser flag")
+		}
+	default:
+		return fmt.Errorf("invalid mixed content policy %q, expected block, upgrade, or allow", m.MixedContent)
+	}
+
+	switch network.ReferrerPolicy(m.ReferrerPolicy) {
+	case "", network.ReferrerPolicyNoReferrer, network.ReferrerPolicyNoReferrerWhenDowngrade, network.ReferrerPolicyOrigin,
+		network.ReferrerPolicyOriginWhenCrossOrigin, network.ReferrerPolicySameOrigin, network.ReferrerPolicyStrictOrigin,
+		network.ReferrerPolicyStrictOriginWhenCrossOrigin, network.ReferrerPolicyUnsafeURL:
+	default:
+		return fmt.Errorf("invalid referrer policy %q", m.ReferrerPolicy)
+	}
+
+	if m.RenderIfCookie != nil && m.RenderIfCookie.Name == "" {
+		return fmt.Errorf("render_if_cookie needs a cookie name")
+	}
+
+	if m.WaitFor != nil {
+		if m.WaitFor.Attribute == "" && m.WaitFor.Element == "" && !m.WaitFor.Fonts && !m.WaitFor.NetworkIdle {
+			return fmt.Errorf("wait_for needs attribute, element, fonts, or network_idle")
+		}
+		if m.WaitFor.NetworkIdleTime != "" {
+			if !m.WaitFor.NetworkIdle {
+				return fmt.Errorf("wait_for network idle time needs network_idle")
+			}
+			period, err := time.ParseDuration(m.WaitFor.NetworkIdleTime)
+			if err != nil {
+				return fmt.Errorf("invalid wait_for network idle time: %v", err)
+			}
+			if period <= 0 {
+				return fmt.Errorf("wait_for network idle time must be positive")
+			}
+		}
+	}
+
+	if err := validateForwardHeaders(m.ForwardHeaders); err != nil {
+		return err
+	}
+
+	var resourceTypes []network.ResourceType
+	if len(m.ResourceTypes) > 0 {
+		resourceTypes, err = parseResourceTypes(m.ResourceTypes)
+		if err != nil {
+			return err
+		}
+	}
+
+	var settleTime time.Duration
+	if m.SettleTime != "" {
+		settleTime, err = time.ParseDuration(m.SettleTime)
 		if err != nil {
-			cancel()
-			m.chromeCtx = nil
+			return fmt.Errorf("invalid settle time: %w", err)
+		}
+		if settleTime < 0 || settleTime > maxSettleTime {
+			return fmt.Errorf("invalid settle time %s, expected at most %s", settleTime, maxSettleTime)
+		}
+	}
+
+	switch m.ShadowDOM {
+	case "", "declarative", "flatten", "auto":
+	default:
+		return fmt.Errorf("invalid shadow DOM output %q, expected declarative, flatten, or auto", m.ShadowDOM)
+	}
+
+	switch m.SnapshotMethod {
+	case "", "get_document", "dom_snapshot":
+	case "stream":
+		// these need the whole tree before the serialization starts
+		switch {
+		case m.Select != nil:
+			return fmt.Errorf("stream snapshot method cannot be used with select")
+		case m.CriticalCSS:
+			return fmt.Errorf("stream snapshot method cannot be used with critical_css")
+		case m.ShadowDOM == "flatten" || m.ShadowDOM == "auto":
+			return fmt.Errorf("stream snapshot method cannot be used with flattened shadow DOM")
+		case m.OptimizeImages != nil:
+			return fmt.Errorf("stream snapshot method cannot be used with optimize_images")
+		case m.ParallelSerialize > 0:
+			return fmt.Errorf("stream snapshot method cannot be used with parallel_serialize")
+		case m.MaxNodes > 0:
+			return fmt.Errorf("stream snapshot method cannot be used with max_nodes")
+		case m.RecordDir != "":
+			return fmt.Errorf("stream snapshot method cannot be used with record_dir")
+		}
+	default:
+		return fmt.Errorf("invalid snapshot method %q, expected get_document, dom_snapshot, or stream", m.SnapshotMethod)
+	}
+
+	if m.MaxOutputSize != nil {
+		switch {
+		case m.MaxOutputSize.Size <= 0:
+			return fmt.Errorf("invalid max output size %d, expected a positive number of bytes", m.MaxOutputSize.Size)
+		case m.MaxOutputSize.Truncate && m.ParallelSerialize > 0:
+			// children serialized concurrently aren't counted until they're all done
+			return fmt.Errorf("truncated max output size cannot be used with parallel_serialize")
+		}
+	}
+
+	switch m.BrowserCache {
+	case "", "disable", "enable":
+	default:
+		return fmt.Errorf("invalid browser cache policy %q, expected disable or enable", m.BrowserCache)
+	}
+
+	switch m.Downloads {
+	case "", "deny", "default":
+	default:
+		return fmt.Errorf("invalid downloads behavior %q, expected deny or default", m.Downloads)
+	}
+
+	if m.Viewport != nil {
+		if err := m.Viewport.validate(); err != nil {
+			return err
+		}
+	}
+
+	if m.Locale == localeFromRequest {
+		if !slices.ContainsFunc(m.forwardHeaderNames(), func(name string) bool { return strings.EqualFold(name, "Accept-Language") }) {
+			return fmt.Errorf("locale from_request requires Accept-Language among forward_headers")
+		}
+	} else if m.Locale != "" {
+		if _, err := language.Parse(m.Locale); err != nil {
+			return fmt.Errorf("invalid locale %q: %w", m.Locale, err)
+		}
+	}
+	if m.Timezone != "" {
+		if _, err := time.LoadLocation(m.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone %q: %w", m.Timezone, err)
+		}
+	}
+
+	if m.Device != "" {
+		if _, ok := lookupDevice(m.Device); !ok {
+			return fmt.Errorf("unknown device %q, expected a device of Chrome DevTools, e.g. \"iPhone 13\", or \"Pixel 5\"", m.Device)
+		}
+	}
+
+	if m.NetworkEmulation != nil {
+		if _, err := m.NetworkEmulation.conditions(); err != nil {
+			return fmt.Errorf("invalid network emulation: %w", err)
+		}
+	}
+
+	if m.Proxy != nil {
+		if err := m.Proxy.validate(); err != nil {
+			return err
+		}
+	}
+
+	if m.Output != nil {
+		if err := m.Output.validate(); err != nil {
+			return err
+		}
+		if m.Output.captures() && m.Mode == "hints_only" {
+			return fmt.Errorf("%s output cannot be combined with hints_only mode", m.Output.Format)
+		}
+		if m.Output.captures() && m.SnapshotToken != "" {
+			return fmt.Errorf("%s output cannot be combined with snapshot_token", m.Output.Format)
 		}
-	}()
-	err = chromedp.Run(m.chromeCtx, chromedp.ActionFunc(func(ctx context.Context) error {
-		protocolVersion, product, revision, userAgent, jsVersion, err := browser.GetVersion().Do(ctx)
+	}
+
+	if m.BlockURLs != nil {
+		for _, pattern := range m.BlockURLs.Patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid blocked URL pattern %q: %w", pattern, err)
+			}
+		}
+		if err := m.BlockURLs.compile(); err != nil {
+			return fmt.Errorf("invalid blocked URL regexp: %w", err)
+		}
+	}
+
+	for _, rewrite := range m.RewriteURLs {
+		if err := rewrite.compile(); err != nil {
+			return fmt.Errorf("invalid rewritten URL regexp %q: %w", rewrite.From, err)
+		}
+	}
+
+	if m.CanonicalURL != nil {
+		switch m.CanonicalURL.TrailingSlash {
+		case "", "add", "remove":
+		default:
+			return fmt.Errorf("invalid trailing slash policy %q, expected add or remove", m.CanonicalURL.TrailingSlash)
+		}
+	}
+
+	minBackoff, maxBackoff, cleanupTimeout := time.Second, time.Minute, 10*time.Second
+	if m.RestartBackoff != nil {
+		if m.RestartBackoff.Min != "" {
+			minBackoff, err = time.ParseDuration(m.RestartBackoff.Min)
+			if err != nil {
+				return err
+			}
+		}
+		if m.RestartBackoff.Max != "" {
+			maxBackoff, err = time.ParseDuration(m.RestartBackoff.Max)
+			if err != nil {
+				return err
+			}
+		}
+		if maxBackoff < minBackoff {
+			return fmt.Errorf("maximum restart backoff must not be less than minimum")
+		}
+	}
+	if m.CleanupTimeout != "" {
+		cleanupTimeout, err = time.ParseDuration(m.CleanupTimeout)
 		if err != nil {
 			return err
 		}
-		m.log.Info("browser connected",
-			zap.String("protocol_version", protocolVersion),
-			zap.String("product", product),
-			zap.String("revision", revision),
-			zap.String("user_agent", userAgent),
-			zap.String("js_version", jsVersion))
+	}
+
+	failures, window, cooldown := 5, time.Minute, 5*time.Minute
+	if m.CircuitBreaker != nil {
+		if m.CircuitBreaker.Failures != nil {
+			failures = *m.CircuitBreaker.Failures
+		}
+		if failures < 0 {
+			return fmt.Errorf("circuit breaker failures must not be negative")
+		}
+		if m.CircuitBreaker.Window != "" {
+			window, err = time.ParseDuration(m.CircuitBreaker.Window)
+			if err != nil {
+				return err
+			}
+		}
+		if m.CircuitBreaker.Cooldown != "" {
+			cooldown, err = time.ParseDuration(m.CircuitBreaker.Cooldown)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// each remote browser restarts, and has its circuit breaker, on its own, so that a dead one is skipped
+	newBrowser := func(url string) *browserState {
+		return &browserState{
+			url:            url,
+			minBackoff:     minBackoff,
+			maxBackoff:     maxBackoff,
+			backoff:        minBackoff,
+			cleanupTimeout: cleanupTimeout,
+			breaker:        newCircuitBreaker(failures, window, cooldown),
+		}
+	}
+	if m.ExecBrowser != nil {
+		b := newBrowser("")
+		b.userDataDir = m.ExecBrowser.UserDataDir
+		if m.ExecBrowser.TempUserDataDir {
+			b.userDataDir, err = os.MkdirTemp("", "caddy-chrome-")
+			if err != nil {
+				return err
+			}
+			b.removeUserDataDir = true
+		}
+		m.browsers = []*browserState{b}
+	} else {
+		var keepAlive time.Duration
+		if m.RemoteBrowser.KeepAlive != "" {
+			keepAlive, err = time.ParseDuration(m.RemoteBrowser.KeepAlive)
+			if err != nil {
+				return err
+			}
+		}
+		var healthCheck time.Duration
+		if m.RemoteBrowser.HealthCheck != "" {
+			healthCheck, err = time.ParseDuration(m.RemoteBrowser.HealthCheck)
+			if err != nil {
+				return err
+			}
+			if healthCheck <= 0 {
+				return fmt.Errorf("invalid health check interval %s, expected a positive duration", healthCheck)
+			}
+		}
+		for _, remoteURL := range m.RemoteBrowser.urls() {
+			b := newBrowser(remoteURL)
+			b.keepAlive = keepAlive
+			b.healthCheck = healthCheck
+			b.maxConcurrency = m.RemoteBrowser.MaxConcurrency
+			m.browsers = append(m.browsers, b)
+		}
+	}
+
+	m.renderer = &Renderer{
+		FulfillHosts:            m.FulfillHosts,
+		ContinueHosts:           m.ContinueHosts,
+		ResourceTypes:           resourceTypes,
+		OnNewDocumentScript:     onNewDocumentScript,
+		InjectScripts:           injectScripts,
+		PostRenderScript:        postRenderScript,
+		Sanitize:                m.Sanitize,
+		ParallelSerialize:       m.ParallelSerialize,
+		NoForcedDoctype:         m.NoForcedDoctype,
+		Fragment:                m.Fragment,
+		AMP:                     m.AMP,
+		Select:                  m.Select,
+		Output:                  m.Output,
+		WaitFor:                 m.WaitFor,
+		SettleTime:              settleTime,
+		RemoveSelectors:         m.RemoveSelectors,
+		DOMSnapshot:             m.SnapshotMethod == "dom_snapshot",
+		StreamDOM:               m.SnapshotMethod == "stream",
+		FlattenShadowDOM:        m.ShadowDOM == "flatten",
+		OmitEmptyHeadBody:       m.OmitEmptyHeadBody,
+		Minify:                  m.Minify,
+		CriticalCSS:             m.CriticalCSS,
+		Iframes:                 m.Iframes,
+		AdoptedStyleSheets:      m.AdoptedStyleSheets,
+		OptimizeImages:          m.OptimizeImages,
+		StripHydration:          m.StripHydration,
+		Bots:                    m.Bots,
+		ServiceWorkers:          m.ServiceWorkers == "allow",
+		BrowserCache:            m.BrowserCache == "enable",
+		BrowserDownloads:        m.Downloads == "default",
+		AcceptDialogs:           m.Dialogs == "accept",
+		NetworkEmulation:        m.NetworkEmulation,
+		Proxy:                   m.Proxy,
+		Device:                  m.Device,
+		Viewport:                m.Viewport,
+		Locale:                  m.Locale,
+		Timezone:                m.Timezone,
+		BlockURLs:               m.BlockURLs,
+		RewriteURLs:             m.RewriteURLs,
+		MaxRequests:             m.MaxRequests,
+		HintsOnly:               m.Mode == "hints_only",
+		MaxUpstreamErrors:       m.MaxUpstreamErrors,
+		MaxNodes:                m.MaxNodes,
+		ValidateOutput:          m.ValidateOutput,
+		FailOnException:         m.FailOnException != "",
+		TruncateOutput:          m.truncateOutput(),
+		UpgradeInsecureRequests: m.MixedContent == "upgrade",
+		ReferrerPolicy:          network.ReferrerPolicy(m.ReferrerPolicy),
+		Links:                   m.LinksConfig,
+		RedactQuery:             m.RedactQuery,
+		RecordDir:               m.RecordDir,
+		Logger:                  m.log,
+	}
+
+	if m.Warmup != "" && m.Warmup != "about:blank" {
+		if u, err := url.Parse(m.Warmup); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid warmup URL %q, expected an absolute http or https URL", m.Warmup)
+		}
+	}
+
+	if m.LazyStart {
+		// browsers aren't connected until the first render, unless a health check finds them responding sooner
+		m.startHealthChecks()
 		return nil
-	}))
-	if err != nil {
+	}
+	connected := 0
+	for _, b := range m.browsers {
+		if err := m.startBrowser(b); err != nil {
+			if len(m.browsers) > 1 {
+				// the others render meanwhile, it's reconnected once the restart backoff passes
+				m.browserLog(b).Warn("failed to connect to remote browser, skipping it", zap.Error(err))
+				b.nextRestart = time.Now().Add(b.backoff)
+				continue
+			}
+			if m.RemoteBrowser != nil {
+				return fmt.Errorf("failed to connect to remote browser at %s, check that it's running and reachable (or set lazy_start to connect on the first render): %w", m.RedactQuery.Redact(b.url), err)
+			}
+			return fmt.Errorf("failed to start browser, check that it's installed, exec path, and flags (or set lazy_start to start it on the first render): %w", err)
+		}
+		if err := smokeTest(b.chromeCtx); err != nil {
+			if len(m.browsers) > 1 {
+				// as if it didn't connect, the others render meanwhile
+				m.browserLog(b).Warn("remote browser connected, but failed to render a blank page, skipping it", zap.Error(err))
+				_ = m.stopBrowser(b)
+				b.nextRestart = time.Now().Add(b.backoff)
+				continue
+			}
+			m.stopBrowsers()
+			return fmt.Errorf("browser connected, but failed to render a blank page, check browser flags: %w", err)
+		}
+		connected++
+	}
+	if connected == 0 {
+		return fmt.Errorf("failed to connect to any of remote browsers, or to render a blank page by them, check that they're running and reachable (or set lazy_start to connect on the first render)")
+	}
+	m.startHealthChecks()
+	if m.Warmup != "" {
+		m.warmUp()
+	}
+	return nil
+}
+
+// startHealthChecks starts probing remote browsers that aren't connected, if health_check is set, until cleanup.
+func (m *Middleware) startHealthChecks() {
+	if m.RemoteBrowser == nil || m.RemoteBrowser.HealthCheck == "" {
 		return
 	}
+	m.stopHealthChecks = make(chan struct{})
+	for _, b := range m.browsers {
+		go m.healthCheck(b, m.stopHealthChecks)
+	}
+}
 
-	return nil
+// stopBrowsers stops the browsers started so far, when provisioning fails.
+func (m *Middleware) stopBrowsers() {
+	for _, b := range m.browsers {
+		_ = m.stopBrowser(b)
+	}
 }
 
 func (m *Middleware) Cleanup() error {
-	if m.chromeCtx != nil {
-		timeoutCtx, cancel := context.WithTimeout(m.chromeCtx, 10*time.Second)
-		defer cancel()
-		if err := chromedp.Cancel(timeoutCtx); err != nil {
-			return err
+	if m.stopHealthChecks != nil {
+		close(m.stopHealthChecks)
+	}
+	for _, b := range m.browsers {
+		b.mu.Lock()
+		b.closing = true
+		b.mu.Unlock()
+	}
+
+	var err error
+	for _, b := range m.browsers {
+		if !b.drainRenders(b.cleanupTimeout) {
+			m.browserLog(b).Warn("in-flight renders didn't finish in time, closing browser", zap.Duration("timeout", b.cleanupTimeout))
+		}
+
+		b.mu.Lock()
+		stopErr := m.stopBrowser(b)
+		if b.removeUserDataDir {
+			if removeErr := os.RemoveAll(b.userDataDir); removeErr != nil && stopErr == nil {
+				stopErr = removeErr
+			}
+		}
+		b.mu.Unlock()
+		if err == nil {
+			err = stopErr
 		}
-		m.chromeCtx = nil
 	}
-	return nil
+	return err
 }
 
 func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
@@ -152,6 +923,26 @@ func (m *Middleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 					return d.ArgErr()
 				}
 				m.Timeout = d.Val()
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					name := d.Val()
+					if d.CountRemainingArgs() != 1 {
+						return d.ArgErr()
+					}
+					d.NextArg()
+					switch name {
+					case "default":
+						m.TimeoutDefault = d.Val()
+					case "max":
+						m.MaxTimeout = d.Val()
+					default:
+						return d.ArgErr()
+					}
+				}
+			case "max_total_time":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.MaxTotalTime = d.Val()
 			case "mime_types":
 				m.MIMETypes = d.RemainingArgs()
 				if len(m.MIMETypes) == 0 {
@@ -172,33 +963,963 @@ func (m *Middleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 					if d.Val() == "--" {
 						continue
 					} else if flags {
-						m.ExecBrowser.Flags = append(m.ExecBrowser.Flags, d.Val())
+						flag := d.Val()
+						// join value quoted in the middle of the token, e.g. --js-flags="--foo --bar"
+						if i := strings.Index(flag, `="`); i != -1 && !strings.HasSuffix(flag[i+2:], `"`) {
+							for d.NextArg() {
+								flag += " " + d.Val()
+								if strings.HasSuffix(d.Val(), `"`) {
+									break
+								}
+							}
+						}
+						m.ExecBrowser.Flags = append(m.ExecBrowser.Flags, flag)
 					} else {
 						m.ExecBrowser.Path = d.Val()
 					}
 				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "env":
+						if d.CountRemainingArgs() != 2 {
+							return d.ArgErr()
+						}
+						d.NextArg()
+						name := d.Val()
+						d.NextArg()
+						if m.ExecBrowser.Env == nil {
+							m.ExecBrowser.Env = make(map[string]string)
+						}
+						m.ExecBrowser.Env[name] = d.Val()
+					case "user_data_dir":
+						if d.CountRemainingArgs() != 1 {
+							return d.ArgErr()
+						}
+						d.NextArg()
+						m.ExecBrowser.UserDataDir = d.Val()
+					case "temp_user_data_dir":
+						if d.CountRemainingArgs() != 0 {
+							return d.ArgErr()
+						}
+						m.ExecBrowser.TempUserDataDir = true
+					default:
+						return d.ArgErr()
+					}
+				}
 			case "url":
 				m.RemoteBrowser = &RemoteBrowser{}
-				if d.CountRemainingArgs() != 1 {
+				args := d.RemainingArgs()
+				if len(args) == 0 {
 					return d.ArgErr()
 				}
-				d.NextArg()
-				m.RemoteBrowser.URL = d.Val()
+				m.RemoteBrowser.URL = args[0]
+				m.RemoteBrowser.URLs = args[1:]
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "max_concurrency":
+						if d.CountRemainingArgs() != 1 {
+							return d.ArgErr()
+						}
+						d.NextArg()
+						maxConcurrency, err := strconv.Atoi(d.Val())
+						if err != nil {
+							return d.Errf("invalid max concurrency: %v", err)
+						}
+						m.RemoteBrowser.MaxConcurrency = maxConcurrency
+					case "keep_alive":
+						if d.CountRemainingArgs() != 1 {
+							return d.ArgErr()
+						}
+						d.NextArg()
+						m.RemoteBrowser.KeepAlive = d.Val()
+					case "health_check":
+						if d.CountRemainingArgs() != 1 {
+							return d.ArgErr()
+						}
+						d.NextArg()
+						m.RemoteBrowser.HealthCheck = d.Val()
+					default:
+						return d.ArgErr()
+					}
+				}
 			case "fulfill_hosts":
 				m.FulfillHosts = append(m.FulfillHosts, d.RemainingArgs()...)
 			case "continue_hosts":
 				m.ContinueHosts = append(m.ContinueHosts, d.RemainingArgs()...)
-			case "links":
-				m.Links = true
-				if d.CountRemainingArgs() != 0 {
+			case "resource_types":
+				if d.CountRemainingArgs() == 0 {
 					return d.ArgErr()
 				}
-			default:
-				return d.ArgErr()
-			}
-		}
-	}
-	return nil
+				m.ResourceTypes = append(m.ResourceTypes, d.RemainingArgs()...)
+			case "restart_backoff":
+				args := d.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return d.ArgErr()
+				}
+				m.RestartBackoff = &RestartBackoff{Min: args[0]}
+				if len(args) > 1 {
+					m.RestartBackoff.Max = args[1]
+				}
+			case "circuit_breaker":
+				args := d.RemainingArgs()
+				if len(args) == 0 || len(args) > 3 {
+					return d.ArgErr()
+				}
+				failures, err := strconv.Atoi(args[0])
+				if err != nil {
+					return d.Errf("invalid number of failures: %v", err)
+				}
+				m.CircuitBreaker = &CircuitBreaker{Failures: &failures}
+				if len(args) > 1 {
+					m.CircuitBreaker.Window = args[1]
+				}
+				if len(args) > 2 {
+					m.CircuitBreaker.Cooldown = args[2]
+				}
+			case "lazy_start":
+				if d.CountRemainingArgs() != 0 {
+					return d.ArgErr()
+				}
+				m.LazyStart = true
+			case "warmup":
+				switch d.CountRemainingArgs() {
+				case 0:
+					m.Warmup = "about:blank"
+				case 1:
+					d.NextArg()
+					m.Warmup = d.Val()
+				default:
+					return d.ArgErr()
+				}
+			case "cleanup_timeout":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				m.CleanupTimeout = d.Val()
+			case "status_path":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.StatusPath = d.Val()
+			case "parallel_serialize":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				threshold, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid node count: %v", err)
+				}
+				m.ParallelSerialize = threshold
+			case "debug_header":
+				if d.CountRemainingArgs() != 2 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				m.DebugHeader = d.Val()
+				d.NextArg()
+				m.DebugSecret = d.Val()
+			case "record_dir":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				m.RecordDir = d.Val()
+			case "bypass_query":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				m.BypassQuery = d.Val()
+			case "snapshot_token":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				m.SnapshotToken = d.Val()
+			case "server_timing":
+				if d.CountRemainingArgs() != 0 {
+					return d.ArgErr()
+				}
+				m.ServerTiming = true
+			case "normalize_query":
+				if d.CountRemainingArgs() != 0 {
+					return d.ArgErr()
+				}
+				m.NormalizeQuery = &NormalizeQuery{}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "strip":
+						m.NormalizeQuery.Strip = append(m.NormalizeQuery.Strip, d.RemainingArgs()...)
+					case "keep":
+						m.NormalizeQuery.Keep = append(m.NormalizeQuery.Keep, d.RemainingArgs()...)
+					case "cache_key_only":
+						if d.CountRemainingArgs() != 0 {
+							return d.ArgErr()
+						}
+						m.NormalizeQuery.CacheKeyOnly = true
+					default:
+						return d.ArgErr()
+					}
+				}
+			case "redact_query":
+				if d.CountRemainingArgs() == 0 {
+					return d.ArgErr()
+				}
+				m.RedactQuery = append(m.RedactQuery, d.RemainingArgs()...)
+			case "canonical_url":
+				if d.CountRemainingArgs() != 0 {
+					return d.ArgErr()
+				}
+				m.CanonicalURL = &CanonicalURL{}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "trailing_slash":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						m.CanonicalURL.TrailingSlash = d.Val()
+					case "strict":
+						if d.CountRemainingArgs() != 0 {
+							return d.ArgErr()
+						}
+						m.CanonicalURL.Strict = true
+					default:
+						return d.ArgErr()
+					}
+				}
+			case "on_new_document_script":
+				script, err := unmarshalScript(d)
+				if err != nil {
+					return err
+				}
+				m.OnNewDocumentScript = script
+			case "inject_script":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				m.InjectScripts = append(m.InjectScripts, d.Val())
+			case "post_render_script":
+				script, err := unmarshalScript(d)
+				if err != nil {
+					return err
+				}
+				m.PostRenderScript = script
+			case "page_context":
+				if d.CountRemainingArgs() != 0 {
+					return d.ArgErr()
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					name := d.Val()
+					if d.CountRemainingArgs() != 1 {
+						return d.ArgErr()
+					}
+					d.NextArg()
+					if m.PageContext == nil {
+						m.PageContext = make(map[string]string)
+					}
+					m.PageContext[name] = d.Val()
+				}
+			case "forward_headers":
+				if d.CountRemainingArgs() == 0 {
+					return d.ArgErr()
+				}
+				m.ForwardHeaders = append(m.ForwardHeaders, d.RemainingArgs()...)
+			case "csp_nonce":
+				m.CSPNonce = &CSPNonce{}
+				switch d.CountRemainingArgs() {
+				case 0:
+				case 1:
+					d.NextArg()
+					m.CSPNonce.Policy = d.Val()
+				default:
+					return d.ArgErr()
+				}
+			case "sanitize":
+				if d.CountRemainingArgs() != 0 {
+					return d.ArgErr()
+				}
+				m.Sanitize = &Sanitize{}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "attributes":
+						m.Sanitize.Attributes = append(m.Sanitize.Attributes, d.RemainingArgs()...)
+					case "schemes":
+						m.Sanitize.Schemes = append(m.Sanitize.Schemes, d.RemainingArgs()...)
+					default:
+						return d.ArgErr()
+					}
+				}
+			case "no_forced_doctype":
+				if d.CountRemainingArgs() != 0 {
+					return d.ArgErr()
+				}
+				m.NoForcedDoctype = true
+			case "amp":
+				if d.CountRemainingArgs() != 0 {
+					return d.ArgErr()
+				}
+				m.AMP = true
+			case "fragment":
+				if d.CountRemainingArgs() != 0 {
+					return d.ArgErr()
+				}
+				m.Fragment = true
+			case "select":
+				args := d.RemainingArgs()
+				switch {
+				case len(args) == 1:
+					m.Select = &Select{Selector: args[0]}
+				case len(args) == 2 && args[1] == "required":
+					m.Select = &Select{Selector: args[0], Required: true}
+				default:
+					return d.ArgErr()
+				}
+			case "omit_empty_head_body":
+				if d.CountRemainingArgs() != 0 {
+					return d.ArgErr()
+				}
+				m.OmitEmptyHeadBody = true
+			case "minify":
+				if d.CountRemainingArgs() != 0 {
+					return d.ArgErr()
+				}
+				m.Minify = true
+			case "shadow_dom":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				m.ShadowDOM = d.Val()
+			case "snapshot_method":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				m.SnapshotMethod = d.Val()
+			case "remove_selectors":
+				if d.CountRemainingArgs() == 0 {
+					return d.ArgErr()
+				}
+				m.RemoveSelectors = append(m.RemoveSelectors, d.RemainingArgs()...)
+			case "render_if_cookie":
+				args := d.RemainingArgs()
+				switch len(args) {
+				case 1:
+					m.RenderIfCookie = &RenderIfCookie{Name: args[0]}
+				case 2:
+					m.RenderIfCookie = &RenderIfCookie{Name: args[0], Value: args[1]}
+				default:
+					return d.ArgErr()
+				}
+			case "wait_for":
+				args := d.RemainingArgs()
+				if m.WaitFor == nil {
+					m.WaitFor = &WaitFor{}
+				}
+				if len(args) > 0 {
+					if err := parseWaitFor(d, m.WaitFor, args); err != nil {
+						return err
+					}
+					break
+				}
+				blocked := false
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					if err := parseWaitFor(d, m.WaitFor, append([]string{d.Val()}, d.RemainingArgs()...)); err != nil {
+						return err
+					}
+					blocked = true
+				}
+				if !blocked {
+					return d.ArgErr()
+				}
+			case "settle_time":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				m.SettleTime = d.Val()
+			case "service_workers":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				m.ServiceWorkers = d.Val()
+			case "browser_cache":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				m.BrowserCache = d.Val()
+			case "downloads":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				m.Downloads = d.Val()
+			case "device":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				m.Device = d.Val()
+			case "viewport":
+				if d.CountRemainingArgs() != 0 {
+					return d.ArgErr()
+				}
+				m.Viewport = &Viewport{}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "width", "height":
+						name := d.Val()
+						if d.CountRemainingArgs() != 1 {
+							return d.ArgErr()
+						}
+						d.NextArg()
+						size, err := strconv.Atoi(d.Val())
+						if err != nil {
+							return d.Errf("invalid %s: %v", name, err)
+						}
+						if name == "width" {
+							m.Viewport.Width = size
+						} else {
+							m.Viewport.Height = size
+						}
+					case "device_scale_factor":
+						if d.CountRemainingArgs() != 1 {
+							return d.ArgErr()
+						}
+						d.NextArg()
+						scale, err := strconv.ParseFloat(d.Val(), 64)
+						if err != nil {
+							return d.Errf("invalid device scale factor: %v", err)
+						}
+						m.Viewport.DeviceScaleFactor = scale
+					case "mobile":
+						if d.CountRemainingArgs() != 0 {
+							return d.ArgErr()
+						}
+						m.Viewport.Mobile = true
+					case "user_agent":
+						if d.CountRemainingArgs() != 1 {
+							return d.ArgErr()
+						}
+						d.NextArg()
+						m.Viewport.UserAgent = d.Val()
+					default:
+						return d.ArgErr()
+					}
+				}
+			case "proxy":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				m.Proxy = &Proxy{URL: d.Val()}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "credentials":
+						if d.CountRemainingArgs() != 2 {
+							return d.ArgErr()
+						}
+						d.NextArg()
+						m.Proxy.Username = d.Val()
+						d.NextArg()
+						m.Proxy.Password = d.Val()
+					case "bypass":
+						bypass := d.RemainingArgs()
+						if len(bypass) == 0 {
+							return d.ArgErr()
+						}
+						m.Proxy.Bypass = append(m.Proxy.Bypass, bypass...)
+					default:
+						return d.ArgErr()
+					}
+				}
+			case "network_emulation":
+				m.NetworkEmulation = &NetworkEmulation{}
+				switch d.CountRemainingArgs() {
+				case 0:
+				case 1:
+					d.NextArg()
+					m.NetworkEmulation.Preset = d.Val()
+				default:
+					return d.ArgErr()
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "latency":
+						if d.CountRemainingArgs() != 1 {
+							return d.ArgErr()
+						}
+						d.NextArg()
+						m.NetworkEmulation.Latency = d.Val()
+					case "download", "upload":
+						name := d.Val()
+						if d.CountRemainingArgs() != 1 {
+							return d.ArgErr()
+						}
+						d.NextArg()
+						throughput, err := strconv.ParseFloat(d.Val(), 64)
+						if err != nil {
+							return d.Errf("invalid throughput: %v", err)
+						}
+						if name == "download" {
+							m.NetworkEmulation.Download = throughput
+						} else {
+							m.NetworkEmulation.Upload = throughput
+						}
+					default:
+						return d.ArgErr()
+					}
+				}
+			case "render_statuses":
+				if d.CountRemainingArgs() == 0 {
+					return d.ArgErr()
+				}
+				for d.NextArg() {
+					code := d.Val()
+					if len(code) == 3 && strings.HasSuffix(code, "xx") {
+						code = code[:1]
+					}
+					status, err := strconv.Atoi(code)
+					if err != nil {
+						return d.Errf("invalid status code %q: %v", d.Val(), err)
+					}
+					m.RenderStatuses = append(m.RenderStatuses, status)
+				}
+			case "max_concurrency":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				maxConcurrency, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid max concurrency: %v", err)
+				}
+				m.MaxConcurrency = maxConcurrency
+			case "cache":
+				args := d.RemainingArgs()
+				switch len(args) {
+				case 1:
+					m.Cache = &Cache{TTL: args[0]}
+				case 2:
+					maxEntries, err := strconv.Atoi(args[1])
+					if err != nil {
+						return d.Errf("invalid max entries: %v", err)
+					}
+					m.Cache = &Cache{TTL: args[0], MaxEntries: maxEntries}
+				default:
+					return d.ArgErr()
+				}
+			case "max_requests":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				maxRequests, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid request count: %v", err)
+				}
+				m.MaxRequests = maxRequests
+			case "max_upstream_errors":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				maxErrors, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid error count: %v", err)
+				}
+				m.MaxUpstreamErrors = maxErrors
+			case "max_nodes":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				maxNodes, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid node count: %v", err)
+				}
+				m.MaxNodes = maxNodes
+			case "max_output_size":
+				if d.CountRemainingArgs() < 1 || d.CountRemainingArgs() > 2 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				size, err := humanize.ParseBytes(d.Val())
+				if err != nil {
+					return d.Errf("invalid size: %v", err)
+				}
+				m.MaxOutputSize = &MaxOutputSize{Size: int64(size)}
+				if d.NextArg() {
+					switch d.Val() {
+					case "truncate":
+						m.MaxOutputSize.Truncate = true
+					case "fallback":
+					default:
+						return d.Errf("invalid policy %q, expected fallback or truncate", d.Val())
+					}
+				}
+			case "validate_output":
+				if d.CountRemainingArgs() != 0 {
+					return d.ArgErr()
+				}
+				m.ValidateOutput = true
+			case "fail_on_exception":
+				if d.CountRemainingArgs() > 1 {
+					return d.ArgErr()
+				}
+				m.FailOnException = "error"
+				if d.NextArg() {
+					m.FailOnException = d.Val()
+				}
+			case "dialogs":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				m.Dialogs = d.Val()
+			case "mode":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				m.Mode = d.Val()
+			case "output":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				m.Output = &Output{Format: d.Val()}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "viewport":
+						if d.CountRemainingArgs() != 2 {
+							return d.ArgErr()
+						}
+						d.NextArg()
+						width, err := strconv.Atoi(d.Val())
+						if err != nil {
+							return d.Errf("invalid viewport width: %v", err)
+						}
+						d.NextArg()
+						height, err := strconv.Atoi(d.Val())
+						if err != nil {
+							return d.Errf("invalid viewport height: %v", err)
+						}
+						m.Output.Width, m.Output.Height = width, height
+					case "full_page":
+						if d.CountRemainingArgs() != 0 {
+							return d.ArgErr()
+						}
+						m.Output.FullPage = true
+					default:
+						return d.ArgErr()
+					}
+				}
+			case "redirect_behavior":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				m.RedirectBehavior = d.Val()
+			case "on_unavailable":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				m.OnUnavailable = d.Val()
+			case "on_error":
+				if d.CountRemainingArgs() != 0 {
+					return d.ArgErr()
+				}
+				m.OnError = &OnError{}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "status":
+						if d.CountRemainingArgs() != 1 {
+							return d.ArgErr()
+						}
+						d.NextArg()
+						status, err := strconv.Atoi(d.Val())
+						if err != nil {
+							return d.Errf("invalid status: %v", err)
+						}
+						m.OnError.Status = status
+					case "body":
+						if d.CountRemainingArgs() != 1 {
+							return d.ArgErr()
+						}
+						d.NextArg()
+						m.OnError.Body = d.Val()
+					case "content_type":
+						if d.CountRemainingArgs() != 1 {
+							return d.ArgErr()
+						}
+						d.NextArg()
+						m.OnError.ContentType = d.Val()
+					default:
+						return d.ArgErr()
+					}
+				}
+			case "meta_refresh":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				m.MetaRefresh = d.Val()
+			case "force_scheme":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				m.ForceScheme = d.Val()
+			case "host_header":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.HostHeader = d.Val()
+			case "mixed_content":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				m.MixedContent = d.Val()
+			case "referrer_policy":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				m.ReferrerPolicy = d.Val()
+			case "block_urls":
+				m.BlockURLs = &BlockURLs{Patterns: d.RemainingArgs()}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "regexp":
+						if d.CountRemainingArgs() == 0 {
+							return d.ArgErr()
+						}
+						m.BlockURLs.Regexps = append(m.BlockURLs.Regexps, d.RemainingArgs()...)
+					case "analytics":
+						if d.CountRemainingArgs() != 0 {
+							return d.ArgErr()
+						}
+						m.BlockURLs.Analytics = true
+					default:
+						return d.ArgErr()
+					}
+				}
+			case "locale":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				m.Locale = d.Val()
+			case "timezone":
+				if d.CountRemainingArgs() != 1 {
+					return d.ArgErr()
+				}
+				d.NextArg()
+				m.Timezone = d.Val()
+			case "rewrite_url":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+				m.RewriteURLs = append(m.RewriteURLs, &RewriteURL{From: args[0], To: args[1]})
+			case "critical_css":
+				if d.CountRemainingArgs() != 0 {
+					return d.ArgErr()
+				}
+				m.CriticalCSS = true
+			case "adopted_style_sheets":
+				if d.CountRemainingArgs() != 0 {
+					return d.ArgErr()
+				}
+				m.AdoptedStyleSheets = true
+			case "iframes":
+				if d.CountRemainingArgs() != 0 {
+					return d.ArgErr()
+				}
+				m.Iframes = true
+			case "optimize_images":
+				m.OptimizeImages = &OptimizeImages{}
+				switch d.CountRemainingArgs() {
+				case 0:
+				case 1:
+					d.NextArg()
+					skipFirst, err := strconv.Atoi(d.Val())
+					if err != nil {
+						return d.Errf("invalid image count: %v", err)
+					}
+					m.OptimizeImages.SkipFirst = skipFirst
+				default:
+					return d.ArgErr()
+				}
+			case "strip_hydration":
+				stripHydration, err := unmarshalStripHydration(d)
+				if err != nil {
+					return err
+				}
+				m.StripHydration = stripHydration
+			case "bots":
+				if d.CountRemainingArgs() != 0 {
+					return d.ArgErr()
+				}
+				m.Bots = &Bots{}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "user_agents":
+						m.Bots.UserAgents = append(m.Bots.UserAgents, d.RemainingArgs()...)
+					case "strip_scripts":
+						if d.CountRemainingArgs() != 0 {
+							return d.ArgErr()
+						}
+						m.Bots.StripScripts = true
+					case "strip_hydration":
+						stripHydration, err := unmarshalStripHydration(d)
+						if err != nil {
+							return err
+						}
+						m.Bots.StripHydration = stripHydration
+					default:
+						return d.ArgErr()
+					}
+				}
+			case "links":
+				m.Links = true
+				if d.CountRemainingArgs() != 0 {
+					return d.ArgErr()
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					if m.LinksConfig == nil {
+						m.LinksConfig = &LinksConfig{}
+					}
+					switch d.Val() {
+					case "priority":
+						args := d.RemainingArgs()
+						if len(args) < 2 {
+							return d.ArgErr()
+						}
+						m.LinksConfig.Priorities = append(m.LinksConfig.Priorities, LinkPriority{Priority: args[0], Patterns: args[1:]})
+					case "add":
+						args := d.RemainingArgs()
+						if len(args) < 2 {
+							return d.ArgErr()
+						}
+						entry := LinkEntry{URL: args[0]}
+						for _, arg := range args[1:] {
+							name, value, _ := strings.Cut(arg, "=")
+							switch name {
+							case "rel":
+								entry.Rel = value
+							case "as":
+								entry.As = value
+							default:
+								return d.Errf("unknown link parameter: %s", arg)
+							}
+						}
+						if entry.Rel == "" {
+							return d.Err("link rel is required")
+						}
+						m.LinksConfig.Static = append(m.LinksConfig.Static, entry)
+					case "preconnect_threshold":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						threshold, err := strconv.Atoi(d.Val())
+						if err != nil {
+							return d.Errf("invalid preconnect threshold: %v", err)
+						}
+						m.LinksConfig.PreconnectThreshold = threshold
+					default:
+						return d.ArgErr()
+					}
+				}
+			default:
+				return d.ArgErr()
+			}
+		}
+	}
+	return nil
+}
+
+// unmarshalScript parses either inline script, or file subdirective followed by the path.
+func unmarshalScript(d *caddyfile.Dispenser) (*Script, error) {
+	args := d.RemainingArgs()
+	switch {
+	case len(args) == 1:
+		return &Script{Inline: args[0]}, nil
+	case len(args) == 2 && args[0] == "file":
+		return &Script{File: args[1]}, nil
+	default:
+		return nil, d.ArgErr()
+	}
+}
+
+// unmarshalStripHydration parses strip_hydration with optional comments and attributes subdirectives.
+func unmarshalStripHydration(d *caddyfile.Dispenser) (*StripHydration, error) {
+	if d.CountRemainingArgs() != 0 {
+		return nil, d.ArgErr()
+	}
+	stripHydration := &StripHydration{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "comments":
+			stripHydration.Comments = append(stripHydration.Comments, d.RemainingArgs()...)
+		case "attributes":
+			stripHydration.Attributes = append(stripHydration.Attributes, d.RemainingArgs()...)
+		default:
+			return nil, d.ArgErr()
+		}
+	}
+	return stripHydration, nil
+}
+
+// isLoopback reports whether the host is a loopback address, or localhost.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// parseWaitFor parses a wait_for condition, given either on the directive's line, or on a line of its block.
+func parseWaitFor(d *caddyfile.Dispenser, w *WaitFor, args []string) error {
+	switch {
+	case args[0] == "attribute" && len(args) == 2:
+		w.Attribute = args[1]
+	case (args[0] == "element" || args[0] == "selector") && len(args) == 2:
+		w.Element = args[1]
+	case args[0] == "fonts" && len(args) == 1:
+		w.Fonts = true
+	case args[0] == "network_idle" && len(args) <= 2:
+		w.NetworkIdle = true
+		if len(args) == 2 {
+			w.NetworkIdleTime = args[1]
+		}
+	case args[0] == "attribute", args[0] == "element", args[0] == "selector", args[0] == "fonts", args[0] == "network_idle":
+		return d.ArgErr()
+	default:
+		return d.Errf("unknown wait_for signal %q, expected attribute, element, selector, fonts, or network_idle", args[0])
+	}
+	return nil
+}
+
+// parseFlag splits a command line flag into name and value suitable for chromedp.Flag. Flags without value are
+// treated as boolean switches, quotes around the value are removed.
+func parseFlag(flag string) (string, any) {
+	name, value, hasValue := strings.Cut(strings.TrimPrefix(flag, "--"), "=")
+	if !hasValue {
+		return name, true
+	}
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	return name, value
 }
 
 var (
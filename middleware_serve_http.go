@@ -2,26 +2,19 @@ package caddy_chrome
 
 import (
 	"bytes"
-	"context"
-	"encoding/base64"
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
-	"github.com/chromedp/cdproto/dom"
-	"github.com/chromedp/cdproto/emulation"
-	"github.com/chromedp/cdproto/fetch"
-	"github.com/chromedp/cdproto/network"
-	"github.com/chromedp/cdproto/page"
-	"github.com/chromedp/cdproto/runtime"
-	"github.com/chromedp/chromedp"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"io"
 	"mime"
 	"net/http"
-	"net/http/httptest"
-	"net/url"
-	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 var bufPool = sync.Pool{
@@ -30,198 +23,324 @@ var bufPool = sync.Pool{
 	},
 }
 
+// snapshotHeader carries the snapshot token of requests for the DOM tree instead of the rendered page.
+const snapshotHeader = "X-Caddy-Chrome-Snapshot"
+
 var skipHeaders = map[string]struct{}{
 	"Accept-Ranges":  {},
 	"Content-Length": {},
 	"Etag":           {},
 	"Last-Modified":  {},
-	"Vary":           {},
 }
 
 func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if m.StatusPath != "" && r.URL.Path == m.StatusPath {
+		return m.serveStatus(w, r)
+	}
+	if m.bypasses(r) {
+		m.log.Debug("bypassing render", zap.String("url", m.RedactQuery.Redact(r.URL.String())), zap.String("bypass_query", m.BypassQuery))
+		countBypass()
+		return next.ServeHTTP(w, withoutQueryParam(r, m.BypassQuery))
+	}
+	if m.RenderIfCookie != nil {
+		// the page has a variant for requests with the cookie
+		w.Header().Add("Vary", "Cookie")
+		if !m.RenderIfCookie.Match(r) {
+			return next.ServeHTTP(w, r)
+		}
+	}
+	received := time.Now()
+
+	navigateURL := m.requestScheme(r) + "://" + r.Host + r.RequestURI
+	// renderKey identifies renders producing the same page
+	renderKey := withQuery(navigateURL, m.NormalizeQuery.Normalize(r.URL.RawQuery))
+	if m.NormalizeQuery != nil && !m.NormalizeQuery.CacheKeyOnly {
+		navigateURL = renderKey
+	}
+	renderKey = m.CanonicalURL.Canonicalize(renderKey)
+	if m.CanonicalURL != nil && m.CanonicalURL.Strict {
+		navigateURL = m.CanonicalURL.Canonicalize(navigateURL)
+	}
+	// bots get a different variant of the page
+	bot := m.Bots.Match(r.UserAgent())
+	if bot {
+		renderKey = "bot:" + renderKey
+	}
+	debug := m.isDebug(r)
+	snapshot := m.snapshotToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(snapshotHeader)), []byte(m.snapshotToken)) == 1
+	// debug and snapshot requests are always rendered, pages with a CSP nonce too, as it has to differ in every response
+	cached := m.cache != nil && (r.Method == http.MethodGet || r.Method == http.MethodHead) && !debug && !snapshot &&
+		m.CSPNonce == nil
+	// stale is the cached page the upstream is asked whether it has changed, it's rendered again only if it has
+	var stale *cacheEntry
+	if cached {
+		if entry := m.cache.get(renderKey, r, received); entry != nil {
+			m.log.Debug("serving cached render", zap.String("render_key", m.RedactQuery.Redact(renderKey)), zap.Time("stored", entry.stored))
+			return entry.write(w, r, received)
+		}
+		if !isConditional(r) {
+			stale = m.cache.stale(renderKey, r, received)
+		}
+	}
+
 	buf := bufPool.Get().(*bytes.Buffer)
 	buf.Reset()
 	defer bufPool.Put(buf)
 
-	recorder := caddyhttp.NewResponseRecorder(w, buf, func(code int, header http.Header) bool {
-		if len(m.MIMETypes) == 0 {
-			return true
-		}
-		contentType := header.Get("Content-Type")
-		mediaType, _, err := mime.ParseMediaType(contentType)
+	// the body is read once, the handlers get it as it was, and it's sent again when a 307 or 308 redirect is followed
+	var body []byte
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(r.Body)
 		if err != nil {
-			return false
+			return caddyhttp.Error(http.StatusBadRequest, errors.Wrap(err, "failed to read request body"))
 		}
-		for _, mimeType := range m.MIMETypes {
-			if mediaType == mimeType {
-				return true
-			}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	upstreamReq, shouldBuffer := r, m.shouldBuffer
+	if stale != nil {
+		upstreamReq = stale.conditional(r)
+		shouldBuffer = func(code int, header http.Header) bool {
+			return code == http.StatusNotModified || m.shouldBuffer(code, header)
 		}
-		return false
-	})
-	err := next.ServeHTTP(recorder, r)
+	}
+	recorder := caddyhttp.NewResponseRecorder(w, buf, shouldBuffer)
+	err := next.ServeHTTP(recorder, upstreamReq)
 	if err != nil {
 		return err
 	}
+	if stale != nil && recorder.Buffered() && recorder.Status() == http.StatusNotModified {
+		m.log.Debug("serving revalidated render", zap.String("render_key", m.RedactQuery.Redact(renderKey)), zap.Time("stored", stale.stored))
+		entry := stale.revalidated(recorder.Header(), received, m.cache.ttl)
+		m.cache.put(renderKey, entry)
+		return entry.write(w, r, received)
+	}
 	if !recorder.Buffered() {
 		return nil
 	}
+	if isRedirect(recorder) && m.RedirectBehavior != "follow" {
+		return recorder.WriteResponse()
+	}
+	if !isRedirect(recorder) && !isRenderable(buf.Bytes()) {
+		m.log.Debug("empty or binary body, passing through", zap.Int("status", recorder.Status()))
+		return recorder.WriteResponse()
+	}
+
+	if m.MetaRefresh == "pass" || m.MetaRefresh == "redirect" {
+		if delay, target, ok := metaRefresh(buf.Bytes()); ok {
+			m.log.Debug("meta refresh", zap.Int("delay", delay), zap.String("target", m.RedactQuery.Redact(target)), zap.String("policy", m.MetaRefresh))
+			if m.MetaRefresh == "redirect" {
+				return writeMetaRefreshRedirect(w, delay, target)
+			}
+			return recorder.WriteResponse()
+		}
+	}
 
 	m.log.Debug("got response", zap.String("response", buf.String()), zap.String("content_type", recorder.Header().Get("Content-Type")))
 
-	var scheme string
-	if r.TLS == nil {
-		scheme = "http"
-	} else {
-		scheme = "https"
+	// renders over the limit wait for a slot, rather than all of them slowing down, or the browser running out of memory
+	releaseSlot, err := m.acquireRenderSlot(r.Context(), m.renderTimeout(r))
+	if errors.Is(err, errNoRenderSlot) {
+		m.log.Warn("all render slots taken, responding 503", zap.Int("max_concurrency", cap(m.renderSlots)))
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer releaseSlot()
+
+	chromeCtx, release, err := m.acquireBrowser()
+	if err != nil {
+		m.log.Debug("browser unavailable", zap.String("breaker", m.breakerState()))
+		w.Header().Set("X-Caddy-Chrome-Breaker", m.breakerState())
+		return m.writeUnavailable(w, recorder)
 	}
-	navigateURL := scheme + "://" + r.Host + r.RequestURI
+	// the browser is acquired again if it's lost during the render
+	defer func() {
+		release()
+	}()
 
-	timeoutCtx, timeoutCancel := context.WithTimeout(m.chromeCtx, m.timeout)
-	defer timeoutCancel()
+	m.log.Debug("rendering", zap.String("navigate_url", m.RedactQuery.Redact(navigateURL)), zap.String("render_key", m.RedactQuery.Redact(renderKey)))
 
-	browserCtx, browserCancel := chromedp.NewContext(timeoutCtx, chromedp.WithNewBrowserContext())
-	defer browserCancel()
+	var nonce string
+	if m.CSPNonce != nil {
+		nonce, err = newNonce()
+		if err != nil {
+			return errors.Wrap(err, "failed to generate nonce")
+		}
+	}
+	contextScript, err := m.pageContextScript(r)
+	if err != nil {
+		return errors.Wrap(err, "failed to build page context")
+	}
 
-	reqContext := r.Context()
-	go func() {
-		<-reqContext.Done()
-		browserCancel()
-	}()
-	server := reqContext.Value(caddyhttp.ServerCtxKey).(http.Handler)
-
-	links := newLinks()
-
-	var tasks chromedp.Tasks
-	tasks = append(tasks, fetch.Enable())
-	tasks = append(tasks, runtime.Enable())
-	tasks = append(tasks, chromedp.ActionFunc(func(ctx context.Context) error {
-		chromedp.ListenTarget(ctx, func(event any) {
-			switch event := event.(type) {
-			case *fetch.EventRequestPaused:
-				go func() {
-					var res response
-					pausedURL, err := url.Parse(event.Request.URL)
-					m.log.Debug("request paused",
-						zap.String("request_url", event.Request.URL),
-						zap.Bool("is_navigate", event.Request.URL == navigateURL),
-						zap.Bool("has_post_data", event.Request.HasPostData))
-
-					if err != nil {
-						m.log.Error("failed to parse request URL", zap.String("request_url", event.Request.URL), zap.Error(err))
-						browserCancel()
-						return
-					}
-
-					if event.Request.URL == navigateURL {
-						res = recorder
-
-					} else if shouldHandleResourceType(event.ResourceType) && (pausedURL.Host == r.Host || slices.Contains(m.FulfillHosts, pausedURL.Host)) {
-						if pausedURL.Host == r.Host {
-							links.AddResource(event.Request.URL, event.ResourceType)
-						} else {
-							links.AddPreconnect(pausedURL.Scheme + "://" + pausedURL.Host)
-						}
-
-						var body io.Reader
-						if event.Request.HasPostData {
-							body = strings.NewReader(event.Request.PostData)
-						}
-						subRequest := httptest.NewRequest(event.Request.Method, event.Request.URL, body).WithContext(reqContext)
-						for name, value := range event.Request.Headers {
-							subRequest.Header.Add(name, value.(string))
-						}
-
-						subResponse := &responseWriter{header: make(http.Header)}
-
-						server.ServeHTTP(subResponse, subRequest)
-
-						res = subResponse
-
-					} else if shouldHandleResourceType(event.ResourceType) && slices.Contains(m.ContinueHosts, pausedURL.Host) {
-						links.AddPreconnect(pausedURL.Scheme + "://" + pausedURL.Host)
-
-						err = fetch.ContinueRequest(event.RequestID).Do(ctx)
-						if err != nil {
-							m.log.Error("failed to continue request", zap.String("request_url", event.Request.URL), zap.Error(err))
-							browserCancel()
-						}
-
-						m.log.Debug("request continued", zap.String("request_url", event.Request.URL))
-
-						return
-
-					} else {
-						if pausedURL.Host == r.Host {
-							links.AddResource(event.Request.URL, event.ResourceType)
-						} else {
-							links.AddPreconnect(pausedURL.Scheme + "://" + pausedURL.Host)
-						}
-
-						err := fetch.FailRequest(event.RequestID, network.ErrorReasonBlockedByClient).Do(ctx)
-						if err != nil {
-							m.log.Error("failed to block request", zap.String("request_url", event.Request.URL), zap.Error(err))
-							browserCancel()
-						}
-
-						m.log.Debug("request blocked", zap.String("request_url", event.Request.URL))
-
-						return
-					}
-
-					fulfill := fetch.FulfillRequest(event.RequestID, int64(res.Status()))
-					fulfill.ResponseHeaders = make([]*fetch.HeaderEntry, 0, len(res.Header()))
-					for name, values := range res.Header() {
-						for _, value := range values {
-							fulfill.ResponseHeaders = append(fulfill.ResponseHeaders, &fetch.HeaderEntry{name, value})
-						}
-					}
-					fulfill.Body = base64.StdEncoding.EncodeToString(res.Buffer().Bytes())
-					err = fulfill.Do(ctx)
-					if err != nil {
-						m.log.Error("failed to fulfill request", zap.String("request_url", event.Request.URL), zap.Error(err))
-						browserCancel()
-						return
-					}
-
-					m.log.Debug("request fulfilled", zap.String("request_url", event.Request.URL))
-				}()
-			case *runtime.EventExceptionThrown:
-				m.log.Error("exception thrown in runtime", zap.String("exception_details", event.ExceptionDetails.Exception.Description))
-			}
-		})
-		return nil
-	}))
-	for _, cookie := range r.Cookies() {
-		tasks = append(tasks, network.SetCookie(cookie.Name, cookie.Value).WithDomain(r.Host))
+	renderReq := &renderRequest{
+		url:           navigateURL,
+		host:          r.Host,
+		hostHeader:    m.HostHeader,
+		document:      recorder,
+		handler:       r.Context().Value(caddyhttp.ServerCtxKey).(http.Handler),
+		ctx:           r.Context(),
+		cookies:       r.Cookies(),
+		userAgent:     r.UserAgent(),
+		headers:       m.forwardedHeaders(r),
+		referer:       r.Referer(),
+		timeout:       m.renderTimeout(r),
+		nonce:         nonce,
+		contextScript: contextScript,
+		method:        r.Method,
+		body:          body,
+		contentType:   r.Header.Get("Content-Type"),
+		bot:           bot,
+		debug:         debug,
+		// with auto, clients get declarative shadow DOM, unless they're bots, or browsers not supporting it
+		flattenShadowDOM: m.ShadowDOM == "auto" && (bot || !supportsDeclarativeShadowDOM(r.UserAgent())),
 	}
-	if ua := r.UserAgent(); ua != "" {
-		tasks = append(tasks, emulation.SetUserAgentOverride(ua))
+	if m.ServerTiming {
+		renderReq.timings = &renderTimings{}
 	}
-	tasks = append(tasks, chromedp.ActionFunc(func(ctx context.Context) error {
-		_, err := page.AddScriptToEvaluateOnNewDocument(onNewDocumentScript).Do(ctx)
-		return err
-	}))
-	tasks = append(tasks, chromedp.Navigate(navigateURL))
-	tasks = append(tasks, chromedp.Evaluate("window.CaddyChrome.pendingTask", nil, func(p *runtime.EvaluateParams) *runtime.EvaluateParams {
-		p.AwaitPromise = true
-		return p
-	}))
-	var serializer *domSerializer
-	tasks = append(tasks, chromedp.ActionFunc(func(ctx context.Context) error {
-		root, err := dom.GetDocument().WithDepth(-1).WithPierce(true).Do(ctx)
+	for redirects := 0; isRedirect(renderReq.document); redirects++ {
+		target, ok := redirectTarget(renderReq.url, renderReq.document.Header().Get("Location"))
+		if !ok || redirects == maxRedirects {
+			m.log.Debug("not following redirect", zap.String("url", m.RedactQuery.Redact(renderReq.url)), zap.String("location", m.RedactQuery.Redact(renderReq.document.Header().Get("Location"))))
+			return m.writeDocument(w, recorder, renderReq.document)
+		}
+		renderReq.url = target
+		if status := renderReq.document.Status(); status != http.StatusTemporaryRedirect && status != http.StatusPermanentRedirect {
+			// as by browsers, other redirects are followed by GET
+			renderReq.method, renderReq.body, renderReq.contentType = http.MethodGet, nil, ""
+		}
+		renderReq.document = renderReq.fetchDocument()
+	}
+	if renderReq.document != recorder && (!m.shouldRender(renderReq.document.Header()) || !m.rendersStatus(renderReq.document.Status()) ||
+		!isRenderable(renderReq.document.Buffer().Bytes())) {
+		return m.writeDocument(w, recorder, renderReq.document)
+	}
+
+	if m.maxTotalTime > 0 {
+		remaining := m.maxTotalTime - time.Since(received)
+		if deadline, ok := r.Context().Deadline(); ok {
+			remaining = min(remaining, time.Until(deadline))
+		}
+		if remaining <= 0 {
+			m.log.Debug("no time left to render", zap.Duration("max_total_time", m.maxTotalTime))
+			return m.writeUnavailable(w, recorder)
+		}
+		renderReq.timeout = min(renderReq.timeout, remaining)
+	}
+
+	renderStarted := time.Now()
+	rendering, err := m.renderer.render(chromeCtx, renderReq)
+	if remaining := renderReq.timeout - time.Since(renderStarted); err != nil && browserLost(chromeCtx, r) && remaining > 0 {
+		// the connection was lost, e.g. a remote browser restarted, it's re-established by the first request acquiring
+		// the browser again, others wait for it, the render is retried once in the rest of the time
+		m.log.Debug("browser lost during render, retrying", zap.String("url", m.RedactQuery.Redact(renderReq.url)), zap.Error(err))
+		release()
+		chromeCtx, release, err = m.acquireBrowser()
 		if err != nil {
+			release = func() {}
+			observeRender(time.Since(renderStarted), renderOutcomeError)
+			m.log.Debug("browser unavailable", zap.String("breaker", m.breakerState()))
+			w.Header().Set("X-Caddy-Chrome-Breaker", m.breakerState())
+			return m.writeUnavailable(w, recorder)
+		}
+		renderReq.timeout = remaining
+		rendering, err = m.renderer.render(chromeCtx, renderReq)
+	}
+	observeRender(time.Since(renderStarted), renderOutcome(err))
+	if err != nil && m.ServerTiming {
+		// phases up to the failure, e.g. the one the timeout fired in, are reported by the fallback response
+		w.Header().Add("Server-Timing", renderReq.timings.serverTiming(time.Since(renderStarted)))
+	}
+	if errors.Is(err, ErrTooManyNodes) {
+		m.log.Warn("DOM tree too large, passing through", zap.String("url", m.RedactQuery.Redact(renderReq.url)), zap.Int("max_nodes", m.MaxNodes))
+		return m.writeDocument(w, recorder, renderReq.document)
+	}
+	if errors.Is(err, ErrUpstreamErrors) {
+		m.log.Warn("upstream failing, passing through", zap.String("url", m.RedactQuery.Redact(renderReq.url)), zap.Error(err))
+		return m.writeDocument(w, recorder, renderReq.document)
+	}
+	if errors.Is(err, ErrInvalidOutput) {
+		m.log.Warn("rendered page doesn't look like HTML, passing through", zap.String("url", m.RedactQuery.Redact(renderReq.url)), zap.Error(err))
+		return m.writeDocument(w, recorder, renderReq.document)
+	}
+	var thrown *exceptionsError
+	if errors.As(err, &thrown) {
+		m.log.Warn("page threw exceptions", zap.String("url", m.RedactQuery.Redact(renderReq.url)), zap.Strings("exceptions", thrown.exceptions), zap.String("fail_on_exception", m.FailOnException))
+		if m.FailOnException == "pass" {
+			// the recorder writes headers of the response writer, a document requested when following redirects has its own
+			document, header := renderReq.document, w.Header()
+			if document != recorder {
+				header = document.Header().Clone()
+				document = &headerOverride{response: document, header: header}
+			}
+			if debug {
+				setExceptionsHeader(header, thrown.exceptions)
+			}
+			return m.writeDocument(w, recorder, document)
+		}
+		if debug {
+			setExceptionsHeader(w.Header(), thrown.exceptions)
+		}
+		if m.OnError != nil {
+			return m.OnError.write(w, r, err)
+		}
+		return caddyhttp.Error(http.StatusBadGateway, err)
+	}
+	if err != nil {
+		if m.OnError != nil {
+			m.log.Error("render failed", zap.String("url", m.RedactQuery.Redact(renderReq.url)), zap.Error(err))
+			return m.OnError.write(w, r, err)
+		}
+		return err
+	}
+	defer rendering.release()
+
+	if debug && len(rendering.exceptions) > 0 {
+		setExceptionsHeader(w.Header(), rendering.exceptions)
+	}
+
+	if rendering.location != "" {
+		m.log.Debug("page redirected", zap.String("url", m.RedactQuery.Redact(renderReq.url)), zap.String("location", m.RedactQuery.Redact(rendering.location)), zap.Int("status", rendering.Status()))
+		return writeRedirect(w, rendering.Status(), rendering.location)
+	}
+
+	if m.Mode == "hints_only" {
+		return m.writeHints(w, recorder, rendering)
+	}
+
+	if snapshot {
+		return writeSnapshot(w, rendering)
+	}
+
+	if cached && r.Method == http.MethodGet {
+		// validators of the upstream response are replaced by writing the rendered page, the page is revalidated by
+		// them only if it's the response to the request, not one requested when following redirects
+		var etag, lastModified string
+		if rendering.document == recorder {
+			etag, lastModified = recorder.Header().Get("Etag"), recorder.Header().Get("Last-Modified")
+		}
+		cacheRecorder := &cacheRecorder{ResponseWriter: w}
+		if err := m.writeRendering(cacheRecorder, r, recorder, rendering, nonce); err != nil {
 			return err
 		}
-		serializer = &domSerializer{root: root}
+		if entry := newCacheEntry(r, cacheRecorder, time.Now(), m.cache.ttl); entry != nil {
+			entry.etag, entry.lastModified = etag, lastModified
+			m.cache.put(renderKey, entry)
+		}
 		return nil
-	}))
-	err = chromedp.Run(browserCtx, tasks)
-	if err != nil {
-		return errors.Wrap(err, "failed to run chrome")
 	}
 
-	headers := recorder.Header().Clone()
+	return m.writeRendering(w, r, recorder, rendering, nonce)
+}
+
+// setRenderedHeader replaces headers of the response with the ones of the document response, except those describing
+// its body, and makes the page vary by request headers that influenced the render.
+func (m *Middleware) setRenderedHeader(w http.ResponseWriter, r *http.Request, rendering *rendering) {
+	headers := rendering.document.Header().Clone()
 	for name, _ := range w.Header() {
 		w.Header().Del(name)
 	}
@@ -233,31 +352,338 @@ func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next cadd
 			w.Header().Add(name, value)
 		}
 	}
+	if m.isDebug(r) && len(rendering.exceptions) > 0 {
+		setExceptionsHeader(w.Header(), rendering.exceptions)
+	}
+
+	// the page varies by what the upstream response did, and by the request headers that influenced the render
+	vary := headers.Values("Vary")
+	if m.Bots != nil || m.ShadowDOM == "auto" {
+		// the page has a variant for bots, or for browsers not supporting declarative shadow DOM
+		vary = append(vary, "User-Agent")
+	}
+	if m.RenderIfCookie != nil || r.Header.Get("Cookie") != "" {
+		// cookies of the request are set in Chrome
+		vary = append(vary, "Cookie")
+	}
+	// page_context variables are resolved from them
+	vary = append(vary, m.pageContextHeaders()...)
+	// forwarded headers are passed to the upstream handlers
+	for _, name := range m.forwardHeaderNames() {
+		if len(r.Header.Values(name)) > 0 {
+			vary = append(vary, name)
+		}
+	}
+	w.Header().Del("Vary")
+	if value := mergeVary(vary...); value != "" {
+		w.Header().Set("Vary", value)
+	}
+}
+
+// writeCapture writes the PDF, or the screenshot of the page, with headers of the document response.
+func (m *Middleware) writeCapture(w http.ResponseWriter, r *http.Request, rendering *rendering) error {
+	m.setRenderedHeader(w, r, rendering)
+	w.Header().Set("Content-Type", m.Output.contentType())
+	w.Header().Set("Content-Length", strconv.Itoa(len(rendering.capture)))
+	// policies of the document don't apply to an image, or a PDF
+	w.Header().Del("Content-Security-Policy")
+	w.Header().Del("Content-Security-Policy-Report-Only")
+	if m.ServerTiming {
+		w.Header().Add("Server-Timing", rendering.timings.serverTiming(rendering.duration))
+	}
+	w.WriteHeader(rendering.Status())
+	_, err := w.Write(rendering.capture)
+	return err
+}
+
+// isDebug reports whether the request carries the debug header with the secret.
+func (m *Middleware) isDebug(r *http.Request) bool {
+	return m.DebugHeader != "" && m.debugSecret != "" &&
+		subtle.ConstantTimeCompare([]byte(r.Header.Get(m.DebugHeader)), []byte(m.debugSecret)) == 1
+}
+
+// writeHints writes the document response un-rendered, with Link headers of resources the page loaded in Chrome, for
+// the hints_only mode.
+func (m *Middleware) writeHints(w http.ResponseWriter, recorder caddyhttp.ResponseRecorder, rendering *rendering) error {
+	// the recorder writes headers of the response writer, a document requested when following redirects has its own
+	document, header := rendering.document, w.Header()
+	if document != recorder {
+		header = document.Header().Clone()
+		document = &headerOverride{response: document, header: header}
+	}
+	rendering.links.MakeHeaders(header)
+	if m.ServerTiming {
+		header.Add("Server-Timing", rendering.timings.serverTiming(rendering.duration))
+	}
+	return m.writeDocument(w, recorder, document)
+}
+
+// writeUnavailable writes the response when the page can't be rendered, either the document response un-rendered, or
+// 503 with Retry-After if configured.
+func (m *Middleware) writeUnavailable(w http.ResponseWriter, recorder caddyhttp.ResponseRecorder) error {
+	if m.OnUnavailable != "serve_503" {
+		return recorder.WriteResponse()
+	}
+	retryAfter := m.retryAfter()
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Round(time.Second)/time.Second)))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	return nil
+}
+
+// writeMetaRefreshRedirect responds with a redirect instead of a meta refresh page, immediate refreshes are permanent
+// redirects, as crawlers treat them so, delayed ones temporary.
+func writeMetaRefreshRedirect(w http.ResponseWriter, delay int, target string) error {
+	if delay == 0 {
+		return writeRedirect(w, http.StatusMovedPermanently, target)
+	}
+	return writeRedirect(w, http.StatusFound, target)
+}
+
+// writeRedirect responds with a redirect without a body.
+func writeRedirect(w http.ResponseWriter, status int, target string) error {
+	for name := range skipHeaders {
+		w.Header().Del(name)
+	}
+	w.Header().Del("Content-Type")
+	w.Header().Set("Location", target)
+	w.WriteHeader(status)
+	return nil
+}
+
+// writeSnapshot writes the DOM tree the serializer got from Chrome as JSON, for debugging of the serializer.
+func writeSnapshot(w http.ResponseWriter, rendering *rendering) error {
+	var root any
+	if rendering.serializer != nil && rendering.serializer.root != nil {
+		if stream := rendering.serializer.stream; stream != nil {
+			if err := stream.all(); err != nil {
+				return errors.Wrap(err, "failed to fetch streamed tree")
+			}
+		}
+		root = rendering.serializer.root
+	}
+	for name := range w.Header() {
+		w.Header().Del(name)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	return json.NewEncoder(w).Encode(root)
+}
+
+// writeRendering writes the response with the serialized DOM, or the document response if there's nothing to
+// serialize.
+func (m *Middleware) writeRendering(w http.ResponseWriter, r *http.Request, recorder caddyhttp.ResponseRecorder, rendering *rendering, nonce string) error {
+	if rendering.capture != nil {
+		return m.writeCapture(w, r, rendering)
+	}
+	if rendering.serializer == nil || rendering.serializer.root == nil {
+		m.log.Error("no document to serialize, passing through")
+		return m.writeDocument(w, recorder, rendering.document)
+	}
+
+	// the page is serialized upfront if it may be too large to be sent, so that the upstream one can be instead
+	var serialized []byte
+	if m.MaxOutputSize != nil && !m.MaxOutputSize.Truncate {
+		buf := bufPool.Get().(*bytes.Buffer)
+		buf.Reset()
+		defer bufPool.Put(buf)
+		rendering.timings.begin(timingSerialize)
+		err := rendering.serializer.Serialize(&limitWriter{w: buf, limit: m.MaxOutputSize.Size})
+		rendering.timings.end()
+		if errors.Is(err, ErrOutputTooLarge) {
+			m.log.Warn("rendered page too large, passing through", zap.String("url", m.RedactQuery.Redact(r.URL.String())), zap.Int64("max_output_size", m.MaxOutputSize.Size))
+			return m.writeDocument(w, recorder, rendering.document)
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to serialize")
+		}
+		serialized = buf.Bytes()
+	} else if m.ServerTiming || hasOutputTransformers() {
+		// also when it's timed, the header is sent before the body, or when it's transformed
+		buf := bufPool.Get().(*bytes.Buffer)
+		buf.Reset()
+		defer bufPool.Put(buf)
+		rendering.timings.begin(timingSerialize)
+		err := rendering.serializer.Serialize(buf)
+		rendering.timings.end()
+		if err != nil {
+			return errors.Wrap(err, "failed to serialize")
+		}
+		m.warnTruncated(r, rendering.serializer)
+		serialized = buf.Bytes()
+	}
+
+	m.setRenderedHeader(w, r, rendering)
+	w.Header().Set("Content-Type", serializedContentType(w.Header().Get("Content-Type"), rendering.serializer.xml))
+
+	if m.CSPNonce != nil {
+		w.Header().Set("Content-Security-Policy", m.CSPNonce.Header(w.Header().Get("Content-Security-Policy"), nonce))
+	} else if style := rendering.serializer.injectedStyle(); style != "" {
+		// the injected style has no nonce, policies of the upstream have to allow it by its hash
+		for _, name := range []string{"Content-Security-Policy", "Content-Security-Policy-Report-Only"} {
+			for i, policy := range w.Header()[name] {
+				w.Header()[name][i] = allowInlineStyle(policy, style)
+			}
+		}
+	}
 
 	if m.Links {
-		links.MakeHeaders(w.Header())
+		rendering.links.MakeHeaders(w.Header())
+	}
+
+	if m.ServerTiming {
+		w.Header().Add("Server-Timing", rendering.timings.serverTiming(rendering.duration))
+	}
+
+	if hasOutputTransformers() {
+		body, err := transformOutput(r, w.Header(), serialized)
+		if err != nil {
+			return errors.Wrap(err, "failed to transform output")
+		}
+		w.WriteHeader(rendering.Status())
+		_, err = w.Write(body)
+		return err
 	}
 
-	w.WriteHeader(recorder.Status())
+	w.WriteHeader(rendering.Status())
 
-	if err := serializer.Serialize(w); err != nil {
+	if serialized != nil {
+		_, err := w.Write(serialized)
+		return err
+	}
+	if err := rendering.serializer.Serialize(w); err != nil {
 		return errors.Wrap(err, "failed to serialize")
 	}
+	m.warnTruncated(r, rendering.serializer)
 
 	return nil
 }
 
-func shouldHandleResourceType(resourceType network.ResourceType) bool {
-	switch resourceType {
-	case network.ResourceTypeScript:
-		fallthrough
-	case network.ResourceTypeXHR:
-		fallthrough
-	case network.ResourceTypeFetch:
+// shouldBuffer reports whether the upstream response is buffered to be rendered, or a redirect to be followed.
+// Encoded (e.g. gzip compressed) responses are passed through, Chrome needs the document as is, and the rendered
+// page is compressed by the encode handler, if it's ordered before this one.
+func (m *Middleware) shouldBuffer(code int, header http.Header) bool {
+	if encoding := header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return false
+	}
+	return m.shouldRender(header) && m.rendersStatus(code) ||
+		m.RedirectBehavior == "follow" && code >= 300 && code < 400 && header.Get("Location") != ""
+}
+
+// Statuses of responses to conditional, or range requests, they're never rendered. The upstream evaluates the
+// conditions against its own representation, the rendered page has no validators (Etag, and Last-Modified are stripped)
+// and isn't served by ranges (Accept-Ranges is stripped), so a client can only have them from a response passed
+// through, and the upstream's decision applies to it.
+var conditionalStatuses = map[int]bool{
+	http.StatusPartialContent:     true,
+	http.StatusNotModified:        true,
+	http.StatusPreconditionFailed: true,
+}
+
+// rendersStatus reports whether a response with the status code is rendered.
+func (m *Middleware) rendersStatus(code int) bool {
+	if conditionalStatuses[code] {
+		return false
+	}
+	if len(m.RenderStatuses) == 0 {
+		return true
+	}
+	for _, status := range m.RenderStatuses {
+		if caddyhttp.StatusCodeMatches(code, status) {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldRender reports whether a response with the headers is rendered, based on its MIME type.
+func (m *Middleware) shouldRender(header http.Header) bool {
+	if len(m.MIMETypes) == 0 {
 		return true
-	default:
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
 		return false
 	}
+	for _, mimeType := range m.MIMETypes {
+		if mediaType == mimeType {
+			return true
+		}
+	}
+	return false
+}
+
+// writeDocument writes a document response un-rendered, either the buffered upstream response, or one requested when
+// following redirects.
+func (m *Middleware) writeDocument(w http.ResponseWriter, recorder caddyhttp.ResponseRecorder, document response) error {
+	if document == recorder {
+		return recorder.WriteResponse()
+	}
+	for name := range w.Header() {
+		w.Header().Del(name)
+	}
+	for name, values := range document.Header() {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(document.Status())
+	_, err := document.Buffer().WriteTo(w)
+	return err
+}
+
+// requestScheme returns the scheme the client used, X-Forwarded-Proto is respected only if the request comes from
+// a trusted proxy.
+func (m *Middleware) requestScheme(r *http.Request) string {
+	if m.ForceScheme != "" {
+		return m.ForceScheme
+	}
+	if trusted, _ := caddyhttp.GetVar(r.Context(), caddyhttp.TrustedProxyVarKey).(bool); trusted {
+		proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+		switch proto = strings.ToLower(strings.TrimSpace(proto)); proto {
+		case "http", "https":
+			return proto
+		}
+	}
+	if r.TLS == nil {
+		return "http"
+	}
+	return "https"
+}
+
+// serverTiming returns the Server-Timing header entry of the render, so that it shows in the browser's devtools.
+func serverTiming(duration time.Duration) string {
+	return "chrome-render;dur=" + timingMilliseconds(duration)
+}
+
+// renderTimeout returns the timeout for rendering, resolving placeholders from the request if the configured timeout
+// contains any, at most the max timeout, the default one if the resolved value isn't a valid timeout.
+func (m *Middleware) renderTimeout(r *http.Request) time.Duration {
+	if m.timeoutTemplate == "" {
+		return m.timeout
+	}
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	value := repl.ReplaceAll(m.timeoutTemplate, "")
+	timeout, err := time.ParseDuration(value)
+	if err == nil && timeout <= 0 {
+		err = errors.New("timeout must be positive")
+	}
+	if err != nil {
+		m.log.Warn("invalid timeout, using default", zap.String("timeout", m.timeoutTemplate), zap.String("value", value),
+			zap.Duration("default", m.timeout), zap.Error(err))
+		return m.timeout
+	}
+	return min(timeout, m.maxTimeout)
+}
+
+func (m *Middleware) serveStatus(w http.ResponseWriter, r *http.Request) error {
+	status := m.BrowserStatus(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status.Connected {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return json.NewEncoder(w).Encode(status)
 }
 
 var (
@@ -1,15 +1,630 @@
 package caddy_chrome
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"github.com/alecthomas/assert/v2"
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddytest"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+// skipWithoutChrome skips the test if there's no browser chromedp would be able to find.
+func skipWithoutChrome(tb testing.TB) {
+	for _, name := range []string{"headless_shell", "headless-shell", "chromium", "chromium-browser", "google-chrome", "google-chrome-stable"} {
+		if _, err := exec.LookPath(name); err == nil {
+			return
+		}
+	}
+	tb.Skip("Chrome not found")
+}
+
+func TestMiddleware_requestScheme(t *testing.T) {
+	withVars := func(r *http.Request, trusted bool) *http.Request {
+		vars := map[string]any{caddyhttp.TrustedProxyVarKey: trusted}
+		return r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, vars))
+	}
+
+	m := &Middleware{}
+	assert.Equal(t, "http", m.requestScheme(withVars(httptest.NewRequest("GET", "http://localhost/", nil), false)))
+	assert.Equal(t, "https", m.requestScheme(withVars(httptest.NewRequest("GET", "https://localhost/", nil), false)))
+
+	forwarded := httptest.NewRequest("GET", "http://localhost/", nil)
+	forwarded.Header.Set("X-Forwarded-Proto", "HTTPS, http")
+	assert.Equal(t, "http", m.requestScheme(withVars(forwarded, false)))
+	assert.Equal(t, "https", m.requestScheme(withVars(forwarded, true)))
+	forwarded.Header.Set("X-Forwarded-Proto", "ftp")
+	assert.Equal(t, "http", m.requestScheme(withVars(forwarded, true)))
+
+	m.ForceScheme = "https"
+	assert.Equal(t, "https", m.requestScheme(withVars(httptest.NewRequest("GET", "http://localhost/", nil), false)))
+}
+
+func TestServerTiming(t *testing.T) {
+	assert.Equal(t, "chrome-render;dur=1234.567", serverTiming(1234567*time.Microsecond))
+	assert.Equal(t, "chrome-render;dur=0", serverTiming(0))
+}
+
+func TestMiddleware_shouldBuffer(t *testing.T) {
+	header := func(pairs ...string) http.Header {
+		h := make(http.Header)
+		for i := 0; i < len(pairs); i += 2 {
+			h.Set(pairs[i], pairs[i+1])
+		}
+		return h
+	}
+	m := &Middleware{MIMETypes: []string{"text/html"}, RedirectBehavior: "follow"}
+	assert.True(t, m.shouldBuffer(http.StatusOK, header("Content-Type", "text/html; charset=utf-8")))
+	assert.True(t, m.shouldBuffer(http.StatusOK, header("Content-Type", "text/html", "Content-Encoding", "identity")))
+	assert.False(t, m.shouldBuffer(http.StatusOK, header("Content-Type", "text/html", "Content-Encoding", "gzip")))
+	assert.False(t, m.shouldBuffer(http.StatusOK, header("Content-Type", "image/png")))
+	assert.True(t, m.shouldBuffer(http.StatusFound, header("Location", "/")))
+	assert.False(t, m.shouldBuffer(http.StatusFound, header("Location", "/", "Content-Encoding", "br")))
+
+	m.RenderStatuses = []int{2, http.StatusNotFound}
+	assert.True(t, m.shouldBuffer(http.StatusCreated, header("Content-Type", "text/html")))
+	assert.True(t, m.shouldBuffer(http.StatusNotFound, header("Content-Type", "text/html")))
+	assert.False(t, m.shouldBuffer(http.StatusInternalServerError, header("Content-Type", "text/html")))
+	assert.True(t, m.shouldBuffer(http.StatusFound, header("Location", "/")))
+
+	// responses to conditional, and range requests are passed through
+	assert.False(t, m.shouldBuffer(http.StatusPartialContent, header("Content-Type", "text/html", "Content-Range", "bytes 0-9/100")))
+	assert.False(t, m.shouldBuffer(http.StatusNotModified, header("Content-Type", "text/html")))
+	assert.False(t, m.shouldBuffer(http.StatusPreconditionFailed, header("Content-Type", "text/html")))
+}
+
+func TestWriteSnapshot(t *testing.T) {
+	root := document(element("html", nil, element("body", nil, text("Hello"))))
+	rendered := &rendering{serializer: newDomSerializer(root)}
+	defer rendered.release()
+	w := httptest.NewRecorder()
+	w.Header().Set("Link", "</app.js>; rel=preload")
+
+	assert.NoError(t, writeSnapshot(w, rendered))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	assert.Zero(t, w.Header().Get("Link"))
+	var snapshot cdp.Node
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &snapshot))
+	assert.Equal(t, "#document", snapshot.NodeName)
+	assert.Equal(t, "Hello", snapshot.Children[0].Children[0].Children[0].NodeValue)
+
+	w = httptest.NewRecorder()
+	assert.NoError(t, writeSnapshot(w, &rendering{}))
+	assert.Equal(t, "null\n", w.Body.String())
+}
+
+func TestMiddleware_writeRendering_NothingToSerialize(t *testing.T) {
+	for _, testCase := range []struct {
+		name      string
+		rendering *rendering
+	}{
+		{name: "nil serializer", rendering: &rendering{links: NewLinkHints(nil)}},
+		{name: "nil root", rendering: &rendering{links: NewLinkHints(nil), serializer: newDomSerializer(nil)}},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			defer testCase.rendering.release()
+			m := &Middleware{log: zap.NewNop(), Links: true}
+			w := httptest.NewRecorder()
+			var buf bytes.Buffer
+			recorder := caddyhttp.NewResponseRecorder(w, &buf, func(int, http.Header) bool { return true })
+			recorder.Header().Set("Content-Type", "text/html")
+			recorder.WriteHeader(http.StatusCreated)
+			_, err := recorder.Write([]byte("<p>upstream</p>"))
+			assert.NoError(t, err)
+			testCase.rendering.document = recorder
+
+			assert.NoError(t, m.writeRendering(w, httptest.NewRequest(http.MethodGet, "/", nil), recorder, testCase.rendering, ""))
+			assert.Equal(t, http.StatusCreated, w.Code)
+			assert.Equal(t, "text/html", w.Header().Get("Content-Type"))
+			assert.Equal(t, "<p>upstream</p>", w.Body.String())
+		})
+	}
+}
+
+func TestMiddleware_writeRendering_Vary(t *testing.T) {
+	for _, testCase := range []struct {
+		name     string
+		m        *Middleware
+		upstream string
+		cookie   string
+		header   http.Header
+		expected string
+	}{
+		{name: "none", m: &Middleware{}},
+		{name: "upstream", m: &Middleware{}, upstream: "Accept-Language", expected: "Accept-Language"},
+		{name: "bots", m: &Middleware{Bots: &Bots{}}, upstream: "Accept-Language", expected: "Accept-Language, User-Agent"},
+		{name: "cookies", m: &Middleware{}, cookie: "session=1", expected: "Cookie"},
+		{name: "render_if_cookie", m: &Middleware{RenderIfCookie: &RenderIfCookie{Name: "render"}, Bots: &Bots{}}, upstream: "cookie", expected: "Cookie, User-Agent"},
+		{name: "any", m: &Middleware{Bots: &Bots{}}, upstream: "*", expected: "*"},
+		{name: "page_context", m: &Middleware{PageContext: map[string]string{"locale": "{http.request.header.Accept-Language}", "ip": "{http.request.remote.host}"}}, upstream: "accept-language", expected: "Accept-Language"},
+		{name: "forward_headers default", m: &Middleware{}, header: http.Header{"Accept-Language": {"cs"}}, expected: "Accept-Language"},
+		{name: "forward_headers", m: &Middleware{ForwardHeaders: []string{"Accept-Language", "X-Tenant"}}, header: http.Header{"X-Tenant": {"a"}}, expected: "X-Tenant"},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.m.log = zap.NewNop()
+			upstream := &responseWriter{status: http.StatusOK, header: http.Header{"Content-Type": {"text/html"}}}
+			if testCase.upstream != "" {
+				upstream.header.Set("Vary", testCase.upstream)
+			}
+			rendered := &rendering{
+				document:   upstream,
+				links:      NewLinkHints(nil),
+				serializer: newDomSerializer(document(element("p", nil, text("rendered")))),
+			}
+			defer rendered.release()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if testCase.cookie != "" {
+				r.Header.Set("Cookie", testCase.cookie)
+			}
+			for name, values := range testCase.header {
+				r.Header[name] = values
+			}
+			w := httptest.NewRecorder()
+
+			assert.NoError(t, testCase.m.writeRendering(w, r, nil, rendered, ""))
+			assert.Equal(t, testCase.expected, w.Header().Get("Vary"))
+		})
+	}
+}
+
+func TestMiddleware_ServeHTTP_Cookies(t *testing.T) {
+	h := newTestHarness(t, &Middleware{}, nil)
+
+	w := h.get("http://localhost/cookie.html", http.Header{"Cookie": {"test=cookie"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `document.cookie is [test=cookie]`)
+
+	// the test server listens on non-standard ports, cookies must apply to the page regardless
+	for _, url := range []string{"http://localhost:9080/cookie.html", "http://127.0.0.1:9080/cookie.html", "http://app.example.com:9443/cookie.html"} {
+		w = h.get(url, http.Header{"Cookie": {"test=cookie"}})
+		assert.Contains(t, w.Body.String(), `document.cookie is [test=cookie]`, url)
+	}
+}
+
+func TestMiddleware_ServeHTTP_Headers(t *testing.T) {
+	h := newTestHarness(t, &Middleware{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("X-Upstream", "kept")
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = io.WriteString(w, `<script>document.write("rendered")</script>`)
+	}))
+
+	w := h.get("http://localhost/", nil)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "max-age=60", w.Header().Get("Cache-Control"))
+	assert.Equal(t, "kept", w.Header().Get("X-Upstream"))
+	assert.Zero(t, w.Header().Get("Last-Modified"))
+	assert.Contains(t, w.Body.String(), `rendered`)
+}
+
+func TestMiddleware_ServeHTTP_PageContext(t *testing.T) {
+	h := newTestHarness(t, &Middleware{
+		PageContext: map[string]string{"locale": "{http.request.header.Accept-Language}", "bucket": "b"},
+		OnNewDocumentScript: &Script{
+			Inline: `window.APP_LOCALE = window.CaddyChrome.context.locale`,
+		},
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = io.WriteString(w, `<script>document.write(window.APP_LOCALE + " " + window.CaddyChrome.context.bucket)</script>`)
+	}))
+
+	w := h.get("http://localhost/", http.Header{"Accept-Language": {"cs-CZ"}})
+	assert.Contains(t, w.Body.String(), `cs-CZ b`)
+	assert.Equal(t, "Accept-Language", w.Header().Get("Vary"))
+}
+
+func TestMiddleware_ServeHTTP_InjectScripts(t *testing.T) {
+	dir := t.TempDir()
+	for name, source := range map[string]string{
+		"match_media.js": `window.matchMedia = () => ({matches: true, addEventListener() {}})`,
+		"flags.js":       `window.FLAGS = {dark: window.matchMedia("(prefers-color-scheme: dark)").matches}`,
+	} {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(source), 0o644))
+	}
+	h := newTestHarness(t, &Middleware{
+		InjectScripts: []string{filepath.Join(dir, "match_media.js"), filepath.Join(dir, "flags.js")},
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = io.WriteString(w, `<script>document.write("dark " + window.FLAGS.dark)</script>`)
+	}))
+
+	w := h.get("http://localhost/", nil)
+	assert.Contains(t, w.Body.String(), `dark true`)
+}
+
+func TestMiddleware_ServeHTTP_BrowserLost(t *testing.T) {
+	if os.Getenv(remoteBrowserEnv) != "" {
+		t.Skip("the remote browser can't be killed")
+	}
+	m := &Middleware{}
+	var killed atomic.Bool
+	h := newTestHarness(t, m, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api" {
+			// the connection to the browser drops in the middle of the first render
+			if killed.CompareAndSwap(false, true) {
+				b := m.browsers[0]
+				b.mu.Lock()
+				chromeCtx := b.chromeCtx
+				b.mu.Unlock()
+				assert.NoError(t, chromedp.FromContext(chromeCtx).Browser.Process().Kill())
+				<-chromeCtx.Done()
+			}
+			_, _ = io.WriteString(w, "api")
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = io.WriteString(w, `<p id="api"></p><script>
+			const event = new Event("pending-task");
+			event.complete = fetch("/api").then((res) => res.text()).then((text) => {
+				document.getElementById("api").textContent = text;
+			});
+			document.dispatchEvent(event);
+		</script>`)
+	}))
+
+	w := h.get("http://localhost/", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `<p id="api">api</p>`)
+	assert.True(t, killed.Load())
+	assert.Equal(t, 1, m.BrowserStatus(context.Background()).Restarts)
+}
+
+func TestMiddleware_ServeHTTP_Viewport(t *testing.T) {
+	h := newTestHarness(t, &Middleware{Viewport: &Viewport{
+		Width:             390,
+		Height:            844,
+		DeviceScaleFactor: 3,
+		Mobile:            true,
+		UserAgent:         "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X)",
+	}}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = io.WriteString(w, `<meta name="viewport" content="width=device-width">
+			<script>document.write([innerWidth, devicePixelRatio, "ontouchstart" in window, navigator.userAgent].join(" "))</script>`)
+	}))
+
+	w := h.get("http://localhost/", http.Header{"User-Agent": {"Mozilla/5.0 (X11; Linux x86_64)"}})
+	assert.Contains(t, w.Body.String(), `390 3 true Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X)`)
+}
+
+func TestMiddleware_ServeHTTP_Cache(t *testing.T) {
+	var requests atomic.Int64
+	h := newTestHarness(t, &Middleware{Cache: &Cache{TTL: "1m"}, ServerTiming: true}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = io.WriteString(w, `<script>document.write("rendered")</script>`)
+	}))
+
+	w := h.get("http://localhost/", nil)
+	assert.Contains(t, w.Body.String(), `rendered`)
+	assert.Zero(t, w.Header().Get("Age"))
+	assert.NotZero(t, w.Header().Get("Server-Timing"))
+	assert.Equal(t, int64(1), requests.Load())
+
+	// timings of the render aren't replayed with the cached page
+	w = h.get("http://localhost/", nil)
+	assert.Contains(t, w.Body.String(), `rendered`)
+	assert.Equal(t, "0", w.Header().Get("Age"))
+	assert.Zero(t, w.Header().Get("Server-Timing"))
+	assert.Equal(t, int64(1), requests.Load())
+
+	// a request with cookies gets its own render
+	w = h.get("http://localhost/", http.Header{"Cookie": {"session=1"}})
+	assert.Zero(t, w.Header().Get("Age"))
+	assert.Equal(t, int64(2), requests.Load())
+}
+
+func TestMiddleware_ServeHTTP_CacheRevalidate(t *testing.T) {
+	var rendered, notModified atomic.Int64
+	h := newTestHarness(t, &Middleware{Cache: &Cache{TTL: "1m"}}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		rendered.Add(1)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "max-age=1")
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = io.WriteString(w, `<script>document.write("rendered v1")</script>`)
+	}))
+
+	w := h.get("http://localhost/", nil)
+	assert.Contains(t, w.Body.String(), `rendered v1`)
+	assert.Zero(t, w.Header().Get("Etag"))
+	assert.Equal(t, int64(1), rendered.Load())
+
+	// the stale page hasn't changed, the upstream responds 304, and the cached page is served
+	time.Sleep(1100 * time.Millisecond)
+	w = h.get("http://localhost/", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `rendered v1`)
+	assert.Equal(t, "0", w.Header().Get("Age"))
+	assert.Equal(t, int64(1), rendered.Load())
+	assert.Equal(t, int64(1), notModified.Load())
+
+	// it's fresh again
+	w = h.get("http://localhost/", nil)
+	assert.Contains(t, w.Body.String(), `rendered v1`)
+	assert.Equal(t, int64(1), notModified.Load())
+}
+
+func TestMiddleware_ServeHTTP_CacheRevalidateChanged(t *testing.T) {
+	var version atomic.Int64
+	version.Store(1)
+	var requests atomic.Int64
+	h := newTestHarness(t, &Middleware{Cache: &Cache{TTL: "1m"}}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := `"v` + strconv.FormatInt(version.Load(), 10) + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		requests.Add(1)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "max-age=1")
+		w.Header().Set("ETag", etag)
+		_, _ = io.WriteString(w, `<script>document.write("rendered " + `+etag+`)</script>`)
+	}))
+
+	w := h.get("http://localhost/", nil)
+	assert.Contains(t, w.Body.String(), `rendered v1`)
+
+	// the page has changed since, it's rendered again
+	version.Store(2)
+	time.Sleep(1100 * time.Millisecond)
+	w = h.get("http://localhost/", nil)
+	assert.Contains(t, w.Body.String(), `rendered v2`)
+	assert.Zero(t, w.Header().Get("Age"))
+	assert.Equal(t, int64(2), requests.Load())
+
+	w = h.get("http://localhost/", nil)
+	assert.Contains(t, w.Body.String(), `rendered v2`)
+	assert.Equal(t, "0", w.Header().Get("Age"))
+	assert.Equal(t, int64(2), requests.Load())
+}
+
+func TestMiddleware_ServeHTTP_CacheCSPNonce(t *testing.T) {
+	var requests atomic.Int64
+	h := newTestHarness(t, &Middleware{Cache: &Cache{TTL: "1m"}, CSPNonce: &CSPNonce{}}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = io.WriteString(w, `<script>document.write("rendered")</script>`)
+	}))
+
+	// every response gets its own nonce, so it isn't cached
+	first := h.get("http://localhost/", nil).Header().Get("Content-Security-Policy")
+	second := h.get("http://localhost/", nil).Header().Get("Content-Security-Policy")
+	assert.Equal(t, int64(2), requests.Load())
+	assert.Contains(t, first, "'nonce-")
+	assert.NotEqual(t, first, second)
+}
+
+func TestMiddleware_ServeHTTP_ForwardHeaders(t *testing.T) {
+	h := newTestHarness(t, &Middleware{ForwardHeaders: []string{"Accept-Language", "X-Tenant"}}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api" {
+			_, _ = io.WriteString(w, r.Header.Get("X-Tenant")+" "+r.Header.Get("Authorization"))
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = io.WriteString(w, `<p id="api"></p><script>
+			const event = new Event("pending-task");
+			event.complete = fetch("/api").then((res) => res.text()).then((text) => {
+				document.getElementById("api").textContent = text + " " + navigator.language;
+			});
+			document.dispatchEvent(event);
+		</script>`)
+	}))
+
+	w := h.get("http://localhost/", http.Header{"X-Tenant": {"acme"}, "Accept-Language": {"cs-CZ"}, "Authorization": {"Bearer secret"}})
+	assert.Contains(t, w.Body.String(), `<p id="api">acme  cs-CZ</p>`)
+	assert.Equal(t, "Accept-Language, X-Tenant", w.Header().Get("Vary"))
+}
+
+func TestMiddleware_ServeHTTP_PageStatus(t *testing.T) {
+	h := newTestHarness(t, &Middleware{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		switch r.URL.Path {
+		case "/missing":
+			_, _ = io.WriteString(w, `<head></head><script>
+				const meta = document.createElement("meta");
+				meta.name = "prerender-status-code";
+				meta.content = "404";
+				document.head.appendChild(meta);
+				document.write("not found");
+			</script>`)
+		case "/moved":
+			_, _ = io.WriteString(w, `<head><meta name="prerender-status-code" content="301"><meta name="prerender-header" content="Location: /new"></head>`)
+		case "/navigate":
+			_, _ = io.WriteString(w, `<script>location.href = "/login"</script>`)
+		default:
+			_, _ = io.WriteString(w, `login`)
+		}
+	}))
+
+	w := h.get("http://localhost/missing", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), `not found`)
+
+	w = h.get("http://localhost/moved", nil)
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	assert.Equal(t, "/new", w.Header().Get("Location"))
+	assert.Zero(t, w.Body.String())
+
+	w = h.get("http://localhost/navigate", nil)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "http://localhost/login", w.Header().Get("Location"))
+	assert.Zero(t, w.Body.String())
+
+	// Chrome requests the navigation URL normalized
+	w = h.get("http://LOCALHOST:80/a%7e", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `login`)
+}
+
+func TestMiddleware_ServeHTTP_FailOnException(t *testing.T) {
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = io.WriteString(w, `<p>upstream</p><script>document.write("rendered"); undefinedFunction()</script>`)
+	})
+
+	h := newTestHarness(t, &Middleware{DebugHeader: "X-Debug", DebugSecret: "secret"}, upstream)
+	w := h.get("http://localhost/", http.Header{"X-Debug": {"secret"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `rendered`)
+	assert.Equal(t, "ReferenceError: undefinedFunction is not defined", w.Header().Get(exceptionsHeader))
+
+	// without the debug header, or with a wrong secret, exceptions aren't exposed
+	w = h.get("http://localhost/", nil)
+	assert.Zero(t, w.Header().Get(exceptionsHeader))
+	w = h.get("http://localhost/", http.Header{"X-Debug": {"1"}})
+	assert.Zero(t, w.Header().Get(exceptionsHeader))
+
+	h = newTestHarness(t, &Middleware{FailOnException: "pass"}, upstream)
+	w = h.get("http://localhost/", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), `rendered`)
+
+	h = newTestHarness(t, &Middleware{FailOnException: "error"}, upstream)
+	_, err := h.serve(httptest.NewRequest(http.MethodGet, "http://localhost/", nil))
+	assert.IsError(t, err, ErrUncaughtException)
+	var handlerErr caddyhttp.HandlerError
+	assert.True(t, errors.As(err, &handlerErr))
+	assert.Equal(t, http.StatusBadGateway, handlerErr.StatusCode)
+}
+
+func TestMiddleware_ServeHTTP_Output(t *testing.T) {
+	for _, testCase := range []struct {
+		output      *Output
+		contentType string
+		magic       string
+	}{
+		{&Output{Format: "pdf"}, "application/pdf", "%PDF-"},
+		{&Output{Format: "pdf", FullPage: true}, "application/pdf", "%PDF-"},
+		{&Output{Format: "png", Width: 1200, Height: 630}, "image/png", "\x89PNG"},
+		{&Output{Format: "png", FullPage: true}, "image/png", "\x89PNG"},
+	} {
+		t.Run(testCase.output.Format, func(t *testing.T) {
+			h := newTestHarness(t, &Middleware{Output: testCase.output}, nil)
+
+			w := h.get("http://localhost/html.html", nil)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, testCase.contentType, w.Header().Get("Content-Type"))
+			assert.Equal(t, strconv.Itoa(w.Body.Len()), w.Header().Get("Content-Length"))
+			assert.True(t, strings.HasPrefix(w.Body.String(), testCase.magic))
+
+			// other MIME types are still passed through
+			w = h.get("http://localhost/javascript_external.js", nil)
+			assert.NotEqual(t, testCase.contentType, w.Header().Get("Content-Type"))
+		})
+	}
+}
+
+func TestMiddleware_ServeHTTP_Conditional(t *testing.T) {
+	h := newTestHarness(t, &Middleware{}, nil)
+
+	w := h.get("http://localhost/html.html", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Zero(t, w.Header().Get("Etag"))
+	assert.Zero(t, w.Header().Get("Last-Modified"))
+	assert.Zero(t, w.Header().Get("Accept-Ranges"))
+
+	w = h.get("http://localhost/html.html", http.Header{"If-Modified-Since": {time.Now().UTC().Format(http.TimeFormat)}})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	w = h.get("http://localhost/html.html", http.Header{"Range": {"bytes=0-9"}})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, 10, w.Body.Len())
+
+	w = h.get("http://localhost/html.html", http.Header{"If-Unmodified-Since": {"Mon, 02 Jan 2006 15:04:05 GMT"}})
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+}
+
+func TestMiddleware_writeHints(t *testing.T) {
+	m := &Middleware{Mode: "hints_only", ServerTiming: true, log: zap.NewNop()}
+	links := NewLinkHints(nil)
+	links.Add("http://localhost/app.js", network.ResourceTypeScript)
+
+	// the buffered upstream response
+	w := httptest.NewRecorder()
+	buf := new(bytes.Buffer)
+	recorder := caddyhttp.NewResponseRecorder(w, buf, func(status int, header http.Header) bool { return true })
+	recorder.Header().Set("Content-Type", "text/html")
+	recorder.WriteHeader(http.StatusOK)
+	_, _ = recorder.Write([]byte(`<script src="/app.js"></script>`))
+	assert.NoError(t, m.writeHints(w, recorder, &rendering{document: recorder, links: links, duration: time.Millisecond}))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `<script src="/app.js"></script>`, w.Body.String())
+	assert.Equal(t, "<http://localhost/app.js>; rel=preload; as=script", w.Header().Get("Link"))
+	assert.Equal(t, "chrome-render;dur=1", w.Header().Get("Server-Timing"))
+
+	// a document requested when following redirects
+	document := &responseWriter{status: http.StatusCreated, header: http.Header{"Content-Type": {"text/html"}}}
+	_, _ = document.Write([]byte(`<script src="/app.js"></script>`))
+	w = httptest.NewRecorder()
+	assert.NoError(t, m.writeHints(w, recorder, &rendering{document: document, links: links}))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, `<script src="/app.js"></script>`, w.Body.String())
+	assert.Equal(t, "<http://localhost/app.js>; rel=preload; as=script", w.Header().Get("Link"))
+	assert.Zero(t, document.Header().Get("Link"))
+}
+
+func TestMiddleware_ServeHTTP_HintsOnly(t *testing.T) {
+	h := newTestHarness(t, &Middleware{Mode: "hints_only"}, nil)
+
+	w := h.get("http://localhost/links.html", nil)
+	expected, err := os.ReadFile(filepath.Join("testdata", "links.html"))
+	assert.NoError(t, err)
+	assert.Equal(t, string(expected), w.Body.String())
+	assert.Contains(t, strings.Join(w.Header().Values("Link"), ", "), "<http://localhost/links.js>; rel=preload; as=script")
+}
+
+func TestMiddleware_ServeHTTP_Links(t *testing.T) {
+	h := newTestHarness(t, &Middleware{Links: true}, nil)
+
+	w := h.get("http://localhost/links.html", nil)
+	links := w.Header().Values("Link")
+	slices.Sort(links)
+	assert.Equal(t, []string{
+		"<http://localhost/links.css>; rel=preload; as=style",
+		"<http://localhost/links.jpg>; rel=preload; as=image",
+		"<http://localhost/links.js>; rel=preload; as=script",
+		"<https://www.googletagmanager.com>; rel=preconnect",
+	}, links)
+}
+
+func TestMiddleware_ServeHTTP_LinksModules(t *testing.T) {
+	h := newTestHarness(t, &Middleware{Links: true}, nil)
+
+	w := h.get("http://localhost/javascript_module_import.html", nil)
+	assert.Contains(t, w.Body.String(), `Hello from Javascript module`)
+	assert.Equal(t, []string{
+		"<http://localhost/links.js>; rel=preload; as=script",
+		"<http://localhost/javascript_module_import.js>; rel=modulepreload",
+		"<http://localhost/javascript_module.js>; rel=modulepreload",
+	}, w.Header().Values("Link"))
+}
+
 func TestMiddleware_ServeHTTP(t *testing.T) {
 	caddytest.Default.LoadRequestTimeout = 30 * time.Second
 	tester := caddytest.NewTester(t)
@@ -30,8 +645,69 @@ func TestMiddleware_ServeHTTP(t *testing.T) {
 				respond {http.request.body}
 			}
 
+			respond /referer.json "Referer is {http.request.header.Referer}"
+			respond /no_content.json 204
+
+			header /empty.html Content-Type text/html
+			respond /empty.html 200
+
+			header /status.html Content-Type text/html
+			respond /status.html "<h1>Custom status</h1><script>document.body.append('ren' + 'dered')</script>" 599
+
 			chrome {
 				links
+				server_timing
+				status_path /_chrome/status
+				post_render_script file ./testdata/post_render.js
+				bots {
+					strip_scripts
+				}
+			}
+			root ./testdata
+			file_server
+		}
+		http://localhost:9081 {
+			chrome {
+				fragment
+			}
+			root ./testdata
+			file_server
+		}
+		http://localhost:9082 {
+			chrome {
+				select "#app"
+			}
+			root ./testdata
+			file_server
+		}
+		http://localhost:9083 {
+			chrome {
+				critical_css
+				redirect_behavior follow
+				host_header localhost:9999
+				iframes
+				adopted_style_sheets
+				meta_refresh redirect
+				remove_selectors .cookie-banner "[data-dev-only]"
+				on_new_document_script "window.APP_CONFIG = {greeting: 'Hello from ' + 'on-new-document script'}"
+			}
+			header /redirect.html Location /html.html
+			respond /redirect.html 302
+			respond /host.json "Host is {http.request.hostport}"
+			root ./testdata
+			file_server
+		}
+		http://localhost:9084 {
+			chrome {
+				wait_for attribute data-ssr-ready
+				wait_for fonts
+			}
+			root ./testdata
+			file_server
+		}
+		http://localhost:9085 {
+			chrome {
+				shadow_dom flatten
 			}
 			root ./testdata
 			file_server
@@ -39,6 +715,7 @@ func TestMiddleware_ServeHTTP(t *testing.T) {
 
 	for _, testCase := range []struct {
 		url              string
+		status           int
 		verifier         func(*testing.T, *http.Response, string)
 		configureRequest func(*http.Request) error
 	}{
@@ -47,6 +724,13 @@ func TestMiddleware_ServeHTTP(t *testing.T) {
 			verifier: func(t *testing.T, res *http.Response, body string) {
 				assert.Contains(t, body, `<html>`)
 				assert.Contains(t, body, `<h1>Hello from HTML</h1>`)
+				// phases of the render, then the whole render
+				timing := res.Header.Get("Server-Timing")
+				assert.True(t, strings.HasPrefix(timing, "nav;dur="))
+				assert.Contains(t, timing, ", wait;dur=")
+				assert.Contains(t, timing, ", dom;dur=")
+				assert.Contains(t, timing, ", serialize;dur=")
+				assert.Contains(t, timing, ", chrome-render;dur=")
 			},
 		},
 		{
@@ -56,12 +740,32 @@ func TestMiddleware_ServeHTTP(t *testing.T) {
 				assert.Contains(t, body, `<h1>Hello from HTML</h1>`)
 			},
 		},
+		{
+			url: "http://localhost:9080/doctype_quirks.html",
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.True(t, strings.HasPrefix(body, `<html>`))
+				assert.Contains(t, body, `<p>Hello from quirks mode</p>`)
+			},
+		},
+		{
+			url: "http://localhost:9080/doctype_legacy.html",
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.True(t, strings.HasPrefix(body, `<!DOCTYPE html PUBLIC "-//W3C//DTD HTML 4.01 Transitional//EN" "http://www.w3.org/TR/html4/loose.dtd"><html>`))
+				assert.Contains(t, body, `<p>Hello from limited-quirks mode</p>`)
+			},
+		},
 		{
 			url: "http://localhost:9080/html_class.html",
 			verifier: func(t *testing.T, res *http.Response, body string) {
 				assert.Contains(t, body, `<html class="test">`)
 			},
 		},
+		{
+			url: "http://localhost:9080/html_attributes.html",
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.Contains(t, body, `<html class="test" lang="cs" dir="ltr" data-theme="dark" data-n-head="%7B%22lang%22%3A%7B%221%22%3A%22cs%22%7D%7D" ng-version="17.0.0">`)
+			},
+		},
 		{
 			url: "http://localhost:9080/javascript_inline.html",
 			verifier: func(t *testing.T, res *http.Response, body string) {
@@ -107,6 +811,51 @@ func TestMiddleware_ServeHTTP(t *testing.T) {
 				assert.Contains(t, body, `<p>slot default</p>`)
 			},
 		},
+		{
+			url: "http://localhost:9083/adopted_style_sheets.html",
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.Contains(t, body, `<template shadowrootmode="closed"><p>Hello from styled component</p><style>p { color: red; }</style></template>`)
+			},
+		},
+		{
+			url: "http://localhost:9083/on_new_document.html",
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.Contains(t, body, `<p id="greeting">Hello from on-new-document script</p>`)
+			},
+		},
+		{
+			url: "http://localhost:9083/remove_selectors.html",
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.Contains(t, body, `<main><p>Content</p></main>`)
+				assert.NotContains(t, body, `<div class="cookie-banner">`)
+				assert.NotContains(t, body, `<div data-dev-only>`)
+				assert.NotContains(t, body, `Dev toolbar`)
+			},
+		},
+		{
+			url: "http://localhost:9085/slot.html",
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.NotContains(t, body, `<template shadowrootmode`)
+				assert.Contains(t, body, `<h1><span slot="title">Assigned title</span></h1>`)
+				assert.Contains(t, body, `<p>Assigned default</p>`)
+				assert.Contains(t, body, `<footer>Fallback footer</footer>`)
+			},
+		},
+		{
+			url: "http://localhost:9085/shadow_dom_flatten.html",
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.NotContains(t, body, `<template shadowrootmode`)
+				assert.Contains(t, body, `<outer-card><article><inner-title><h2><b slot="heading">Card heading</b></h2></inner-title>`+
+					`<div class="body">Card body</div></article></outer-card>`)
+			},
+		},
+		{
+			url: "http://localhost:9084/wait_for.html",
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.Contains(t, body, `<html data-ssr-ready>`)
+				assert.Contains(t, body, `<p id="content">Ready</p>`)
+			},
+		},
 		{
 			url: "http://localhost:9080/cookie.html",
 			configureRequest: func(req *http.Request) error {
@@ -118,6 +867,16 @@ func TestMiddleware_ServeHTTP(t *testing.T) {
 				assert.Contains(t, body, `document.cookie is [test=cookie]`)
 			},
 		},
+		{
+			url: "http://localhost:9081/cookie.html",
+			configureRequest: func(req *http.Request) error {
+				req.AddCookie(&http.Cookie{Name: "test", Value: "cookie"})
+				return nil
+			},
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.Contains(t, body, `document.cookie is [test=cookie]`)
+			},
+		},
 		{
 			url: "http://localhost:9080/user_agent.html",
 			configureRequest: func(req *http.Request) error {
@@ -136,6 +895,36 @@ func TestMiddleware_ServeHTTP(t *testing.T) {
 				assert.Contains(t, body, `Hello from fetch GET component!`)
 			},
 		},
+		{
+			url: "http://localhost:9080/referer.html",
+			configureRequest: func(req *http.Request) error {
+				req.Header.Set("Referer", "https://example.com/search?q=test")
+				return nil
+			},
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.Contains(t, body, `document.referrer is [https://example.com/search?q=test]`)
+				assert.Contains(t, body, `referer.json says [Referer is http://localhost:9080/referer.html]`)
+			},
+		},
+		{
+			url: "http://localhost:9083/host_header.html",
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.Contains(t, body, `host.json says [Host is localhost:9999]`)
+			},
+		},
+		{
+			url: "http://localhost:9080/no_content.html",
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.Contains(t, body, `no_content.json responded [204] with []`)
+			},
+		},
+		{
+			url: "http://localhost:9083/iframe.html",
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.Contains(t, body, `<iframe src="iframe_content.html" srcdoc="&lt;!DOCTYPE html&gt;&lt;html&gt;`)
+				assert.Contains(t, body, `&lt;p id=&#34;iframe-content&#34;&gt;Hello from iframe&lt;/p&gt;`)
+			},
+		},
 		{
 			url: "http://localhost:9080/fetch_post.html",
 			verifier: func(t *testing.T, res *http.Response, body string) {
@@ -143,6 +932,12 @@ func TestMiddleware_ServeHTTP(t *testing.T) {
 				assert.Contains(t, body, `Hello from fetch POST component!`)
 			},
 		},
+		{
+			url: "http://localhost:9080/links_not_found.html",
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.Equal(t, []string{"<http://localhost:9080/links.js>; rel=preload; as=script"}, res.Header.Values("Link"))
+			},
+		},
 		{
 			url: "http://localhost:9080/links.html",
 			verifier: func(t *testing.T, res *http.Response, body string) {
@@ -167,6 +962,15 @@ func TestMiddleware_ServeHTTP(t *testing.T) {
 				assert.Contains(t, body, `<div foo:bar="baz">`)
 			},
 		},
+		{
+			url: "http://localhost:9080/attribute_namespace_svg.html",
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.Contains(t, body, `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" style="display: none">`)
+				assert.Contains(t, body, `<symbol id="icon" viewBox="0 0 10 10"><circle cx="5" cy="5" r="4"></circle></symbol>`)
+				assert.Contains(t, body, `<svg class="static"><use xlink:href="#icon"></use></svg>`)
+				assert.Contains(t, body, `<svg class="dynamic"><use xlink:href="#icon"></use></svg>`)
+			},
+		},
 		{
 			url: "http://localhost:9080/attribute_boolean.html",
 			verifier: func(t *testing.T, res *http.Response, body string) {
@@ -212,12 +1016,121 @@ func TestMiddleware_ServeHTTP(t *testing.T) {
 				assert.Contains(t, body, `ul > li {`)
 			},
 		},
+		{
+			url: "http://localhost:9080/whitespace_pre.html",
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.Contains(t, body, "<pre>func main() {\n\tif  x  {\n\t\treturn   1\n\t}\n}\n\n   </pre>")
+				assert.Contains(t, body, "<textarea>  first line\n\n    indented &lt;line&gt;\n</textarea>")
+				// the parser drops the first newline, the second one is the text's
+				assert.Contains(t, body, "<pre id=\"leading-newline\">\n\nstarts with a newline</pre>")
+			},
+		},
+		{
+			url: "http://localhost:9080/table.html",
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.Contains(t, body, `<caption>Caption</caption>`)
+				assert.Contains(t, body, `<colgroup><col span="2" /></colgroup>`)
+				assert.Contains(t, body, `<tbody><tr><th>A</th><th>B</th></tr>`)
+				assert.Contains(t, body, `<tr><td>1</td><td>2</td></tr>`)
+				assert.True(t, strings.Index(body, `Loose text`) < strings.Index(body, `<table>`), "foster-parented text must be before table")
+			},
+		},
+		{
+			url: "http://localhost:9080/template.html",
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.Contains(t, body, `<template id="item"><li class="item"><span>Item</span></li></template>`)
+				assert.Contains(t, body, `<ul><li class="item"><span>Item</span></li></ul>`)
+			},
+		},
+		{
+			url: "http://localhost:9081/fragment.html",
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.True(t, strings.HasPrefix(body, `<div class="item" data-rendered>Item</div>`), body)
+				assert.NotContains(t, body, `<!DOCTYPE`)
+				assert.NotContains(t, body, `<body>`)
+			},
+		},
+		{
+			url: "http://localhost:9082/select.html",
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.Equal(t, `<main id="app"><h1>Hello from app</h1></main>`, body)
+			},
+		},
+		{
+			url: "http://localhost:9083/redirect.html",
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.Contains(t, body, `<h1>Hello from HTML</h1>`)
+			},
+		},
+		{
+			url: "http://localhost:9083/critical_css.html",
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.Contains(t, body, `.title {
+    color: red;
+}`)
+				assert.Contains(t, body, `@media (min-width: 1px){.title {
+        font-weight: bold;
+    }}`)
+				assert.NotContains(t, body, `.unused`)
+				assert.True(t, strings.Index(body, `</style></head>`) > 0, "critical CSS must be at the end of head")
+				assert.Contains(t, body, `<link rel="stylesheet" href="critical_css.css" /></body>`)
+			},
+		},
+		{
+			url: "http://localhost:9080/javascript_inline.html",
+			configureRequest: func(req *http.Request) error {
+				req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)")
+				return nil
+			},
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.Contains(t, body, `<h1>Hello from inline Javascript</h1>`)
+				assert.NotContains(t, body, `<script>`)
+				assert.Equal(t, "User-Agent", res.Header.Get("Vary"))
+			},
+		},
+		{
+			url:    "http://localhost:9083/meta_refresh.html",
+			status: http.StatusMovedPermanently,
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.Equal(t, "/html.html", res.Header.Get("Location"))
+				assert.Equal(t, "", body)
+			},
+		},
+		{
+			url:    "http://localhost:9080/status.html",
+			status: 599,
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.Contains(t, body, `<h1>Custom status</h1>`)
+				assert.Contains(t, body, `rendered`)
+			},
+		},
+		{
+			url: "http://localhost:9080/empty.html",
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.Equal(t, "", body)
+			},
+		},
 		{
 			url: "http://localhost:9080/comment.html",
 			verifier: func(t *testing.T, res *http.Response, body string) {
 				assert.Contains(t, body, `<!-- Hello from comment -->`)
 			},
 		},
+		{
+			url: "http://localhost:9080/post_render.html",
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.Contains(t, body, `<h1 data-post-render="">Hello after post-render script</h1>`)
+				assert.NotContains(t, body, `dev-banner`)
+			},
+		},
+		{
+			url: "http://localhost:9080/_chrome/status",
+			verifier: func(t *testing.T, res *http.Response, body string) {
+				assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+				assert.Contains(t, body, `"connected":true`)
+				assert.Contains(t, body, `"breaker":"closed"`)
+			},
+		},
 		{
 			url: "http://localhost:9080/pending_task.html",
 			verifier: func(t *testing.T, res *http.Response, body string) {
@@ -236,7 +1149,11 @@ func TestMiddleware_ServeHTTP(t *testing.T) {
 					t.Fatal(err)
 				}
 			}
-			res := tester.AssertResponseCode(req, 200)
+			status := testCase.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			res := tester.AssertResponseCode(req, status)
 			defer res.Body.Close()
 			bodyBytes, err := io.ReadAll(res.Body)
 			if err != nil {
@@ -246,3 +1163,213 @@ func TestMiddleware_ServeHTTP(t *testing.T) {
 		})
 	}
 }
+
+func BenchmarkMiddleware_ServeHTTP(b *testing.B) {
+	skipWithoutChrome(b)
+
+	caddytest.Default.LoadRequestTimeout = 30 * time.Second
+	tester := caddytest.NewTester(b)
+	tester.InitServer(`
+		{
+			skip_install_trust
+			admin localhost:2999
+			http_port 9080
+			https_port 9443
+		}
+		http://localhost:9080 {
+			chrome
+			root ./testdata
+			file_server
+		}
+		http://localhost:9081 {
+			chrome {
+				fragment
+			}
+			root ./testdata
+			file_server
+		}
+		http://localhost:9082 {
+			chrome {
+				select "#app"
+			}
+			root ./testdata
+			file_server
+		}
+		http://localhost:9083 {
+			chrome {
+				critical_css
+			}
+			root ./testdata
+			file_server
+		}`, "caddyfile")
+
+	for _, path := range []string{"/html.html", "/javascript_module.html", "/shadow_dom_nested.html"} {
+		b.Run(path, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				req, err := http.NewRequest("GET", "http://localhost:9080"+path, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				res := tester.AssertResponseCode(req, 200)
+				if _, err := io.Copy(io.Discard, res.Body); err != nil {
+					b.Fatal(err)
+				}
+				res.Body.Close()
+			}
+		})
+	}
+}
+
+func TestMiddleware_ServeHTTP_BypassQuery(t *testing.T) {
+	h := newTestHarness(t, &Middleware{BypassQuery: "__raw"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = io.WriteString(w, `<script>document.write("rendered `+r.URL.RawQuery+`")</script>`)
+	}))
+
+	w := h.get("http://localhost/?page=2", nil)
+	assert.Contains(t, w.Body.String(), `rendered page=2</body>`)
+
+	w = h.get("http://localhost/?page=2&__raw", nil)
+	assert.Equal(t, `<script>document.write("rendered page=2")</script>`, w.Body.String())
+}
+
+func TestMiddleware_ServeHTTP_XHTML(t *testing.T) {
+	h := newTestHarness(t, &Middleware{MIMETypes: []string{"application/xhtml+xml"}}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xhtml+xml; charset=utf-8")
+		_, _ = io.WriteString(w, `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>XHTML</title></head><body>`+
+			`<input type="checkbox" checked="checked" /><div id="app"></div>`+
+			`<script>document.getElementById("app").appendChild(document.createElement("span"))</script>`+
+			`</body></html>`)
+	}))
+
+	w := h.get("http://localhost/", nil)
+	assert.Equal(t, "application/xhtml+xml; charset=utf-8", w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	assert.NotContains(t, body, `<!DOCTYPE html>`)
+	assert.Contains(t, body, `<input type="checkbox" checked="checked" />`)
+	assert.Contains(t, body, `<div id="app"><span /></div>`)
+}
+
+func TestMiddleware_ServeHTTP_RewriteURLs(t *testing.T) {
+	h := newTestHarness(t, &Middleware{
+		BlockURLs:   &BlockURLs{Regexps: []string{`/blocked\.js$`}},
+		RewriteURLs: []*RewriteURL{{From: `/(old|blocked)\.js$`, To: "/new.js"}},
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/new.js":
+			w.Header().Set("Content-Type", "text/javascript")
+			_, _ = io.WriteString(w, `document.body.append("rewritten ")`)
+		case "/old.js", "/blocked.js":
+			w.Header().Set("Content-Type", "text/javascript")
+			_, _ = io.WriteString(w, `document.body.append("original ")`)
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = io.WriteString(w, `<body><script src="/old.js"></script><script src="/blocked.js"></script></body>`)
+		}
+	}))
+
+	w := h.get("http://localhost/", nil)
+	assert.Contains(t, w.Body.String(), `rewritten </body>`)
+	assert.NotContains(t, w.Body.String(), `original`)
+}
+
+func TestMiddleware_ServeHTTP_LocaleTimezone(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = io.WriteString(w, `<script>
+			const options = Intl.DateTimeFormat().resolvedOptions()
+			document.write([options.locale, options.timeZone, new Date(Date.UTC(2024, 0, 1)).getTimezoneOffset()].join(" "))
+		</script>`)
+	})
+
+	h := newTestHarness(t, &Middleware{Locale: "de-DE", Timezone: "Asia/Tokyo"}, handler)
+	w := h.get("http://localhost/", nil)
+	assert.Contains(t, w.Body.String(), "de-DE Asia/Tokyo -540")
+
+	h = newTestHarness(t, &Middleware{Locale: "from_request", Timezone: "UTC"}, handler)
+	w = h.get("http://localhost/", http.Header{"Accept-Language": {"cs-CZ,cs;q=0.9"}})
+	assert.Contains(t, w.Body.String(), "cs-CZ UTC 0")
+}
+
+func TestMiddleware_ServeHTTP_Post(t *testing.T) {
+	h := newTestHarness(t, &Middleware{RedirectBehavior: "follow"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/submit":
+			w.Header().Set("Location", "/result")
+			w.WriteHeader(http.StatusTemporaryRedirect)
+		case "/result":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = io.WriteString(w, `<p>`+r.Method+` `+string(body)+`</p>`)
+		}
+	}))
+
+	r := httptest.NewRequest(http.MethodPost, "http://localhost/result", strings.NewReader("name=caddy"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w, err := h.serve(r)
+	assert.NoError(t, err)
+	assert.Contains(t, w.Body.String(), `<p>POST name=caddy</p>`)
+
+	// the body is sent again to the redirect target
+	r = httptest.NewRequest(http.MethodPost, "http://localhost/submit", strings.NewReader("name=caddy"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w, err = h.serve(r)
+	assert.NoError(t, err)
+	assert.Contains(t, w.Body.String(), `<p>POST name=caddy</p>`)
+}
+
+func TestMiddleware_ServeHTTP_ServerTimingTimeout(t *testing.T) {
+	h := newTestHarness(t, &Middleware{ServerTiming: true, Timeout: "500ms", OnError: &OnError{}}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		// a pending task that never completes
+		_, _ = io.WriteString(w, `<script>
+			const event = new Event("pending-task", {bubbles: true});
+			event.complete = new Promise(() => {});
+			document.dispatchEvent(event);
+		</script>`)
+	}))
+
+	w := h.get("http://localhost/", nil)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	// the timeout fired while waiting for the pending task, phases until then are reported
+	timing := w.Header().Get("Server-Timing")
+	assert.True(t, strings.HasPrefix(timing, "nav;dur="))
+	assert.Contains(t, timing, ", wait;dur=")
+	assert.NotContains(t, timing, "dom;dur=")
+	assert.Contains(t, timing, ", chrome-render;dur=")
+}
+
+func TestMiddleware_ServeHTTP_ShadowDOMAuto(t *testing.T) {
+	h := newTestHarness(t, &Middleware{ShadowDOM: "auto"}, nil)
+
+	w := h.get("http://localhost/shadow_dom_flatten.html", http.Header{"User-Agent": {"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"}})
+	assert.Contains(t, w.Body.String(), `<outer-card><template shadowrootmode="open">`)
+	assert.Contains(t, w.Header().Get("Vary"), "User-Agent")
+
+	w = h.get("http://localhost/shadow_dom_flatten.html", http.Header{"User-Agent": {"Mozilla/5.0 (X11; Linux x86_64; rv:115.0) Gecko/20100101 Firefox/115.0"}})
+	assert.NotContains(t, w.Body.String(), `<template shadowrootmode`)
+	assert.Contains(t, w.Body.String(), `<outer-card><article><inner-title><h2><b slot="heading">Card heading</b></h2></inner-title>`)
+}
+
+func TestMiddleware_renderTimeout(t *testing.T) {
+	m := &Middleware{log: zap.NewNop(), timeoutTemplate: "{timeout}", timeout: 5 * time.Second, maxTimeout: 30 * time.Second}
+	for _, testCase := range []struct {
+		value    string
+		expected time.Duration
+	}{
+		{value: "20s", expected: 20 * time.Second},
+		{value: "1h", expected: 30 * time.Second},
+		{value: "soon", expected: 5 * time.Second},
+		{value: "-1s", expected: 5 * time.Second},
+		{value: "", expected: 5 * time.Second},
+	} {
+		t.Run(testCase.value, func(t *testing.T) {
+			repl := caddy.NewReplacer()
+			repl.Set("timeout", testCase.value)
+			r := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+			r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+			assert.Equal(t, testCase.expected, m.renderTimeout(r))
+		})
+	}
+}
@@ -1,13 +1,34 @@
 package caddy_chrome
 
 import (
+	"context"
 	"encoding/json"
 	"github.com/alecthomas/assert/v2"
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"regexp"
 	"testing"
 )
 
+func TestParseFlag(t *testing.T) {
+	for _, testCase := range []struct {
+		flag  string
+		name  string
+		value any
+	}{
+		{flag: "--headless", name: "headless", value: true},
+		{flag: "--headless=new", name: "headless", value: "new"},
+		{flag: `--js-flags="--max-old-space-size=512 --expose-gc"`, name: "js-flags", value: "--max-old-space-size=512 --expose-gc"},
+		{flag: "--js-flags=--max-old-space-size=512", name: "js-flags", value: "--max-old-space-size=512"},
+	} {
+		t.Run(testCase.flag, func(t *testing.T) {
+			name, value := parseFlag(testCase.flag)
+			assert.Equal(t, testCase.name, name)
+			assert.Equal(t, testCase.value, value)
+		})
+	}
+}
+
 func TestMiddleware_UnmarshalCaddyfile(t *testing.T) {
 	re := regexp.MustCompile(`\s+`)
 	for _, testCase := range []struct {
@@ -29,6 +50,33 @@ func TestMiddleware_UnmarshalCaddyfile(t *testing.T) {
 			}`,
 			json: `{"timeout":"10s"}`,
 		},
+		{
+			caddyfile: `chrome {
+				timeout {env.RENDER_TIMEOUT}
+			}`,
+			json: `{"timeout":"{env.RENDER_TIMEOUT}"}`,
+		},
+		{
+			caddyfile: `chrome {
+				timeout {http.vars.render_timeout} {
+					default 5s
+					max 30s
+				}
+			}`,
+			json: `{"timeout":"{http.vars.render_timeout}","timeout_default":"5s","max_timeout":"30s"}`,
+		},
+		{
+			caddyfile: `chrome {
+				render_statuses 2xx 404
+			}`,
+			json: `{"render_statuses":[2,404]}`,
+		},
+		{
+			caddyfile: `chrome {
+				max_total_time 10s
+			}`,
+			json: `{"max_total_time":"10s"}`,
+		},
 		{
 			caddyfile: `chrome {
 				mime_types text/html
@@ -77,6 +125,43 @@ func TestMiddleware_UnmarshalCaddyfile(t *testing.T) {
 			}`,
 			json: `{"exec_browser":{"default_flags":true,"flags":["--headless"]}}`,
 		},
+		{
+			caddyfile: `chrome {
+				exec --js-flags="--max-old-space-size=512 --expose-gc" --headless
+			}`,
+			json: `{"exec_browser":{"default_flags":true,"flags":["--js-flags=\"--max-old-space-size=512 --expose-gc\"","--headless"]}}`,
+		},
+		{
+			caddyfile: `chrome {
+				exec "--js-flags=--max-old-space-size=512 --expose-gc"
+			}`,
+			json: `{"exec_browser":{"default_flags":true,"flags":["--js-flags=--max-old-space-size=512 --expose-gc"]}}`,
+		},
+		{
+			caddyfile: `chrome {
+				exec /usr/bin/chrome --headless {
+					env TZ Europe/Prague
+					env LANG "en_US.UTF-8"
+				}
+			}`,
+			json: `{"exec_browser":{"path":"/usr/bin/chrome","default_flags":true,"flags":["--headless"],"env":{"LANG":"en_US.UTF-8","TZ":"Europe/Prague"}}}`,
+		},
+		{
+			caddyfile: `chrome {
+				exec {
+					user_data_dir /var/lib/caddy/chrome
+				}
+			}`,
+			json: `{"exec_browser":{"default_flags":true,"user_data_dir":"/var/lib/caddy/chrome"}}`,
+		},
+		{
+			caddyfile: `chrome {
+				exec {
+					temp_user_data_dir
+				}
+			}`,
+			json: `{"exec_browser":{"default_flags":true,"temp_user_data_dir":true}}`,
+		},
 		{
 			caddyfile: `chrome {
 				exec_no_default_flags /usr/bin/chrome
@@ -95,6 +180,36 @@ func TestMiddleware_UnmarshalCaddyfile(t *testing.T) {
 			}`,
 			json: `{"remote_browser":{"url":"http://localhost:9222/"}}`,
 		},
+		{
+			caddyfile: `chrome {
+				url unix:///run/chrome/devtools.sock
+			}`,
+			json: `{"remote_browser":{"url":"unix:///run/chrome/devtools.sock"}}`,
+		},
+		{
+			caddyfile: `chrome {
+				url http://localhost:9222/ {
+					keep_alive 30s
+				}
+			}`,
+			json: `{"remote_browser":{"url":"http://localhost:9222/","keep_alive":"30s"}}`,
+		},
+		{
+			caddyfile: `chrome {
+				url http://chrome-1:9222 http://chrome-2:9222 {
+					health_check 10s
+				}
+			}`,
+			json: `{"remote_browser":{"url":"http://chrome-1:9222","urls":["http://chrome-2:9222"],"health_check":"10s"}}`,
+		},
+		{
+			caddyfile: `chrome {
+				url http://chrome-1:9222 http://chrome-2:9222 {
+					max_concurrency 4
+				}
+			}`,
+			json: `{"remote_browser":{"url":"http://chrome-1:9222","urls":["http://chrome-2:9222"],"max_concurrency":4}}`,
+		},
 		{
 			caddyfile: `chrome {
 				fulfill_hosts localhost
@@ -125,6 +240,644 @@ func TestMiddleware_UnmarshalCaddyfile(t *testing.T) {
 			}`,
 			json: `{"links":true}`,
 		},
+		{
+			caddyfile: `chrome {
+				no_forced_doctype
+			}`,
+			json: `{"no_forced_doctype":true}`,
+		},
+		{
+			caddyfile: `chrome {
+				fragment
+			}`,
+			json: `{"fragment":true}`,
+		},
+		{
+			caddyfile: `chrome {
+				amp
+			}`,
+			json: `{"amp":true}`,
+		},
+		{
+			caddyfile: `chrome {
+				service_workers allow
+			}`,
+			json: `{"service_workers":"allow"}`,
+		},
+		{
+			caddyfile: `chrome {
+				browser_cache enable
+			}`,
+			json: `{"browser_cache":"enable"}`,
+		},
+		{
+			caddyfile: `chrome {
+				downloads default
+			}`,
+			json: `{"downloads":"default"}`,
+		},
+		{
+			caddyfile: `chrome {
+				device "iPhone 13"
+			}`,
+			json: `{"device":"iPhone 13"}`,
+		},
+		{
+			caddyfile: `chrome {
+				viewport {
+					width 390
+					height 844
+					device_scale_factor 3
+					mobile
+					user_agent "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X)"
+				}
+			}`,
+			json: `{"viewport":{"width":390,"height":844,"device_scale_factor":3,"mobile":true,"user_agent":"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X)"}}`,
+		},
+		{
+			caddyfile: `chrome {
+				proxy http://egress.internal:3128 {
+					credentials render {env.PROXY_PASSWORD}
+					bypass *.internal 10.0.0.0/8
+				}
+			}`,
+			json: `{"proxy":{"url":"http://egress.internal:3128","username":"render","password":"{env.PROXY_PASSWORD}","bypass":["*.internal","10.0.0.0/8"]}}`,
+		},
+		{
+			caddyfile: `chrome {
+				network_emulation slow-3g
+			}`,
+			json: `{"network_emulation":{"preset":"slow-3g"}}`,
+		},
+		{
+			caddyfile: `chrome {
+				network_emulation {
+					latency 150ms
+					download 1250000
+					upload 625000
+				}
+			}`,
+			json: `{"network_emulation":{"latency":"150ms","download":1250000,"upload":625000}}`,
+		},
+		{
+			caddyfile: `chrome {
+				block_urls *://cdn.example.com/ads/* {
+					regexp ^https?://[^/]+/track[?]
+					analytics
+				}
+			}`,
+			json: `{"block_urls":{"patterns":["*://cdn.example.com/ads/*"],"regexps":["^https?://[^/]+/track[?]"],"analytics":true}}`,
+		},
+		{
+			caddyfile: `chrome {
+				rewrite_url ^https://cdn[.]example[.]com/beacon[.]js$ /stubs/beacon.js
+				rewrite_url ^(https?://[^/]+)/v1/(.*)$ $1/v2/$2
+			}`,
+			json: `{"rewrite_urls":[{"from":"^https://cdn[.]example[.]com/beacon[.]js$","to":"/stubs/beacon.js"},{"from":"^(https?://[^/]+)/v1/(.*)$","to":"$1/v2/$2"}]}`,
+		},
+		{
+			caddyfile: `chrome {
+				max_requests 500
+			}`,
+			json: `{"max_requests":500}`,
+		},
+		{
+			caddyfile: `chrome {
+				max_nodes 100000
+			}`,
+			json: `{"max_nodes":100000}`,
+		},
+		{
+			caddyfile: `chrome {
+				max_upstream_errors 5
+			}`,
+			json: `{"max_upstream_errors":5}`,
+		},
+		{
+			caddyfile: `chrome {
+				output pdf
+			}`,
+			json: `{"output":{"format":"pdf"}}`,
+		},
+		{
+			caddyfile: `chrome {
+				output png {
+					viewport 1200 630
+					full_page
+				}
+			}`,
+			json: `{"output":{"format":"png","width":1200,"height":630,"full_page":true}}`,
+		},
+		{
+			caddyfile: `chrome {
+				fail_on_exception
+			}`,
+			json: `{"fail_on_exception":"error"}`,
+		},
+		{
+			caddyfile: `chrome {
+				fail_on_exception pass
+			}`,
+			json: `{"fail_on_exception":"pass"}`,
+		},
+		{
+			caddyfile: `chrome {
+				max_output_size 5MB
+			}`,
+			json: `{"max_output_size":{"size":5000000}}`,
+		},
+		{
+			caddyfile: `chrome {
+				max_output_size 1MiB truncate
+			}`,
+			json: `{"max_output_size":{"size":1048576,"truncate":true}}`,
+		},
+		{
+			caddyfile: `chrome {
+				validate_output
+			}`,
+			json: `{"validate_output":true}`,
+		},
+		{
+			caddyfile: `chrome {
+				mixed_content upgrade
+			}`,
+			json: `{"mixed_content":"upgrade"}`,
+		},
+		{
+			caddyfile: `chrome {
+				referrer_policy same-origin
+			}`,
+			json: `{"referrer_policy":"same-origin"}`,
+		},
+		{
+			caddyfile: `chrome {
+				on_unavailable serve_503
+			}`,
+			json: `{"on_unavailable":"serve_503"}`,
+		},
+		{
+			caddyfile: `chrome {
+				on_error {
+					status 500
+					body "<h1>Something went wrong</h1>"
+					content_type text/html
+				}
+			}`,
+			json: `{"on_error":{"status":500,"body":"\u003ch1\u003eSomething went wrong\u003c/h1\u003e","content_type":"text/html"}}`,
+		},
+		{
+			caddyfile: `chrome {
+				meta_refresh redirect
+			}`,
+			json: `{"meta_refresh":"redirect"}`,
+		},
+		{
+			caddyfile: `chrome {
+				dialogs accept
+			}`,
+			json: `{"dialogs":"accept"}`,
+		},
+		{
+			caddyfile: `chrome {
+				mode hints_only
+			}`,
+			json: `{"mode":"hints_only"}`,
+		},
+		{
+			caddyfile: `chrome {
+				redirect_behavior follow
+			}`,
+			json: `{"redirect_behavior":"follow"}`,
+		},
+		{
+			caddyfile: `chrome {
+				force_scheme https
+			}`,
+			json: `{"force_scheme":"https"}`,
+		},
+		{
+			caddyfile: `chrome {
+				host_header app.internal
+			}`,
+			json: `{"host_header":"app.internal"}`,
+		},
+		{
+			caddyfile: `chrome {
+				critical_css
+			}`,
+			json: `{"critical_css":true}`,
+		},
+		{
+			caddyfile: `chrome {
+				adopted_style_sheets
+			}`,
+			json: `{"adopted_style_sheets":true}`,
+		},
+		{
+			caddyfile: `chrome {
+				iframes
+			}`,
+			json: `{"iframes":true}`,
+		},
+		{
+			caddyfile: `chrome {
+				optimize_images
+			}`,
+			json: `{"optimize_images":{}}`,
+		},
+		{
+			caddyfile: `chrome {
+				optimize_images 2
+			}`,
+			json: `{"optimize_images":{"skip_first":2}}`,
+		},
+		{
+			caddyfile: `chrome {
+				strip_hydration
+			}`,
+			json: `{"strip_hydration":{}}`,
+		},
+		{
+			caddyfile: `chrome {
+				strip_hydration {
+					comments "ko *" /ko
+					attributes data-hk q:*
+				}
+			}`,
+			json: `{"strip_hydration":{"comments":["ko *","/ko"],"attributes":["data-hk","q:*"]}}`,
+		},
+		{
+			caddyfile: `chrome {
+				bots {
+					user_agents *googlebot* *bingbot*
+					strip_scripts
+					strip_hydration {
+						attributes data-reactroot
+					}
+				}
+			}`,
+			json: `{"bots":{"user_agents":["*googlebot*","*bingbot*"],"strip_scripts":true,"strip_hydration":{"attributes":["data-reactroot"]}}}`,
+		},
+		{
+			caddyfile: `chrome {
+				select "#app"
+			}`,
+			json: `{"select":{"selector":"#app"}}`,
+		},
+		{
+			caddyfile: `chrome {
+				select "main > .content" required
+			}`,
+			json: `{"select":{"selector":"main \u003e .content","required":true}}`,
+		},
+		{
+			caddyfile: `chrome {
+				omit_empty_head_body
+			}`,
+			json: `{"omit_empty_head_body":true}`,
+		},
+		{
+			caddyfile: `chrome {
+				minify
+			}`,
+			json: `{"minify":true}`,
+		},
+		{
+			caddyfile: `chrome {
+				locale de-DE
+				timezone Europe/Berlin
+			}`,
+			json: `{"locale":"de-DE","timezone":"Europe/Berlin"}`,
+		},
+		{
+			caddyfile: `chrome {
+				locale from_request
+			}`,
+			json: `{"locale":"from_request"}`,
+		},
+		{
+			caddyfile: `chrome {
+				shadow_dom flatten
+			}`,
+			json: `{"shadow_dom":"flatten"}`,
+		},
+		{
+			caddyfile: `chrome {
+				shadow_dom auto
+			}`,
+			json: `{"shadow_dom":"auto"}`,
+		},
+		{
+			caddyfile: `chrome {
+				snapshot_method dom_snapshot
+			}`,
+			json: `{"snapshot_method":"dom_snapshot"}`,
+		},
+		{
+			caddyfile: `chrome {
+				snapshot_method stream
+			}`,
+			json: `{"snapshot_method":"stream"}`,
+		},
+		{
+			caddyfile: `chrome {
+				remove_selectors .cookie-banner "script[src*=analytics]"
+			}`,
+			json: `{"remove_selectors":[".cookie-banner","script[src*=analytics]"]}`,
+		},
+		{
+			caddyfile: `chrome {
+				render_if_cookie prerender
+			}`,
+			json: `{"render_if_cookie":{"name":"prerender"}}`,
+		},
+		{
+			caddyfile: `chrome {
+				render_if_cookie bucket b
+			}`,
+			json: `{"render_if_cookie":{"name":"bucket","value":"b"}}`,
+		},
+		{
+			caddyfile: `chrome {
+				forward_headers Accept-Language Authorization X-Tenant
+			}`,
+			json: `{"forward_headers":["Accept-Language","Authorization","X-Tenant"]}`,
+		},
+		{
+			caddyfile: `chrome {
+				resource_types script xhr fetch stylesheet image
+			}`,
+			json: `{"resource_types":["script","xhr","fetch","stylesheet","image"]}`,
+		},
+		{
+			caddyfile: `chrome {
+				cache 10m 1000
+			}`,
+			json: `{"cache":{"ttl":"10m","max_entries":1000}}`,
+		},
+		{
+			caddyfile: `chrome {
+				max_concurrency 4
+			}`,
+			json: `{"max_concurrency":4}`,
+		},
+		{
+			caddyfile: `chrome {
+				wait_for attribute data-ssr-ready
+			}`,
+			json: `{"wait_for":{"attribute":"data-ssr-ready"}}`,
+		},
+		{
+			caddyfile: `chrome {
+				settle_time 100ms
+			}`,
+			json: `{"settle_time":"100ms"}`,
+		},
+		{
+			caddyfile: `chrome {
+				wait_for element "#app .loaded"
+			}`,
+			json: `{"wait_for":{"element":"#app .loaded"}}`,
+		},
+		{
+			caddyfile: `chrome {
+				wait_for element "#app"
+				wait_for fonts
+			}`,
+			json: `{"wait_for":{"element":"#app","fonts":true}}`,
+		},
+		{
+			caddyfile: `chrome {
+				wait_for {
+					attribute data-ssr-ready
+					element "#app"
+					network_idle
+				}
+			}`,
+			json: `{"wait_for":{"attribute":"data-ssr-ready","element":"#app","network_idle":true}}`,
+		},
+		{
+			caddyfile: `chrome {
+				wait_for selector ".widget"
+				wait_for network_idle 1s
+			}`,
+			json: `{"wait_for":{"element":".widget","network_idle":true,"network_idle_time":"1s"}}`,
+		},
+		{
+			caddyfile: `chrome {
+				links {
+					priority high first_image /img/hero-*
+					priority low /js/analytics.js
+					preconnect_threshold 2
+				}
+			}`,
+			json: `{"links":true,"links_config":{"priorities":[{"priority":"high","patterns":["first_image","/img/hero-*"]},{"priority":"low","patterns":["/js/analytics.js"]}],"preconnect_threshold":2}}`,
+		},
+		{
+			caddyfile: `chrome {
+				links {
+					add https://fonts.gstatic.com rel=preconnect
+					add /fonts/main.woff2 rel=preload as=font
+				}
+			}`,
+			json: `{"links":true,"links_config":{"static":[{"url":"https://fonts.gstatic.com","rel":"preconnect"},{"url":"/fonts/main.woff2","rel":"preload","as":"font"}]}}`,
+		},
+		{
+			caddyfile: `chrome {
+				restart_backoff 500ms
+			}`,
+			json: `{"restart_backoff":{"min":"500ms"}}`,
+		},
+		{
+			caddyfile: `chrome {
+				restart_backoff 1s 30s
+			}`,
+			json: `{"restart_backoff":{"min":"1s","max":"30s"}}`,
+		},
+		{
+			caddyfile: `chrome {
+				circuit_breaker 3
+			}`,
+			json: `{"circuit_breaker":{"failures":3}}`,
+		},
+		{
+			caddyfile: `chrome {
+				circuit_breaker 3 1m 10m
+			}`,
+			json: `{"circuit_breaker":{"failures":3,"window":"1m","cooldown":"10m"}}`,
+		},
+		{
+			caddyfile: `chrome {
+				status_path /_chrome/status
+			}`,
+			json: `{"status_path":"/_chrome/status"}`,
+		},
+		{
+			caddyfile: `chrome {
+				parallel_serialize 10000
+			}`,
+			json: `{"parallel_serialize":10000}`,
+		},
+		{
+			caddyfile: `chrome {
+				debug_header X-Chrome-Debug {env.CHROME_DEBUG_SECRET}
+			}`,
+			json: `{"debug_header":"X-Chrome-Debug","debug_secret":"{env.CHROME_DEBUG_SECRET}"}`,
+		},
+		{
+			caddyfile: `chrome {
+				bypass_query __raw
+			}`,
+			json: `{"bypass_query":"__raw"}`,
+		},
+		{
+			caddyfile: `chrome {
+				snapshot_token {env.CHROME_SNAPSHOT_TOKEN}
+			}`,
+			json: `{"snapshot_token":"{env.CHROME_SNAPSHOT_TOKEN}"}`,
+		},
+		{
+			caddyfile: `chrome {
+				record_dir /var/lib/caddy-chrome/recordings
+			}`,
+			json: `{"record_dir":"/var/lib/caddy-chrome/recordings"}`,
+		},
+		{
+			caddyfile: `chrome {
+				server_timing
+			}`,
+			json: `{"server_timing":true}`,
+		},
+		{
+			caddyfile: `chrome {
+				lazy_start
+			}`,
+			json: `{"lazy_start":true}`,
+		},
+		{
+			caddyfile: `chrome {
+				warmup
+			}`,
+			json: `{"warmup":"about:blank"}`,
+		},
+		{
+			caddyfile: `chrome {
+				warmup https://example.com/
+			}`,
+			json: `{"warmup":"https://example.com/"}`,
+		},
+		{
+			caddyfile: `chrome {
+				cleanup_timeout 30s
+			}`,
+			json: `{"cleanup_timeout":"30s"}`,
+		},
+		{
+			caddyfile: `chrome {
+				normalize_query {
+					strip utm_* fbclid
+				}
+			}`,
+			json: `{"normalize_query":{"strip":["utm_*","fbclid"]}}`,
+		},
+		{
+			caddyfile: `chrome {
+				normalize_query {
+					keep page sort
+					cache_key_only
+				}
+			}`,
+			json: `{"normalize_query":{"keep":["page","sort"],"cache_key_only":true}}`,
+		},
+		{
+			caddyfile: `chrome {
+				redact_query token auth_*
+			}`,
+			json: `{"redact_query":["token","auth_*"]}`,
+		},
+		{
+			caddyfile: `chrome {
+				canonical_url
+			}`,
+			json: `{"canonical_url":{}}`,
+		},
+		{
+			caddyfile: `chrome {
+				canonical_url {
+					trailing_slash remove
+					strict
+				}
+			}`,
+			json: `{"canonical_url":{"trailing_slash":"remove","strict":true}}`,
+		},
+		{
+			caddyfile: `chrome {
+				on_new_document_script "window.APP_CONFIG = {ssr: true}"
+			}`,
+			json: `{"on_new_document_script":{"inline":"window.APP_CONFIG = {ssr: true}"}}`,
+		},
+		{
+			caddyfile: `chrome {
+				on_new_document_script file shims.js
+			}`,
+			json: `{"on_new_document_script":{"file":"shims.js"}}`,
+		},
+		{
+			caddyfile: `chrome {
+				inject_script match_media.js
+				inject_script /etc/caddy/flags.js
+			}`,
+			json: `{"inject_scripts":["match_media.js","/etc/caddy/flags.js"]}`,
+		},
+		{
+			caddyfile: `chrome {
+				post_render_script "document.querySelector('.banner').remove()"
+			}`,
+			json: `{"post_render_script":{"inline":"document.querySelector('.banner').remove()"}}`,
+		},
+		{
+			caddyfile: `chrome {
+				post_render_script file post_render.js
+			}`,
+			json: `{"post_render_script":{"file":"post_render.js"}}`,
+		},
+		{
+			caddyfile: `chrome {
+				page_context {
+					locale {http.request.header.Accept-Language}
+					bucket {http.request.cookie.bucket}
+				}
+			}`,
+			json: `{"page_context":{"bucket":"{http.request.cookie.bucket}","locale":"{http.request.header.Accept-Language}"}}`,
+		},
+		{
+			caddyfile: `chrome {
+				csp_nonce
+			}`,
+			json: `{"csp_nonce":{}}`,
+		},
+		{
+			caddyfile: `chrome {
+				csp_nonce "script-src 'nonce-{nonce}' 'strict-dynamic'"
+			}`,
+			json: `{"csp_nonce":{"policy":"script-src 'nonce-{nonce}' 'strict-dynamic'"}}`,
+		},
+		{
+			caddyfile: `chrome {
+				sanitize
+			}`,
+			json: `{"sanitize":{}}`,
+		},
+		{
+			caddyfile: `chrome {
+				sanitize {
+					attributes on* data-track-*
+					schemes javascript vbscript
+				}
+			}`,
+			json: `{"sanitize":{"attributes":["on*","data-track-*"],"schemes":["javascript","vbscript"]}}`,
+		},
 	} {
 		t.Run(re.ReplaceAllString(testCase.caddyfile, " "), func(t *testing.T) {
 			m := new(Middleware)
@@ -140,3 +893,74 @@ func TestMiddleware_UnmarshalCaddyfile(t *testing.T) {
 		})
 	}
 }
+
+func TestIsLoopback(t *testing.T) {
+	assert.True(t, isLoopback("127.0.0.1"))
+	assert.True(t, isLoopback("::1"))
+	assert.True(t, isLoopback("localhost"))
+	assert.False(t, isLoopback("0.0.0.0"))
+	assert.False(t, isLoopback("192.168.1.10"))
+	assert.False(t, isLoopback("example.com"))
+}
+
+func TestMiddleware_Provision_InjectScripts(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	m := &Middleware{LazyStart: true, InjectScripts: []string{"testdata/missing.js"}}
+	err := m.Provision(ctx)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `failed to load injected script "testdata/missing.js"`)
+}
+
+func TestMiddleware_Provision_RemoteBrowserURL(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	for _, remoteURL := range []string{"ws://localhost:9222/devtools/browser/0a1b2c", "wss://chrome.example.com:443/devtools/browser/0a1b2c", "http://localhost:9222", "https://chrome.example.com:443", "unix:///run/chrome/devtools.sock"} {
+		m := &Middleware{LazyStart: true, RemoteBrowser: &RemoteBrowser{URL: remoteURL}}
+		assert.NoError(t, m.Provision(ctx), remoteURL)
+	}
+
+	// the browsers may be given by urls only
+	m := &Middleware{LazyStart: true, RemoteBrowser: &RemoteBrowser{URLs: []string{"http://chrome-1:9222", "http://chrome-2:9222"}}}
+	assert.NoError(t, m.Provision(ctx))
+	assert.Equal(t, 2, len(m.browsers))
+	assert.Equal(t, "http://chrome-1:9222", m.browsers[0].url)
+
+	m = &Middleware{LazyStart: true, RemoteBrowser: &RemoteBrowser{URL: "ftp://localhost:9222"}}
+	err := m.Provision(ctx)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid remote browser URL scheme "ftp"`)
+
+	m = &Middleware{LazyStart: true, RemoteBrowser: &RemoteBrowser{}}
+	err = m.Provision(ctx)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `remote browser URL is required`)
+}
+
+func TestMiddleware_Provision_LazyStartHealthCheck(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	m := &Middleware{LazyStart: true, RemoteBrowser: &RemoteBrowser{URL: "http://localhost:9222", HealthCheck: "1h"}}
+	assert.NoError(t, m.Provision(ctx))
+	// disconnected browsers are probed even though they aren't connected until the first render
+	assert.NotZero(t, m.stopHealthChecks)
+	assert.NoError(t, m.Cleanup())
+}
+
+func TestMiddleware_Provision_LocaleTimezone(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	for _, testCase := range []struct {
+		m   *Middleware
+		err string
+	}{
+		{m: &Middleware{Timezone: "Mars/Olympus_Mons"}, err: `invalid timezone "Mars/Olympus_Mons"`},
+		{m: &Middleware{Locale: "not a locale"}, err: `invalid locale "not a locale"`},
+		{m: &Middleware{Locale: "from_request", ForwardHeaders: []string{"Authorization"}}, err: `locale from_request requires Accept-Language among forward_headers`},
+	} {
+		testCase.m.LazyStart = true
+		err := testCase.m.Provision(ctx)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), testCase.err)
+	}
+}
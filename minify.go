@@ -0,0 +1,103 @@
+package caddy_chrome
+
+import (
+	"github.com/chromedp/cdproto/cdp"
+	"strings"
+)
+
+// Elements rendered as blocks by default, whitespace between them isn't rendered. Elements of the head, and scripts,
+// aren't among them, whitespace around invisible elements may still separate words of the text around them.
+// See https://html.spec.whatwg.org/multipage/rendering.html#flow-content-3
+var blockElements = map[string]bool{
+	"address":    true,
+	"article":    true,
+	"aside":      true,
+	"blockquote": true,
+	"body":       true,
+	"caption":    true,
+	"colgroup":   true,
+	"dd":         true,
+	"details":    true,
+	"dialog":     true,
+	"div":        true,
+	"dl":         true,
+	"dt":         true,
+	"fieldset":   true,
+	"figcaption": true,
+	"figure":     true,
+	"footer":     true,
+	"form":       true,
+	"h1":         true,
+	"h2":         true,
+	"h3":         true,
+	"h4":         true,
+	"h5":         true,
+	"h6":         true,
+	"head":       true,
+	"header":     true,
+	"hgroup":     true,
+	"hr":         true,
+	"html":       true,
+	"legend":     true,
+	"li":         true,
+	"main":       true,
+	"menu":       true,
+	"nav":        true,
+	"ol":         true,
+	"p":          true,
+	"search":     true,
+	"section":    true,
+	"summary":    true,
+	"table":      true,
+	"tbody":      true,
+	"td":         true,
+	"tfoot":      true,
+	"th":         true,
+	"thead":      true,
+	"tr":         true,
+	"ul":         true,
+}
+
+// isBlockElement reports whether the node is an HTML element rendered as a block by default.
+func isBlockElement(node *cdp.Node) bool {
+	return node.NodeType == cdp.NodeTypeElement && !node.IsSVG && blockElements[strings.ToLower(node.LocalName)]
+}
+
+// isWhitespaceText reports whether the node is a text node of only whitespace.
+func isWhitespaceText(node *cdp.Node) bool {
+	return node.NodeType == cdp.NodeTypeText && strings.Trim(node.NodeValue, " \t\n\f\r") == ""
+}
+
+// dropsWhitespace reports whether the i-th child of the parent is whitespace the minified output leaves out, i.e.
+// whitespace-only text in a block container, or in the head, between blocks, or the start or the end of the container.
+// Comments and other whitespace around it are looked past, any other sibling, e.g. an inline element, keeps it, so
+// that words aren't joined, and whitespace inside preformatted elements is always kept.
+func (s *domSerializer) dropsWhitespace(parent *cdp.Node, i int) bool {
+	if !s.minify || s.preformatted || !isWhitespaceText(parent.Children[i]) {
+		return false
+	}
+	if parent.NodeType != cdp.NodeTypeDocument && !isBlockElement(parent) {
+		return false
+	}
+	if parent.NodeType == cdp.NodeTypeElement && strings.ToLower(parent.LocalName) == "head" {
+		// nothing in the head is rendered
+		return true
+	}
+	return separatesBlocks(parent.Children[:i], -1) && separatesBlocks(parent.Children[i+1:], 1)
+}
+
+// separatesBlocks reports whether the nearest sibling in the direction, other than comments and whitespace, is a
+// block element, or there's none.
+func separatesBlocks(siblings []*cdp.Node, direction int) bool {
+	for j := range siblings {
+		sibling := siblings[j]
+		if direction < 0 {
+			sibling = siblings[len(siblings)-1-j]
+		}
+		if sibling.NodeType == cdp.NodeTypeComment || isWhitespaceText(sibling) {
+			continue
+		}
+		return isBlockElement(sibling) || sibling.NodeType == cdp.NodeTypeDocumentType
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package caddy_chrome
+
+import (
+	"bytes"
+	"github.com/alecthomas/assert/v2"
+	"github.com/chromedp/cdproto/cdp"
+	"testing"
+)
+
+func TestDomSerializer_Minify(t *testing.T) {
+	for _, testCase := range []struct {
+		name     string
+		root     *cdp.Node
+		expected string
+	}{
+		{
+			name: "between blocks",
+			root: document(element("html", nil,
+				element("head", nil, text("\n  "), element("title", nil, text("Title")), text("\n  "), element("meta", []string{"charset", "utf-8"}), text("\n")),
+				text("\n"),
+				element("body", nil, text("\n  "), element("div", nil, text("\n    "), element("p", nil, text("Hello")), text("\n  ")), text("\n  "), comment(" footer "), text("\n  "), element("footer", nil), text("\n")))),
+			expected: `<!DOCTYPE html><html><head><title>Title</title><meta charset="utf-8" /></head>` +
+				`<body><div><p>Hello</p></div><!-- footer --><footer></footer></body></html>`,
+		},
+		{
+			name:     "adjacent inline elements",
+			root:     document(element("p", nil, element("span", nil, text("Hello")), text(" \n "), element("span", nil, text("world")), text("\n"))),
+			expected: `<!DOCTYPE html><p><span>Hello</span> ` + "\n" + ` <span>world</span>` + "\n" + `</p>`,
+		},
+		{
+			name:     "inline between blocks",
+			root:     document(element("div", nil, element("div", nil), text("\n"), element("a", nil, text("Link")), text("\n"), element("div", nil))),
+			expected: `<!DOCTYPE html><div><div></div>` + "\n" + `<a>Link</a>` + "\n" + `<div></div></div>`,
+		},
+		{
+			name:     "inline container",
+			root:     document(element("span", nil, element("div", nil), text(" "), element("div", nil))),
+			expected: `<!DOCTYPE html><span><div></div> <div></div></span>`,
+		},
+		{
+			name:     "text",
+			root:     document(element("p", nil, text("  Hello,\n  world  "))),
+			expected: `<!DOCTYPE html><p>  Hello,` + "\n" + `  world  </p>`,
+		},
+		{
+			name: "pre",
+			root: document(element("pre", nil,
+				text("\n"), element("div", nil, text("a")), text("\n  "), element("div", nil, text("b")), text("\n"))),
+			expected: `<!DOCTYPE html><pre>` + "\n" + `<div>a</div>` + "\n  " + `<div>b</div>` + "\n" + `</pre>`,
+		},
+		{
+			name:     "textarea",
+			root:     document(element("form", nil, element("textarea", nil, text("\n\n")))),
+			expected: `<!DOCTYPE html><form><textarea>` + "\n\n" + `</textarea></form>`,
+		},
+		{
+			name:     "script and style",
+			root:     document(element("div", nil, element("script", nil, text("\n")), text("\n"), element("style", nil, text("\n  ")))),
+			expected: `<!DOCTYPE html><div><script>` + "\n" + `</script>` + "\n" + `<style>` + "\n  " + `</style></div>`,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			s := newDomSerializer(testCase.root)
+			defer s.release()
+			s.minify = true
+			var buf bytes.Buffer
+			assert.NoError(t, s.Serialize(&buf))
+			assert.Equal(t, testCase.expected, buf.String())
+
+			// the same in parallel
+			parallel := newDomSerializer(testCase.root)
+			defer parallel.release()
+			parallel.minify = true
+			parallel.parallelThreshold = 1
+			buf.Reset()
+			assert.NoError(t, parallel.Serialize(&buf))
+			assert.Equal(t, testCase.expected, buf.String())
+		})
+	}
+}
+
+func TestDomSerializer_MinifyDisabled(t *testing.T) {
+	root := document(element("div", nil, text("\n  "), element("p", nil, text("Hello")), text("\n")))
+	s := newDomSerializer(root)
+	defer s.release()
+	var buf bytes.Buffer
+	assert.NoError(t, s.Serialize(&buf))
+	assert.Equal(t, `<!DOCTYPE html><div>`+"\n  "+`<p>Hello</p>`+"\n"+`</div>`, buf.String())
+}
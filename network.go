@@ -0,0 +1,52 @@
+package caddy_chrome
+
+import (
+	"fmt"
+	"github.com/chromedp/cdproto/network"
+	"time"
+)
+
+// Presets use the same conditions as Chrome DevTools.
+var networkEmulationPresets = map[string]*network.EmulateNetworkConditionsParams{
+	"offline": network.EmulateNetworkConditions(true, 0, -1, -1),
+	"slow-3g": network.EmulateNetworkConditions(false, 2000, 50000, 50000).
+		WithConnectionType(network.ConnectionTypeCellular3g),
+	"fast-3g": network.EmulateNetworkConditions(false, 562.5, 180000, 84375).
+		WithConnectionType(network.ConnectionTypeCellular3g),
+}
+
+// NetworkEmulation emulates network conditions during render, explicit values override the ones of the preset.
+type NetworkEmulation struct {
+	Preset  string `json:"preset,omitempty"`
+	Latency string `json:"latency,omitempty"`
+	// Download and Upload are throughputs in bytes per second.
+	Download float64 `json:"download,omitempty"`
+	Upload   float64 `json:"upload,omitempty"`
+}
+
+// conditions returns parameters of the emulation.
+func (n *NetworkEmulation) conditions() (*network.EmulateNetworkConditionsParams, error) {
+	conditions := network.EmulateNetworkConditions(false, 0, -1, -1)
+	if n.Preset != "" {
+		preset, ok := networkEmulationPresets[n.Preset]
+		if !ok {
+			return nil, fmt.Errorf("unknown network emulation preset %q, expected offline, slow-3g, or fast-3g", n.Preset)
+		}
+		presetConditions := *preset
+		conditions = &presetConditions
+	}
+	if n.Latency != "" {
+		latency, err := time.ParseDuration(n.Latency)
+		if err != nil {
+			return nil, err
+		}
+		conditions.Latency = float64(latency) / float64(time.Millisecond)
+	}
+	if n.Download != 0 {
+		conditions.DownloadThroughput = n.Download
+	}
+	if n.Upload != 0 {
+		conditions.UploadThroughput = n.Upload
+	}
+	return conditions, nil
+}
@@ -0,0 +1,141 @@
+package caddy_chrome
+
+import (
+	"context"
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/chromedp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// networkWaiter waits until the page's network is idle, it's enabled right before the navigation, and gets events of
+// the page.
+type networkWaiter interface {
+	enable() chromedp.Action
+	event(event any)
+	wait(ctx context.Context) error
+}
+
+// networkIdle tracks the networkIdle lifecycle event of the page's main frame, fired by Chrome once the document has
+// had no network connections for 500ms.
+type networkIdle struct {
+	frameID    cdp.FrameID
+	navigating atomic.Bool
+	loading    atomic.Bool
+	once       sync.Once
+	idle       chan struct{}
+}
+
+func newNetworkIdle() *networkIdle {
+	return &networkIdle{idle: make(chan struct{})}
+}
+
+// enable returns the action enabling lifecycle events, it must run right before the navigation. Chrome replays the
+// events of the current (blank) document on enabling, those are ignored.
+func (n *networkIdle) enable() chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		// the main frame has the ID of its target
+		n.frameID = cdp.FrameID(chromedp.FromContext(ctx).Target.TargetID)
+		if err := page.SetLifecycleEventsEnabled(true).Do(ctx); err != nil {
+			return err
+		}
+		n.navigating.Store(true)
+		return nil
+	})
+}
+
+// event handles a lifecycle event, the page is idle after a document started loading by the navigation.
+func (n *networkIdle) event(event any) {
+	lifecycleEvent, ok := event.(*page.EventLifecycleEvent)
+	if !ok || !n.navigating.Load() || lifecycleEvent.FrameID != n.frameID {
+		return
+	}
+	switch lifecycleEvent.Name {
+	case "init":
+		n.loading.Store(true)
+	case "networkIdle":
+		if n.loading.Load() {
+			n.once.Do(func() { close(n.idle) })
+		}
+	}
+}
+
+// wait blocks until the page is idle.
+func (n *networkIdle) wait(ctx context.Context) error {
+	select {
+	case <-n.idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// networkQuiet tracks requests of the page, the page is idle once none of them has been in flight for the quiet
+// period. Unlike networkIdle, it's the state when waited for, requests started later by scripts delay it.
+type networkQuiet struct {
+	period     time.Duration
+	mu         sync.Mutex
+	navigating bool
+	inFlight   map[network.RequestID]bool
+	lastActive time.Time
+}
+
+func newNetworkQuiet(period time.Duration) *networkQuiet {
+	return &networkQuiet{period: period, inFlight: make(map[network.RequestID]bool)}
+}
+
+// enable returns the action starting the tracking, it must run right before the navigation.
+func (n *networkQuiet) enable() chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		n.navigating = true
+		n.lastActive = time.Now()
+		return nil
+	})
+}
+
+// event handles a network event, a request is in flight from being sent until it's finished or failed, redirects
+// keep the request ID.
+func (n *networkQuiet) event(event any) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.navigating {
+		return
+	}
+	switch event := event.(type) {
+	case *network.EventRequestWillBeSent:
+		n.inFlight[event.RequestID] = true
+	case *network.EventLoadingFinished:
+		delete(n.inFlight, event.RequestID)
+	case *network.EventLoadingFailed:
+		delete(n.inFlight, event.RequestID)
+	default:
+		return
+	}
+	n.lastActive = time.Now()
+}
+
+// quiet reports whether no request has been in flight for the quiet period.
+func (n *networkQuiet) quiet() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.navigating && len(n.inFlight) == 0 && time.Since(n.lastActive) >= n.period
+}
+
+// wait blocks until the page is quiet.
+func (n *networkQuiet) wait(ctx context.Context) error {
+	ticker := time.NewTicker(waitForInterval)
+	defer ticker.Stop()
+	for !n.quiet() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
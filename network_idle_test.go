@@ -0,0 +1,37 @@
+package caddy_chrome
+
+import (
+	"context"
+	"github.com/alecthomas/assert/v2"
+	"github.com/chromedp/cdproto/network"
+	"testing"
+	"time"
+)
+
+func TestNetworkQuiet(t *testing.T) {
+	quiet := newNetworkQuiet(50 * time.Millisecond)
+	assert.False(t, quiet.quiet())
+
+	// requests before the navigation are ignored
+	quiet.event(&network.EventRequestWillBeSent{RequestID: "blank"})
+	assert.NoError(t, quiet.enable().Do(context.Background()))
+	quiet.event(&network.EventRequestWillBeSent{RequestID: "document"})
+	quiet.event(&network.EventRequestWillBeSent{RequestID: "api"})
+	quiet.event(&network.EventLoadingFinished{RequestID: "document"})
+	time.Sleep(60 * time.Millisecond)
+	assert.False(t, quiet.quiet())
+
+	quiet.event(&network.EventLoadingFailed{RequestID: "api"})
+	assert.False(t, quiet.quiet())
+	time.Sleep(60 * time.Millisecond)
+	assert.True(t, quiet.quiet())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, quiet.wait(ctx))
+
+	quiet.event(&network.EventRequestWillBeSent{RequestID: "late"})
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.IsError(t, quiet.wait(ctx), context.DeadlineExceeded)
+}
@@ -0,0 +1,29 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"github.com/chromedp/cdproto/network"
+	"testing"
+)
+
+func TestNetworkEmulation_Conditions(t *testing.T) {
+	conditions, err := (&NetworkEmulation{Preset: "slow-3g", Latency: "100ms"}).conditions()
+	assert.NoError(t, err)
+	assert.Equal(t, &network.EmulateNetworkConditionsParams{
+		Latency:            100,
+		DownloadThroughput: 50000,
+		UploadThroughput:   50000,
+		ConnectionType:     network.ConnectionTypeCellular3g,
+	}, conditions)
+	assert.Equal(t, 2000.0, networkEmulationPresets["slow-3g"].Latency, "preset must not be modified")
+
+	conditions, err = (&NetworkEmulation{Download: 1000}).conditions()
+	assert.NoError(t, err)
+	assert.Equal(t, network.EmulateNetworkConditions(false, 0, 1000, -1), conditions)
+
+	_, err = (&NetworkEmulation{Preset: "5g"}).conditions()
+	assert.Error(t, err)
+
+	_, err = (&NetworkEmulation{Latency: "slow"}).conditions()
+	assert.Error(t, err)
+}
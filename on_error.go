@@ -0,0 +1,48 @@
+package caddy_chrome
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"net/http"
+	"strconv"
+)
+
+// errorPlaceholder is the placeholder of the render error in the body of the error response.
+const errorPlaceholder = "http.chrome.error"
+
+// OnError is the response to a failed render, so that clients get a consistent error page instead of Caddy's generic
+// handling of the returned error. It's distinct from on_unavailable, which handles renders that didn't start.
+type OnError struct {
+	// Status defaults to 502.
+	Status int `json:"status,omitempty"`
+	// Body may contain placeholders, {http.chrome.error} is the error message.
+	Body        string `json:"body,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// write writes the error response, headers of the upstream response describing its body are dropped, and the response
+// isn't cached, so that a transient failure doesn't stick.
+func (e *OnError) write(w http.ResponseWriter, r *http.Request, renderErr error) error {
+	status := e.Status
+	if status == 0 {
+		status = http.StatusBadGateway
+	}
+	body := e.Body
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok && body != "" {
+		repl.Set(errorPlaceholder, renderErr.Error())
+		body = repl.ReplaceAll(body, "")
+	}
+
+	for name := range skipHeaders {
+		w.Header().Del(name)
+	}
+	contentType := e.ContentType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_, err := w.Write([]byte(body))
+	return err
+}
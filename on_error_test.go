@@ -0,0 +1,37 @@
+package caddy_chrome
+
+import (
+	"context"
+	"github.com/alecthomas/assert/v2"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOnError_write(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/page", nil)
+	r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Etag", `"abc"`)
+	w.Header().Set("Content-Length", "1234")
+
+	onError := &OnError{Status: http.StatusInternalServerError, Body: "<p>Render failed: {http.chrome.error}</p>", ContentType: "text/html"}
+	assert.NoError(t, onError.write(w, r, errors.New("failed to run chrome")))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "<p>Render failed: failed to run chrome</p>", w.Body.String())
+	assert.Equal(t, "text/html", w.Header().Get("Content-Type"))
+	assert.Equal(t, "42", w.Header().Get("Content-Length"))
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	assert.Zero(t, w.Header().Get("Etag"))
+}
+
+func TestOnError_write_Defaults(t *testing.T) {
+	w := httptest.NewRecorder()
+	assert.NoError(t, (&OnError{}).write(w, httptest.NewRequest(http.MethodGet, "/", nil), errors.New("timeout")))
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Equal(t, "", w.Body.String())
+	assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+}
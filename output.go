@@ -0,0 +1,87 @@
+package caddy_chrome
+
+import (
+	"context"
+	"fmt"
+	"github.com/chromedp/cdproto/page"
+	"github.com/pkg/errors"
+	"math"
+)
+
+// Output is what the rendered page is responded as, the serialized DOM (html, default), or a capture of the page,
+// a PDF (pdf), or a PNG screenshot (png), e.g. for printable pages, or social preview images. Only responses of
+// the configured MIME types are rendered either way.
+type Output struct {
+	Format string `json:"format,omitempty"`
+	// Width and Height are of the viewport in CSS pixels, they override the size of Viewport, or of the device, the
+	// page is rendered in the default one of the browser if they're zero.
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+	// FullPage captures the whole page rather than the viewport, as a single page of the PDF.
+	FullPage bool `json:"full_page,omitempty"`
+}
+
+// cssPixelsPerInch converts sizes of the page to the paper size of the PDF.
+const cssPixelsPerInch = 96
+
+func (o *Output) validate() error {
+	switch o.Format {
+	case "", "html", "pdf", "png":
+	default:
+		return fmt.Errorf("invalid output format %q, expected html, pdf, or png", o.Format)
+	}
+	if o.Width < 0 || o.Height < 0 || (o.Width == 0) != (o.Height == 0) {
+		return fmt.Errorf("invalid viewport %dx%d, expected positive width and height", o.Width, o.Height)
+	}
+	if o.FullPage && !o.captures() {
+		return fmt.Errorf("full page requires pdf or png output")
+	}
+	return nil
+}
+
+// captures reports whether the page is captured, instead of being serialized.
+func (o *Output) captures() bool {
+	return o != nil && (o.Format == "pdf" || o.Format == "png")
+}
+
+// contentType returns the Content-Type of the capture.
+func (o *Output) contentType() string {
+	if o.Format == "pdf" {
+		return "application/pdf"
+	}
+	return "image/png"
+}
+
+// capture prints the page to PDF, or takes its screenshot.
+func (o *Output) capture(ctx context.Context) ([]byte, error) {
+	var width, height float64
+	if o.FullPage {
+		_, _, _, _, _, contentSize, err := page.GetLayoutMetrics().Do(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get page size")
+		}
+		width, height = math.Ceil(contentSize.Width), math.Ceil(contentSize.Height)
+	}
+	if o.Format == "pdf" {
+		params := page.PrintToPDF().WithPrintBackground(true)
+		if o.FullPage {
+			params = params.
+				WithPaperWidth(width / cssPixelsPerInch).
+				WithPaperHeight(height / cssPixelsPerInch).
+				WithMarginTop(0).
+				WithMarginBottom(0).
+				WithMarginLeft(0).
+				WithMarginRight(0)
+		}
+		data, _, err := params.Do(ctx)
+		return data, errors.Wrap(err, "failed to print to PDF")
+	}
+	params := page.CaptureScreenshot().WithFormat(page.CaptureScreenshotFormatPng).WithFromSurface(true)
+	if o.FullPage {
+		params = params.
+			WithCaptureBeyondViewport(true).
+			WithClip(&page.Viewport{Width: width, Height: height, Scale: 1})
+	}
+	data, err := params.Do(ctx)
+	return data, errors.Wrap(err, "failed to capture screenshot")
+}
@@ -0,0 +1,74 @@
+package caddy_chrome
+
+import (
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+)
+
+// ErrOutputTooLarge is the error of serializing a rendered page into more bytes than MaxOutputSize allows.
+var ErrOutputTooLarge = errors.New("rendered page too large")
+
+// MaxOutputSize limits the size of the serialized page, so that a pathological page (e.g. one generating content in
+// a loop) doesn't produce a gigantic response. Pages over the limit are passed through un-rendered, unless Truncate is
+// set.
+type MaxOutputSize struct {
+	// Size is the limit in bytes.
+	Size int64 `json:"size"`
+	// Truncate stops serializing nodes once the limit is reached instead, elements already started are closed, so the
+	// page is still well-formed, but a little over the limit.
+	Truncate bool `json:"truncate,omitempty"`
+}
+
+// truncateOutput returns the size the serialized page is truncated at, zero if it isn't.
+func (m *Middleware) truncateOutput() int64 {
+	if m.MaxOutputSize == nil || !m.MaxOutputSize.Truncate {
+		return 0
+	}
+	return m.MaxOutputSize.Size
+}
+
+// warnTruncated logs a warning if the serializer truncated the page.
+func (m *Middleware) warnTruncated(r *http.Request, serializer *domSerializer) {
+	if serializer.truncated {
+		m.log.Warn("rendered page too large, truncated", zap.String("url", m.RedactQuery.Redact(r.URL.String())), zap.Int64("max_output_size", serializer.truncateAt))
+	}
+}
+
+// limitWriter fails with ErrOutputTooLarge, and writes nothing, once more than limit bytes would have been written.
+type limitWriter struct {
+	w     io.Writer
+	n     int64
+	limit int64
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	if w.n+int64(len(p)) > w.limit {
+		return 0, errors.Wrapf(ErrOutputTooLarge, "more than %d bytes", w.limit)
+	}
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// countingWriter counts bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// truncates reports whether the serialization reached truncateAt, nodes aren't serialized after that.
+func (s *domSerializer) truncates() bool {
+	if s.written == nil || s.written.n < s.truncateAt {
+		return false
+	}
+	s.truncated = true
+	return true
+}
@@ -0,0 +1,71 @@
+package caddy_chrome
+
+import (
+	"bytes"
+	"errors"
+	"github.com/alecthomas/assert/v2"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLimitWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := &limitWriter{w: &buf, limit: 5}
+	_, err := w.Write([]byte("abc"))
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("de"))
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("f"))
+	assert.True(t, errors.Is(err, ErrOutputTooLarge))
+	assert.Equal(t, "abcde", buf.String())
+}
+
+func TestDomSerializer_Truncate(t *testing.T) {
+	root := largeDocument(20, 100)
+	var whole bytes.Buffer
+	assert.NoError(t, (&domSerializer{root: root}).Serialize(&whole))
+
+	s := &domSerializer{root: root, truncateAt: 10_000}
+	var truncated bytes.Buffer
+	assert.NoError(t, s.Serialize(&truncated))
+	assert.True(t, s.truncated)
+	assert.True(t, truncated.Len() >= 10_000 && truncated.Len() < 11_000, "%d bytes", truncated.Len())
+	// open elements are closed
+	assert.True(t, strings.HasSuffix(truncated.String(), "</section></body></html>"), truncated.String()[truncated.Len()-100:])
+
+	s = &domSerializer{root: root, truncateAt: int64(whole.Len())}
+	assert.NoError(t, s.Serialize(&bytes.Buffer{}))
+	assert.False(t, s.truncated)
+}
+
+func TestMiddleware_writeRendering_MaxOutputSize(t *testing.T) {
+	write := func(m *Middleware) *httptest.ResponseRecorder {
+		m.log = zap.NewNop()
+		upstream := &responseWriter{status: http.StatusOK, header: http.Header{"Content-Type": {"text/html"}}}
+		_, _ = upstream.Write([]byte(`<p>upstream</p>`))
+		rendered := &rendering{
+			document:   upstream,
+			links:      NewLinkHints(nil),
+			serializer: newDomSerializer(largeDocument(20, 100)),
+		}
+		rendered.serializer.truncateAt = m.truncateOutput()
+		defer rendered.release()
+		w := httptest.NewRecorder()
+		assert.NoError(t, m.writeRendering(w, httptest.NewRequest(http.MethodGet, "/", nil), nil, rendered, ""))
+		return w
+	}
+
+	w := write(&Middleware{MaxOutputSize: &MaxOutputSize{Size: 10_000}})
+	assert.Equal(t, `<p>upstream</p>`, w.Body.String())
+
+	w = write(&Middleware{MaxOutputSize: &MaxOutputSize{Size: 10_000, Truncate: true}})
+	assert.True(t, w.Body.Len() >= 10_000 && w.Body.Len() < 11_000, "%d bytes", w.Body.Len())
+	assert.True(t, strings.HasSuffix(w.Body.String(), "</html>"))
+
+	w = write(&Middleware{MaxOutputSize: &MaxOutputSize{Size: 10_000_000}})
+	assert.True(t, strings.HasSuffix(w.Body.String(), "</html>"))
+	assert.Equal(t, "text/html", w.Header().Get("Content-Type"))
+}
@@ -0,0 +1,38 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"testing"
+)
+
+func TestOutput_validate(t *testing.T) {
+	for _, output := range []*Output{
+		{},
+		{Format: "html", Width: 1280, Height: 720},
+		{Format: "pdf", FullPage: true},
+		{Format: "png", Width: 1200, Height: 630},
+	} {
+		assert.NoError(t, output.validate())
+	}
+	for _, testCase := range []struct {
+		output   *Output
+		expected string
+	}{
+		{&Output{Format: "jpeg"}, `invalid output format "jpeg", expected html, pdf, or png`},
+		{&Output{Format: "png", Width: 1200}, `invalid viewport 1200x0, expected positive width and height`},
+		{&Output{Format: "png", Width: -1, Height: 630}, `invalid viewport -1x630, expected positive width and height`},
+		{&Output{Format: "html", FullPage: true}, `full page requires pdf or png output`},
+	} {
+		assert.EqualError(t, testCase.output.validate(), testCase.expected)
+	}
+}
+
+func TestOutput_captures(t *testing.T) {
+	assert.False(t, (*Output)(nil).captures())
+	assert.False(t, (&Output{}).captures())
+	assert.False(t, (&Output{Format: "html"}).captures())
+	assert.True(t, (&Output{Format: "pdf"}).captures())
+	assert.True(t, (&Output{Format: "png"}).captures())
+	assert.Equal(t, "application/pdf", (&Output{Format: "pdf"}).contentType())
+	assert.Equal(t, "image/png", (&Output{Format: "png"}).contentType())
+}
@@ -0,0 +1,42 @@
+package caddy_chrome
+
+import (
+	"encoding/json"
+	"github.com/caddyserver/caddy/v2"
+	"net/http"
+	"regexp"
+)
+
+// requestHeaderPlaceholderRegexp matches placeholders of request headers, e.g. {http.request.header.Accept-Language}.
+var requestHeaderPlaceholderRegexp = regexp.MustCompile(`\{http\.request\.header\.([^}]+)}`)
+
+// pageContextScript returns the script setting window.CaddyChrome.context to the values of the page_context variables
+// resolved for the request, it runs before the page's own scripts. It's empty if there are no variables, only the
+// configured ones are exposed, so that nothing else of the request, e.g. its cookies, leaks to the page.
+func (m *Middleware) pageContextScript(r *http.Request) (string, error) {
+	if len(m.PageContext) == 0 {
+		return "", nil
+	}
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	values := make(map[string]string, len(m.PageContext))
+	for name, value := range m.PageContext {
+		values[name] = repl.ReplaceAll(value, "")
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	return "window.CaddyChrome.context = Object.freeze(" + string(data) + ");", nil
+}
+
+// pageContextHeaders returns names of the request headers the page_context variables are resolved from, the rendered
+// page varies by them.
+func (m *Middleware) pageContextHeaders() []string {
+	var names []string
+	for _, value := range m.PageContext {
+		for _, match := range requestHeaderPlaceholderRegexp.FindAllStringSubmatch(value, -1) {
+			names = append(names, match[1])
+		}
+	}
+	return names
+}
@@ -0,0 +1,36 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddleware_pageContextScript(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Language", "cs-CZ")
+	r.Header.Set("Cookie", "session=secret")
+	caddyhttp.NewTestReplacer(r)
+
+	script, err := (&Middleware{}).pageContextScript(r)
+	assert.NoError(t, err)
+	assert.Zero(t, script)
+
+	script, err = (&Middleware{PageContext: map[string]string{
+		"locale": "{http.request.header.Accept-Language}",
+		"bucket": "</script>",
+	}}).pageContextScript(r)
+	assert.NoError(t, err)
+	// only the configured values are exposed
+	assert.Equal(t, `window.CaddyChrome.context = Object.freeze({"bucket":"\u003c/script\u003e","locale":"cs-CZ"});`, script)
+}
+
+func TestMiddleware_pageContextHeaders(t *testing.T) {
+	assert.Zero(t, (&Middleware{}).pageContextHeaders())
+	assert.Equal(t, []string{"X-Bucket"}, (&Middleware{PageContext: map[string]string{
+		"bucket": "{http.request.header.X-Bucket}",
+		"ip":     "{http.request.remote.host}",
+	}}).pageContextHeaders())
+}
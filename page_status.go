@@ -0,0 +1,44 @@
+package caddy_chrome
+
+import (
+	"github.com/chromedp/cdproto/cdp"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// pageStatus returns the status the rendered page declares by <meta name="prerender-status-code" content="404">, and
+// the target of a redirect by <meta name="prerender-header" content="Location: /moved">, as with prerender.io, for
+// single page apps that know a page doesn't exist, or has moved, only once they've rendered it. The status is zero if
+// there's none, or it's invalid, the location is only of redirects.
+func pageStatus(root *cdp.Node) (int, string) {
+	head, _ := documentHeadBody(root)
+	if head == nil {
+		return 0, ""
+	}
+	var status int
+	var location string
+	for _, child := range head.Children {
+		if child.NodeType != cdp.NodeTypeElement || child.LocalName != "meta" {
+			continue
+		}
+		content := attributeValue(child, "content")
+		switch strings.ToLower(attributeValue(child, "name")) {
+		case "prerender-status-code":
+			if code, err := strconv.Atoi(strings.TrimSpace(content)); err == nil && code >= 200 && code <= 599 {
+				status = code
+			}
+		case "prerender-header":
+			if name, value, ok := strings.Cut(content, ":"); ok && http.CanonicalHeaderKey(strings.TrimSpace(name)) == "Location" {
+				location = strings.TrimSpace(value)
+			}
+		}
+	}
+	if status < 300 || status >= 400 || status == http.StatusNotModified {
+		location = ""
+	} else if location == "" {
+		// a redirect without a target can't be followed
+		status = 0
+	}
+	return status, location
+}
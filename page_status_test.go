@@ -0,0 +1,64 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"github.com/chromedp/cdproto/cdp"
+	"testing"
+)
+
+func TestPageStatus(t *testing.T) {
+	meta := func(name, content string) *cdp.Node {
+		return element("meta", []string{"name", name, "content", content})
+	}
+	for _, testCase := range []struct {
+		name     string
+		head     []*cdp.Node
+		status   int
+		location string
+	}{
+		{
+			name: "none",
+			head: []*cdp.Node{element("title", nil, text("Page"))},
+		},
+		{
+			name:   "not found",
+			head:   []*cdp.Node{meta("prerender-status-code", "404")},
+			status: 404,
+		},
+		{
+			name:     "redirect",
+			head:     []*cdp.Node{meta("Prerender-Status-Code", " 301 "), meta("prerender-header", "location: /moved")},
+			status:   301,
+			location: "/moved",
+		},
+		{
+			name: "redirect without location",
+			head: []*cdp.Node{meta("prerender-status-code", "302")},
+		},
+		{
+			name:   "location without redirect",
+			head:   []*cdp.Node{meta("prerender-status-code", "410"), meta("prerender-header", "Location: /gone")},
+			status: 410,
+		},
+		{
+			name:   "not modified",
+			head:   []*cdp.Node{meta("prerender-status-code", "304"), meta("prerender-header", "Location: /moved")},
+			status: 304,
+		},
+		{
+			name: "other header",
+			head: []*cdp.Node{meta("prerender-status-code", "302"), meta("prerender-header", "Cache-Control: no-cache")},
+		},
+		{
+			name: "invalid",
+			head: []*cdp.Node{meta("prerender-status-code", "hello"), meta("prerender-status-code", "999")},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			root := document(element("html", nil, element("head", nil, testCase.head...), element("body", nil)))
+			status, location := pageStatus(root)
+			assert.Equal(t, testCase.status, status)
+			assert.Equal(t, testCase.location, location)
+		})
+	}
+}
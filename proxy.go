@@ -0,0 +1,69 @@
+package caddy_chrome
+
+import (
+	"fmt"
+	"github.com/chromedp/cdproto/fetch"
+	"github.com/chromedp/cdproto/target"
+	"net/url"
+	"strings"
+)
+
+// Proxy is the proxy server requests the browser sends over the network go through, i.e. continued ones, e.g. an
+// egress proxy of a locked-down environment. It's set on the browser context of each render, so it applies to remote
+// browsers too.
+type Proxy struct {
+	// URL of the proxy server, e.g. http://egress.internal:3128, or socks5://egress.internal:1080.
+	URL string `json:"url"`
+	// Username and Password answer authentication challenges of the proxy, Chrome doesn't take them from the URL.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// Bypass are hosts requested directly, in Chrome's format, e.g. *.internal, or 10.0.0.0/8.
+	Bypass []string `json:"bypass,omitempty"`
+}
+
+// validate checks the URL is one Chrome takes as a proxy server.
+func (p *Proxy) validate() error {
+	proxyURL, err := url.Parse(p.URL)
+	if err != nil {
+		return fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks4", "socks5":
+	default:
+		return fmt.Errorf("invalid proxy URL scheme %q, expected http, https, socks4, or socks5", proxyURL.Scheme)
+	}
+	if proxyURL.User != nil {
+		return fmt.Errorf("proxy URL cannot contain credentials, use credentials instead")
+	}
+	if proxyURL.Host == "" {
+		return fmt.Errorf("proxy URL has no host")
+	}
+	return nil
+}
+
+// browserContext sets the proxy of a new browser context.
+func (p *Proxy) browserContext(params *target.CreateBrowserContextParams) *target.CreateBrowserContextParams {
+	params = params.WithProxyServer(p.URL)
+	if len(p.Bypass) > 0 {
+		params = params.WithProxyBypassList(strings.Join(p.Bypass, ";"))
+	}
+	return params
+}
+
+// authenticates reports whether the proxy needs authentication challenges answered.
+func (p *Proxy) authenticates() bool {
+	return p != nil && p.Username != ""
+}
+
+// authResponse answers the authentication challenge with credentials of the proxy if it's the proxy's, the browser's
+// default handling, i.e. cancelling, is kept for servers.
+func (p *Proxy) authResponse(challenge *fetch.AuthChallenge) *fetch.AuthChallengeResponse {
+	if challenge.Source != fetch.AuthChallengeSourceProxy {
+		return &fetch.AuthChallengeResponse{Response: fetch.AuthChallengeResponseResponseDefault}
+	}
+	return &fetch.AuthChallengeResponse{
+		Response: fetch.AuthChallengeResponseResponseProvideCredentials,
+		Username: p.Username,
+		Password: p.Password,
+	}
+}
@@ -0,0 +1,93 @@
+package caddy_chrome
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Recording is what a render took from Chrome, the DOM tree as it was before serialization and the requests of
+// the page, saved so that the serialization can be replayed without Chrome, e.g. in regression tests of
+// the serializer against real sites. The tree is under the root key, as in the result of DOM.getDocument, so that
+// recordings can be read by NewDOMSerializer too.
+type Recording struct {
+	URL string `json:"url"`
+	// Status and Header are of the document response.
+	Status    int         `json:"status"`
+	Header    http.Header `json:"header,omitempty"`
+	Root      *cdp.Node   `json:"root"`
+	Resources []Resource  `json:"resources,omitempty"`
+}
+
+// ReadRecording reads a recording saved by a renderer with RecordDir.
+func ReadRecording(r io.Reader) (*Recording, error) {
+	recording := new(Recording)
+	if err := json.NewDecoder(r).Decode(recording); err != nil {
+		return nil, err
+	}
+	if recording.Root == nil {
+		return nil, errors.New("recording has no DOM tree")
+	}
+	return recording, nil
+}
+
+// recordingName returns the file name of the recording of the URL, renders of the same URL overwrite each other.
+func recordingName(url string) string {
+	hash := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(hash[:8]) + ".json"
+}
+
+// save writes the recording into the directory, into a temporary file first, so that readers never see a partial one.
+func (rec *Recording) save(dir string) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".recording-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(dir, recordingName(rec.URL)))
+}
+
+// Replay serializes the DOM tree of the recording with the serialization options of the renderer, as the render
+// would. Options that need the live page (Select, CriticalCSS) aren't applied, ones that changed the page before it
+// was recorded (e.g. RemoveSelectors) already are in the tree.
+func (r *Renderer) Replay(recording *Recording) ([]byte, error) {
+	header := recording.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	req := &renderRequest{
+		url:      recording.URL,
+		document: &responseWriter{status: recording.Status, header: header},
+	}
+	root := recording.Root
+	skipDoctype := r.NoForcedDoctype || r.Fragment || !isHTML(req.document.Header().Get("Content-Type"))
+	if r.Fragment {
+		root = fragmentRoot(root)
+	}
+	serializer := r.newSerializer(root, req, skipDoctype, nil)
+	defer serializer.release()
+
+	var buf bytes.Buffer
+	if err := serializer.Serialize(&buf); err != nil {
+		return nil, errors.Wrap(err, "failed to serialize")
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,74 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"github.com/chromedp/cdproto/cdp"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderer_Replay(t *testing.T) {
+	for _, testCase := range []struct {
+		name      string
+		recording string
+		renderer  *Renderer
+	}{
+		{name: "article", recording: "article", renderer: &Renderer{}},
+		{name: "article_flatten", recording: "article", renderer: &Renderer{FlattenShadowDOM: true}},
+		{name: "article_fragment", recording: "article", renderer: &Renderer{Fragment: true}},
+		{name: "xhtml", recording: "xhtml", renderer: &Renderer{}},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", "record", testCase.recording+".json"))
+			assert.NoError(t, err)
+			defer f.Close()
+			expected, err := os.ReadFile(filepath.Join("testdata", "record", testCase.name+".html"))
+			assert.NoError(t, err)
+
+			recording, err := ReadRecording(f)
+			assert.NoError(t, err)
+			html, err := testCase.renderer.Replay(recording)
+			assert.NoError(t, err)
+			assert.Equal(t, string(expected), string(html))
+		})
+	}
+}
+
+func TestRecording_save(t *testing.T) {
+	dir := t.TempDir()
+	recording := &Recording{
+		URL:    "https://example.com/",
+		Status: http.StatusOK,
+		Header: http.Header{"Content-Type": {"text/html"}},
+		Root: &cdp.Node{NodeType: cdp.NodeTypeDocument, NodeName: "#document", Children: []*cdp.Node{
+			{NodeType: cdp.NodeTypeElement, NodeName: "P", LocalName: "p"},
+		}},
+		Resources: []Resource{{URL: "https://example.com/app.js", ResourceType: "Script", Outcome: ResourceFulfilled, Status: http.StatusOK}},
+	}
+	assert.NoError(t, recording.save(dir))
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, recordingName(recording.URL), entries[0].Name())
+
+	f, err := os.Open(filepath.Join(dir, entries[0].Name()))
+	assert.NoError(t, err)
+	defer f.Close()
+	read, err := ReadRecording(f)
+	assert.NoError(t, err)
+	assert.Equal(t, recording.URL, read.URL)
+	assert.Equal(t, recording.Header, read.Header)
+	assert.Equal(t, recording.Resources, read.Resources)
+	html, err := (&Renderer{}).Replay(read)
+	assert.NoError(t, err)
+	assert.Equal(t, `<!DOCTYPE html><p></p>`, string(html))
+}
+
+func TestReadRecording_NoTree(t *testing.T) {
+	_, err := ReadRecording(strings.NewReader(`{"url":"https://example.com/"}`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,101 @@
+package caddy_chrome
+
+import (
+	"bytes"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// maxRedirects is the number of redirects followed before the last one is passed through.
+const maxRedirects = 10
+
+func isRedirect(res response) bool {
+	status := res.Status()
+	return status >= 300 && status < 400 && status != http.StatusNotModified && res.Header().Get("Location") != ""
+}
+
+// redirectTarget resolves the Location of a redirect from the URL, redirects to other origins (including from http to
+// https) can't be followed, the client has to.
+func redirectTarget(rawURL string, location string) (string, bool) {
+	base, err := url.Parse(rawURL)
+	if err != nil {
+		return "", false
+	}
+	target, err := base.Parse(location)
+	if err != nil || target.Scheme != base.Scheme || target.Host != base.Host {
+		return "", false
+	}
+	target.Fragment = ""
+	return target.String(), true
+}
+
+// metaRefresh returns the delay in seconds and the URL of the first meta refresh in the HTML document that has a URL,
+// i.e. it redirects rather than reloads the page.
+func metaRefresh(body []byte) (int, string, bool) {
+	tokenizer := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return 0, "", false
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			if token.DataAtom != atom.Meta {
+				continue
+			}
+			var httpEquiv, content string
+			for _, attr := range token.Attr {
+				switch attr.Key {
+				case "http-equiv":
+					httpEquiv = attr.Val
+				case "content":
+					content = attr.Val
+				}
+			}
+			if !strings.EqualFold(httpEquiv, "refresh") {
+				continue
+			}
+			if delay, target, ok := parseRefresh(content); ok {
+				return delay, target, true
+			}
+		}
+	}
+}
+
+// parseRefresh parses the content of a meta refresh, e.g. "5; url=/next", and reports whether it has a URL.
+func parseRefresh(content string) (int, string, bool) {
+	content = strings.TrimSpace(content)
+	end := strings.IndexFunc(content, func(r rune) bool { return r < '0' || r > '9' })
+	if end == -1 {
+		return 0, "", false
+	}
+	delay, err := strconv.Atoi(content[:end])
+	if err != nil {
+		return 0, "", false
+	}
+	rest := strings.TrimLeft(content[end:], ".0123456789")
+	rest = strings.TrimSpace(rest)
+	if rest == "" || rest[0] != ';' && rest[0] != ',' {
+		return 0, "", false
+	}
+	rest = strings.TrimSpace(rest[1:])
+	if len(rest) >= 3 && strings.EqualFold(rest[:3], "url") {
+		if after := strings.TrimSpace(rest[3:]); strings.HasPrefix(after, "=") {
+			rest = strings.TrimSpace(after[1:])
+		}
+	}
+	if rest != "" && (rest[0] == '"' || rest[0] == '\'') {
+		quote := rest[0]
+		rest = rest[1:]
+		if i := strings.IndexByte(rest, quote); i != -1 {
+			rest = rest[:i]
+		}
+	}
+	if rest == "" {
+		return 0, "", false
+	}
+	return delay, rest, true
+}
@@ -0,0 +1,56 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"net/http"
+	"testing"
+)
+
+func TestIsRedirect(t *testing.T) {
+	redirect := &responseWriter{status: http.StatusFound, header: http.Header{"Location": {"/login"}}}
+	assert.True(t, isRedirect(redirect))
+	assert.False(t, isRedirect(&responseWriter{status: http.StatusFound, header: http.Header{}}))
+	assert.False(t, isRedirect(&responseWriter{status: http.StatusNotModified, header: http.Header{"Location": {"/login"}}}))
+	assert.False(t, isRedirect(&responseWriter{header: http.Header{"Location": {"/login"}}}))
+}
+
+func TestRedirectTarget(t *testing.T) {
+	for _, testCase := range []struct {
+		location string
+		expected string
+		ok       bool
+	}{
+		{"/login?next=%2Fpage", "http://localhost/login?next=%2Fpage", true},
+		{"other.html#top", "http://localhost/dir/other.html", true},
+		{"http://localhost/absolute.html", "http://localhost/absolute.html", true},
+		{"https://localhost/dir/page.html", "", false},
+		{"http://example.com/", "", false},
+		{"//example.com/", "", false},
+	} {
+		target, ok := redirectTarget("http://localhost/dir/page.html", testCase.location)
+		assert.Equal(t, testCase.ok, ok, testCase.location)
+		assert.Equal(t, testCase.expected, target, testCase.location)
+	}
+}
+
+func TestMetaRefresh(t *testing.T) {
+	for _, testCase := range []struct {
+		body   string
+		delay  int
+		target string
+		ok     bool
+	}{
+		{`<meta http-equiv="refresh" content="0; url=/next">`, 0, "/next", true},
+		{`<html><head><META HTTP-EQUIV="Refresh" CONTENT="5;URL='https://example.com/'"></head></html>`, 5, "https://example.com/", true},
+		{`<meta http-equiv="refresh" content="3, /next">`, 3, "/next", true},
+		{`<meta http-equiv="refresh" content="1.5; url=/next" />`, 1, "/next", true},
+		{`<meta http-equiv="refresh" content="30">`, 0, "", false},
+		{`<meta name="refresh" content="0; url=/next">`, 0, "", false},
+		{`<p>Hello</p>`, 0, "", false},
+	} {
+		delay, target, ok := metaRefresh([]byte(testCase.body))
+		assert.Equal(t, testCase.ok, ok, testCase.body)
+		assert.Equal(t, testCase.delay, delay, testCase.body)
+		assert.Equal(t, testCase.target, target, testCase.body)
+	}
+}
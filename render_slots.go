@@ -0,0 +1,29 @@
+package caddy_chrome
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// errNoRenderSlot is returned when all renders of the middleware are in flight for longer than the request may wait.
+var errNoRenderSlot = errors.New("no render slot available")
+
+// acquireRenderSlot waits up to the timeout for one of the renders in flight to finish, unless the request is
+// canceled, and returns a function releasing the slot once the render is done.
+func (m *Middleware) acquireRenderSlot(ctx context.Context, timeout time.Duration) (func(), error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case m.renderSlots <- struct{}{}:
+		return m.releaseRenderSlot, nil
+	case <-timer.C:
+		return nil, errNoRenderSlot
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (m *Middleware) releaseRenderSlot() {
+	<-m.renderSlots
+}
@@ -0,0 +1,35 @@
+package caddy_chrome
+
+import (
+	"context"
+	"github.com/alecthomas/assert/v2"
+	"testing"
+	"time"
+)
+
+func TestMiddleware_acquireRenderSlot(t *testing.T) {
+	m := &Middleware{renderSlots: make(chan struct{}, 2)}
+
+	release1, err := m.acquireRenderSlot(context.Background(), time.Second)
+	assert.NoError(t, err)
+	release2, err := m.acquireRenderSlot(context.Background(), time.Second)
+	assert.NoError(t, err)
+
+	start := time.Now()
+	_, err = m.acquireRenderSlot(context.Background(), 50*time.Millisecond)
+	assert.IsError(t, err, errNoRenderSlot)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = m.acquireRenderSlot(ctx, time.Second)
+	assert.IsError(t, err, context.Canceled)
+
+	time.AfterFunc(50*time.Millisecond, release1)
+	release3, err := m.acquireRenderSlot(context.Background(), time.Second)
+	assert.NoError(t, err)
+
+	release2()
+	release3()
+	assert.Equal(t, 0, len(m.renderSlots))
+}
@@ -0,0 +1,1618 @@
+package caddy_chrome
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/chromedp/cdproto/browser"
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/css"
+	"github.com/chromedp/cdproto/dom"
+	"github.com/chromedp/cdproto/emulation"
+	"github.com/chromedp/cdproto/fetch"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/chromedp"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Renderer renders pages in Chrome and serializes the resulting DOM to HTML. It is what the middleware uses under the
+// hood, so it can be used without running Caddy.
+type Renderer struct {
+	// Browser is a chromedp context of a running browser, each render runs in a new browser context created from it.
+	Browser context.Context
+	// Handler serves the navigation and requests of the page to the same host and FulfillHosts. If nil, they're sent
+	// over the network.
+	Handler       http.Handler
+	Timeout       time.Duration
+	FulfillHosts  []string
+	ContinueHosts []string
+	// ResourceTypes are of requests that are fulfilled or continued, the rest are blocked, nil means the defaults, i.e.
+	// scripts, XHR, and fetch.
+	ResourceTypes []network.ResourceType
+	// OnNewDocumentScript runs in every document of the page before its scripts, after the built-in one, e.g. to
+	// stub browser APIs, or to set up globals.
+	OnNewDocumentScript string
+	// InjectScripts run in every document of the page in order, after OnNewDocumentScript.
+	InjectScripts     []string
+	PostRenderScript  string
+	Sanitize          *Sanitize
+	ParallelSerialize int
+	// NoForcedDoctype disables writing HTML doctype into documents without one, it's never written into non-HTML
+	// documents.
+	NoForcedDoctype bool
+	// Fragment renders responses that are HTML fragments rather than whole documents, they're rendered inside a body
+	// of a wrapper document and only the contents of the body are serialized.
+	Fragment bool
+	Select   *Select
+	// Output captures the page as a PDF, or a screenshot, instead of serializing it, the rendering has no serializer
+	// then.
+	Output  *Output
+	WaitFor *WaitFor
+	// SettleTime is a delay after the page is ready, before the DOM is taken, for apps with last-moment DOM updates
+	// that aren't covered by the pending tasks, or the wait_for signal.
+	SettleTime time.Duration
+	// OmitEmptyHeadBody omits empty head and body elements, e.g. the ones the browser inserted, whose tags are
+	// optional. Fragment and select outputs never have them.
+	OmitEmptyHeadBody bool
+	// Minify leaves out whitespace-only text between blocks, whitespace that may be rendered is kept.
+	Minify bool
+	// FlattenShadowDOM serializes shadow roots flattened into their hosts instead of declarative shadow DOM, for
+	// clients not supporting it.
+	FlattenShadowDOM bool
+	// DOMSnapshot takes the DOM tree by DOMSnapshot.captureSnapshot in a single call, instead of DOM.getDocument,
+	// which is faster for large pages, but less faithful, e.g. in telling user-agent shadow roots apart.
+	DOMSnapshot bool
+	// StreamDOM takes the DOM tree from Chrome by parts, the serialization starts once the children of the head and
+	// the body are known, and their subtrees are fetched while what's before them is written, so that the first bytes
+	// of large pages are sent sooner. The page keeps running meanwhile, so changes it makes late may show in the parts
+	// fetched later. It's exclusive with options needing the whole tree upfront, Select, CriticalCSS,
+	// FlattenShadowDOM, OptimizeImages, ParallelSerialize, MaxNodes, RecordDir, and DOMSnapshot.
+	StreamDOM bool
+	// AMP serializes AMP documents faithfully, as they were authored, the AMP runtime isn't loaded, so that it doesn't
+	// rewrite the DOM, and options adding or removing markup (e.g. stripping scripts for bots, optimizing images, or
+	// critical CSS) are skipped for them. The doctype is always written, even with NoForcedDoctype.
+	AMP bool
+	// RemoveSelectors are CSS selectors of elements removed from the DOM before serialization, e.g. cookie banners,
+	// or dev toolbars.
+	RemoveSelectors []string
+	// CriticalCSS inlines rules of external stylesheets used by the page into the head and moves the stylesheet links
+	// to the end of the body, so that they don't block rendering.
+	CriticalCSS bool
+	// AdoptedStyleSheets inlines adopted (constructed) stylesheets of shadow roots and the document as style
+	// elements, so that the serialized shadow DOM is styled.
+	AdoptedStyleSheets bool
+	// Iframes loads same-origin iframes and inlines their documents into srcdoc attributes.
+	Iframes        bool
+	OptimizeImages *OptimizeImages
+	StripHydration *StripHydration
+	// Bots sets serialization options of renders for bots.
+	Bots *Bots
+	// ServiceWorkers lets the page use service workers, by default requests bypass them, so that they can't intercept
+	// them.
+	ServiceWorkers bool
+	// BrowserCache lets the browser cache responses, by default it's disabled, so that renders don't depend on what
+	// previous renders loaded.
+	BrowserCache bool
+	// AcceptDialogs accepts JavaScript dialogs the page opens (alert, confirm, prompt, and beforeunload), by default
+	// they're dismissed, they'd block the page until the render timed out otherwise.
+	AcceptDialogs bool
+	// BrowserDownloads keeps the download behavior of the browser, by default downloads the page triggers are denied,
+	// so that the render doesn't stall waiting for them.
+	BrowserDownloads bool
+	NetworkEmulation *NetworkEmulation
+	// Proxy is the proxy server of requests the browser sends over the network if set.
+	Proxy *Proxy
+	// Device is the name of a device preset to emulate, its viewport, scale factor, touch, and user agent, if the
+	// request has none.
+	Device string
+	// Viewport overrides the one of the device.
+	Viewport *Viewport
+	// Locale overrides the one of the browser, e.g. for Intl formatting, it's taken from the forwarded Accept-Language
+	// header if it's from_request. Timezone is an IANA timezone ID overriding the one of the browser.
+	Locale    string
+	Timezone  string
+	BlockURLs *BlockURLs
+	// RewriteURLs rewrite URLs of requests of the page that aren't blocked, before they're routed by the host lists.
+	RewriteURLs []*RewriteURL
+	// MaxRequests fails requests of the page once it made this many, zero means unlimited.
+	MaxRequests int
+	// HintsOnly loads the page only to discover resources it needs, the DOM isn't taken, the rendering has no
+	// serializer.
+	HintsOnly bool
+	// MaxUpstreamErrors aborts the render with ErrUpstreamErrors once this many sub-requests served by the handler got
+	// a server error, so that a struggling upstream isn't loaded by requests of a page that would render degraded,
+	// zero means unlimited.
+	MaxUpstreamErrors int
+	// FailOnException fails the render with ErrUncaughtException if JavaScript of the page threw an uncaught
+	// exception, so that a page half-rendered by a broken bundle isn't served.
+	FailOnException bool
+	// MaxNodes fails the render with ErrTooManyNodes if the DOM tree has more nodes, so that a pathological page isn't
+	// serialized, zero means unlimited.
+	MaxNodes int
+	// ValidateOutput fails the render of an HTML document with ErrInvalidOutput if the DOM tree doesn't look like
+	// a page, e.g. a script replaced it with an error message, so that it isn't served instead of the upstream one.
+	// Fragments aren't validated.
+	ValidateOutput bool
+	// TruncateOutput stops serializing nodes of the page once it's this many bytes, zero means unlimited.
+	TruncateOutput int64
+	// UpgradeInsecureRequests makes the browser load http resources of the page over https, instead of blocking them
+	// as mixed content.
+	UpgradeInsecureRequests bool
+	// ReferrerPolicy is the policy of the page, which determines Referer of its requests, empty keeps the policy of
+	// the document response, or the browser default.
+	ReferrerPolicy network.ReferrerPolicy
+	Links          *LinksConfig
+	// RedactQuery masks values of query parameters in logged URLs.
+	RedactQuery RedactQuery
+	// RecordDir saves recordings of renders into the directory, so that their serialization can be replayed without
+	// Chrome, see Replay.
+	RecordDir string
+	Logger    *zap.Logger
+}
+
+type renderRequest struct {
+	url  string
+	host string
+	// hostHeader overrides Host of requests to the handler, if set
+	hostHeader string
+	// document is the response for the navigation, if nil, it's requested from handler
+	document  response
+	handler   http.Handler
+	ctx       context.Context
+	cookies   []*http.Cookie
+	userAgent string
+	// headers are forwarded from the request to requests of the page served by the handler
+	headers http.Header
+	referer string
+	timeout time.Duration
+	nonce   string
+	// contextScript sets window.CaddyChrome.context of the page, if set
+	contextScript string
+	// method, body, and contentType are of the request, the navigation is a POST if it was, other methods navigate
+	// by GET, the body is sent again when a 307 or 308 redirect is followed
+	method      string
+	body        []byte
+	contentType string
+	// bot renders the variant of the page for bots
+	bot bool
+	// flattenShadowDOM flattens shadow roots for a client not supporting declarative shadow DOM, see FlattenShadowDOM
+	flattenShadowDOM bool
+	// timings records phases of the render for server_timing, if set
+	timings *renderTimings
+	debug   bool
+}
+
+// fetchDocument requests the document at the URL from the handler, with the method and the body of the request.
+func (req *renderRequest) fetchDocument() response {
+	document := &responseWriter{header: make(http.Header)}
+	method := req.method
+	if method == "" {
+		method = http.MethodGet
+	}
+	var body io.Reader
+	if req.body != nil {
+		body = bytes.NewReader(req.body)
+	}
+	documentRequest := httptest.NewRequest(method, req.url, body).WithContext(req.ctx)
+	if req.contentType != "" {
+		documentRequest.Header.Set("Content-Type", req.contentType)
+	}
+	for _, cookie := range req.cookies {
+		documentRequest.AddCookie(cookie)
+	}
+	if req.userAgent != "" {
+		documentRequest.Header.Set("User-Agent", req.userAgent)
+	}
+	for name, values := range req.headers {
+		documentRequest.Header[name] = values
+	}
+	if req.referer != "" {
+		documentRequest.Header.Set("Referer", req.referer)
+	}
+	if req.hostHeader != "" {
+		documentRequest.Host = req.hostHeader
+	}
+	req.handler.ServeHTTP(document, documentRequest)
+	return document
+}
+
+type rendering struct {
+	document   response
+	links      *LinkHints
+	serializer *domSerializer
+	duration   time.Duration
+	// timings are phases of the render, and of its serialization, if they're recorded
+	timings *renderTimings
+	// capture is the PDF, or the screenshot of the page, with Output capturing it
+	capture    []byte
+	console    []ConsoleMessage
+	exceptions []string
+	resources  []Resource
+	// status is the one the page declared, if any
+	status int
+	// location is the target of the redirect the page made, the page isn't serialized then
+	location string
+	// cancel closes the browser context of a streamed render, it's kept open until the tree is serialized
+	cancel func()
+}
+
+// Status returns the status of the rendered page, the one of the document response, unless the page declared another
+// one, or redirected.
+func (r *rendering) Status() int {
+	if r.status != 0 {
+		return r.status
+	}
+	return r.document.Status()
+}
+
+func (r *rendering) release() {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	if r.serializer != nil {
+		r.serializer.release()
+	}
+}
+
+// RenderResult is the serialized DOM of a rendered page, and what happened during the render.
+type RenderResult struct {
+	HTML []byte
+	// Capture is the PDF, or the screenshot of the page with Output capturing it, there's no HTML then, and Header has
+	// the Content-Type of the capture.
+	Capture []byte
+	// Header and Status are of the document response, unless the page declared another status, or redirected, then
+	// Header has the Location, and there's no HTML.
+	Header http.Header
+	Status int
+	// Links are values of Link headers with hints of resources the page loaded.
+	Links   []string
+	Console []ConsoleMessage
+	// Exceptions are descriptions of uncaught exceptions the page threw, without stack traces.
+	Exceptions []string
+	Resources  []Resource
+	Duration   time.Duration
+}
+
+// ConsoleMessage is a message the page logged to the console, Type is e.g. log, or error.
+type ConsoleMessage struct {
+	Type string
+	Text string
+}
+
+// Render navigates to the URL and returns the serialized DOM, or the capture with Output capturing the page, and the
+// headers and status of the document response, or of the page's redirect.
+func (r *Renderer) Render(ctx context.Context, rawURL string) ([]byte, http.Header, int, error) {
+	result, err := r.RenderResult(ctx, rawURL)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if result.Capture != nil {
+		return result.Capture, result.Header, result.Status, nil
+	}
+	return result.HTML, result.Header, result.Status, nil
+}
+
+// RenderResult is Render returning also links, console messages, and requests of the page.
+func (r *Renderer) RenderResult(ctx context.Context, rawURL string) (*RenderResult, error) {
+	if r.Browser == nil {
+		return nil, errors.New("no browser")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	handler := r.Handler
+	if handler == nil {
+		handler = transportHandler{http.DefaultTransport}
+	}
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	rendering, err := r.render(r.Browser, &renderRequest{
+		url:     rawURL,
+		host:    u.Host,
+		handler: handler,
+		ctx:     ctx,
+		timeout: timeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rendering.release()
+
+	header := rendering.document.Header().Clone()
+	var buf bytes.Buffer
+	if rendering.location != "" {
+		header.Set("Location", rendering.location)
+	} else if rendering.capture != nil {
+		header.Set("Content-Type", r.Output.contentType())
+	} else if err := rendering.serializer.Serialize(&buf); err != nil {
+		return nil, errors.Wrap(err, "failed to serialize")
+	}
+	return &RenderResult{
+		HTML:       buf.Bytes(),
+		Capture:    rendering.capture,
+		Header:     header,
+		Status:     rendering.Status(),
+		Links:      rendering.links.Headers(),
+		Console:    rendering.console,
+		Exceptions: rendering.exceptions,
+		Resources:  rendering.resources,
+		Duration:   rendering.duration,
+	}, nil
+}
+
+func (r *Renderer) render(chromeCtx context.Context, req *renderRequest) (*rendering, error) {
+	log := r.Logger
+	if log == nil {
+		log = zap.NewNop()
+	}
+
+	start := time.Now()
+	req.timings.reset()
+	if req.document == nil {
+		req.document = req.fetchDocument()
+	}
+	navigation := req.document
+	if r.Fragment {
+		navigation = wrapFragment(req.document)
+	}
+	if r.UpgradeInsecureRequests {
+		header := navigation.Header().Clone()
+		header.Add("Content-Security-Policy", "upgrade-insecure-requests")
+		navigation = &headerOverride{response: navigation, header: header}
+	}
+	if r.ReferrerPolicy != "" {
+		header := navigation.Header().Clone()
+		header.Set("Referrer-Policy", string(r.ReferrerPolicy))
+		navigation = &headerOverride{response: navigation, header: header}
+	}
+
+	timeoutCtx, timeoutCancel := context.WithTimeout(chromeCtx, req.timeout)
+	var browserContextOptions []chromedp.CreateBrowserContextOption
+	if r.Proxy != nil {
+		browserContextOptions = append(browserContextOptions, r.Proxy.browserContext)
+	}
+	browserCtx, browserCancel := chromedp.NewContext(timeoutCtx, chromedp.WithNewBrowserContext(browserContextOptions...))
+	stop := context.AfterFunc(req.ctx, browserCancel)
+	// sub-requests keep values of the request, but they're canceled with the render, e.g. when it times out, so that
+	// slow handlers don't outlive it
+	subCtx, subCancel := context.WithCancel(req.ctx)
+	context.AfterFunc(browserCtx, subCancel)
+	cancel := func() {
+		stop()
+		browserCancel()
+		timeoutCancel()
+		subCancel()
+	}
+	// a streamed tree is fetched while it's serialized, the rendering closes the browser context on release then
+	streams := r.StreamDOM && !req.debug && !r.Output.captures()
+	defer func() {
+		if !streams {
+			cancel()
+		}
+	}()
+
+	links := NewLinkHints(r.Links)
+	var requests atomic.Int64
+	var upstreamErrors atomic.Int64
+	var stats fetchStats
+	stats.start = start
+	var consoleMu sync.Mutex
+	var console []ConsoleMessage
+	var exceptions []string
+	var styleSheets *criticalCSS
+	if r.CriticalCSS {
+		styleSheets = newCriticalCSS()
+	}
+	var idle networkWaiter
+	if r.WaitFor != nil && r.WaitFor.NetworkIdle {
+		var err error
+		idle, err = r.WaitFor.networkWaiter()
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid network idle time")
+		}
+	}
+
+	var tasks chromedp.Tasks
+	tasks = append(tasks, fetch.Enable().WithHandleAuthRequests(r.Proxy.authenticates()))
+	tasks = append(tasks, runtime.Enable())
+	// navigatedAway is the URL the page navigated to, e.g. by location.href, it's responded as a redirect
+	var navigatedAway atomic.Pointer[string]
+	tasks = append(tasks, chromedp.ActionFunc(func(ctx context.Context) error {
+		// the main frame has the ID of its target
+		mainFrame := cdp.FrameID(chromedp.FromContext(ctx).Target.TargetID)
+		chromedp.ListenTarget(ctx, func(event any) {
+			if idle != nil {
+				idle.event(event)
+			}
+			switch event := event.(type) {
+			case *fetch.EventRequestPaused:
+				go func() {
+					var res response
+					// started is when the handler started serving the request, the navigation was served before
+					var started time.Time
+					pausedURL, err := url.Parse(event.Request.URL)
+					loggedURL := r.RedactQuery.Redact(event.Request.URL)
+					// Chrome requests the URL normalized, e.g. with the host lowercased
+					isNavigate := sameURL(event.Request.URL, req.url)
+					log.Debug("request paused",
+						zap.String("request_url", loggedURL),
+						zap.Bool("is_navigate", isNavigate),
+						zap.Bool("has_post_data", event.Request.HasPostData))
+
+					if err != nil {
+						log.Error("failed to parse request URL", zap.String("request_url", loggedURL), zap.Error(err))
+						stats.add(event, ResourceFailed, 0, 0)
+						browserCancel()
+						return
+					}
+					// requestURL is where the request is fulfilled from, or continued to, the page keeps the URL it requested
+					requestURL, routedURL := event.Request.URL, pausedURL
+					if rewritten, ok := rewriteURL(r.RewriteURLs, requestURL); ok && !isNavigate {
+						if rewrittenURL, err := url.Parse(rewritten); err == nil {
+							log.Debug("request rewritten", zap.String("request_url", loggedURL), zap.String("rewritten_url", r.RedactQuery.Redact(rewritten)))
+							requestURL, routedURL = rewritten, rewrittenURL
+						}
+					}
+
+					if isNavigate {
+						res = navigation
+
+					} else if event.ResourceType == network.ResourceTypeDocument && event.FrameID == mainFrame {
+						target := event.Request.URL
+						navigatedAway.CompareAndSwap(nil, &target)
+						log.Debug("page navigated away", zap.String("request_url", loggedURL))
+						if err := fetch.FailRequest(event.RequestID, network.ErrorReasonAborted).Do(ctx); err != nil {
+							log.Error("failed to abort navigation", zap.String("request_url", loggedURL), zap.Error(err))
+						}
+						stats.add(event, ResourceBlocked, 0, 0)
+						browserCancel()
+						return
+
+					} else if count := requests.Add(1); r.MaxRequests > 0 && count > int64(r.MaxRequests) {
+						if count == int64(r.MaxRequests)+1 {
+							log.Warn("too many requests, failing the rest", zap.String("url", r.RedactQuery.Redact(req.url)), zap.Int("max_requests", r.MaxRequests))
+						}
+						err := fetch.FailRequest(event.RequestID, network.ErrorReasonBlockedByClient).Do(ctx)
+						if err != nil {
+							log.Error("failed to block request", zap.String("request_url", loggedURL), zap.Error(err))
+							stats.add(event, ResourceFailed, 0, 0)
+							browserCancel()
+						} else {
+							stats.add(event, ResourceBlocked, 0, 0)
+						}
+
+						log.Debug("request over limit blocked", zap.String("request_url", loggedURL))
+
+						return
+
+					} else if r.BlockURLs.Match(event.Request.URL) || r.AMP && matchAnyText(ampRuntimeURLPatterns, event.Request.URL) {
+						err := fetch.FailRequest(event.RequestID, network.ErrorReasonBlockedByClient).Do(ctx)
+						if err != nil {
+							log.Error("failed to block request", zap.String("request_url", loggedURL), zap.Error(err))
+							stats.add(event, ResourceFailed, 0, 0)
+							browserCancel()
+						} else {
+							stats.add(event, ResourceBlocked, 0, 0)
+						}
+
+						log.Debug("request blocked by URL", zap.String("request_url", loggedURL))
+
+						return
+
+					} else if r.handlesResourceType(event.ResourceType) && (routedURL.Host == req.host || slices.Contains(r.FulfillHosts, routedURL.Host)) {
+						if pausedURL.Host == req.host {
+							links.Add(event.Request.URL, event.ResourceType)
+						} else {
+							links.AddPreconnect(pausedURL.Scheme+"://"+pausedURL.Host, event.ResourceType)
+						}
+
+						var body io.Reader
+						if event.Request.HasPostData {
+							body = strings.NewReader(event.Request.PostData)
+						}
+						subRequest := httptest.NewRequest(event.Request.Method, requestURL, body).WithContext(subCtx)
+						for name, value := range event.Request.Headers {
+							subRequest.Header.Add(name, value.(string))
+						}
+						for name, values := range req.headers {
+							subRequest.Header[name] = values
+						}
+						if req.hostHeader != "" && routedURL.Host == req.host {
+							subRequest.Host = req.hostHeader
+						}
+						if subRequest.Header.Get("Referer") == "" {
+							if referer := defaultReferer(req.url, pausedURL, event.Request.ReferrerPolicy); referer != "" {
+								subRequest.Header.Set("Referer", referer)
+							}
+						}
+
+						subResponse := &responseWriter{header: make(http.Header)}
+
+						started = time.Now()
+						req.handler.ServeHTTP(subResponse, subRequest)
+						if status := subResponse.Status(); status < 200 || status >= 300 {
+							links.Exclude(event.Request.URL)
+						}
+						if status := subResponse.Status(); r.MaxUpstreamErrors > 0 && status >= 500 {
+							if count := upstreamErrors.Add(1); count >= int64(r.MaxUpstreamErrors) {
+								if count == int64(r.MaxUpstreamErrors) {
+									log.Warn("too many upstream errors, aborting render", zap.String("url", r.RedactQuery.Redact(req.url)), zap.Int("max_upstream_errors", r.MaxUpstreamErrors))
+								}
+								stats.add(event, ResourceFailed, status, 0)
+								browserCancel()
+								return
+							}
+						}
+
+						res = subResponse
+
+					} else if r.handlesResourceType(event.ResourceType) && slices.Contains(r.ContinueHosts, routedURL.Host) {
+						links.AddPreconnect(pausedURL.Scheme+"://"+pausedURL.Host, event.ResourceType)
+
+						started = time.Now()
+						continueRequest := fetch.ContinueRequest(event.RequestID)
+						if requestURL != event.Request.URL {
+							continueRequest = continueRequest.WithURL(requestURL)
+						}
+						err = continueRequest.Do(ctx)
+						if err != nil {
+							log.Error("failed to continue request", zap.String("request_url", loggedURL), zap.Error(err))
+							stats.add(event, ResourceFailed, 0, 0)
+							browserCancel()
+						} else {
+							stats.addTimed(event, ResourceContinued, 0, 0, started)
+						}
+
+						log.Debug("request continued", zap.String("request_url", loggedURL))
+
+						return
+
+					} else {
+						if pausedURL.Host == req.host {
+							links.Add(event.Request.URL, event.ResourceType)
+						} else {
+							links.AddPreconnect(pausedURL.Scheme+"://"+pausedURL.Host, event.ResourceType)
+						}
+
+						err := fetch.FailRequest(event.RequestID, network.ErrorReasonBlockedByClient).Do(ctx)
+						if err != nil {
+							log.Error("failed to block request", zap.String("request_url", loggedURL), zap.Error(err))
+							stats.add(event, ResourceFailed, 0, 0)
+							browserCancel()
+						} else {
+							stats.add(event, ResourceBlocked, 0, 0)
+						}
+
+						log.Debug("request blocked", zap.String("request_url", loggedURL))
+
+						return
+					}
+
+					fulfill := fetch.FulfillRequest(event.RequestID, int64(res.Status())).WithResponsePhrase(statusPhrase(res))
+					fulfill.ResponseHeaders = fulfillHeaders(res.Header())
+					if bodyAllowed(res.Status()) {
+						fulfill.Body = base64.StdEncoding.EncodeToString(res.Buffer().Bytes())
+					}
+					err = fulfill.Do(ctx)
+					if err != nil {
+						log.Error("failed to fulfill request", zap.String("request_url", loggedURL), zap.Error(err))
+						stats.add(event, ResourceFailed, 0, 0)
+						browserCancel()
+						return
+					}
+					stats.addTimed(event, ResourceFulfilled, res.Status(), res.Buffer().Len(), started)
+
+					log.Debug("request fulfilled", zap.String("request_url", loggedURL))
+				}()
+			case *network.EventRequestWillBeSent:
+				// the initiator has a URL only if it's a script importing a module
+				if event.Type == network.ResourceTypeScript && event.Initiator != nil && event.Initiator.Type == network.InitiatorTypeScript && event.Initiator.URL != "" {
+					links.AddModule(event.Request.URL)
+				}
+			case *fetch.EventAuthRequired:
+				go func() {
+					err := fetch.ContinueWithAuth(event.RequestID, r.Proxy.authResponse(event.AuthChallenge)).Do(ctx)
+					if err != nil {
+						log.Error("failed to answer authentication challenge", zap.String("request_url", r.RedactQuery.Redact(event.Request.URL)), zap.Error(err))
+					}
+				}()
+			case *page.EventJavascriptDialogOpening:
+				go func() {
+					log.Debug("javascript dialog opened", zap.String("type", event.Type.String()), zap.String("message", event.Message), zap.Bool("accept", r.AcceptDialogs))
+					// an accepted prompt returns its default value
+					if err := page.HandleJavaScriptDialog(r.AcceptDialogs).WithPromptText(event.DefaultPrompt).Do(ctx); err != nil {
+						log.Error("failed to handle javascript dialog", zap.String("type", event.Type.String()), zap.Error(err))
+					}
+				}()
+			case *css.EventStyleSheetAdded:
+				if styleSheets != nil {
+					styleSheets.addStyleSheet(event.Header)
+				}
+			case *runtime.EventConsoleAPICalled:
+				consoleMu.Lock()
+				console = append(console, ConsoleMessage{Type: event.Type.String(), Text: consoleText(event.Args)})
+				consoleMu.Unlock()
+			case *runtime.EventExceptionThrown:
+				text := exceptionText(event.ExceptionDetails)
+				log.Error("exception thrown in runtime", zap.String("exception_details", text))
+				consoleMu.Lock()
+				exceptions = append(exceptions, text)
+				consoleMu.Unlock()
+			}
+		})
+		return nil
+	}))
+	for _, cookie := range req.cookies {
+		tasks = append(tasks, setCookie(cookie, req.host, req.url))
+	}
+	if !r.ServiceWorkers {
+		tasks = append(tasks, network.SetBypassServiceWorker(true))
+	}
+	if !r.BrowserCache {
+		tasks = append(tasks, network.SetCacheDisabled(true))
+	}
+	if !r.BrowserDownloads {
+		tasks = append(tasks, chromedp.ActionFunc(func(ctx context.Context) error {
+			return browser.SetDownloadBehavior(browser.SetDownloadBehaviorBehaviorDeny).
+				WithBrowserContextID(chromedp.FromContext(ctx).BrowserContextID).
+				Do(cdp.WithExecutor(ctx, chromedp.FromContext(ctx).Browser))
+		}))
+	}
+	if r.NetworkEmulation != nil {
+		conditions, err := r.NetworkEmulation.conditions()
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid network emulation")
+		}
+		tasks = append(tasks, conditions)
+	}
+	if r.Device != "" {
+		info, ok := lookupDevice(r.Device)
+		if !ok {
+			return nil, errors.Errorf("unknown device %q", r.Device)
+		}
+		tasks = append(tasks, chromedp.Emulate(info))
+	}
+	if r.Viewport != nil || r.Output != nil && r.Output.Width > 0 {
+		viewport := r.Viewport
+		if viewport == nil {
+			viewport = &Viewport{}
+		}
+		width, height := viewport.Width, viewport.Height
+		if r.Output != nil && r.Output.Width > 0 {
+			width, height = r.Output.Width, r.Output.Height
+		}
+		tasks = append(tasks, viewport.emulate(width, height))
+	}
+	locale := r.Locale
+	if locale == localeFromRequest {
+		locale = acceptedLocale(req.headers.Get("Accept-Language"))
+	}
+	if locale != "" {
+		tasks = append(tasks, emulation.SetLocaleOverride().WithLocale(locale))
+	}
+	if r.Timezone != "" {
+		tasks = append(tasks, emulation.SetTimezoneOverride(r.Timezone))
+	}
+	ua := req.userAgent
+	if r.Viewport != nil && r.Viewport.UserAgent != "" {
+		ua = r.Viewport.UserAgent
+	}
+	if ua != "" {
+		// navigator.languages of the page follows the forwarded Accept-Language
+		tasks = append(tasks, emulation.SetUserAgentOverride(ua).WithAcceptLanguage(req.headers.Get("Accept-Language")))
+	}
+	tasks = append(tasks, chromedp.ActionFunc(func(ctx context.Context) error {
+		_, err := page.AddScriptToEvaluateOnNewDocument(onNewDocumentScript).Do(ctx)
+		return err
+	}))
+	if req.contextScript != "" {
+		tasks = append(tasks, chromedp.ActionFunc(func(ctx context.Context) error {
+			_, err := page.AddScriptToEvaluateOnNewDocument(req.contextScript).Do(ctx)
+			return err
+		}))
+	}
+	if r.AdoptedStyleSheets {
+		tasks = append(tasks, chromedp.ActionFunc(func(ctx context.Context) error {
+			_, err := page.AddScriptToEvaluateOnNewDocument(adoptedStyleSheetsScript).Do(ctx)
+			return err
+		}))
+	}
+	if r.OnNewDocumentScript != "" {
+		tasks = append(tasks, chromedp.ActionFunc(func(ctx context.Context) error {
+			_, err := page.AddScriptToEvaluateOnNewDocument(r.OnNewDocumentScript).Do(ctx)
+			return err
+		}))
+	}
+	for _, script := range r.InjectScripts {
+		tasks = append(tasks, chromedp.ActionFunc(func(ctx context.Context) error {
+			_, err := page.AddScriptToEvaluateOnNewDocument(script).Do(ctx)
+			return err
+		}))
+	}
+	if idle != nil {
+		tasks = append(tasks, idle.enable())
+	}
+	tasks = append(tasks, req.timings.beginTask(timingNavigation))
+	if req.method == http.MethodPost {
+		tasks = append(tasks, navigateByPost(req.url))
+	} else if req.referer != "" {
+		tasks = append(tasks, navigateWithReferrer(req.url, req.referer))
+	} else {
+		tasks = append(tasks, chromedp.Navigate(req.url))
+	}
+	tasks = append(tasks, req.timings.beginTask(timingWait))
+	tasks = append(tasks, chromedp.Evaluate("window.CaddyChrome.pendingTask", nil, func(p *runtime.EvaluateParams) *runtime.EvaluateParams {
+		p.AwaitPromise = true
+		return p
+	}))
+	if r.WaitFor != nil {
+		tasks = append(tasks, r.WaitFor.wait(idle, log))
+	}
+	if r.SettleTime > 0 {
+		tasks = append(tasks, chromedp.Sleep(r.SettleTime))
+	}
+	if r.PostRenderScript != "" {
+		tasks = append(tasks, chromedp.Evaluate("(async () => {\n"+r.PostRenderScript+"\n})()", nil, func(p *runtime.EvaluateParams) *runtime.EvaluateParams {
+			p.AwaitPromise = true
+			return p
+		}))
+	}
+	tasks = append(tasks, chromedp.Evaluate("window.CaddyChrome.restoreIsAttributes()", nil))
+	tasks = append(tasks, chromedp.ActionFunc(func(ctx context.Context) error {
+		// entry points of modules are requested by the parser, like classic scripts
+		var modules []string
+		if err := chromedp.Evaluate("window.CaddyChrome.moduleScripts()", &modules).Do(ctx); err != nil {
+			return err
+		}
+		for _, module := range modules {
+			links.AddModule(module)
+		}
+		return nil
+	}))
+	if r.AdoptedStyleSheets {
+		tasks = append(tasks, chromedp.Evaluate("window.CaddyChrome.inlineAdoptedStyleSheets()", nil))
+	}
+	if len(r.RemoveSelectors) > 0 {
+		tasks = append(tasks, removeElements(r.RemoveSelectors))
+	}
+	var serializer *domSerializer
+	var recorded *cdp.Node
+	var captured []byte
+	tasks = append(tasks, req.timings.beginTask(timingDOM))
+	tasks = append(tasks, chromedp.ActionFunc(func(ctx context.Context) error {
+		if r.HintsOnly {
+			return nil
+		}
+		if r.Output.captures() {
+			var err error
+			captured, err = r.Output.capture(ctx)
+			return err
+		}
+		var root *cdp.Node
+		var err error
+		if r.DOMSnapshot {
+			root, err = captureSnapshot(ctx, r.Select != nil)
+		} else if streams {
+			root, err = dom.GetDocument().WithDepth(streamDepth).WithPierce(true).Do(ctx)
+		} else {
+			root, err = dom.GetDocument().WithDepth(-1).WithPierce(true).Do(ctx)
+		}
+		if err != nil {
+			return err
+		}
+		recorded = root
+		if r.MaxNodes > 0 && exceedsNodes(root, r.MaxNodes) {
+			return errors.Wrapf(ErrTooManyNodes, "more than %d", r.MaxNodes)
+		}
+		if r.ValidateOutput && !r.Fragment && isHTML(req.document.Header().Get("Content-Type")) {
+			if err := validateOutput(root); err != nil {
+				return err
+			}
+		}
+		if req.debug {
+			outerHTML, err := dom.GetOuterHTML().WithNodeID(root.NodeID).Do(ctx)
+			if err != nil {
+				return err
+			}
+			tree, err := json.Marshal(root)
+			if err != nil {
+				return err
+			}
+			log.Debug("dom snapshot",
+				zap.String("url", r.RedactQuery.Redact(req.url)),
+				zap.Any("tree", json.RawMessage(tree)),
+				zap.String("outer_html", outerHTML))
+		}
+		skipDoctype := r.NoForcedDoctype || r.Fragment || !isHTML(req.document.Header().Get("Content-Type"))
+		if r.Fragment {
+			root = fragmentRoot(root)
+		}
+		if r.Select != nil {
+			nodeID, err := dom.QuerySelector(root.NodeID, r.Select.Selector).Do(ctx)
+			if err != nil {
+				return err
+			}
+			if selected := findNode(root, nodeID); selected != nil {
+				root = selected
+				skipDoctype = true
+			} else if r.Select.Required {
+				return errors.Errorf("selector %q matched nothing", r.Select.Selector)
+			} else {
+				log.Debug("selector matched nothing, serializing whole document", zap.String("selector", r.Select.Selector))
+			}
+		}
+		var critical *criticalStyles
+		if styleSheets != nil {
+			critical, err = styleSheets.collect(ctx, root)
+			if err != nil {
+				return err
+			}
+		}
+		serializer = r.newSerializer(root, req, skipDoctype, critical)
+		if streams {
+			serializer.stream = newDOMStream(recorded, func(node *cdp.Node) (*cdp.Node, error) {
+				return dom.DescribeNode().WithBackendNodeID(node.BackendNodeID).WithDepth(-1).WithPierce(true).Do(ctx)
+			})
+		}
+		return nil
+	}))
+	err := chromedp.Run(browserCtx, tasks)
+	// also of a failed render, the phase it failed in ends with it
+	req.timings.end()
+	log.Debug("render requests", append([]zap.Field{zap.String("url", r.RedactQuery.Redact(req.url))}, stats.fields()...)...)
+	if req.debug {
+		// also of failed renders, e.g. a sub-request taking the whole timeout
+		stats.mu.Lock()
+		log.Info("render waterfall",
+			zap.String("url", r.RedactQuery.Redact(req.url)),
+			zap.Strings("waterfall", waterfall(stats.resources, time.Since(start), r.RedactQuery.Redact)))
+		stats.mu.Unlock()
+	}
+	if count := upstreamErrors.Load(); r.MaxUpstreamErrors > 0 && count >= int64(r.MaxUpstreamErrors) {
+		// the render might have finished before it was aborted, but the page is degraded anyway
+		err = errors.Wrapf(ErrUpstreamErrors, "%d sub-requests failed", count)
+	}
+	consoleMu.Lock()
+	if r.FailOnException && len(exceptions) > 0 && !errors.Is(err, ErrUpstreamErrors) {
+		err = &exceptionsError{exceptions: slices.Clone(exceptions)}
+	}
+	consoleMu.Unlock()
+	if target := navigatedAway.Load(); target != nil {
+		streams = false
+		if serializer != nil {
+			serializer.release()
+		}
+		return &rendering{
+			document: req.document,
+			links:    links,
+			duration: time.Since(start),
+			status:   http.StatusFound,
+			location: *target,
+		}, nil
+	}
+	if errors.Is(err, ErrUpstreamErrors) || errors.Is(err, ErrUncaughtException) {
+		streams = false
+		if serializer != nil {
+			serializer.release()
+		}
+		return nil, err
+	}
+	if err != nil {
+		streams = false
+		if serializer != nil {
+			serializer.release()
+		}
+		return nil, errors.Wrap(err, "failed to run chrome")
+	}
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	if r.RecordDir != "" {
+		recording := &Recording{
+			URL:       req.url,
+			Status:    req.document.Status(),
+			Header:    req.document.Header(),
+			Root:      recorded,
+			Resources: stats.resources,
+		}
+		if err := recording.save(r.RecordDir); err != nil {
+			log.Error("failed to save recording", zap.String("url", r.RedactQuery.Redact(req.url)), zap.Error(err))
+		}
+	}
+	consoleMu.Lock()
+	defer consoleMu.Unlock()
+	rendered := &rendering{
+		document:   req.document,
+		links:      links,
+		serializer: serializer,
+		duration:   time.Since(start),
+		timings:    req.timings,
+		capture:    captured,
+		console:    slices.Clone(console),
+		exceptions: slices.Clone(exceptions),
+		resources:  slices.Clone(stats.resources),
+	}
+	if recorded != nil {
+		if status, location := pageStatus(recorded); status != 0 {
+			log.Debug("page declared status", zap.String("url", r.RedactQuery.Redact(req.url)), zap.Int("status", status), zap.String("location", r.RedactQuery.Redact(location)))
+			rendered.status = status
+			rendered.location = location
+		}
+	}
+	if streams {
+		rendered.cancel = cancel
+	}
+	return rendered, nil
+}
+
+// newSerializer returns the serializer of the tree with serialization options of the renderer and the request.
+func (r *Renderer) newSerializer(root *cdp.Node, req *renderRequest, skipDoctype bool, critical *criticalStyles) *domSerializer {
+	if r.FlattenShadowDOM || req.flattenShadowDOM {
+		root = flattenShadowDOM(root)
+	}
+	serializer := newDomSerializer(root)
+	serializer.critical = critical
+	serializer.optimizeImages = r.OptimizeImages
+	serializer.stripHydration = r.StripHydration
+	if req.bot && r.Bots != nil {
+		serializer.stripScripts = r.Bots.StripScripts
+		if r.Bots.StripHydration != nil {
+			serializer.stripHydration = r.Bots.StripHydration
+		}
+	}
+	serializer.parallelThreshold = r.ParallelSerialize
+	serializer.nonce = req.nonce
+	serializer.sanitize = r.Sanitize
+	serializer.skipDoctype = skipDoctype
+	serializer.omitEmptyHeadBody = r.OmitEmptyHeadBody
+	serializer.minify = r.Minify
+	serializer.truncateAt = r.TruncateOutput
+	if r.Iframes {
+		serializer.iframesOrigin = origin(req.url)
+	}
+	serializer.xml = !r.Fragment && isXML(req.document.Header().Get("Content-Type"))
+	if r.AMP && isAMP(root) {
+		serializer.keepAMP()
+	}
+	return serializer
+}
+
+// consoleText returns the arguments of a console call joined by spaces, as the browser would print them.
+func consoleText(args []*runtime.RemoteObject) string {
+	texts := make([]string, 0, len(args))
+	for _, arg := range args {
+		switch {
+		case arg.Type == runtime.TypeString:
+			var value string
+			if err := json.Unmarshal(arg.Value, &value); err == nil {
+				texts = append(texts, value)
+				continue
+			}
+		case arg.Value != nil:
+			texts = append(texts, string(arg.Value))
+			continue
+		}
+		texts = append(texts, arg.Description)
+	}
+	return strings.Join(texts, " ")
+}
+
+// hopByHopHeaders are meaningful only for a single connection, they're not forwarded to Chrome.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// fulfillHeaders returns headers of a fulfilled response without hop-by-hop headers, each value of a multi-valued
+// header (e.g. Set-Cookie) is a separate entry.
+func fulfillHeaders(header http.Header) []*fetch.HeaderEntry {
+	header = header.Clone()
+	for _, connectionHeader := range header.Values("Connection") {
+		for _, name := range strings.Split(connectionHeader, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+
+	entries := make([]*fetch.HeaderEntry, 0, len(header))
+	for name, values := range header {
+		for _, value := range values {
+			entries = append(entries, &fetch.HeaderEntry{Name: name, Value: value})
+		}
+	}
+	return entries
+}
+
+// Outcomes of requests of the page.
+const (
+	ResourceFulfilled = "fulfilled"
+	ResourceContinued = "continued"
+	ResourceBlocked   = "blocked"
+	// ResourceFailed is a request the interception failed to handle, e.g. Chrome rejected the fulfillment.
+	ResourceFailed = "failed"
+)
+
+// Resource is a request of the page and how it was handled.
+type Resource struct {
+	URL          string
+	ResourceType string
+	Outcome      string
+	// Status of the fulfilled response.
+	Status int
+	// Size is of the body of the fulfilled response.
+	Size int
+	// Start is when the request started being handled since the start of the render, and Duration how long it took,
+	// i.e. serving and fulfilling it, or continuing it; they're zero for others and the navigation.
+	Start    time.Duration
+	Duration time.Duration
+}
+
+// fetchStats counts how requests of a render were handled by the fetch interception.
+type fetchStats struct {
+	fulfilled atomic.Int64
+	continued atomic.Int64
+	blocked   atomic.Int64
+	failed    atomic.Int64
+	// bytes is the total size of bodies of the fulfilled responses
+	bytes atomic.Int64
+
+	// start is of the render, times of resources are relative to it
+	start     time.Time
+	mu        sync.Mutex
+	resources []Resource
+}
+
+func (s *fetchStats) add(event *fetch.EventRequestPaused, outcome string, status int, size int) {
+	s.addTimed(event, outcome, status, size, time.Time{})
+}
+
+// addTimed adds the request handled since started until now, or untimed if started is zero.
+func (s *fetchStats) addTimed(event *fetch.EventRequestPaused, outcome string, status int, size int, started time.Time) {
+	switch outcome {
+	case ResourceFulfilled:
+		s.fulfilled.Add(1)
+		s.bytes.Add(int64(size))
+	case ResourceContinued:
+		s.continued.Add(1)
+	case ResourceBlocked:
+		s.blocked.Add(1)
+	case ResourceFailed:
+		s.failed.Add(1)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resource := Resource{
+		URL:          event.Request.URL,
+		ResourceType: event.ResourceType.String(),
+		Outcome:      outcome,
+		Status:       status,
+		Size:         size,
+	}
+	if !started.IsZero() {
+		resource.Start = started.Sub(s.start)
+		resource.Duration = time.Since(started)
+	}
+	s.resources = append(s.resources, resource)
+}
+
+func (s *fetchStats) fields() []zap.Field {
+	return []zap.Field{
+		zap.Int64("fulfilled", s.fulfilled.Load()),
+		zap.Int64("continued", s.continued.Load()),
+		zap.Int64("blocked", s.blocked.Load()),
+		zap.Int64("failed", s.failed.Load()),
+		zap.Int64("fulfilled_bytes", s.bytes.Load()),
+	}
+}
+
+// navigateWithReferrer is chromedp.Navigate with the referrer of the navigation set.
+func navigateWithReferrer(urlstr string, referrer string) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		listenCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		loaded := make(chan struct{})
+		var once sync.Once
+		chromedp.ListenTarget(listenCtx, func(event any) {
+			if _, ok := event.(*page.EventLoadEventFired); ok {
+				once.Do(func() { close(loaded) })
+			}
+		})
+
+		_, _, errorText, err := page.Navigate(urlstr).WithReferrer(referrer).Do(ctx)
+		if err != nil {
+			return err
+		}
+		if errorText != "" {
+			return errors.Errorf("page load error %s", errorText)
+		}
+		select {
+		case <-loaded:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// navigateByPost navigates the blank page the render starts in by submitting a form, so that the navigation is a POST
+// as the request was, e.g. for pages of form results. The navigation is fulfilled by the upstream response, so the
+// form is empty, and it has no referrer.
+func navigateByPost(urlstr string) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		listenCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		loaded := make(chan struct{})
+		var once sync.Once
+		chromedp.ListenTarget(listenCtx, func(event any) {
+			if _, ok := event.(*page.EventLoadEventFired); ok {
+				once.Do(func() { close(loaded) })
+			}
+		})
+
+		action, err := json.Marshal(urlstr)
+		if err != nil {
+			return err
+		}
+		_, exception, err := runtime.Evaluate(`(() => {
+			const form = document.createElement("form")
+			form.method = "post"
+			form.action = ` + string(action) + `
+			document.documentElement.append(form)
+			form.submit()
+		})()`).Do(ctx)
+		if err != nil {
+			return err
+		}
+		if exception != nil {
+			return errors.Errorf("failed to submit navigation form: %s", exceptionText(exception))
+		}
+		select {
+		case <-loaded:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// defaultReferer returns Referer of a request of the page, which the browser didn't send, as it would be with the
+// referrer policy of the request, strict-origin-when-cross-origin by default.
+func defaultReferer(documentURL string, requestURL *url.URL, policy network.ReferrerPolicy) string {
+	document, err := url.Parse(documentURL)
+	if err != nil {
+		return ""
+	}
+	document.Fragment = ""
+	document.User = nil
+	full := document.String()
+	origin := document.Scheme + "://" + document.Host + "/"
+	sameOrigin := document.Scheme == requestURL.Scheme && document.Host == requestURL.Host
+	downgrade := document.Scheme == "https" && requestURL.Scheme != "https"
+
+	switch policy {
+	case network.ReferrerPolicyNoReferrer:
+		return ""
+	case network.ReferrerPolicyUnsafeURL:
+		return full
+	case network.ReferrerPolicyNoReferrerWhenDowngrade:
+		if downgrade {
+			return ""
+		}
+		return full
+	case network.ReferrerPolicyOrigin:
+		return origin
+	case network.ReferrerPolicyOriginWhenCrossOrigin:
+		if sameOrigin {
+			return full
+		}
+		return origin
+	case network.ReferrerPolicySameOrigin:
+		if sameOrigin {
+			return full
+		}
+		return ""
+	case network.ReferrerPolicyStrictOrigin:
+		if downgrade {
+			return ""
+		}
+		return origin
+	default:
+		if downgrade {
+			return ""
+		}
+		if sameOrigin {
+			return full
+		}
+		return origin
+	}
+}
+
+const (
+	fragmentPrefix = "<!DOCTYPE html><html><head></head><body>"
+	fragmentSuffix = "</body></html>"
+)
+
+// wrapFragment returns the response with the body wrapped in a document, explicit body makes sure elements that
+// would otherwise be moved to head (e.g. script, or link) stay in the fragment.
+func wrapFragment(document response) response {
+	wrapped := &responseWriter{status: document.Status(), header: document.Header().Clone()}
+	wrapped.header.Del("Content-Length")
+	wrapped.buffer.Grow(len(fragmentPrefix) + document.Buffer().Len() + len(fragmentSuffix))
+	wrapped.buffer.WriteString(fragmentPrefix)
+	wrapped.buffer.Write(document.Buffer().Bytes())
+	wrapped.buffer.WriteString(fragmentSuffix)
+	return wrapped
+}
+
+// fragmentRoot returns a document fragment with children of the body of the wrapper document.
+func fragmentRoot(root *cdp.Node) *cdp.Node {
+	for _, html := range root.Children {
+		if html.NodeType != cdp.NodeTypeElement || html.LocalName != "html" {
+			continue
+		}
+		for _, body := range html.Children {
+			if body.NodeType == cdp.NodeTypeElement && body.LocalName == "body" {
+				return &cdp.Node{
+					NodeType: cdp.NodeTypeDocumentFragment,
+					NodeName: "#document-fragment",
+					Children: body.Children,
+				}
+			}
+		}
+	}
+	return root
+}
+
+// Select serializes only the first element matching the CSS selector. If nothing matches, the whole document is
+// serialized, or if it's required, the render fails.
+type Select struct {
+	Selector string `json:"selector,omitempty"`
+	Required bool   `json:"required,omitempty"`
+}
+
+// maxSettleTime bounds SettleTime, it's a last resort for a few late updates, not a substitute of the ready signal.
+const maxSettleTime = 5 * time.Second
+
+// waitForInterval is how often the page is checked for the ready signal.
+const waitForInterval = 50 * time.Millisecond
+
+// WaitFor waits, after pending tasks are settled, until the page signals it's ready by an attribute of the document
+// element, and/or an element matching the CSS selector, for pages that can't use the pending task protocol, and/or until
+// web fonts of the page are loaded, so that layout-dependent output isn't taken with fallback fonts, and/or until the
+// network is idle. All the conditions must be satisfied, they're awaited concurrently, bounded by the render timeout,
+// if they're not satisfied in time, the DOM is taken as it is.
+type WaitFor struct {
+	Attribute   string `json:"attribute,omitempty"`
+	Element     string `json:"element,omitempty"`
+	Fonts       bool   `json:"fonts,omitempty"`
+	NetworkIdle bool   `json:"network_idle,omitempty"`
+	// NetworkIdleTime is the quiet period with no requests of the page in flight the network idle condition needs,
+	// if it's not set, Chrome's networkIdle lifecycle event (500ms after the load) is awaited.
+	NetworkIdleTime string `json:"network_idle_time,omitempty"`
+}
+
+// waitForReserve is the part of the render timeout kept for taking the DOM after the wait_for conditions time out.
+const waitForReserve = 500 * time.Millisecond
+
+// waitCondition is one of the conditions of WaitFor, its name is reported if it isn't satisfied in time.
+type waitCondition struct {
+	name string
+	wait func(ctx context.Context) error
+}
+
+// networkWaiter returns the tracker of the network idle condition.
+func (w *WaitFor) networkWaiter() (networkWaiter, error) {
+	if w.NetworkIdleTime == "" {
+		return newNetworkIdle(), nil
+	}
+	period, err := time.ParseDuration(w.NetworkIdleTime)
+	if err != nil {
+		return nil, err
+	}
+	return newNetworkQuiet(period), nil
+}
+
+// conditions returns the conditions to be awaited, the idle tracker is used for the network idle condition.
+func (w *WaitFor) conditions(idle networkWaiter) []waitCondition {
+	var conditions []waitCondition
+	if w.Attribute != "" {
+		name, _ := json.Marshal(w.Attribute)
+		expression := "document.documentElement.hasAttribute(" + string(name) + ")"
+		conditions = append(conditions, waitCondition{name: "attribute " + w.Attribute, wait: func(ctx context.Context) error {
+			return pollReady(ctx, expression)
+		}})
+	}
+	if w.Element != "" {
+		selector, _ := json.Marshal(w.Element)
+		expression := "document.querySelector(" + string(selector) + ") !== null"
+		conditions = append(conditions, waitCondition{name: "element " + w.Element, wait: func(ctx context.Context) error {
+			return pollReady(ctx, expression)
+		}})
+	}
+	if w.Fonts {
+		conditions = append(conditions, waitCondition{name: "fonts", wait: func(ctx context.Context) error {
+			err := chromedp.Evaluate("document.fonts.ready.then(() => undefined)", nil, func(p *runtime.EvaluateParams) *runtime.EvaluateParams {
+				p.AwaitPromise = true
+				return p
+			}).Do(ctx)
+			return errors.Wrap(err, "failed to wait for fonts")
+		}})
+	}
+	if w.NetworkIdle && idle != nil {
+		conditions = append(conditions, waitCondition{name: strings.TrimSpace("network_idle " + w.NetworkIdleTime), wait: idle.wait})
+	}
+	return conditions
+}
+
+// wait returns the action awaiting all the conditions concurrently. If they aren't satisfied before the render
+// timeout, short of the reserve for taking the DOM, the ones that weren't are logged, and the render goes on.
+func (w *WaitFor) wait(idle networkWaiter, log *zap.Logger) chromedp.Action {
+	conditions := w.conditions(idle)
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		// a failed condition cancels the others
+		waitCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		if deadline, ok := ctx.Deadline(); ok {
+			waitCtx, cancel = context.WithDeadline(waitCtx, deadline.Add(-waitForReserve))
+			defer cancel()
+		}
+		errs := make([]error, len(conditions))
+		var failed error
+		var failedOnce sync.Once
+		var wg sync.WaitGroup
+		for i, condition := range conditions {
+			wg.Add(1)
+			go func(i int, condition waitCondition) {
+				defer wg.Done()
+				errs[i] = condition.wait(waitCtx)
+				if errs[i] != nil && waitCtx.Err() == nil {
+					failedOnce.Do(func() {
+						failed = errs[i]
+						cancel()
+					})
+				}
+			}(i, condition)
+		}
+		wg.Wait()
+		if failed != nil {
+			return failed
+		}
+		var pending []string
+		for i, err := range errs {
+			if err != nil {
+				pending = append(pending, conditions[i].name)
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return errors.Wrapf(ctx.Err(), "wait_for %s not satisfied", strings.Join(pending, ", "))
+		}
+		log.Warn("wait_for not satisfied in time, taking the DOM as it is", zap.Strings("conditions", pending))
+		return nil
+	})
+}
+
+// pollReady evaluates the expression until it's true.
+func pollReady(ctx context.Context, expression string) error {
+	ticker := time.NewTicker(waitForInterval)
+	defer ticker.Stop()
+	for {
+		var ready bool
+		if err := chromedp.Evaluate(expression, &ready).Do(ctx); err != nil {
+			return errors.Wrap(err, "failed to check ready signal")
+		}
+		if ready {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// removeElements returns the action removing elements matching any of the selectors from the DOM.
+func removeElements(selectors []string) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		root, err := dom.GetDocument().WithDepth(-1).Do(ctx)
+		if err != nil {
+			return err
+		}
+		matched := make(map[cdp.NodeID]bool)
+		for _, selector := range selectors {
+			nodeIDs, err := dom.QuerySelectorAll(root.NodeID, selector).Do(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "failed to query selector %q", selector)
+			}
+			for _, nodeID := range nodeIDs {
+				matched[nodeID] = true
+			}
+		}
+		for _, nodeID := range outermostNodes(root, matched, nil) {
+			if err := dom.RemoveNode(nodeID).Do(ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// outermostNodes appends IDs of matched nodes of the tree that aren't descendants of other matched nodes, which are
+// removed with them.
+func outermostNodes(node *cdp.Node, matched map[cdp.NodeID]bool, nodeIDs []cdp.NodeID) []cdp.NodeID {
+	if matched[node.NodeID] {
+		return append(nodeIDs, node.NodeID)
+	}
+	for _, child := range node.Children {
+		nodeIDs = outermostNodes(child, matched, nodeIDs)
+	}
+	if node.TemplateContent != nil {
+		nodeIDs = outermostNodes(node.TemplateContent, matched, nodeIDs)
+	}
+	return nodeIDs
+}
+
+// ErrUpstreamErrors is the error of a render aborted because too many of its sub-requests got a server error, see
+// MaxUpstreamErrors.
+var ErrUpstreamErrors = errors.New("too many upstream errors")
+
+// ErrTooManyNodes is the error of a render whose DOM tree has more nodes than MaxNodes.
+var ErrTooManyNodes = errors.New("too many DOM nodes")
+
+// exceedsNodes reports whether the tree, including shadow roots, template contents, pseudo elements, and frame
+// documents, has more than max nodes, it stops counting once it has.
+func exceedsNodes(root *cdp.Node, max int) bool {
+	count := 0
+	var walk func(node *cdp.Node) bool
+	walk = func(node *cdp.Node) bool {
+		if count++; count > max {
+			return true
+		}
+		for _, nodes := range [][]*cdp.Node{node.ShadowRoots, node.PseudoElements, node.Children} {
+			for _, child := range nodes {
+				if walk(child) {
+					return true
+				}
+			}
+		}
+		for _, child := range []*cdp.Node{node.TemplateContent, node.ContentDocument} {
+			if child != nil && walk(child) {
+				return true
+			}
+		}
+		return false
+	}
+	return walk(root)
+}
+
+// findNode returns the node with the ID in the tree, or nil if there isn't one.
+func findNode(node *cdp.Node, nodeID cdp.NodeID) *cdp.Node {
+	if nodeID == 0 {
+		return nil
+	}
+	if node.NodeID == nodeID {
+		return node
+	}
+	if node.TemplateContent != nil {
+		if found := findNode(node.TemplateContent, nodeID); found != nil {
+			return found
+		}
+	}
+	for _, child := range node.Children {
+		if found := findNode(child, nodeID); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// isHTML reports whether the content type is HTML, or missing, in which case Chrome sniffs it.
+func isHTML(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "text/html"
+}
+
+// isXML reports whether the content type is an XML one, e.g. XHTML or SVG, whose documents are serialized by XML rules.
+func isXML(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml")
+}
+
+// serializedContentType returns Content-Type of the serialized document, the one of the document response if it
+// matches how the document was serialized, otherwise one of the serialization, e.g. when a fragment of an XHTML
+// document was serialized as HTML. The serializer writes UTF-8, so other charsets are replaced.
+func serializedContentType(contentType string, xml bool) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	changed := false
+	if err != nil || xml != isXML(contentType) {
+		mediaType, params, changed = "text/html", nil, true
+		if xml {
+			mediaType = "application/xhtml+xml"
+		}
+	}
+	if charset, ok := params["charset"]; changed || ok && !strings.EqualFold(charset, "utf-8") {
+		if params == nil {
+			params = make(map[string]string)
+		}
+		params["charset"] = "utf-8"
+		return mime.FormatMediaType(mediaType, params)
+	}
+	return contentType
+}
+
+// transportHandler serves requests by sending them over the network.
+type transportHandler struct {
+	transport http.RoundTripper
+}
+
+func (h transportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	outRequest := r.Clone(r.Context())
+	outRequest.RequestURI = ""
+	res, err := h.transport.RoundTrip(outRequest)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	for name, values := range res.Header {
+		w.Header()[name] = values
+	}
+	if rw, ok := w.(*responseWriter); ok {
+		rw.phrase = reasonPhrase(res.Status)
+	}
+	w.WriteHeader(res.StatusCode)
+	_, _ = io.Copy(w, res.Body)
+}
+
+// handlesResourceType reports whether requests of the resource type are fulfilled or continued, the configured ones,
+// or the default ones, stylesheets are needed also to compute critical CSS, and documents other than the navigation
+// for iframes.
+func (r *Renderer) handlesResourceType(resourceType network.ResourceType) bool {
+	return r.shouldHandleResourceType(resourceType) || r.CriticalCSS && resourceType == network.ResourceTypeStylesheet ||
+		r.Iframes && resourceType == network.ResourceTypeDocument
+}
+
+func (r *Renderer) shouldHandleResourceType(resourceType network.ResourceType) bool {
+	if r.ResourceTypes != nil {
+		return slices.Contains(r.ResourceTypes, resourceType)
+	}
+	return slices.Contains(defaultResourceTypes, resourceType)
+}
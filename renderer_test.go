@@ -0,0 +1,499 @@
+package caddy_chrome
+
+import (
+	"bytes"
+	"context"
+	"github.com/alecthomas/assert/v2"
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/fetch"
+	"github.com/chromedp/cdproto/network"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRenderer_Render(t *testing.T) {
+	renderer := &Renderer{
+		Browser: testBrowser(t),
+		Handler: http.FileServer(http.Dir("testdata")),
+	}
+
+	html, headers, status, err := renderer.Render(context.Background(), "http://localhost/javascript_external.html")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, headers.Get("Content-Type"), "text/html")
+	assert.Contains(t, string(html), `<h1>Hello from external Javascript</h1>`)
+}
+
+// flattenedSlotsScript stores the flattened content of slots in a body attribute and removes scripts, so that the
+// serialized page can be rendered again with only the declarative shadow DOM.
+const flattenedSlotsScript = `
+const slots = [];
+for (const host of document.querySelectorAll("*")) {
+    for (const slot of host.shadowRoot?.querySelectorAll("slot") ?? []) {
+        const content = slot.assignedNodes({flatten: true}).map(node => node.textContent.trim()).filter(Boolean);
+        slots.push((slot.name || "default") + "=" + content.join(","));
+    }
+}
+document.body.dataset.slots = slots.join(";");
+document.querySelectorAll("script").forEach(script => script.remove());
+`
+
+func TestRenderer_RenderResult(t *testing.T) {
+	renderer := &Renderer{
+		Browser: testBrowser(t),
+		Handler: http.FileServer(http.Dir("testdata")),
+	}
+
+	for _, testCase := range []struct {
+		url      string
+		verifier func(*testing.T, *RenderResult)
+	}{
+		{
+			url: "http://localhost/javascript_external.html",
+			verifier: func(t *testing.T, result *RenderResult) {
+				assert.Contains(t, string(result.HTML), `<h1>Hello from external Javascript</h1>`)
+				i := slices.IndexFunc(result.Resources, func(resource Resource) bool {
+					return resource.URL == "http://localhost/javascript_external.js"
+				})
+				assert.True(t, i >= 0)
+				resource := result.Resources[i]
+				assert.Equal(t, "Script", resource.ResourceType)
+				assert.Equal(t, ResourceFulfilled, resource.Outcome)
+				assert.Equal(t, http.StatusOK, resource.Status)
+				assert.True(t, resource.Size > 0)
+				assert.True(t, resource.Start > 0 && resource.Duration > 0)
+				assert.True(t, result.Duration > 0)
+			},
+		},
+		{
+			url: "http://localhost/links.html",
+			verifier: func(t *testing.T, result *RenderResult) {
+				links := slices.Clone(result.Links)
+				slices.Sort(links)
+				assert.Equal(t, []string{
+					"<http://localhost/links.css>; rel=preload; as=style",
+					"<http://localhost/links.jpg>; rel=preload; as=image",
+					"<http://localhost/links.js>; rel=preload; as=script",
+					"<https://www.googletagmanager.com>; rel=preconnect",
+				}, links)
+				assert.True(t, slices.Contains(result.Resources, Resource{
+					URL:          "https://www.googletagmanager.com/gtm.js?id=GTM-1234567",
+					ResourceType: "Script",
+					Outcome:      ResourceBlocked,
+				}))
+			},
+		},
+		{
+			url: "http://localhost/console.html",
+			verifier: func(t *testing.T, result *RenderResult) {
+				assert.Equal(t, []ConsoleMessage{
+					{Type: "log", Text: "Hello from console 42"},
+					{Type: "error", Text: "Something failed"},
+				}, result.Console)
+			},
+		},
+	} {
+		t.Run(testCase.url, func(t *testing.T) {
+			result, err := renderer.RenderResult(context.Background(), testCase.url)
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, result.Status)
+			testCase.verifier(t, result)
+		})
+	}
+}
+
+func TestRenderer_Render_slots(t *testing.T) {
+	chromeCtx := testBrowser(t)
+
+	live, _, _, err := (&Renderer{
+		Browser:          chromeCtx,
+		Handler:          http.FileServer(http.Dir("testdata")),
+		PostRenderScript: flattenedSlotsScript,
+	}).Render(context.Background(), "http://localhost/slot.html")
+	assert.NoError(t, err)
+	expected := `data-slots="title=Assigned title;default=Assigned default;footer=Fallback footer"`
+	assert.Contains(t, string(live), expected)
+
+	reparsed, _, _, err := (&Renderer{
+		Browser: chromeCtx,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write(live)
+		}),
+		PostRenderScript: flattenedSlotsScript,
+	}).Render(context.Background(), "http://localhost/slot.html")
+	assert.NoError(t, err)
+	assert.Contains(t, string(reparsed), expected)
+	assert.Equal(t, string(live), string(reparsed))
+}
+
+func TestRenderer_Render_customElements(t *testing.T) {
+	chromeCtx := testBrowser(t)
+
+	live, _, _, err := (&Renderer{
+		Browser: chromeCtx,
+		Handler: http.FileServer(http.Dir("testdata")),
+	}).Render(context.Background(), "http://localhost/custom_elements.html")
+	assert.NoError(t, err)
+	assert.Contains(t, string(live), `<my-greeting name="markup">Hello from markup</my-greeting>`)
+	assert.Contains(t, string(live), `<button is="my-button">Markup button</button>`)
+	assert.Contains(t, string(live), `<button is="my-button">Created button</button>`)
+
+	reparsed, _, _, err := (&Renderer{
+		Browser: chromeCtx,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write(live)
+		}),
+		PostRenderScript: `document.body.dataset.upgraded = Array.from(document.querySelectorAll("my-greeting, button"), element => element.constructor.name).join(",");`,
+	}).Render(context.Background(), "http://localhost/custom_elements.html")
+	assert.NoError(t, err)
+	assert.Contains(t, string(reparsed), `data-upgraded="MyGreeting,MyButton,MyButton,MyButton"`)
+}
+
+func TestRenderer_Render_cancelsSubRequests(t *testing.T) {
+	canceled := make(chan struct{})
+	renderer := &Renderer{
+		Browser: testBrowser(t),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow.js" {
+				<-r.Context().Done()
+				close(canceled)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte(`<script src="/slow.js"></script><p>Waiting</p>`))
+		}),
+		Timeout: 500 * time.Millisecond,
+	}
+
+	_, _, _, err := renderer.Render(context.Background(), "http://localhost/")
+	assert.Error(t, err)
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sub-request outlived the render")
+	}
+}
+
+func TestRenderer_Render_upstreamErrors(t *testing.T) {
+	var requested atomic.Int64
+	renderer := &Renderer{
+		Browser: testBrowser(t),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				requested.Add(1)
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte(`<script>
+				(async () => {
+					for (let i = 0; i < 10; i++) {
+						await fetch("/api/" + i).catch(() => null);
+					}
+				})();
+			</script>`))
+		}),
+		MaxUpstreamErrors: 3,
+	}
+
+	_, _, _, err := renderer.Render(context.Background(), "http://localhost/")
+	assert.IsError(t, err, ErrUpstreamErrors)
+	assert.Equal(t, int64(3), requested.Load())
+}
+
+func TestRenderer_Render_dialogs(t *testing.T) {
+	renderer := &Renderer{
+		Browser: testBrowser(t),
+		Handler: http.FileServer(http.Dir("testdata")),
+		Timeout: 10 * time.Second,
+	}
+
+	start := time.Now()
+	html, _, _, err := renderer.Render(context.Background(), "http://localhost/dialogs.html")
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second, "render took %s", time.Since(start))
+	assert.Contains(t, string(html), "<p>confirmed=false answer=null</p>")
+
+	renderer.AcceptDialogs = true
+	html, _, _, err = renderer.Render(context.Background(), "http://localhost/dialogs.html")
+	assert.NoError(t, err)
+	assert.Contains(t, string(html), "<p>confirmed=true answer=guest</p>")
+}
+
+func TestRenderer_Render_settleTime(t *testing.T) {
+	renderer := &Renderer{
+		Browser: testBrowser(t),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte(`<p id="late">pending</p><script>
+				setTimeout(() => document.getElementById("late").textContent = "settled", 50);
+			</script>`))
+		}),
+		SettleTime: 500 * time.Millisecond,
+	}
+
+	html, _, _, err := renderer.Render(context.Background(), "http://localhost/")
+	assert.NoError(t, err)
+	assert.Contains(t, string(html), `<p id="late">settled</p>`)
+}
+
+func TestRenderer_Render_waitForAll(t *testing.T) {
+	var requested atomic.Bool
+	renderer := &Renderer{
+		Browser: testBrowser(t),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/api" {
+				requested.Store(true)
+				time.Sleep(200 * time.Millisecond)
+				_, _ = w.Write([]byte(`{}`))
+				return
+			}
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte(`<p id="content"></p><script>
+				setTimeout(() => document.documentElement.setAttribute("data-ssr-ready", ""), 50);
+				setTimeout(() => document.getElementById("content").innerHTML = "<b>Ready</b>", 150);
+				setTimeout(() => fetch("/api"), 100);
+			</script>`))
+		}),
+		Timeout: 10 * time.Second,
+		WaitFor: &WaitFor{Attribute: "data-ssr-ready", Element: "#content b", NetworkIdle: true},
+	}
+
+	html, _, _, err := renderer.Render(context.Background(), "http://localhost/")
+	assert.NoError(t, err)
+	assert.Contains(t, string(html), `<html data-ssr-ready>`)
+	assert.Contains(t, string(html), `<p id="content"><b>Ready</b></p>`)
+	assert.True(t, requested.Load())
+}
+
+func TestRenderer_Render_waitForTimeout(t *testing.T) {
+	renderer := &Renderer{
+		Browser: testBrowser(t),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte(`<p id="content">Ready</p><script>
+				document.documentElement.setAttribute("data-ssr-ready", "");
+			</script>`))
+		}),
+		Timeout: time.Second,
+		WaitFor: &WaitFor{Attribute: "data-ssr-ready", Element: "#never"},
+	}
+
+	html, _, _, err := renderer.Render(context.Background(), "http://localhost/")
+	assert.NoError(t, err)
+	assert.Contains(t, string(html), `<p id="content">Ready</p>`)
+}
+
+func TestRenderer_Render_waitForNetworkIdleTime(t *testing.T) {
+	renderer := &Renderer{
+		Browser: testBrowser(t),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/api" {
+				time.Sleep(100 * time.Millisecond)
+				_, _ = w.Write([]byte(`loaded`))
+				return
+			}
+			w.Header().Set("Content-Type", "text/html")
+			// the second request starts after the first one is done, within the quiet period
+			_, _ = w.Write([]byte(`<p id="content"></p><script>
+				fetch("/api").then(() => setTimeout(() => fetch("/api").then((res) => res.text()).then((text) => {
+					document.getElementById("content").textContent = text;
+				}), 100));
+			</script>`))
+		}),
+		Timeout: 10 * time.Second,
+		WaitFor: &WaitFor{NetworkIdle: true, NetworkIdleTime: "300ms"},
+	}
+
+	html, _, _, err := renderer.Render(context.Background(), "http://localhost/")
+	assert.NoError(t, err)
+	assert.Contains(t, string(html), `<p id="content">loaded</p>`)
+}
+
+func TestRenderRequest_fetchDocument(t *testing.T) {
+	req := &renderRequest{
+		url:         "http://localhost/result",
+		ctx:         context.Background(),
+		method:      http.MethodPost,
+		body:        []byte("name=caddy"),
+		contentType: "application/x-www-form-urlencoded",
+		handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			_, _ = io.WriteString(w, r.Method+" "+r.Header.Get("Content-Type")+" "+string(body))
+		}),
+	}
+	// the body can be sent repeatedly
+	for range 2 {
+		assert.Equal(t, "POST application/x-www-form-urlencoded name=caddy", req.fetchDocument().Buffer().String())
+	}
+
+	req.method, req.body, req.contentType = "", nil, ""
+	assert.Equal(t, "GET  ", req.fetchDocument().Buffer().String())
+}
+
+func TestFulfillHeaders(t *testing.T) {
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+	header.Add("Set-Cookie", "a=1")
+	header.Add("Set-Cookie", "b=2")
+	header.Set("Connection", "keep-alive, X-Hop")
+	header.Set("X-Hop", "1")
+	header.Set("Keep-Alive", "timeout=5")
+	header.Set("Transfer-Encoding", "chunked")
+
+	entries := fulfillHeaders(header)
+	slices.SortFunc(entries, func(a, b *fetch.HeaderEntry) int {
+		return strings.Compare(a.Name+": "+a.Value, b.Name+": "+b.Value)
+	})
+	assert.Equal(t, []*fetch.HeaderEntry{
+		{Name: "Content-Type", Value: "application/json"},
+		{Name: "Set-Cookie", Value: "a=1"},
+		{Name: "Set-Cookie", Value: "b=2"},
+	}, entries)
+	assert.Equal(t, "chunked", header.Get("Transfer-Encoding"))
+}
+
+func TestIsXML(t *testing.T) {
+	assert.True(t, isXML("application/xhtml+xml; charset=utf-8"))
+	assert.True(t, isXML("image/svg+xml"))
+	assert.True(t, isXML("application/xml"))
+	assert.True(t, isXML("text/xml"))
+	assert.False(t, isXML("text/html"))
+	assert.False(t, isXML(""))
+}
+
+func TestSerializedContentType(t *testing.T) {
+	for _, testCase := range []struct {
+		contentType string
+		xml         bool
+		expected    string
+	}{
+		{"text/html", false, "text/html"},
+		{"text/html; charset=UTF-8", false, "text/html; charset=UTF-8"},
+		{"text/html; charset=iso-8859-1", false, "text/html; charset=utf-8"},
+		{"", false, "text/html; charset=utf-8"},
+		{"application/xhtml+xml", true, "application/xhtml+xml"},
+		{"image/svg+xml", true, "image/svg+xml"},
+		{"application/xhtml+xml", false, "text/html; charset=utf-8"},
+		{"text/html", true, "application/xhtml+xml; charset=utf-8"},
+	} {
+		assert.Equal(t, testCase.expected, serializedContentType(testCase.contentType, testCase.xml), testCase.contentType)
+	}
+}
+
+func TestWrapFragment(t *testing.T) {
+	document := &responseWriter{status: http.StatusOK, header: make(http.Header)}
+	document.Header().Set("Content-Type", "text/html")
+	document.Header().Set("Content-Length", "24")
+	document.buffer.WriteString(`<script>x()</script><p>`)
+
+	wrapped := wrapFragment(document)
+	assert.Equal(t, http.StatusOK, wrapped.Status())
+	assert.Equal(t, "text/html", wrapped.Header().Get("Content-Type"))
+	assert.Equal(t, "", wrapped.Header().Get("Content-Length"))
+	assert.Equal(t, `<!DOCTYPE html><html><head></head><body><script>x()</script><p></body></html>`, wrapped.Buffer().String())
+	assert.Equal(t, "24", document.Header().Get("Content-Length"))
+}
+
+func TestFragmentRoot(t *testing.T) {
+	root := document(
+		&cdp.Node{NodeType: cdp.NodeTypeDocumentType, NodeName: "html"},
+		element("html", nil,
+			element("head", nil),
+			element("body", nil, element("script", nil, text("x()")), element("p", []string{"class", "a"}, text("1 < 2")))))
+
+	s := newDomSerializer(fragmentRoot(root))
+	defer s.release()
+	s.skipDoctype = true
+	var buf bytes.Buffer
+	assert.NoError(t, s.Serialize(&buf))
+	assert.Equal(t, `<script>x()</script><p class="a">1 &lt; 2</p>`, buf.String())
+}
+
+func TestFindNode(t *testing.T) {
+	app := element("div", []string{"id", "app"}, text("App"))
+	app.NodeID = 3
+	template := element("template", nil)
+	template.TemplateContent = &cdp.Node{NodeType: cdp.NodeTypeDocumentFragment, NodeID: 4}
+	root := document(element("html", nil, element("body", nil, template, app)))
+
+	assert.Equal(t, app, findNode(root, 3))
+	assert.Equal(t, template.TemplateContent, findNode(root, 4))
+	assert.Zero(t, findNode(root, 5))
+	assert.Zero(t, findNode(root, 0))
+}
+
+func TestExceedsNodes(t *testing.T) {
+	// a table with 10,000 rows of 10 cells, 210,005 nodes with the document, html, body, table, and tbody
+	rows := make([]*cdp.Node, 10_000)
+	for i := range rows {
+		cells := make([]*cdp.Node, 10)
+		for j := range cells {
+			cells[j] = element("td", nil, text("cell"))
+		}
+		rows[i] = element("tr", nil, cells...)
+	}
+	root := document(element("html", nil, element("body", nil, element("table", nil, element("tbody", nil, rows...)))))
+
+	assert.False(t, exceedsNodes(root, 210_005))
+	assert.True(t, exceedsNodes(root, 210_004))
+	assert.True(t, exceedsNodes(root, 1000))
+
+	host := element("div", nil)
+	host.ShadowRoots = []*cdp.Node{shadowRoot(cdp.ShadowRootTypeOpen, element("p", nil, text("Shadow")))}
+	template := element("template", nil)
+	template.TemplateContent = &cdp.Node{NodeType: cdp.NodeTypeDocumentFragment, Children: []*cdp.Node{element("span", nil)}}
+	iframe := element("iframe", nil)
+	iframe.ContentDocument = document(element("html", nil))
+	root = document(host, template, iframe)
+	assert.False(t, exceedsNodes(root, 11))
+	assert.True(t, exceedsNodes(root, 10))
+}
+
+func TestOutermostNodes(t *testing.T) {
+	nested := element("span", []string{"class", "dev"})
+	nested.NodeID = 4
+	banner := element("div", []string{"class", "banner"}, nested)
+	banner.NodeID = 3
+	toolbar := element("div", []string{"class", "dev"})
+	toolbar.NodeID = 5
+	app := element("div", []string{"id", "app"})
+	app.NodeID = 6
+	root := document(element("html", nil, element("body", nil, banner, app, toolbar)))
+
+	matched := map[cdp.NodeID]bool{3: true, 4: true, 5: true}
+	assert.Equal(t, []cdp.NodeID{3, 5}, outermostNodes(root, matched, nil))
+	assert.Zero(t, outermostNodes(root, nil, nil))
+}
+
+func TestDefaultReferer(t *testing.T) {
+	for _, testCase := range []struct {
+		documentURL string
+		requestURL  string
+		policy      network.ReferrerPolicy
+		expected    string
+	}{
+		{"http://localhost/page.html?q=1#top", "http://localhost/api.json", "", "http://localhost/page.html?q=1"},
+		{"http://localhost/page.html", "http://api.localhost/api.json", "", "http://localhost/"},
+		{"https://example.com/page.html", "http://example.com/api.json", "", ""},
+		{"http://localhost/page.html", "http://localhost/api.json", network.ReferrerPolicyNoReferrer, ""},
+		{"http://localhost/page.html", "http://localhost/api.json", network.ReferrerPolicyOrigin, "http://localhost/"},
+		{"http://localhost/page.html", "http://localhost/api.json", network.ReferrerPolicySameOrigin, "http://localhost/page.html"},
+		{"http://localhost/page.html", "http://api.localhost/api.json", network.ReferrerPolicySameOrigin, ""},
+		{"http://localhost/page.html", "http://api.localhost/api.json", network.ReferrerPolicyUnsafeURL, "http://localhost/page.html"},
+		{"https://example.com/page.html", "http://example.com/api.json", network.ReferrerPolicyStrictOrigin, ""},
+		{"https://example.com/page.html", "http://example.com/api.json", network.ReferrerPolicyOrigin, "https://example.com/"},
+	} {
+		requestURL, err := url.Parse(testCase.requestURL)
+		assert.NoError(t, err)
+		assert.Equal(t, testCase.expected, defaultReferer(testCase.documentURL, requestURL, testCase.policy), testCase.documentURL+" "+testCase.requestURL+" "+string(testCase.policy))
+	}
+}
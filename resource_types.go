@@ -0,0 +1,43 @@
+package caddy_chrome
+
+import (
+	"fmt"
+	"github.com/chromedp/cdproto/network"
+	"strings"
+)
+
+// resourceTypes are names of resource types in the config, requests of the configured ones are fulfilled or
+// continued, the rest are blocked.
+var resourceTypes = map[string]network.ResourceType{
+	"document":    network.ResourceTypeDocument,
+	"stylesheet":  network.ResourceTypeStylesheet,
+	"image":       network.ResourceTypeImage,
+	"media":       network.ResourceTypeMedia,
+	"font":        network.ResourceTypeFont,
+	"script":      network.ResourceTypeScript,
+	"xhr":         network.ResourceTypeXHR,
+	"fetch":       network.ResourceTypeFetch,
+	"eventsource": network.ResourceTypeEventSource,
+	"manifest":    network.ResourceTypeManifest,
+	"other":       network.ResourceTypeOther,
+}
+
+// defaultResourceTypes are handled if resource types aren't configured, enough for scripts to run and load data.
+var defaultResourceTypes = []network.ResourceType{
+	network.ResourceTypeScript,
+	network.ResourceTypeXHR,
+	network.ResourceTypeFetch,
+}
+
+// parseResourceTypes returns the resource types of the names, they're case-insensitive.
+func parseResourceTypes(names []string) ([]network.ResourceType, error) {
+	var types []network.ResourceType
+	for _, name := range names {
+		resourceType, ok := resourceTypes[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown resource type %q, expected document, stylesheet, image, media, font, script, xhr, fetch, eventsource, manifest, or other", name)
+		}
+		types = append(types, resourceType)
+	}
+	return types, nil
+}
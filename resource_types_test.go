@@ -0,0 +1,35 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"github.com/chromedp/cdproto/network"
+	"testing"
+)
+
+func TestParseResourceTypes(t *testing.T) {
+	types, err := parseResourceTypes([]string{"script", "XHR", "fetch", "stylesheet", "image"})
+	assert.NoError(t, err)
+	assert.Equal(t, []network.ResourceType{
+		network.ResourceTypeScript,
+		network.ResourceTypeXHR,
+		network.ResourceTypeFetch,
+		network.ResourceTypeStylesheet,
+		network.ResourceTypeImage,
+	}, types)
+
+	_, err = parseResourceTypes([]string{"script", "websocket"})
+	assert.EqualError(t, err, `unknown resource type "websocket", expected document, stylesheet, image, media, font, script, xhr, fetch, eventsource, manifest, or other`)
+}
+
+func TestRenderer_handlesResourceType(t *testing.T) {
+	renderer := &Renderer{}
+	assert.True(t, renderer.handlesResourceType(network.ResourceTypeScript))
+	assert.False(t, renderer.handlesResourceType(network.ResourceTypeImage))
+
+	renderer = &Renderer{ResourceTypes: []network.ResourceType{network.ResourceTypeScript, network.ResourceTypeImage}}
+	assert.True(t, renderer.handlesResourceType(network.ResourceTypeImage))
+	assert.False(t, renderer.handlesResourceType(network.ResourceTypeFetch))
+
+	renderer.CriticalCSS = true
+	assert.True(t, renderer.handlesResourceType(network.ResourceTypeStylesheet))
+}
@@ -3,6 +3,8 @@ package caddy_chrome
 import (
 	"bytes"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
 type response interface {
@@ -13,11 +15,15 @@ type response interface {
 
 type responseWriter struct {
 	status int
+	phrase string
 	header http.Header
 	buffer bytes.Buffer
 }
 
 func (r *responseWriter) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
 	return r.status
 }
 
@@ -41,8 +47,54 @@ func (r *responseWriter) Flush() {
 
 }
 
+// statusPhrase returns the reason phrase of the response status, the one received over the network if there's any.
+// Chrome refuses to fulfill requests with a non-standard status code without a phrase.
+func statusPhrase(res response) string {
+	if w, ok := res.(*responseWriter); ok && w.phrase != "" {
+		return w.phrase
+	}
+	if text := http.StatusText(res.Status()); text != "" {
+		return text
+	}
+	return "Unknown"
+}
+
+// bodyAllowed reports whether a response with the status may have a body, informational, 204 No Content and
+// 304 Not Modified responses must not have one.
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// isRenderable reports whether the body may be an HTML document, i.e. it's not empty and it's text.
+func isRenderable(body []byte) bool {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return false
+	}
+	return strings.HasPrefix(http.DetectContentType(body), "text/")
+}
+
+// headerOverride is a response with different headers.
+type headerOverride struct {
+	response
+	header http.Header
+}
+
+func (r *headerOverride) Header() http.Header {
+	return r.header
+}
+
+// reasonPhrase returns the reason phrase of the status line, e.g. "Not Found" of "404 Not Found".
+func reasonPhrase(status string) string {
+	code, phrase, _ := strings.Cut(status, " ")
+	if _, err := strconv.Atoi(code); err != nil {
+		return ""
+	}
+	return strings.TrimSpace(phrase)
+}
+
 var (
 	_ http.ResponseWriter = (*responseWriter)(nil)
 	_ response            = (*responseWriter)(nil)
 	_ http.Flusher        = (*responseWriter)(nil)
+	_ response            = (*headerOverride)(nil)
 )
@@ -0,0 +1,39 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"net/http"
+	"testing"
+)
+
+func TestIsRenderable(t *testing.T) {
+	assert.True(t, isRenderable([]byte("<!doctype html><h1>Hello</h1>")))
+	assert.True(t, isRenderable([]byte("<fetch-component></fetch-component>")))
+	assert.False(t, isRenderable(nil))
+	assert.False(t, isRenderable([]byte(" \n\t")))
+	assert.False(t, isRenderable([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")))
+	assert.False(t, isRenderable([]byte{0x00, 0x01, 0x02, 0x03}))
+}
+
+func TestStatusPhrase(t *testing.T) {
+	assert.Equal(t, "OK", statusPhrase(&responseWriter{}))
+	assert.Equal(t, "Not Found", statusPhrase(&responseWriter{status: http.StatusNotFound}))
+	assert.Equal(t, "Unknown", statusPhrase(&responseWriter{status: 599}))
+	assert.Equal(t, "Network Timeout", statusPhrase(&responseWriter{status: 599, phrase: "Network Timeout"}))
+}
+
+func TestBodyAllowed(t *testing.T) {
+	assert.True(t, bodyAllowed(http.StatusOK))
+	assert.True(t, bodyAllowed(http.StatusFound))
+	assert.True(t, bodyAllowed(http.StatusNotFound))
+	assert.False(t, bodyAllowed(http.StatusContinue))
+	assert.False(t, bodyAllowed(http.StatusNoContent))
+	assert.False(t, bodyAllowed(http.StatusNotModified))
+}
+
+func TestReasonPhrase(t *testing.T) {
+	assert.Equal(t, "Not Found", reasonPhrase("404 Not Found"))
+	assert.Equal(t, "Network Timeout", reasonPhrase("599 Network Timeout"))
+	assert.Equal(t, "", reasonPhrase("599"))
+	assert.Equal(t, "", reasonPhrase("Not Found"))
+}
@@ -0,0 +1,44 @@
+package caddy_chrome
+
+import (
+	"net/url"
+	"regexp"
+)
+
+// RewriteURL rewrites requests of the page to matching URLs, before they're fulfilled or continued by the host lists,
+// e.g. to serve a stub of a script from an internal path. Blocked URLs aren't rewritten.
+type RewriteURL struct {
+	// From is a regular expression matched against full URLs.
+	From string `json:"from"`
+	// To replaces the match, it may reference its submatches, e.g. $1, a relative URL resolves against the request URL.
+	To string `json:"to"`
+
+	re *regexp.Regexp
+}
+
+func (rw *RewriteURL) compile() (err error) {
+	rw.re, err = regexp.Compile(rw.From)
+	return err
+}
+
+// rewriteURL returns the URL rewritten by the first matching rule, or false if none matches.
+func rewriteURL(rules []*RewriteURL, rawURL string) (string, bool) {
+	for _, rule := range rules {
+		if rule.re == nil && rule.compile() != nil {
+			continue
+		}
+		if !rule.re.MatchString(rawURL) {
+			continue
+		}
+		base, err := url.Parse(rawURL)
+		if err != nil {
+			return "", false
+		}
+		target, err := url.Parse(rule.re.ReplaceAllString(rawURL, rule.To))
+		if err != nil {
+			return "", false
+		}
+		return base.ResolveReference(target).String(), true
+	}
+	return "", false
+}
@@ -0,0 +1,34 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"testing"
+)
+
+func TestRewriteURL(t *testing.T) {
+	rules := []*RewriteURL{
+		{From: `^https://cdn\.example\.com/beacon\.js$`, To: "/stubs/beacon.js"},
+		{From: `^(https?://[^/]+)/v1/(.*)$`, To: "$1/v2/$2"},
+		{From: `^https://example\.com/.*$`, To: "/never.js"},
+	}
+	for _, rule := range rules {
+		assert.NoError(t, rule.compile())
+	}
+	for _, testCase := range []struct {
+		url       string
+		rewritten string
+	}{
+		{url: "https://cdn.example.com/beacon.js", rewritten: "https://cdn.example.com/stubs/beacon.js"},
+		{url: "https://example.com/v1/app.js?x=1", rewritten: "https://example.com/v2/app.js?x=1"},
+		{url: "https://example.com/app.js", rewritten: "https://example.com/never.js"},
+		{url: "https://cdn.example.com/app.js"},
+	} {
+		t.Run(testCase.url, func(t *testing.T) {
+			rewritten, ok := rewriteURL(rules, testCase.url)
+			assert.Equal(t, testCase.rewritten != "", ok)
+			assert.Equal(t, testCase.rewritten, rewritten)
+		})
+	}
+
+	assert.Error(t, (&RewriteURL{From: "("}).compile())
+}
@@ -0,0 +1,69 @@
+package caddy_chrome
+
+import (
+	"strings"
+)
+
+var (
+	defaultSanitizeAttributes = []string{"on*"}
+	defaultSanitizeSchemes    = []string{"javascript", "vbscript", "data"}
+)
+
+// See https://html.spec.whatwg.org/multipage/indices.html#attributes-3
+var urlAttributes = map[string]bool{
+	"action":     true,
+	"background": true,
+	"cite":       true,
+	"data":       true,
+	"formaction": true,
+	"href":       true,
+	"poster":     true,
+	"src":        true,
+	"xlink:href": true,
+}
+
+type Sanitize struct {
+	// Attributes are patterns of attribute names to remove, matched using path.Match, default is on*.
+	Attributes []string `json:"attributes,omitempty"`
+	// Schemes of URLs to remove from URL attributes, default is javascript, vbscript, and data (except images).
+	Schemes []string `json:"schemes,omitempty"`
+}
+
+// dropAttribute reports whether the attribute should be left out of the output.
+func (s *Sanitize) dropAttribute(name string, value string) bool {
+	name = strings.ToLower(name)
+	attributes := s.Attributes
+	if len(attributes) == 0 {
+		attributes = defaultSanitizeAttributes
+	}
+	if matchAny(attributes, name) {
+		return true
+	}
+	if !urlAttributes[name] {
+		return false
+	}
+	// browsers ignore whitespace and control characters when resolving the scheme
+	value = strings.ToLower(strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, value))
+	scheme, rest, found := strings.Cut(value, ":")
+	if !found || strings.ContainsAny(scheme, "/?#") {
+		return false
+	}
+	schemes := s.Schemes
+	if len(schemes) == 0 {
+		schemes = defaultSanitizeSchemes
+		if scheme == "data" && strings.HasPrefix(rest, "image/") {
+			return false
+		}
+	}
+	for _, blocked := range schemes {
+		if scheme == strings.ToLower(blocked) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"testing"
+)
+
+func TestSanitize_DropAttribute(t *testing.T) {
+	for _, testCase := range []struct {
+		name     string
+		sanitize *Sanitize
+		attr     string
+		value    string
+		expected bool
+	}{
+		{name: "event handler", sanitize: &Sanitize{}, attr: "onclick", value: "alert(1)", expected: true},
+		{name: "event handler uppercase", sanitize: &Sanitize{}, attr: "ONLOAD", value: "alert(1)", expected: true},
+		{name: "plain attribute", sanitize: &Sanitize{}, attr: "class", value: "javascript:x", expected: false},
+		{name: "javascript url", sanitize: &Sanitize{}, attr: "href", value: "javascript:alert(1)", expected: true},
+		{name: "obfuscated javascript url", sanitize: &Sanitize{}, attr: "href", value: " Java\tScript:alert(1)", expected: true},
+		{name: "http url", sanitize: &Sanitize{}, attr: "href", value: "https://example.com/", expected: false},
+		{name: "relative url with colon", sanitize: &Sanitize{}, attr: "href", value: "/a:b", expected: false},
+		{name: "data url", sanitize: &Sanitize{}, attr: "src", value: "data:text/javascript,alert(1)", expected: true},
+		{name: "data image", sanitize: &Sanitize{}, attr: "src", value: "data:image/png;base64,AAAA", expected: false},
+		{
+			name:     "configured attributes",
+			sanitize: &Sanitize{Attributes: []string{"data-track*"}},
+			attr:     "onclick",
+			value:    "alert(1)",
+			expected: false,
+		},
+		{
+			name:     "configured attributes match",
+			sanitize: &Sanitize{Attributes: []string{"data-track*"}},
+			attr:     "data-tracking-id",
+			value:    "1",
+			expected: true,
+		},
+		{
+			name:     "configured schemes",
+			sanitize: &Sanitize{Schemes: []string{"javascript"}},
+			attr:     "src",
+			value:    "data:text/html,x",
+			expected: false,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert.Equal(t, testCase.expected, testCase.sanitize.dropAttribute(testCase.attr, testCase.value))
+		})
+	}
+}
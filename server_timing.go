@@ -0,0 +1,87 @@
+package caddy_chrome
+
+import (
+	"context"
+	"github.com/chromedp/chromedp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Phases of the render reported by server_timing.
+const (
+	// timingNavigation is from the navigation until the page loaded
+	timingNavigation = "nav"
+	// timingWait is awaiting the pending task, wait_for, settle_time, and the post-render script
+	timingWait = "wait"
+	// timingDOM is getting the DOM tree of the page, or capturing it by output
+	timingDOM = "dom"
+	// timingSerialize is serializing the tree
+	timingSerialize = "serialize"
+)
+
+// renderTimings records durations of phases of the render for the Server-Timing header, a nil one records nothing.
+// Phases are recorded by the goroutine running the render, and serializing it, one after another.
+type renderTimings struct {
+	phases []renderPhase
+	// current is the phase in progress, since started
+	current string
+	started time.Time
+}
+
+type renderPhase struct {
+	name     string
+	duration time.Duration
+}
+
+// begin ends the phase in progress, if any, and starts the named one.
+func (t *renderTimings) begin(name string) {
+	if t == nil {
+		return
+	}
+	t.end()
+	t.current, t.started = name, time.Now()
+}
+
+// end ends the phase in progress, if any, e.g. when the render timed out in the middle of it, so that it's reported
+// with the time it took until then.
+func (t *renderTimings) end() {
+	if t == nil || t.current == "" {
+		return
+	}
+	t.phases = append(t.phases, renderPhase{name: t.current, duration: time.Since(t.started)})
+	t.current = ""
+}
+
+// reset forgets phases of a previous render, e.g. one retried after the browser was lost.
+func (t *renderTimings) reset() {
+	if t == nil {
+		return
+	}
+	t.phases, t.current = nil, ""
+}
+
+// beginTask returns the task beginning the phase, when it's run among other tasks of the render.
+func (t *renderTimings) beginTask(name string) chromedp.Action {
+	return chromedp.ActionFunc(func(context.Context) error {
+		t.begin(name)
+		return nil
+	})
+}
+
+// serverTiming returns the Server-Timing header value with the recorded phases, and the whole render duration.
+func (t *renderTimings) serverTiming(duration time.Duration) string {
+	var b strings.Builder
+	if t != nil {
+		for _, phase := range t.phases {
+			b.WriteString(phase.name + ";dur=" + timingMilliseconds(phase.duration) + ", ")
+		}
+	}
+	b.WriteString(serverTiming(duration))
+	return b.String()
+}
+
+// timingMilliseconds formats the duration in milliseconds, as Server-Timing durations are.
+func timingMilliseconds(duration time.Duration) string {
+	return strconv.FormatFloat(float64(duration.Microseconds())/1000, 'f', -1, 64)
+}
@@ -0,0 +1,32 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"testing"
+	"time"
+)
+
+func TestRenderTimings(t *testing.T) {
+	timings := &renderTimings{}
+	timings.begin(timingNavigation)
+	timings.begin(timingWait)
+	// the render timed out while waiting
+	timings.end()
+	timings.end()
+	assert.Equal(t, 2, len(timings.phases))
+	assert.Equal(t, timingNavigation, timings.phases[0].name)
+	assert.Equal(t, timingWait, timings.phases[1].name)
+
+	timings.phases = []renderPhase{{name: timingNavigation, duration: 120 * time.Millisecond}, {name: timingSerialize, duration: 8500 * time.Microsecond}}
+	assert.Equal(t, "nav;dur=120, serialize;dur=8.5, chrome-render;dur=500", timings.serverTiming(500*time.Millisecond))
+
+	// a retried render reports its own phases
+	timings.reset()
+	assert.Equal(t, "chrome-render;dur=500", timings.serverTiming(500*time.Millisecond))
+
+	// nothing is recorded without server_timing
+	var disabled *renderTimings
+	disabled.begin(timingNavigation)
+	disabled.end()
+	assert.Equal(t, "chrome-render;dur=1", disabled.serverTiming(time.Millisecond))
+}
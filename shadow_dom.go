@@ -0,0 +1,171 @@
+package caddy_chrome
+
+import (
+	"github.com/chromedp/cdproto/cdp"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	iosVersionRegexp     = regexp.MustCompile(`\((?:iPhone|iPad|iPod)[^)]* OS (\d+)_(\d+)`)
+	firefoxVersionRegexp = regexp.MustCompile(`Firefox/(\d+)`)
+	chromeVersionRegexp  = regexp.MustCompile(`Chrome/(\d+)`)
+	safariVersionRegexp  = regexp.MustCompile(`Version/(\d+)\.(\d+)(?:\.\d+)? (?:Mobile/\S+ )?Safari/`)
+)
+
+// supportsDeclarativeShadowDOM reports whether the browser of the user agent parses declarative shadow DOM
+// (shadowrootmode), i.e. it's Chrome 111, Firefox 123, Safari 16.4, or newer; every browser on iOS is Safari of
+// the system. Crawlers, and unknown clients, are assumed not to.
+func supportsDeclarativeShadowDOM(userAgent string) bool {
+	if (&Bots{}).Match(userAgent) {
+		return false
+	}
+	if match := iosVersionRegexp.FindStringSubmatch(userAgent); match != nil {
+		return atLeastVersion(match[1], match[2], 16, 4)
+	}
+	if match := firefoxVersionRegexp.FindStringSubmatch(userAgent); match != nil {
+		return atLeastVersion(match[1], "0", 123, 0)
+	}
+	if match := chromeVersionRegexp.FindStringSubmatch(userAgent); match != nil {
+		return atLeastVersion(match[1], "0", 111, 0)
+	}
+	if match := safariVersionRegexp.FindStringSubmatch(userAgent); match != nil && !strings.Contains(userAgent, "Android") {
+		return atLeastVersion(match[1], match[2], 16, 4)
+	}
+	return false
+}
+
+// atLeastVersion reports whether the major and minor version is at least the one given.
+func atLeastVersion(major, minor string, atLeastMajor, atLeastMinor int) bool {
+	majorVersion, err := strconv.Atoi(major)
+	if err != nil {
+		return false
+	}
+	minorVersion, err := strconv.Atoi(minor)
+	if err != nil {
+		return false
+	}
+	return majorVersion > atLeastMajor || majorVersion == atLeastMajor && minorVersion >= atLeastMinor
+}
+
+// shadowScope is the shadow tree of the host being flattened, slots in it are replaced by nodes assigned to them.
+type shadowScope struct {
+	host  *cdp.Node
+	outer *shadowScope
+}
+
+// flattenShadowDOM returns a copy of the tree with open and closed shadow roots flattened into their hosts, i.e. as
+// the browser renders them: children of the shadow root replace children of the host, and slots are replaced by nodes
+// assigned to them, or their fallback content. It's plain HTML for clients not supporting declarative shadow DOM,
+// encapsulation, e.g. of styles in shadow roots, is lost.
+func flattenShadowDOM(root *cdp.Node) *cdp.Node {
+	return flattenNode(root, nil)
+}
+
+func flattenNode(node *cdp.Node, scope *shadowScope) *cdp.Node {
+	flattened := copyNode(node)
+	if node.TemplateContent != nil {
+		flattened.TemplateContent = flattenNode(node.TemplateContent, nil)
+	}
+	if node.ContentDocument != nil {
+		flattened.ContentDocument = flattenNode(node.ContentDocument, nil)
+	}
+
+	children, childScope := node.Children, scope
+	for _, shadowRoot := range node.ShadowRoots {
+		if shadowRoot.ShadowRootType == cdp.ShadowRootTypeOpen || shadowRoot.ShadowRootType == cdp.ShadowRootTypeClosed {
+			children, childScope = shadowRoot.Children, &shadowScope{host: node, outer: scope}
+			break
+		}
+	}
+	for _, child := range children {
+		flattened.Children = append(flattened.Children, flattenChild(child, childScope)...)
+	}
+	return flattened
+}
+
+// flattenChild returns the flattened node, or if it's a slot of a shadow tree, the flattened nodes assigned to it, or
+// its fallback content.
+func flattenChild(node *cdp.Node, scope *shadowScope) []*cdp.Node {
+	if scope == nil || node.NodeType != cdp.NodeTypeElement || node.LocalName != "slot" || node.IsSVG {
+		return []*cdp.Node{flattenNode(node, scope)}
+	}
+	var flattened []*cdp.Node
+	if assigned := assignedNodes(scope.host, attributeValue(node, "name")); len(assigned) > 0 {
+		// assigned nodes are in the tree of the host
+		for _, child := range assigned {
+			flattened = append(flattened, flattenChild(child, scope.outer)...)
+		}
+	} else {
+		for _, child := range node.Children {
+			flattened = append(flattened, flattenChild(child, scope)...)
+		}
+	}
+	return flattened
+}
+
+// assignedNodes returns children of the host assigned to the slot of the name, elements by their slot attribute,
+// text nodes to the default slot.
+func assignedNodes(host *cdp.Node, name string) []*cdp.Node {
+	var assigned []*cdp.Node
+	for _, child := range host.Children {
+		switch child.NodeType {
+		case cdp.NodeTypeElement:
+			if attributeValue(child, "slot") == name {
+				assigned = append(assigned, child)
+			}
+		case cdp.NodeTypeText:
+			if name == "" {
+				assigned = append(assigned, child)
+			}
+		}
+	}
+	return assigned
+}
+
+// attributeValue returns the value of the attribute of the element, or an empty string if it doesn't have it.
+func attributeValue(node *cdp.Node, name string) string {
+	for i := 0; i+1 < len(node.Attributes); i += 2 {
+		if node.Attributes[i] == name {
+			return node.Attributes[i+1]
+		}
+	}
+	return ""
+}
+
+// copyNode returns a shallow copy of the node without its children and shadow roots, the node can't be copied as
+// a value, since it embeds a mutex.
+func copyNode(node *cdp.Node) *cdp.Node {
+	return &cdp.Node{
+		NodeID:            node.NodeID,
+		ParentID:          node.ParentID,
+		BackendNodeID:     node.BackendNodeID,
+		NodeType:          node.NodeType,
+		NodeName:          node.NodeName,
+		LocalName:         node.LocalName,
+		NodeValue:         node.NodeValue,
+		ChildNodeCount:    node.ChildNodeCount,
+		Attributes:        node.Attributes,
+		DocumentURL:       node.DocumentURL,
+		BaseURL:           node.BaseURL,
+		PublicID:          node.PublicID,
+		SystemID:          node.SystemID,
+		InternalSubset:    node.InternalSubset,
+		XMLVersion:        node.XMLVersion,
+		Name:              node.Name,
+		Value:             node.Value,
+		PseudoType:        node.PseudoType,
+		PseudoIdentifier:  node.PseudoIdentifier,
+		ShadowRootType:    node.ShadowRootType,
+		FrameID:           node.FrameID,
+		ContentDocument:   node.ContentDocument,
+		TemplateContent:   node.TemplateContent,
+		PseudoElements:    node.PseudoElements,
+		DistributedNodes:  node.DistributedNodes,
+		IsSVG:             node.IsSVG,
+		CompatibilityMode: node.CompatibilityMode,
+		AssignedSlot:      node.AssignedSlot,
+		Parent:            node.Parent,
+	}
+}
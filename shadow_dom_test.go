@@ -0,0 +1,71 @@
+package caddy_chrome
+
+import (
+	"bytes"
+	"github.com/alecthomas/assert/v2"
+	"github.com/chromedp/cdproto/cdp"
+	"testing"
+)
+
+func shadowRoot(mode cdp.ShadowRootType, children ...*cdp.Node) *cdp.Node {
+	return &cdp.Node{
+		NodeType:       cdp.NodeTypeDocumentFragment,
+		NodeName:       "#document-fragment",
+		ShadowRootType: mode,
+		Children:       children,
+	}
+}
+
+func TestFlattenShadowDOM(t *testing.T) {
+	inner := element("inner-title", nil, element("slot", []string{"name", "heading"}))
+	inner.ShadowRoots = []*cdp.Node{shadowRoot(cdp.ShadowRootTypeClosed, element("h2", nil, element("slot", nil)))}
+	outer := element("outer-card", nil, element("b", []string{"slot", "heading"}, text("Card heading")), text("Card body"))
+	outer.ShadowRoots = []*cdp.Node{shadowRoot(cdp.ShadowRootTypeOpen, element("article", nil,
+		inner,
+		element("div", []string{"class", "body"}, element("slot", nil)),
+		element("footer", nil, element("slot", []string{"name", "footer"}, text("Fallback footer"))),
+	))}
+	input := element("input", nil)
+	input.ShadowRoots = []*cdp.Node{shadowRoot(cdp.ShadowRootTypeUserAgent, element("div", nil))}
+	root := document(element("html", nil, element("head", nil), element("body", nil, outer, input, element("slot", nil, text("Light slot")))))
+
+	s := newDomSerializer(flattenShadowDOM(root))
+	defer s.release()
+	var buf bytes.Buffer
+	assert.NoError(t, s.Serialize(&buf))
+	assert.Equal(t, `<!DOCTYPE html><html><head></head><body>`+
+		`<outer-card><article>`+
+		`<inner-title><h2><b slot="heading">Card heading</b></h2></inner-title>`+
+		`<div class="body">Card body</div>`+
+		`<footer>Fallback footer</footer>`+
+		`</article></outer-card>`+
+		`<input />`+
+		`<slot>Light slot</slot>`+
+		`</body></html>`, buf.String())
+
+	// the tree of Chrome is left intact
+	assert.Equal(t, 1, len(outer.ShadowRoots))
+	assert.Equal(t, 2, len(outer.Children))
+}
+
+func TestSupportsDeclarativeShadowDOM(t *testing.T) {
+	for _, testCase := range []struct {
+		userAgent string
+		supports  bool
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36", true},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/110.0.0.0 Safari/537.36", false},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.0.0", true},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:123.0) Gecko/20100101 Firefox/123.0", true},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:115.0) Gecko/20100101 Firefox/115.0", false},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Safari/605.1.15", true},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.3 Safari/605.1.15", false},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 16_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.4 Mobile/15E148 Safari/604.1", true},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 15_8 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/120.0.6099.119 Mobile/15E148 Safari/604.1", false},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html) Chrome/120.0.0.0 Safari/537.36", false},
+		{"curl/8.4.0", false},
+		{"", false},
+	} {
+		assert.Equal(t, testCase.supports, supportsDeclarativeShadowDOM(testCase.userAgent), testCase.userAgent)
+	}
+}
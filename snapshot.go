@@ -0,0 +1,196 @@
+package caddy_chrome
+
+import (
+	"context"
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/dom"
+	"github.com/chromedp/cdproto/domsnapshot"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+// captureSnapshot returns the DOM tree of the page captured by DOMSnapshot.captureSnapshot, which returns it flattened
+// in a single call, converted to the shape DOM.getDocument returns, so that it's serialized the same way. Only
+// the document node has its node ID, unless nodeIDs is set, then they're pushed for all nodes, e.g. to query them.
+func captureSnapshot(ctx context.Context, nodeIDs bool) (*cdp.Node, error) {
+	document, err := dom.GetDocument().WithDepth(0).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	documents, strs, err := domsnapshot.CaptureSnapshot([]string{}).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	root := snapshotTree(documents, strs)
+	if root == nil {
+		return nil, errors.New("empty DOM snapshot")
+	}
+	root.NodeID = document.NodeID
+	root.CompatibilityMode = document.CompatibilityMode
+	root.XMLVersion = document.XMLVersion
+
+	if nodeIDs {
+		var nodes []*cdp.Node
+		var backendNodeIDs []cdp.BackendNodeID
+		walkNodes(root, func(node *cdp.Node) {
+			if node != root && node.BackendNodeID != 0 {
+				nodes = append(nodes, node)
+				backendNodeIDs = append(backendNodeIDs, node.BackendNodeID)
+			}
+		})
+		pushed, err := dom.PushNodesByBackendIDsToFrontend(backendNodeIDs).Do(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for i, nodeID := range pushed {
+			if i < len(nodes) {
+				nodes[i].NodeID = nodeID
+			}
+		}
+	}
+
+	return root, nil
+}
+
+// snapshotTree converts documents of a DOM snapshot to the tree of the first one, with content documents of frames
+// linked. Elements of HTML documents have upper-case names, the rest (SVG, MathML) keep their case, which tells
+// their local names. Shadow roots are document fragments of their hosts with their type, other than open or closed
+// ones (i.e. user-agent) aren't serialized.
+func snapshotTree(documents []*domsnapshot.DocumentSnapshot, strs []string) *cdp.Node {
+	str := func(index domsnapshot.StringIndex) string {
+		if index < 0 || int(index) >= len(strs) {
+			return ""
+		}
+		return strs[index]
+	}
+	roots := make([]*cdp.Node, len(documents))
+	var frames []func()
+
+	for d, document := range documents {
+		tree := document.Nodes
+		if tree == nil {
+			continue
+		}
+		shadowRootTypes := rareStrings(tree.ShadowRootType, str)
+		pseudoTypes := rareStrings(tree.PseudoType, str)
+		contentDocuments := rareIntegers(tree.ContentDocumentIndex)
+		nodes := make([]*cdp.Node, len(tree.NodeType))
+
+		for i := range nodes {
+			node := &cdp.Node{NodeType: cdp.NodeType(tree.NodeType[i])}
+			if i < len(tree.NodeName) {
+				node.NodeName = str(tree.NodeName[i])
+			}
+			if i < len(tree.NodeValue) {
+				node.NodeValue = str(tree.NodeValue[i])
+			}
+			if i < len(tree.BackendNodeID) {
+				node.BackendNodeID = tree.BackendNodeID[i]
+			}
+			if i < len(tree.Attributes) {
+				for _, index := range tree.Attributes[i] {
+					node.Attributes = append(node.Attributes, str(domsnapshot.StringIndex(index)))
+				}
+			}
+			nodes[i] = node
+
+			var parent *cdp.Node
+			if i < len(tree.ParentIndex) && tree.ParentIndex[i] >= 0 && int(tree.ParentIndex[i]) < i {
+				parent = nodes[tree.ParentIndex[i]]
+			}
+
+			switch node.NodeType {
+			case cdp.NodeTypeElement:
+				html := node.NodeName == strings.ToUpper(node.NodeName)
+				node.LocalName = node.NodeName
+				if html {
+					node.LocalName = strings.ToLower(node.NodeName)
+				}
+				node.IsSVG = !html && (node.LocalName == "svg" || parent != nil && parent.IsSVG)
+			case cdp.NodeTypeDocumentType:
+				node.PublicID = str(document.PublicID)
+				node.SystemID = str(document.SystemID)
+			case cdp.NodeTypeDocument:
+				node.DocumentURL = str(document.DocumentURL)
+				node.BaseURL = str(document.BaseURL)
+			}
+
+			if index, ok := contentDocuments[i]; ok && index >= 0 && int(index) < len(roots) {
+				frames = append(frames, func() {
+					node.ContentDocument = roots[index]
+				})
+			}
+
+			switch {
+			case parent == nil:
+				if roots[d] == nil {
+					roots[d] = node
+				}
+			case pseudoTypes[i] != "":
+				node.PseudoType = cdp.PseudoType(pseudoTypes[i])
+				parent.PseudoElements = append(parent.PseudoElements, node)
+			case node.NodeType == cdp.NodeTypeDocumentFragment && parent.NodeType == cdp.NodeTypeElement:
+				if parent.LocalName == "template" && !parent.IsSVG {
+					parent.TemplateContent = node
+				} else {
+					node.ShadowRootType = cdp.ShadowRootType(shadowRootTypes[i])
+					parent.ShadowRoots = append(parent.ShadowRoots, node)
+				}
+			default:
+				parent.Children = append(parent.Children, node)
+			}
+		}
+	}
+
+	for _, link := range frames {
+		link()
+	}
+	if len(roots) == 0 {
+		return nil
+	}
+	return roots[0]
+}
+
+func rareStrings(data *domsnapshot.RareStringData, str func(domsnapshot.StringIndex) string) map[int]string {
+	values := make(map[int]string)
+	if data == nil {
+		return values
+	}
+	for i, index := range data.Index {
+		if i < len(data.Value) {
+			values[int(index)] = str(data.Value[i])
+		}
+	}
+	return values
+}
+
+func rareIntegers(data *domsnapshot.RareIntegerData) map[int]int64 {
+	values := make(map[int]int64)
+	if data == nil {
+		return values
+	}
+	for i, index := range data.Index {
+		if i < len(data.Value) {
+			values[int(index)] = data.Value[i]
+		}
+	}
+	return values
+}
+
+// walkNodes calls fn for the node and all nodes under it, including shadow roots, template contents, and pseudo
+// elements.
+func walkNodes(node *cdp.Node, fn func(*cdp.Node)) {
+	fn(node)
+	for _, shadowRoot := range node.ShadowRoots {
+		walkNodes(shadowRoot, fn)
+	}
+	if node.TemplateContent != nil {
+		walkNodes(node.TemplateContent, fn)
+	}
+	for _, pseudo := range node.PseudoElements {
+		walkNodes(pseudo, fn)
+	}
+	for _, child := range node.Children {
+		walkNodes(child, fn)
+	}
+}
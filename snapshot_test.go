@@ -0,0 +1,88 @@
+package caddy_chrome
+
+import (
+	"bytes"
+	"github.com/alecthomas/assert/v2"
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/domsnapshot"
+	"testing"
+)
+
+func stringIndexes(indexes ...int64) []domsnapshot.StringIndex {
+	result := make([]domsnapshot.StringIndex, len(indexes))
+	for i, index := range indexes {
+		result[i] = domsnapshot.StringIndex(index)
+	}
+	return result
+}
+
+func TestSnapshotTree(t *testing.T) {
+	strs := []string{
+		"#document", "", "html", "HTML", "HEAD", "BODY", "DIV", "id", "app", "#text", "Hello", "#document-fragment",
+		"open", "P", "Shadow", "svg", "path", "d", "M0 0", "TEMPLATE", "SPAN", "Template", "IFRAME", "Frame",
+		"http://localhost/page.html", "about:blank", "user-agent", "INPUT",
+	}
+	documents := []*domsnapshot.DocumentSnapshot{
+		{
+			DocumentURL: 24,
+			PublicID:    1,
+			SystemID:    1,
+			Nodes: &domsnapshot.NodeTreeSnapshot{
+				ParentIndex: []int64{-1, 0, 0, 2, 2, 4, 5, 4, 7, 8, 9, 4, 11, 4, 13, 14, 15, 4, 4, 18, 19},
+				NodeType:    []int64{9, 10, 1, 1, 1, 1, 3, 1, 11, 1, 3, 1, 1, 1, 11, 1, 3, 1, 1, 11, 1},
+				NodeName:    stringIndexes(0, 2, 3, 4, 5, 6, 9, 6, 11, 13, 9, 15, 16, 19, 11, 20, 9, 22, 27, 11, 6),
+				NodeValue:   stringIndexes(1, 1, 1, 1, 1, 1, 10, 1, 1, 1, 14, 1, 1, 1, 1, 1, 21, 1, 1, 1, 1),
+				BackendNodeID: []cdp.BackendNodeID{
+					1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21,
+				},
+				Attributes: []domsnapshot.ArrayOfStrings{
+					{}, {}, {}, {}, {}, {7, 8}, {}, {}, {}, {}, {}, {}, {17, 18}, {}, {}, {}, {}, {}, {}, {}, {},
+				},
+				ShadowRootType:       &domsnapshot.RareStringData{Index: []int64{8, 19}, Value: stringIndexes(12, 26)},
+				ContentDocumentIndex: &domsnapshot.RareIntegerData{Index: []int64{17}, Value: []int64{1}},
+			},
+		},
+		{
+			DocumentURL: 25,
+			Nodes: &domsnapshot.NodeTreeSnapshot{
+				ParentIndex: []int64{-1, 0, 1, 1, 3},
+				NodeType:    []int64{9, 1, 1, 1, 3},
+				NodeName:    stringIndexes(0, 3, 4, 5, 9),
+				NodeValue:   stringIndexes(1, 1, 1, 1, 23),
+			},
+		},
+	}
+
+	root := snapshotTree(documents, strs)
+	assert.Equal(t, cdp.NodeTypeDocument, root.NodeType)
+	assert.Equal(t, "http://localhost/page.html", root.DocumentURL)
+
+	body := root.Children[1].Children[1]
+	assert.Equal(t, "body", body.LocalName)
+	app := body.Children[0]
+	assert.Equal(t, []string{"id", "app"}, app.Attributes)
+	assert.Equal(t, cdp.BackendNodeID(6), app.BackendNodeID)
+	assert.Equal(t, cdp.ShadowRootTypeOpen, body.Children[1].ShadowRoots[0].ShadowRootType)
+	svg := body.Children[2]
+	assert.True(t, svg.IsSVG)
+	assert.True(t, svg.Children[0].IsSVG)
+	assert.NotZero(t, body.Children[3].TemplateContent)
+	assert.Equal(t, "about:blank", body.Children[4].ContentDocument.DocumentURL)
+
+	serializer := newDomSerializer(root)
+	defer serializer.release()
+	var buf bytes.Buffer
+	assert.NoError(t, serializer.Serialize(&buf))
+	assert.Equal(t, `<!DOCTYPE html><html><head></head><body>`+
+		`<div id="app">Hello</div>`+
+		`<div><template shadowrootmode="open"><p>Shadow</p></template></div>`+
+		`<svg><path d="M0 0"></path></svg>`+
+		`<template><span>Template</span></template>`+
+		`<iframe></iframe>`+
+		`<input />`+
+		`</body></html>`, buf.String())
+}
+
+func TestSnapshotTree_Empty(t *testing.T) {
+	assert.Zero(t, snapshotTree(nil, nil))
+}
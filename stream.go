@@ -0,0 +1,96 @@
+package caddy_chrome
+
+import (
+	"github.com/chromedp/cdproto/cdp"
+)
+
+// streamDepth is the depth of the tree taken from Chrome before the serialization starts, elements at the depth, i.e.
+// children of the head and the body, are fetched with their subtrees while the tree is serialized.
+const streamDepth = 3
+
+// domStream fetches subtrees of a tree taken to streamDepth in document order, one after another, so that
+// the serializer writes (and flushes to the client) what's already fetched while Chrome describes the rest, instead of
+// the first byte waiting for the whole tree.
+type domStream struct {
+	pending map[*cdp.Node]*streamedNode
+	done    chan struct{}
+	err     error
+}
+
+type streamedNode struct {
+	done chan struct{}
+	err  error
+}
+
+// newDOMStream starts fetching subtrees of elements at streamDepth by describe, which returns the node with its whole
+// subtree.
+func newDOMStream(root *cdp.Node, describe func(node *cdp.Node) (*cdp.Node, error)) *domStream {
+	s := &domStream{
+		pending: make(map[*cdp.Node]*streamedNode),
+		done:    make(chan struct{}),
+	}
+	var order []*cdp.Node
+	var walk func(node *cdp.Node, depth int)
+	walk = func(node *cdp.Node, depth int) {
+		if depth == streamDepth {
+			if node.NodeType == cdp.NodeTypeElement {
+				s.pending[node] = &streamedNode{done: make(chan struct{})}
+				order = append(order, node)
+			}
+			return
+		}
+		for _, child := range node.Children {
+			walk(child, depth+1)
+		}
+	}
+	walk(root, 0)
+
+	go func() {
+		defer close(s.done)
+		for _, node := range order {
+			streamed := s.pending[node]
+			if s.err == nil {
+				described, err := describe(node)
+				if err != nil {
+					s.err = err
+				} else {
+					node.Children = described.Children
+					node.ShadowRoots = described.ShadowRoots
+					node.TemplateContent = described.TemplateContent
+					node.ContentDocument = described.ContentDocument
+					node.PseudoElements = described.PseudoElements
+				}
+			}
+			// once the fetch failed, the rest fails with the same error
+			streamed.err = s.err
+			close(streamed.done)
+		}
+	}()
+	return s
+}
+
+// wait waits until the subtree of the node is fetched, calling flush first if it isn't yet, so that what's serialized
+// gets to the client in the meantime. Nodes that aren't streamed return immediately.
+func (s *domStream) wait(node *cdp.Node, flush func() error) error {
+	streamed, ok := s.pending[node]
+	if !ok {
+		return nil
+	}
+	select {
+	case <-streamed.done:
+	default:
+		if flush != nil {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		<-streamed.done
+	}
+	return streamed.err
+}
+
+// all waits until the whole tree is fetched.
+func (s *domStream) all() error {
+	<-s.done
+	return s.err
+}
@@ -0,0 +1,135 @@
+package caddy_chrome
+
+import (
+	"bytes"
+	"errors"
+	"github.com/alecthomas/assert/v2"
+	"github.com/chromedp/cdproto/cdp"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// shallowTree returns the tree cut at streamDepth as DOM.getDocument would return it, and describe returning
+// the subtrees of the cut elements as DOM.describeNode would.
+func shallowTree(root *cdp.Node, delay time.Duration) (*cdp.Node, func(node *cdp.Node) (*cdp.Node, error)) {
+	subtrees := make(map[cdp.BackendNodeID]*cdp.Node)
+	var cut func(node *cdp.Node, depth int) *cdp.Node
+	cut = func(node *cdp.Node, depth int) *cdp.Node {
+		id := cdp.BackendNodeID(len(subtrees) + 1)
+		subtrees[id] = node
+		shallow := &cdp.Node{
+			BackendNodeID:  id,
+			NodeType:       node.NodeType,
+			NodeName:       node.NodeName,
+			LocalName:      node.LocalName,
+			NodeValue:      node.NodeValue,
+			Attributes:     node.Attributes,
+			ChildNodeCount: int64(len(node.Children)),
+		}
+		if depth < streamDepth {
+			for _, child := range node.Children {
+				shallow.Children = append(shallow.Children, cut(child, depth+1))
+			}
+		}
+		return shallow
+	}
+	shallow := cut(root, 0)
+	return shallow, func(node *cdp.Node) (*cdp.Node, error) {
+		time.Sleep(delay)
+		return subtrees[node.BackendNodeID], nil
+	}
+}
+
+func TestDomStream(t *testing.T) {
+	root := largeDocument(20, 100)
+	var expected bytes.Buffer
+	assert.NoError(t, (&domSerializer{root: root}).Serialize(&expected))
+
+	shallow, describe := shallowTree(root, 0)
+	stream := newDOMStream(shallow, describe)
+	assert.Equal(t, 21, len(stream.pending)) // title, and sections
+
+	var streamed bytes.Buffer
+	assert.NoError(t, (&domSerializer{root: shallow, stream: stream}).Serialize(&streamed))
+	assert.Equal(t, expected.String(), streamed.String())
+	assert.NoError(t, stream.all())
+}
+
+func TestDomStream_Error(t *testing.T) {
+	shallow, describe := shallowTree(largeDocument(3, 10), 0)
+	fetched := 0
+	stream := newDOMStream(shallow, func(node *cdp.Node) (*cdp.Node, error) {
+		if fetched++; fetched == 3 {
+			return nil, errors.New("target closed")
+		}
+		return describe(node)
+	})
+
+	err := (&domSerializer{root: shallow, stream: stream}).Serialize(&bytes.Buffer{})
+	assert.EqualError(t, err, "failed to fetch streamed subtree: target closed")
+	assert.EqualError(t, stream.all(), "target closed")
+}
+
+// firstByteRecorder records when the first bytes got to the client.
+type firstByteRecorder struct {
+	*httptest.ResponseRecorder
+	firstByte time.Time
+}
+
+func (r *firstByteRecorder) Write(p []byte) (int, error) {
+	if r.firstByte.IsZero() {
+		r.firstByte = time.Now()
+	}
+	return r.ResponseRecorder.Write(p)
+}
+
+func TestDomStream_FirstByte(t *testing.T) {
+	shallow, describe := shallowTree(largeDocument(20, 100), 5*time.Millisecond)
+	w := &firstByteRecorder{ResponseRecorder: httptest.NewRecorder()}
+
+	start := time.Now()
+	assert.NoError(t, (&domSerializer{root: shallow, stream: newDOMStream(shallow, describe)}).Serialize(w))
+	total := time.Since(start)
+
+	// the head is sent once its children are fetched, not after all 21 subtrees
+	assert.False(t, w.firstByte.IsZero())
+	assert.True(t, w.firstByte.Sub(start) < total/2, "first byte after %s of %s", w.firstByte.Sub(start), total)
+}
+
+// BenchmarkDomStream reports the time to the first byte written to the client for a large page whose subtrees take Chrome a while to
+// describe, compared to fetching the whole tree before serializing.
+func BenchmarkDomStream(b *testing.B) {
+	root := largeDocument(50, 250)
+	const delay = time.Millisecond
+	b.Run("whole", func(b *testing.B) {
+		var ttfb time.Duration
+		for i := 0; i < b.N; i++ {
+			start := time.Now()
+			shallow, describe := shallowTree(root, delay)
+			stream := newDOMStream(shallow, describe)
+			if err := stream.all(); err != nil {
+				b.Fatal(err)
+			}
+			w := &firstByteRecorder{ResponseRecorder: httptest.NewRecorder()}
+			if err := (&domSerializer{root: shallow}).Serialize(w); err != nil {
+				b.Fatal(err)
+			}
+			ttfb += w.firstByte.Sub(start)
+		}
+		b.ReportMetric(float64(ttfb.Microseconds())/float64(b.N), "ttfb-µs/op")
+	})
+	b.Run("streamed", func(b *testing.B) {
+		var ttfb time.Duration
+		for i := 0; i < b.N; i++ {
+			start := time.Now()
+			shallow, describe := shallowTree(root, delay)
+			w := &firstByteRecorder{ResponseRecorder: httptest.NewRecorder()}
+			if err := (&domSerializer{root: shallow, stream: newDOMStream(shallow, describe)}).Serialize(w); err != nil {
+				b.Fatal(err)
+			}
+			ttfb += w.firstByte.Sub(start)
+		}
+		b.ReportMetric(float64(ttfb.Microseconds())/float64(b.N), "ttfb-µs/op")
+	})
+}
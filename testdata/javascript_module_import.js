@@ -0,0 +1 @@
+import "./javascript_module.js";
@@ -0,0 +1,7 @@
+document.querySelector(".dev-banner")?.remove();
+
+const h1 = document.querySelector("h1");
+if (h1) {
+    h1.textContent = "Hello after post-render script";
+    h1.setAttribute("data-post-render", "");
+}
@@ -0,0 +1,52 @@
+package caddy_chrome
+
+import (
+	"net/http"
+	"sync"
+)
+
+// OutputTransformer modifies rendered pages before they're written to the client, e.g. to inject analytics, or
+// markup of A/B tests. It's an extension point for builds of Caddy embedding the module, registered by
+// RegisterOutputTransformer, typically in init of the plugin package.
+//
+// TransformOutput gets the request, headers of the response, which it may modify, and the serialized document
+// (after CSP nonces, links, and other options of the middleware are applied), and returns the body to write. The
+// body mustn't be retained after the call. An error fails the request. Transformers run in the order they were
+// registered, each getting the output of the previous one, they aren't called for responses passed through
+// un-rendered.
+type OutputTransformer interface {
+	TransformOutput(r *http.Request, header http.Header, body []byte) ([]byte, error)
+}
+
+var (
+	outputTransformersMu sync.RWMutex
+	outputTransformers   []OutputTransformer
+)
+
+// RegisterOutputTransformer registers the transformer of rendered pages of all instances of the middleware.
+func RegisterOutputTransformer(transformer OutputTransformer) {
+	outputTransformersMu.Lock()
+	defer outputTransformersMu.Unlock()
+	outputTransformers = append(outputTransformers, transformer)
+}
+
+// transformOutput runs the registered transformers on the body.
+func transformOutput(r *http.Request, header http.Header, body []byte) ([]byte, error) {
+	outputTransformersMu.RLock()
+	defer outputTransformersMu.RUnlock()
+	for _, transformer := range outputTransformers {
+		var err error
+		body, err = transformer.TransformOutput(r, header, body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+// hasOutputTransformers reports whether there are any registered transformers, so that the output has to be buffered.
+func hasOutputTransformers() bool {
+	outputTransformersMu.RLock()
+	defer outputTransformersMu.RUnlock()
+	return len(outputTransformers) > 0
+}
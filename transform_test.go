@@ -0,0 +1,81 @@
+package caddy_chrome
+
+import (
+	"bytes"
+	"errors"
+	"github.com/alecthomas/assert/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type outputTransformerFunc func(r *http.Request, header http.Header, body []byte) ([]byte, error)
+
+func (f outputTransformerFunc) TransformOutput(r *http.Request, header http.Header, body []byte) ([]byte, error) {
+	return f(r, header, body)
+}
+
+// withOutputTransformers registers the transformers for the duration of the test.
+func withOutputTransformers(t *testing.T, transformers ...OutputTransformer) {
+	outputTransformersMu.Lock()
+	previous := outputTransformers
+	outputTransformers = nil
+	outputTransformersMu.Unlock()
+	t.Cleanup(func() {
+		outputTransformersMu.Lock()
+		outputTransformers = previous
+		outputTransformersMu.Unlock()
+	})
+	for _, transformer := range transformers {
+		RegisterOutputTransformer(transformer)
+	}
+}
+
+func TestMiddleware_writeRendering_OutputTransformers(t *testing.T) {
+	withOutputTransformers(t,
+		outputTransformerFunc(func(r *http.Request, header http.Header, body []byte) ([]byte, error) {
+			header.Set("X-Variant", "b")
+			return bytes.Replace(body, []byte("</body>"), []byte("<script>analytics()</script></body>"), 1), nil
+		}),
+		outputTransformerFunc(func(r *http.Request, header http.Header, body []byte) ([]byte, error) {
+			return append(body, []byte("<!-- "+r.URL.Path+" -->")...), nil
+		}),
+	)
+
+	m := &Middleware{log: zap.NewNop()}
+	w := httptest.NewRecorder()
+	var buf bytes.Buffer
+	recorder := caddyhttp.NewResponseRecorder(w, &buf, func(int, http.Header) bool { return true })
+	recorder.Header().Set("Content-Type", "text/html")
+	recorder.WriteHeader(http.StatusOK)
+	rendering := &rendering{
+		document:   recorder,
+		links:      NewLinkHints(nil),
+		serializer: newDomSerializer(document(element("html", nil, element("head", nil), element("body", nil, text("Hello"))))),
+	}
+	defer rendering.release()
+
+	assert.NoError(t, m.writeRendering(w, httptest.NewRequest(http.MethodGet, "/page.html", nil), recorder, rendering, ""))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "b", w.Header().Get("X-Variant"))
+	assert.Equal(t, "<!DOCTYPE html><html><head></head><body>Hello<script>analytics()</script></body></html><!-- /page.html -->", w.Body.String())
+}
+
+func TestTransformOutput_Error(t *testing.T) {
+	called := false
+	withOutputTransformers(t,
+		outputTransformerFunc(func(r *http.Request, header http.Header, body []byte) ([]byte, error) {
+			return nil, errors.New("broken")
+		}),
+		outputTransformerFunc(func(r *http.Request, header http.Header, body []byte) ([]byte, error) {
+			called = true
+			return body, nil
+		}),
+	)
+
+	_, err := transformOutput(httptest.NewRequest(http.MethodGet, "/", nil), make(http.Header), []byte("<p></p>"))
+	assert.EqualError(t, err, "broken")
+	assert.False(t, called)
+}
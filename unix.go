@@ -0,0 +1,107 @@
+package caddy_chrome
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gobwas/ws"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Chrome doesn't listen on Unix sockets itself, but a proxy in a sidecar can expose its debugging endpoint on one.
+// chromedp dials websockets using the default dialer of gobwas/ws, so it's hooked to route connections to addresses
+// standing in for the sockets. The addresses are from the discard-only prefix 100::/64, so nothing else is ever
+// dialed through them, and as IP addresses, Chrome accepts them in the Host header.
+var (
+	unixSocketsOnce sync.Once
+	unixSocketsMu   sync.Mutex
+	unixSockets     = make(map[string]string)
+)
+
+// unixSocketPath returns the path of the socket of unix:///path/to/socket URLs, abstract sockets are unix:///@name.
+func unixSocketPath(rawURL string) (string, bool) {
+	path, ok := strings.CutPrefix(rawURL, "unix://")
+	if !ok || path == "" {
+		return "", false
+	}
+	if strings.HasPrefix(path, "/@") {
+		path = path[1:]
+	}
+	return path, true
+}
+
+// unixSocketAddr returns the address standing in for the socket.
+func unixSocketAddr(path string) string {
+	unixSocketsOnce.Do(func() {
+		netDial := ws.DefaultDialer.NetDial
+		if netDial == nil {
+			netDial = (&net.Dialer{}).DialContext
+		}
+		ws.DefaultDialer.NetDial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			unixSocketsMu.Lock()
+			path, ok := unixSockets[addr]
+			unixSocketsMu.Unlock()
+			if ok {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			}
+			return netDial(ctx, network, addr)
+		}
+	})
+
+	unixSocketsMu.Lock()
+	defer unixSocketsMu.Unlock()
+	for addr, socketPath := range unixSockets {
+		if socketPath == path {
+			return addr
+		}
+	}
+	addr := fmt.Sprintf("[100::%x]:80", len(unixSockets)+1)
+	unixSockets[addr] = path
+	return addr
+}
+
+// discoverUnixSocket returns the websocket debugger URL of the browser listening on the socket.
+func discoverUnixSocket(ctx context.Context, path string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	addr := unixSocketAddr(path)
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	defer client.CloseIdleConnections()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+"/json/version", nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d of %s", res.StatusCode, req.URL)
+	}
+	var version struct {
+		WebSocketDebuggerURL string `json:"webSocketDebuggerUrl"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&version); err != nil {
+		return "", err
+	}
+	wsURL, err := url.Parse(version.WebSocketDebuggerURL)
+	if err != nil {
+		return "", err
+	}
+	if wsURL.Scheme != "ws" {
+		return "", fmt.Errorf("unexpected websocket debugger URL %q", version.WebSocketDebuggerURL)
+	}
+	wsURL.Host = addr
+	return wsURL.String(), nil
+}
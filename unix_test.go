@@ -0,0 +1,56 @@
+package caddy_chrome
+
+import (
+	"context"
+	"github.com/alecthomas/assert/v2"
+	"github.com/gobwas/ws"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnixSocketPath(t *testing.T) {
+	path, ok := unixSocketPath("unix:///run/chrome/devtools.sock")
+	assert.True(t, ok)
+	assert.Equal(t, "/run/chrome/devtools.sock", path)
+
+	path, ok = unixSocketPath("unix:///@chrome")
+	assert.True(t, ok)
+	assert.Equal(t, "@chrome", path)
+
+	_, ok = unixSocketPath("ws://localhost:9222/")
+	assert.False(t, ok)
+}
+
+func TestDiscoverUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devtools.sock")
+	listener, err := net.Listen("unix", path)
+	assert.NoError(t, err)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/json/version":
+			_, _ = io.WriteString(w, `{"webSocketDebuggerUrl":"ws://127.0.0.1:9222/devtools/browser/0a1b2c"}`)
+		default:
+			_, _ = io.WriteString(w, "host "+r.Host)
+		}
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	wsURL, err := discoverUnixSocket(context.Background(), path)
+	assert.NoError(t, err)
+	addr := unixSocketAddr(path)
+	assert.Equal(t, "ws://"+addr+"/devtools/browser/0a1b2c", wsURL)
+
+	// websocket connections to the address are routed to the socket
+	client := &http.Client{Transport: &http.Transport{DialContext: ws.DefaultDialer.NetDial}}
+	defer client.CloseIdleConnections()
+	res, err := client.Get("http://" + addr + "/")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "host "+addr, string(body))
+}
@@ -0,0 +1,226 @@
+package caddy_chrome
+
+import (
+	"net"
+	"net/url"
+	"path"
+	"strings"
+)
+
+type NormalizeQuery struct {
+	Strip        []string `json:"strip,omitempty"`
+	Keep         []string `json:"keep,omitempty"`
+	CacheKeyOnly bool     `json:"cache_key_only,omitempty"`
+}
+
+// Normalize removes query parameters matching strip patterns, or if there are keep patterns, all parameters that don't
+// match them. Patterns are matched using path.Match, e.g. utm_*.
+func (n *NormalizeQuery) Normalize(rawQuery string) string {
+	if n == nil || rawQuery == "" {
+		return rawQuery
+	}
+	var kept []string
+	for _, pair := range strings.Split(rawQuery, "&") {
+		name, _, _ := strings.Cut(pair, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		keep := len(n.Keep) == 0 || matchAny(n.Keep, name)
+		if keep && !matchAny(n.Strip, name) {
+			kept = append(kept, pair)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+// RedactQuery masks values of query parameters matching the patterns in logged URLs, e.g. of tokens, or emails.
+// Patterns are matched using path.Match.
+type RedactQuery []string
+
+// Redact returns the URL with values of matching query parameters replaced by ***.
+func (r RedactQuery) Redact(rawURL string) string {
+	if len(r) == 0 {
+		return rawURL
+	}
+	base, rest, ok := strings.Cut(rawURL, "?")
+	if !ok {
+		return rawURL
+	}
+	rawQuery, fragment, hasFragment := strings.Cut(rest, "#")
+	pairs := strings.Split(rawQuery, "&")
+	for i, pair := range pairs {
+		name, _, _ := strings.Cut(pair, "=")
+		unescaped := name
+		if u, err := url.QueryUnescape(name); err == nil {
+			unescaped = u
+		}
+		if matchAny(r, unescaped) {
+			pairs[i] = name + "=***"
+		}
+	}
+	redacted := base + "?" + strings.Join(pairs, "&")
+	if hasFragment {
+		redacted += "#" + fragment
+	}
+	return redacted
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAnyText is matchAny for text that isn't a path, wildcards match slashes too.
+func matchAnyText(patterns []string, text string) bool {
+	text = strings.ReplaceAll(text, "/", "\x00")
+	for _, pattern := range patterns {
+		if matchAny([]string{strings.ReplaceAll(pattern, "/", "\x00")}, text) {
+			return true
+		}
+	}
+	return false
+}
+
+// origin returns the scheme and host of the URL, or an empty string if it's invalid.
+func origin(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// hostname returns the host without port, e.g. for a cookie domain, which can't have one.
+func hostname(host string) string {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		return name
+	}
+	return strings.Trim(host, "[]")
+}
+
+// sameURL reports whether the URLs are the same once normalized, as Chrome normalizes URLs it requests, e.g. it
+// lowercases the host, removes the default port, and decodes percent-encoded unreserved characters.
+func sameURL(a, b string) bool {
+	return a == b || normalizeURL(a) == normalizeURL(b)
+}
+
+// normalizeURL returns the URL with the scheme and host lowercased, without the default port, and fragment, and with
+// percent-encoding of the path and query normalized.
+func normalizeURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	scheme, host := strings.ToLower(u.Scheme), strings.ToLower(u.Host)
+	if (scheme == "http" && u.Port() == "80") || (scheme == "https" && u.Port() == "443") {
+		host = strings.TrimSuffix(host, ":"+u.Port())
+	}
+	escapedPath := u.EscapedPath()
+	if escapedPath == "" && host != "" {
+		escapedPath = "/"
+	}
+	normalized := scheme + "://" + host + normalizeEscapes(escapedPath)
+	if u.ForceQuery || u.RawQuery != "" {
+		normalized += "?" + normalizeEscapes(u.RawQuery)
+	}
+	return normalized
+}
+
+// normalizeEscapes decodes percent-encoded unreserved characters, and encodes other characters that aren't allowed
+// in URLs, with uppercase hex digits.
+func normalizeEscapes(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+			decoded := unhex(s[i+1])<<4 | unhex(s[i+2])
+			i += 2
+			if isUnreserved(decoded) {
+				b.WriteByte(decoded)
+			} else {
+				b.WriteByte('%')
+				b.WriteByte(hex[decoded>>4])
+				b.WriteByte(hex[decoded&15])
+			}
+			continue
+		}
+		if c == '%' || c <= ' ' || c >= 0x7f || strings.IndexByte(`"<>\^`+"`{|}", c) >= 0 {
+			b.WriteByte('%')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&15])
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+// withQuery returns the URL with the query replaced.
+func withQuery(rawURL string, rawQuery string) string {
+	base, _, _ := strings.Cut(rawURL, "?")
+	if rawQuery == "" {
+		return base
+	}
+	return base + "?" + rawQuery
+}
+
+type CanonicalURL struct {
+	TrailingSlash string `json:"trailing_slash,omitempty"`
+	Strict        bool   `json:"strict,omitempty"`
+}
+
+// Canonicalize lowercases the host, removes the default port, and adds or removes the trailing slash of the path
+// according to the policy.
+func (c *CanonicalURL) Canonicalize(rawURL string) string {
+	if c == nil {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	u.Host = strings.ToLower(u.Host)
+	if (u.Scheme == "http" && u.Port() == "80") || (u.Scheme == "https" && u.Port() == "443") {
+		u.Host = strings.TrimSuffix(u.Host, ":"+u.Port())
+	}
+	switch c.TrailingSlash {
+	case "add":
+		if !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+			u.RawPath = ""
+		}
+	case "remove":
+		if len(u.Path) > 1 && strings.HasSuffix(u.Path, "/") {
+			u.Path = strings.TrimRight(u.Path, "/")
+			if u.Path == "" {
+				u.Path = "/"
+			}
+			u.RawPath = ""
+		}
+	}
+	return u.String()
+}
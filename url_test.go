@@ -0,0 +1,155 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"testing"
+)
+
+func TestNormalizeQuery_Normalize(t *testing.T) {
+	for _, testCase := range []struct {
+		name      string
+		normalize *NormalizeQuery
+		query     string
+		expected  string
+	}{
+		{
+			name:     "nil",
+			query:    "utm_source=x&page=2",
+			expected: "utm_source=x&page=2",
+		},
+		{
+			name:      "strip",
+			normalize: &NormalizeQuery{Strip: []string{"utm_*", "fbclid"}},
+			query:     "utm_source=x&page=2&fbclid=abc&utm_medium=y",
+			expected:  "page=2",
+		},
+		{
+			name:      "strip all",
+			normalize: &NormalizeQuery{Strip: []string{"utm_*"}},
+			query:     "utm_source=x",
+			expected:  "",
+		},
+		{
+			name:      "keep",
+			normalize: &NormalizeQuery{Keep: []string{"page", "sort"}},
+			query:     "utm_source=x&page=2&sort=asc&ref=home",
+			expected:  "page=2&sort=asc",
+		},
+		{
+			name:      "keep and strip",
+			normalize: &NormalizeQuery{Keep: []string{"p*"}, Strip: []string{"preview"}},
+			query:     "page=2&preview=1&ref=home",
+			expected:  "page=2",
+		},
+		{
+			name:      "escaped name",
+			normalize: &NormalizeQuery{Strip: []string{"utm_source"}},
+			query:     "utm%5Fsource=x&page=2",
+			expected:  "page=2",
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert.Equal(t, testCase.expected, testCase.normalize.Normalize(testCase.query))
+		})
+	}
+}
+
+func TestWithQuery(t *testing.T) {
+	assert.Equal(t, "http://localhost/page?b=2", withQuery("http://localhost/page?a=1&b=2", "b=2"))
+	assert.Equal(t, "http://localhost/page", withQuery("http://localhost/page?a=1", ""))
+	assert.Equal(t, "http://localhost/page?a=1", withQuery("http://localhost/page", "a=1"))
+}
+
+func TestRedactQuery_Redact(t *testing.T) {
+	redact := RedactQuery{"token", "auth_*"}
+	assert.Equal(t, "https://example.com/page?token=***&page=2", redact.Redact("https://example.com/page?token=secret&page=2"))
+	assert.Equal(t, "https://example.com/?auth_code=***&auth%5Fstate=***#top", redact.Redact("https://example.com/?auth_code=1&auth%5Fstate=2#top"))
+	assert.Equal(t, "https://example.com/?token=***", redact.Redact("https://example.com/?token"))
+	assert.Equal(t, "https://example.com/page", redact.Redact("https://example.com/page"))
+	assert.Equal(t, "https://example.com/?token=secret", RedactQuery(nil).Redact("https://example.com/?token=secret"))
+}
+
+func TestOrigin(t *testing.T) {
+	assert.Equal(t, "http://localhost:8080", origin("http://localhost:8080/page.html?q=1"))
+	assert.Equal(t, "https://example.com", origin("https://example.com"))
+	assert.Equal(t, "", origin("about:blank"))
+	assert.Equal(t, "", origin("/page.html"))
+}
+
+func TestHostname(t *testing.T) {
+	assert.Equal(t, "localhost", hostname("localhost:9080"))
+	assert.Equal(t, "example.com", hostname("example.com"))
+	assert.Equal(t, "::1", hostname("[::1]:9080"))
+	assert.Equal(t, "::1", hostname("[::1]"))
+}
+
+func TestSameURL(t *testing.T) {
+	for _, testCase := range []struct {
+		a, b     string
+		expected bool
+	}{
+		{"http://localhost/a", "http://localhost/a", true},
+		{"http://Example.com:80/a%7e", "http://example.com/a~", true},
+		{"https://example.com:443", "https://example.com/", true},
+		{"http://example.com/a%2f?q=%c3%a9", "http://example.com/a%2F?q=%C3%A9", true},
+		{"http://example.com/a b?q=é", "http://example.com/a%20b?q=%C3%A9", true},
+		{"http://example.com/a#top", "http://example.com/a", true},
+		{"http://example.com/a", "http://example.com/b", false},
+		{"http://example.com/a?", "http://example.com/a", false},
+		{"http://example.com:8080/a", "http://example.com/a", false},
+		{"https://example.com/a", "http://example.com/a", false},
+	} {
+		t.Run(testCase.a, func(t *testing.T) {
+			assert.Equal(t, testCase.expected, sameURL(testCase.a, testCase.b))
+		})
+	}
+}
+
+func TestCanonicalURL_Canonicalize(t *testing.T) {
+	for _, testCase := range []struct {
+		name      string
+		canonical *CanonicalURL
+		url       string
+		expected  string
+	}{
+		{
+			name:     "nil",
+			url:      "http://EXAMPLE.com:80/Page/",
+			expected: "http://EXAMPLE.com:80/Page/",
+		},
+		{
+			name:      "host and port",
+			canonical: &CanonicalURL{},
+			url:       "http://EXAMPLE.com:80/Page/?a=1",
+			expected:  "http://example.com/Page/?a=1",
+		},
+		{
+			name:      "non-default port",
+			canonical: &CanonicalURL{},
+			url:       "https://Example.com:8443/",
+			expected:  "https://example.com:8443/",
+		},
+		{
+			name:      "add trailing slash",
+			canonical: &CanonicalURL{TrailingSlash: "add"},
+			url:       "https://example.com:443/page?a=1",
+			expected:  "https://example.com/page/?a=1",
+		},
+		{
+			name:      "remove trailing slash",
+			canonical: &CanonicalURL{TrailingSlash: "remove"},
+			url:       "https://example.com/page//",
+			expected:  "https://example.com/page",
+		},
+		{
+			name:      "remove trailing slash keeps root",
+			canonical: &CanonicalURL{TrailingSlash: "remove"},
+			url:       "https://example.com/",
+			expected:  "https://example.com/",
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert.Equal(t, testCase.expected, testCase.canonical.Canonicalize(testCase.url))
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package caddy_chrome
+
+import (
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidOutput is the error of a render whose DOM tree doesn't look like an HTML page, see ValidateOutput.
+var ErrInvalidOutput = errors.New("rendered page doesn't look like HTML")
+
+// validateOutput checks the rendered tree of an HTML document is structurally a page, i.e. it has an html element with
+// a body (or a frameset) with at least one element in it. A body with only text is what's left when a script replaced
+// the page with e.g. a JSON error.
+func validateOutput(root *cdp.Node) error {
+	if root.NodeType != cdp.NodeTypeDocument {
+		return errors.Wrap(ErrInvalidOutput, "no document")
+	}
+	var html *cdp.Node
+	for _, child := range root.Children {
+		if child.NodeType == cdp.NodeTypeElement && child.LocalName == "html" {
+			html = child
+			break
+		}
+	}
+	if html == nil {
+		return errors.Wrap(ErrInvalidOutput, "no html element")
+	}
+	for _, child := range html.Children {
+		if child.NodeType != cdp.NodeTypeElement {
+			continue
+		}
+		switch child.LocalName {
+		case "frameset":
+			return nil
+		case "body":
+			for _, node := range child.Children {
+				if node.NodeType == cdp.NodeTypeElement {
+					return nil
+				}
+			}
+			return errors.Wrap(ErrInvalidOutput, "no elements in body")
+		}
+	}
+	return errors.Wrap(ErrInvalidOutput, "no body element")
+}
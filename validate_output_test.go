@@ -0,0 +1,59 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"github.com/chromedp/cdproto/cdp"
+	"testing"
+)
+
+func TestValidateOutput(t *testing.T) {
+	for _, testCase := range []struct {
+		name  string
+		root  *cdp.Node
+		error string
+	}{
+		{
+			name: "page",
+			root: document(element("html", nil, element("head", nil), element("body", nil, element("h1", nil, text("Hello"))))),
+		},
+		{
+			name: "frameset",
+			root: document(element("html", nil, element("head", nil), element("frameset", nil))),
+		},
+		{
+			name:  "json error",
+			root:  document(element("html", nil, element("head", nil), element("body", nil, text(`{"error":"Internal Server Error"}`)))),
+			error: "no elements in body: rendered page doesn't look like HTML",
+		},
+		{
+			name:  "empty body",
+			root:  document(element("html", nil, element("head", nil), element("body", nil))),
+			error: "no elements in body: rendered page doesn't look like HTML",
+		},
+		{
+			name:  "no body",
+			root:  document(element("html", nil, element("head", nil))),
+			error: "no body element: rendered page doesn't look like HTML",
+		},
+		{
+			name:  "no html",
+			root:  document(comment("removed")),
+			error: "no html element: rendered page doesn't look like HTML",
+		},
+		{
+			name:  "element",
+			root:  element("p", nil),
+			error: "no document: rendered page doesn't look like HTML",
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := validateOutput(testCase.root)
+			if testCase.error == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, testCase.error)
+				assert.IsError(t, err, ErrInvalidOutput)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package caddy_chrome
+
+import (
+	"net/http"
+	"strings"
+)
+
+// mergeVary returns the Vary header value listing header names of the values, e.g. ones of the upstream response and
+// names of request headers that influenced the render, each once, in the order of their first occurrence. Any of them
+// being * makes the response vary by everything.
+func mergeVary(values ...string) string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if name == "*" {
+				return "*"
+			}
+			canonical := http.CanonicalHeaderKey(name)
+			if seen[canonical] {
+				continue
+			}
+			seen[canonical] = true
+			names = append(names, canonical)
+		}
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,14 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"testing"
+)
+
+func TestMergeVary(t *testing.T) {
+	assert.Equal(t, "", mergeVary())
+	assert.Equal(t, "User-Agent", mergeVary("User-Agent"))
+	assert.Equal(t, "Accept-Language, Accept-Encoding, User-Agent, Cookie",
+		mergeVary("accept-language, Accept-Encoding", "", "User-Agent", "Cookie", "user-agent"))
+	assert.Equal(t, "*", mergeVary("Accept-Language", "*", "Cookie"))
+}
@@ -0,0 +1,45 @@
+package caddy_chrome
+
+import (
+	"fmt"
+	"github.com/chromedp/cdproto/emulation"
+	"github.com/chromedp/chromedp"
+)
+
+// Viewport emulates the screen the page is rendered on, e.g. of a phone, so that responsive pages render their mobile
+// layout, for pages of devices not among the presets of Device.
+type Viewport struct {
+	// Width and Height are in CSS pixels.
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+	// DeviceScaleFactor is the number of device pixels per CSS pixel, 1 if it's zero.
+	DeviceScaleFactor float64 `json:"device_scale_factor,omitempty"`
+	// Mobile emulates a mobile browser, which respects meta viewport of the page, and has touch events.
+	Mobile bool `json:"mobile,omitempty"`
+	// UserAgent replaces the one of the request, so that the page gets the user agent of the device it's rendered on.
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+func (v *Viewport) validate() error {
+	if v.Width <= 0 || v.Height <= 0 {
+		return fmt.Errorf("invalid viewport %dx%d, expected positive width and height", v.Width, v.Height)
+	}
+	if v.DeviceScaleFactor < 0 {
+		return fmt.Errorf("invalid device scale factor %g, expected a positive number", v.DeviceScaleFactor)
+	}
+	return nil
+}
+
+// emulate sets the metrics of the viewport, and touch of a mobile device, the size may be overridden, e.g. by
+// the viewport of the output.
+func (v *Viewport) emulate(width, height int) chromedp.Tasks {
+	scale := v.DeviceScaleFactor
+	if scale == 0 {
+		scale = 1
+	}
+	tasks := chromedp.Tasks{emulation.SetDeviceMetricsOverride(int64(width), int64(height), scale, v.Mobile)}
+	if v.Mobile {
+		tasks = append(tasks, emulation.SetTouchEmulationEnabled(true))
+	}
+	return tasks
+}
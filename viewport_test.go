@@ -0,0 +1,26 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"github.com/chromedp/cdproto/emulation"
+	"github.com/chromedp/chromedp"
+	"testing"
+)
+
+func TestViewport_validate(t *testing.T) {
+	assert.NoError(t, (&Viewport{Width: 390, Height: 844}).validate())
+	assert.NoError(t, (&Viewport{Width: 390, Height: 844, DeviceScaleFactor: 2.625, Mobile: true}).validate())
+	assert.EqualError(t, (&Viewport{Width: 390}).validate(), `invalid viewport 390x0, expected positive width and height`)
+	assert.EqualError(t, (&Viewport{Width: 390, Height: 844, DeviceScaleFactor: -1}).validate(), `invalid device scale factor -1, expected a positive number`)
+}
+
+func TestViewport_emulate(t *testing.T) {
+	tasks := (&Viewport{Width: 1280, Height: 720}).emulate(1280, 720)
+	assert.Equal(t, 1, len(tasks))
+	assert.Equal[chromedp.Action](t, emulation.SetDeviceMetricsOverride(1280, 720, 1, false), tasks[0])
+
+	tasks = (&Viewport{Width: 390, Height: 844, DeviceScaleFactor: 3, Mobile: true}).emulate(1200, 630)
+	assert.Equal(t, 2, len(tasks))
+	assert.Equal[chromedp.Action](t, emulation.SetDeviceMetricsOverride(1200, 630, 3, true), tasks[0])
+	assert.Equal[chromedp.Action](t, emulation.SetTouchEmulationEnabled(true), tasks[1])
+}
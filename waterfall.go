@@ -0,0 +1,45 @@
+package caddy_chrome
+
+import (
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"slices"
+	"strings"
+	"time"
+)
+
+// waterfallWidth is the width of bars of the waterfall in characters.
+const waterfallWidth = 40
+
+// waterfall returns lines of a text waterfall of the timed resources of a render, ordered by their start, with bars
+// scaled to the duration of the render, so that a sub-request taking most of it stands out, e.g.
+//
+//	12ms    +240ms |  ██████████                            | 200    1.2 kB fulfilled http://localhost/api/items
+func waterfall(resources []Resource, duration time.Duration, redact func(string) string) []string {
+	timed := make([]Resource, 0, len(resources))
+	for _, resource := range resources {
+		if resource.Duration > 0 {
+			timed = append(timed, resource)
+		}
+	}
+	slices.SortStableFunc(timed, func(a, b Resource) int {
+		return int(a.Start - b.Start)
+	})
+	if duration <= 0 {
+		duration = 1
+	}
+	lines := make([]string, 0, len(timed))
+	for _, resource := range timed {
+		offset := min(int(resource.Start*waterfallWidth/duration), waterfallWidth-1)
+		length := min(max(int(resource.Duration*waterfallWidth/duration), 1), waterfallWidth-offset)
+		bar := strings.Repeat(" ", offset) + strings.Repeat("█", length) + strings.Repeat(" ", waterfallWidth-offset-length)
+		status := "-"
+		if resource.Status != 0 {
+			status = fmt.Sprint(resource.Status)
+		}
+		lines = append(lines, fmt.Sprintf("%6dms %+7dms |%s| %3s %10s %s %s",
+			resource.Start.Milliseconds(), resource.Duration.Milliseconds(), bar, status, humanize.Bytes(uint64(resource.Size)),
+			resource.Outcome, redact(resource.URL)))
+	}
+	return lines
+}
@@ -0,0 +1,22 @@
+package caddy_chrome
+
+import (
+	"github.com/alecthomas/assert/v2"
+	"testing"
+	"time"
+)
+
+func TestWaterfall(t *testing.T) {
+	lines := waterfall([]Resource{
+		{URL: "http://localhost/api/items?token=secret", Outcome: ResourceFulfilled, Status: 200, Size: 1200, Start: 100 * time.Millisecond, Duration: 800 * time.Millisecond},
+		{URL: "http://localhost/app.js", Outcome: ResourceFulfilled, Status: 200, Size: 52000, Start: 10 * time.Millisecond, Duration: 40 * time.Millisecond},
+		{URL: "https://www.googletagmanager.com/gtm.js", Outcome: ResourceBlocked},
+		{URL: "https://cdn.example.com/font.woff2", Outcome: ResourceContinued, Start: 990 * time.Millisecond, Duration: time.Millisecond},
+	}, time.Second, RedactQuery{"token"}.Redact)
+
+	assert.Equal(t, []string{
+		"    10ms     +40ms |█                                       | 200      52 kB fulfilled http://localhost/app.js",
+		"   100ms    +800ms |    ████████████████████████████████    | 200     1.2 kB fulfilled http://localhost/api/items?token=***",
+		"   990ms      +1ms |                                       █|   -        0 B continued https://cdn.example.com/font.woff2",
+	}, lines)
+}